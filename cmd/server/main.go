@@ -11,9 +11,13 @@ import (
 	"syscall"
 	"time"
 
+	// profiles are validated against the IANA time zones, which minimal images do not ship
+	_ "time/tzdata"
+
 	"github.com/go-playground/validator/v10"
 	"github.com/go-redis/redis/v9"
 	"github.com/google/uuid"
+	authController "github.com/hinccvi/go-ddd/internal/auth/controller/http"
 	v1AuthController "github.com/hinccvi/go-ddd/internal/auth/controller/http/v1"
 	authRepo "github.com/hinccvi/go-ddd/internal/auth/repository"
 	authService "github.com/hinccvi/go-ddd/internal/auth/service"
@@ -26,10 +30,15 @@ import (
 	userService "github.com/hinccvi/go-ddd/internal/user/service"
 	"github.com/hinccvi/go-ddd/pkg/db"
 	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/pkg/password"
 	rds "github.com/hinccvi/go-ddd/pkg/redis"
+	"github.com/hinccvi/go-ddd/pkg/storage"
+	"github.com/hinccvi/go-ddd/tools"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -72,9 +81,13 @@ func main() {
 		logger.Fatal(err)
 	}
 
+	// background jobs stop when the server shuts down
+	jobCtx, stopJobs := context.WithCancel(ctx)
+	defer stopJobs()
+
 	server := &http.Server{
 		Addr:              fmt.Sprintf(":%d", cfg.App.Port),
-		Handler:           buildHandler(logger, rds, db, &cfg),
+		Handler:           buildHandler(jobCtx, logger, rds, db, &cfg),
 		ReadHeaderTimeout: readHeaderTimeout,
 	}
 
@@ -92,6 +105,8 @@ func main() {
 
 	logger.Info("Server shutting down")
 
+	stopJobs()
+
 	ctx, cancel := context.WithTimeout(ctx, gracefulTimeout)
 	defer cancel()
 
@@ -103,7 +118,14 @@ func main() {
 }
 
 // buildHandler sets up the HTTP routing and builds an HTTP handler.
-func buildHandler(logger log.Logger, rds redis.Client, db *sqlx.DB, cfg *config.Config) *echo.Echo {
+// The background jobs of the services run until jobCtx is done.
+func buildHandler(
+	jobCtx context.Context,
+	logger log.Logger,
+	rds redis.Client,
+	db *sqlx.DB,
+	cfg *config.Config,
+) *echo.Echo {
 	t := time.Duration(cfg.Context.Timeout) * time.Second
 
 	e := echo.New()
@@ -111,11 +133,77 @@ func buildHandler(logger log.Logger, rds redis.Client, db *sqlx.DB, cfg *config.
 	e.Validator = &m.CustomValidator{Validator: validator.New()}
 	e.Use(buildMiddleware()...)
 
-	authHandler := middleware.JWTWithConfig(middleware.JWTConfig{
-		Claims:     &authService.JWTCustomClaims{},
-		SigningKey: []byte(cfg.Jwt.AccessSigningKey),
+	keys, err := authService.LoadKeySet(cfg)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// TOTP secrets are encrypted with it, so a missing key must fail here rather than on enrollment
+	if err = tools.CheckEncryptionKey(cfg.TwoFactor.EncryptionKey); err != nil {
+		logger.Fatalf("two_factor.encryption_key: %v", err)
+	}
+
+	// the rate limits are per client IP, which must not be taken from headers clients control
+	e.IPExtractor, err = m.IPExtractor(cfg.TrustedProxies)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	passwordPolicy, err := password.Load(cfg.PasswordPolicy)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	hashers, err := newPasswordHashers(cfg)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	mailer, err := mail.New(cfg, *flagEnv, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	blobs, err := storage.New(cfg)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	authSvc := authService.New(
+		cfg,
+		rds,
+		authRepo.New(db, logger),
+		keys,
+		hashers,
+		passwordPolicy,
+		authService.NewLogSMSSender(logger),
+		mailer,
+		logger,
+		t,
+	)
+
+	authHandler := m.Auth(func(ctx context.Context, token string) (m.Principal, error) {
+		return authSvc.VerifyAccessToken(ctx, token)
 	})
 
+	// the user endpoints also accept API keys for machine access
+	userAuthHandler := m.AuthWithAPIKey(
+		func(ctx context.Context, token string) (m.Principal, error) {
+			return authSvc.VerifyAccessToken(ctx, token)
+		},
+		func(ctx context.Context, key string) (m.Principal, error) {
+			return authSvc.VerifyAPIKey(ctx, key)
+		},
+	)
+
+	authorizer := m.NewAuthorizer(authSvc.HasPermission)
+
+	limiter := m.NewRateLimiter(rds, cfg.App.Name, logger)
+	rateLimit := func(group string) echo.MiddlewareFunc {
+		rule := cfg.RateLimit[group]
+		return limiter.Limit(group, rule.Limit, time.Duration(rule.Window)*time.Second)
+	}
+
 	dg := e.Group("")
 
 	hcController.RegisterHandlers(
@@ -123,17 +211,41 @@ func buildHandler(logger log.Logger, rds redis.Client, db *sqlx.DB, cfg *config.
 		Version,
 	)
 
+	authController.RegisterHandlers(
+		dg,
+		authSvc,
+		authHandler,
+	)
+
 	v1AuthController.RegisterHandlers(
-		dg.Group("/v1"),
-		authService.New(cfg, rds, authRepo.New(db, logger), logger, t),
+		dg.Group("/v1", rateLimit("auth")),
+		authSvc,
+		logger,
+		authHandler,
+		authorizer,
+	)
+
+	userSvc := userService.New(
+		cfg,
+		rds,
+		userRepo.New(db, logger),
+		passwordPolicy,
+		hashers,
+		mailer,
+		authSvc,
+		blobs,
 		logger,
+		t,
 	)
 
+	go purgeDeletedUsers(jobCtx, userSvc, time.Duration(cfg.SoftDelete.PurgeInterval)*time.Minute, logger)
+
 	v1UserController.RegisterHandlers(
-		dg.Group("/v1"),
-		userService.New(rds, userRepo.New(db, logger), logger, t),
+		dg.Group("/v1", rateLimit("user")),
+		userSvc,
 		logger,
-		authHandler,
+		userAuthHandler,
+		authorizer,
 	)
 
 	return e
@@ -163,3 +275,58 @@ func buildMiddleware() []echo.MiddlewareFunc {
 
 	return middlewares
 }
+
+// purgeDeletedUsers purges the users past the soft delete retention period every interval until ctx is done.
+// Running it on every instance is safe, a user is only purged once.
+func purgeDeletedUsers(ctx context.Context, s userService.Service, interval time.Duration, logger log.Logger) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.PurgeDeleted(ctx)
+			if err != nil {
+				logger.Errorf("purging deleted users failed: %v", err)
+			}
+
+			if n > 0 {
+				logger.Infof("purged %d deleted users", n)
+			}
+		}
+	}
+}
+
+// newPasswordHashers sets up password hashing with the configured algorithm.
+// Hashes of the other algorithm are still verified and replaced on the next login.
+func newPasswordHashers(cfg *config.Config) (*tools.PasswordHashers, error) {
+	argon2id := tools.Argon2idHasher{
+		Memory:      cfg.PasswordHash.Argon2id.Memory,
+		Iterations:  cfg.PasswordHash.Argon2id.Iterations,
+		Parallelism: cfg.PasswordHash.Argon2id.Parallelism,
+	}
+	bcryptHasher := tools.BcryptHasher{Cost: cfg.PasswordHash.Bcrypt.Cost}
+
+	switch cfg.PasswordHash.Algorithm {
+	case tools.AlgorithmArgon2id:
+		if argon2id.Memory == 0 || argon2id.Iterations == 0 || argon2id.Parallelism == 0 {
+			return nil, errors.New("argon2id memory, iterations and parallelism must be positive")
+		}
+
+		return tools.NewPasswordHashers(argon2id, bcryptHasher), nil
+	case tools.AlgorithmBcrypt:
+		if bcryptHasher.Cost < bcrypt.MinCost || bcryptHasher.Cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+
+		return tools.NewPasswordHashers(bcryptHasher, argon2id), nil
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", cfg.PasswordHash.Algorithm)
+	}
+}
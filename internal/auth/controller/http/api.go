@@ -0,0 +1,33 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/hinccvi/go-ddd/internal/auth/service"
+	"github.com/labstack/echo/v4"
+)
+
+const jwksCacheControl = "public, max-age=300"
+
+// RegisterHandlers registers the unversioned endpoints of the auth service.
+// The OAuth2 authorization endpoint requires a logged in user, the other OAuth2 endpoints authenticate the client.
+func RegisterHandlers(g *echo.Group, service service.Service, authHandler echo.MiddlewareFunc) {
+	g.GET("/.well-known/jwks.json", jwks(service))
+
+	oauth := g.Group("/oauth")
+	{
+		oauth.GET("/authorize", oauthAuthorize(service), authHandler)
+		oauth.POST("/token", oauthToken(service))
+		oauth.POST("/introspect", oauthIntrospect(service))
+		oauth.POST("/revoke", oauthRevoke(service))
+	}
+}
+
+// jwks publishes the public keys access tokens can be verified with, so that other
+// services can verify tokens without sharing a secret.
+func jwks(service service.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderCacheControl, jwksCacheControl)
+		return c.JSON(http.StatusOK, service.JWKS())
+	}
+}
@@ -0,0 +1,224 @@
+package http
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/auth/service"
+	"github.com/hinccvi/go-ddd/internal/config"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	m "github.com/hinccvi/go-ddd/internal/middleware"
+	"github.com/hinccvi/go-ddd/internal/mocks"
+	"github.com/hinccvi/go-ddd/internal/test"
+	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/pkg/password"
+	"github.com/hinccvi/go-ddd/tools"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAPI(t *testing.T) {
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	router := mocks.Router(logger)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	user := entity.User{ID: uuid.New(), Username: "user", Password: string(hash)}
+
+	var cfg config.Config
+	cfg.App.Name = "test"
+	cfg.Jwt.AccessSigningKey = "secret"
+	cfg.Jwt.RefreshSigningKey = "secret"
+	cfg.Jwt.AccessExpiration = 1
+	cfg.Jwt.RefreshExpiration = 1
+	cfg.OAuth.CodeExpiration = 60
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByLogin", mock.Anything, "user").Return(user, nil)
+	repo.On("GetOAuthClient", mock.Anything, "backend").Return(entity.OAuthClient{
+		ClientID:     "backend",
+		SecretHash:   sql.NullString{String: tools.SHA256("secret"), Valid: true},
+		Name:         "backend",
+		RedirectURIs: "https://app.example.com/callback",
+		GrantTypes:   "client_credentials authorization_code",
+		Scopes:       "read",
+	}, nil)
+	repo.On("GetOAuthClient", mock.Anything, mock.Anything).Return(entity.OAuthClient{}, sql.ErrNoRows)
+
+	s := service.New(
+		&cfg,
+		rds,
+		&repo,
+		nil,
+		tools.NewPasswordHashers(tools.BcryptHasher{Cost: bcrypt.MinCost}),
+		password.New(config.PasswordPolicy{}, nil),
+		&mocks.SMSSender{},
+		&mail.Memory{},
+		logger,
+		2*time.Second,
+	)
+
+	loginResp, err := s.Login(context.TODO(), service.LoginRequest{Username: "user", Password: "secret"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	authHandler := m.Auth(func(ctx context.Context, token string) (m.Principal, error) {
+		return s.VerifyAccessToken(ctx, token)
+	})
+
+	RegisterHandlers(router.Group(""), s, authHandler)
+
+	header := http.Header{}
+	header.Add("Authorization", fmt.Sprintf("Bearer %s", loginResp.AccessToken))
+
+	form := func(user, secret string) http.Header {
+		h := http.Header{}
+		h.Set("Content-Type", "application/x-www-form-urlencoded")
+		if user != "" {
+			r, _ := http.NewRequest(http.MethodPost, "/", nil)
+			r.SetBasicAuth(user, secret)
+			h.Set("Authorization", r.Header.Get("Authorization"))
+		}
+
+		return h
+	}
+
+	authorizeURL := "/oauth/authorize?response_type=code&client_id=backend&redirect_uri=https://app.example.com/callback" +
+		"&code_challenge=E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM&code_challenge_method=S256"
+
+	tests := []test.APITestCase{
+		{
+			Name:         "jwks",
+			Method:       http.MethodGet,
+			URL:          "/.well-known/jwks.json",
+			WantStatus:   http.StatusOK,
+			WantResponse: `{"keys":[]}`,
+		},
+		{
+			Name:       "oauth authorize ok",
+			Method:     http.MethodGet,
+			URL:        authorizeURL,
+			Header:     header,
+			WantStatus: http.StatusFound,
+		},
+		{
+			Name:       "oauth authorize missing token",
+			Method:     http.MethodGet,
+			URL:        authorizeURL,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "oauth authorize unknown client",
+			Method:       http.MethodGet,
+			URL:          "/oauth/authorize?response_type=code&client_id=xxx",
+			Header:       header,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `{"error":"invalid_request","error_description":"unknown client"}`,
+		},
+		{
+			Name:         "oauth token client credentials ok",
+			Method:       http.MethodPost,
+			URL:          "/oauth/token",
+			Body:         "grant_type=client_credentials",
+			Header:       form("backend", "secret"),
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"token_type":"Bearer"*`,
+		},
+		{
+			Name:         "oauth token credentials in form ok",
+			Method:       http.MethodPost,
+			URL:          "/oauth/token",
+			Body:         "grant_type=client_credentials&client_id=backend&client_secret=secret&scope=read",
+			Header:       form("", ""),
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"scope":"read"*`,
+		},
+		{
+			Name:         "oauth token invalid client",
+			Method:       http.MethodPost,
+			URL:          "/oauth/token",
+			Body:         "grant_type=client_credentials",
+			Header:       form("backend", "xxx"),
+			WantStatus:   http.StatusUnauthorized,
+			WantResponse: `*"error":"invalid_client"*`,
+		},
+		{
+			Name:         "oauth token unsupported grant type",
+			Method:       http.MethodPost,
+			URL:          "/oauth/token",
+			Body:         "grant_type=password",
+			Header:       form("backend", "secret"),
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `{"error":"unsupported_grant_type"}`,
+		},
+		{
+			Name:         "oauth token invalid code",
+			Method:       http.MethodPost,
+			URL:          "/oauth/token",
+			Body:         "grant_type=authorization_code&code=xxx&code_verifier=xxx",
+			Header:       form("backend", "secret"),
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"invalid_grant"*`,
+		},
+		{
+			Name:         "oauth introspect ok",
+			Method:       http.MethodPost,
+			URL:          "/oauth/introspect",
+			Body:         "token=" + loginResp.AccessToken,
+			Header:       form("backend", "secret"),
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"active":true*`,
+		},
+		{
+			Name:         "oauth introspect inactive",
+			Method:       http.MethodPost,
+			URL:          "/oauth/introspect",
+			Body:         "token=xxx",
+			Header:       form("backend", "secret"),
+			WantStatus:   http.StatusOK,
+			WantResponse: `{"active":false}`,
+		},
+		{
+			Name:       "oauth introspect invalid client",
+			Method:     http.MethodPost,
+			URL:        "/oauth/introspect",
+			Body:       "token=xxx",
+			Header:     form("", ""),
+			WantStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:       "oauth revoke ok",
+			Method:     http.MethodPost,
+			URL:        "/oauth/revoke",
+			Body:       "token=xxx",
+			Header:     form("backend", "secret"),
+			WantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
@@ -0,0 +1,135 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/auth/service"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	m "github.com/hinccvi/go-ddd/internal/middleware"
+	"github.com/labstack/echo/v4"
+)
+
+const noStore = "no-store"
+
+// oauthAuthorize issues an authorization code to a client for the logged in user and redirects back to the client.
+func oauthAuthorize(s service.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.OAuthAuthorizeRequest
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		principal, ok := m.GetPrincipal(c)
+		if !ok {
+			return errs.ErrInvalidJwt
+		}
+
+		claims, ok := principal.(*service.JWTCustomClaims)
+		if !ok {
+			return errs.ErrInvalidJwt
+		}
+
+		id, err := uuid.Parse(claims.Subject)
+		if err != nil {
+			return errs.ErrInvalidJwt
+		}
+
+		ctx := c.Request().Context()
+		redirect, err := s.OAuthAuthorize(ctx, entity.User{ID: id, Username: claims.UserName}, req)
+		if err != nil {
+			return oauthError(c, err)
+		}
+
+		return c.Redirect(http.StatusFound, redirect)
+	}
+}
+
+// oauthToken is the token endpoint of RFC 6749 section 3.2.
+func oauthToken(s service.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.OAuthTokenRequest
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		req.OAuthClientCredentials = clientCredentials(c, req.OAuthClientCredentials)
+		req.IP = c.RealIP()
+		req.UserAgent = c.Request().UserAgent()
+
+		c.Response().Header().Set(echo.HeaderCacheControl, noStore)
+
+		ctx := c.Request().Context()
+		res, err := s.OAuthToken(ctx, req)
+		if err != nil {
+			return oauthError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+// oauthIntrospect is the introspection endpoint of RFC 7662.
+func oauthIntrospect(s service.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.OAuthTokenActionRequest
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		req.OAuthClientCredentials = clientCredentials(c, req.OAuthClientCredentials)
+
+		ctx := c.Request().Context()
+		res, err := s.OAuthIntrospect(ctx, req)
+		if err != nil {
+			return oauthError(c, err)
+		}
+
+		return c.JSON(http.StatusOK, res)
+	}
+}
+
+// oauthRevoke is the revocation endpoint of RFC 7009.
+func oauthRevoke(s service.Service) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req service.OAuthTokenActionRequest
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+
+		req.OAuthClientCredentials = clientCredentials(c, req.OAuthClientCredentials)
+
+		ctx := c.Request().Context()
+		if err := s.OAuthRevoke(ctx, req); err != nil {
+			return oauthError(c, err)
+		}
+
+		return c.NoContent(http.StatusOK)
+	}
+}
+
+// clientCredentials prefers HTTP basic auth over the credentials in the form, as RFC 6749 section 2.3.1 recommends.
+func clientCredentials(c echo.Context, form service.OAuthClientCredentials) service.OAuthClientCredentials {
+	if id, secret, ok := c.Request().BasicAuth(); ok {
+		return service.OAuthClientCredentials{ClientID: id, ClientSecret: secret}
+	}
+
+	return form
+}
+
+// oauthError writes an OAuthError in the format of RFC 6749 section 5.2,
+// other errors are left to the error handler.
+func oauthError(c echo.Context, err error) error {
+	var oe *service.OAuthError
+	if !errors.As(err, &oe) {
+		return err
+	}
+
+	if oe.Status == http.StatusUnauthorized {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="oauth"`)
+	}
+
+	return c.JSON(oe.Status, oe)
+}
@@ -3,20 +3,52 @@ package v1
 import (
 	"strings"
 
+	"github.com/google/uuid"
 	"github.com/hinccvi/go-ddd/internal/auth/service"
 	errs "github.com/hinccvi/go-ddd/internal/errors"
+	m "github.com/hinccvi/go-ddd/internal/middleware"
 	"github.com/hinccvi/go-ddd/pkg/log"
 	"github.com/hinccvi/go-ddd/tools"
 	"github.com/labstack/echo/v4"
 )
 
-func RegisterHandlers(g *echo.Group, service service.Service, logger log.Logger) {
-	r := &resource{logger, service}
+func RegisterHandlers(
+	g *echo.Group,
+	s service.Service,
+	logger log.Logger,
+	authHandler echo.MiddlewareFunc,
+	authorizer m.Authorizer,
+) {
+	r := &resource{logger, s}
 
 	auth := g.Group("/auth")
 	{
 		auth.POST("/login", r.login)
 		auth.POST("/refresh", r.refresh)
+		auth.POST("/sms/send", r.sendSMSCode)
+		auth.POST("/sms/login", r.smsLogin)
+		auth.POST("/2fa/verify", r.verifyTwoFactor)
+		auth.POST("/password/forgot", r.forgotPassword)
+		auth.POST("/password/reset", r.resetPassword)
+		auth.GET("/oidc/:provider/authorize", r.oidcAuthorize)
+		auth.GET("/oidc/:provider/callback", r.oidcCallback)
+		auth.POST("/passkeys/login/begin", r.beginPasskeyLogin)
+		auth.POST("/passkeys/login/finish", r.finishPasskeyLogin)
+
+		auth.POST("/logout", r.logout, authHandler)
+		auth.GET("/sessions", r.listSessions, authHandler)
+		auth.DELETE("/sessions/:id", r.revokeSession, authHandler)
+		auth.POST("/logout-all", r.logoutAll, authHandler)
+		auth.POST("/2fa/enroll", r.enrollTwoFactor, authHandler)
+		auth.POST("/2fa/confirm", r.confirmTwoFactor, authHandler)
+		auth.GET("/passkeys", r.listPasskeys, authHandler)
+		auth.DELETE("/passkeys/:id", r.deletePasskey, authHandler)
+		auth.POST("/passkeys/register/begin", r.beginPasskeyRegistration, authHandler)
+		auth.POST("/passkeys/register/finish", r.finishPasskeyRegistration, authHandler)
+
+		auth.GET("/lockouts", r.listLockedAccounts, authHandler, authorizer.Require(service.PermissionUnlock))
+		auth.DELETE("/lockouts/:id", r.unlockAccount, authHandler, authorizer.Require(service.PermissionUnlock))
+		auth.POST("/oauth/clients", r.createOAuthClient, authHandler, authorizer.Require(service.PermissionManageClients))
 	}
 }
 
@@ -31,6 +63,9 @@ func (r resource) login(c echo.Context) error {
 		return err
 	}
 
+	req.IP = c.RealIP()
+	req.UserAgent = c.Request().UserAgent()
+
 	ctx := c.Request().Context()
 	res, err := r.service.Login(ctx, req)
 	if err != nil {
@@ -66,3 +101,363 @@ func (r resource) refresh(c echo.Context) error {
 
 	return tools.JSONRespOk(c, &res)
 }
+
+func (r resource) sendSMSCode(c echo.Context) error {
+	var req service.SendSMSCodeRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err := r.service.SendSMSCode(ctx, req); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) smsLogin(c echo.Context) error {
+	var req service.SMSLoginRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	req.IP = c.RealIP()
+	req.UserAgent = c.Request().UserAgent()
+
+	ctx := c.Request().Context()
+	res, err := r.service.SMSLogin(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) forgotPassword(c echo.Context) error {
+	var req service.ForgotPasswordRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err := r.service.ForgotPassword(ctx, req); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) resetPassword(c echo.Context) error {
+	var req service.ResetPasswordRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err := r.service.ResetPassword(ctx, req); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) oidcAuthorize(c echo.Context) error {
+	var req service.OIDCAuthorizeRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	req.IP = c.RealIP()
+	req.UserAgent = c.Request().UserAgent()
+
+	ctx := c.Request().Context()
+	res, err := r.service.OIDCAuthorize(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) oidcCallback(c echo.Context) error {
+	var req service.OIDCCallbackRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	res, err := r.service.OIDCCallback(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) logout(c echo.Context) error {
+	claims, _, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err = r.service.Logout(ctx, *claims); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) listSessions(c echo.Context) error {
+	claims, id, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	res, err := r.service.ListSessions(ctx, id, claims.SessionID)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) revokeSession(c echo.Context) error {
+	var req service.RevokeSessionRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	_, id, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err = r.service.RevokeSession(ctx, id, req.ID); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) logoutAll(c echo.Context) error {
+	_, id, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err = r.service.LogoutAll(ctx, id); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) enrollTwoFactor(c echo.Context) error {
+	_, id, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	res, err := r.service.EnrollTwoFactor(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) confirmTwoFactor(c echo.Context) error {
+	var req service.ConfirmTwoFactorRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	_, id, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	res, err := r.service.ConfirmTwoFactor(ctx, id, req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) verifyTwoFactor(c echo.Context) error {
+	var req service.VerifyTwoFactorRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	res, err := r.service.VerifyTwoFactor(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) listLockedAccounts(c echo.Context) error {
+	ctx := c.Request().Context()
+	res, err := r.service.ListLockedAccounts(ctx)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) unlockAccount(c echo.Context) error {
+	var req service.UnlockAccountRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err := r.service.UnlockAccount(ctx, *req.ID); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) createOAuthClient(c echo.Context) error {
+	var req service.CreateOAuthClientRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	res, err := r.service.CreateOAuthClient(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) beginPasskeyRegistration(c echo.Context) error {
+	claims, id, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	res, err := r.service.BeginPasskeyRegistration(ctx, id, claims.UserName)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) finishPasskeyRegistration(c echo.Context) error {
+	var req service.FinishPasskeyRegistrationRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	_, id, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err = r.service.FinishPasskeyRegistration(ctx, id, req); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) beginPasskeyLogin(c echo.Context) error {
+	ctx := c.Request().Context()
+	res, err := r.service.BeginPasskeyLogin(ctx)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) finishPasskeyLogin(c echo.Context) error {
+	var req service.FinishPasskeyLoginRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	req.IP = c.RealIP()
+	req.UserAgent = c.Request().UserAgent()
+
+	ctx := c.Request().Context()
+	res, err := r.service.FinishPasskeyLogin(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) listPasskeys(c echo.Context) error {
+	_, id, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	res, err := r.service.ListPasskeys(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) deletePasskey(c echo.Context) error {
+	var req service.PasskeyRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	_, id, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	if err = r.service.DeletePasskey(ctx, id, *req.ID); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+// currentUser returns the claims and user id of the access token validated by the auth middleware.
+func currentUser(c echo.Context) (*service.JWTCustomClaims, uuid.UUID, error) {
+	principal, ok := m.GetPrincipal(c)
+	if !ok {
+		return nil, uuid.UUID{}, errs.ErrInvalidJwt
+	}
+
+	claims, ok := principal.(*service.JWTCustomClaims)
+	if !ok {
+		return nil, uuid.UUID{}, errs.ErrInvalidJwt
+	}
+
+	id, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, uuid.UUID{}, errs.ErrInvalidJwt
+	}
+
+	return claims, id, nil
+}
@@ -2,8 +2,10 @@ package v1
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
+	"regexp"
 	"testing"
 	"time"
 
@@ -12,9 +14,12 @@ import (
 	"github.com/hinccvi/go-ddd/internal/auth/service"
 	"github.com/hinccvi/go-ddd/internal/config"
 	"github.com/hinccvi/go-ddd/internal/entity"
+	m "github.com/hinccvi/go-ddd/internal/middleware"
 	"github.com/hinccvi/go-ddd/internal/mocks"
 	"github.com/hinccvi/go-ddd/internal/test"
 	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/pkg/password"
 	"github.com/hinccvi/go-ddd/tools"
 	"github.com/stretchr/testify/mock"
 )
@@ -22,6 +27,8 @@ import (
 func TestHandler(t *testing.T) {
 	id1 := uuid.New()
 	id2 := uuid.New()
+	id3 := uuid.New()
+	id4 := uuid.New()
 
 	hashedPassword, err := tools.Bcrypt("secret")
 	if err != nil {
@@ -29,7 +36,7 @@ func TestHandler(t *testing.T) {
 		t.FailNow()
 	}
 
-	mockGetUserByUsername := []entity.User{
+	mockGetUserByLogin := []entity.User{
 		{
 			ID:       id1,
 			Username: "user",
@@ -40,11 +47,31 @@ func TestHandler(t *testing.T) {
 			Username: "user1",
 			Password: hashedPassword,
 		},
+		{
+			ID:       id3,
+			Username: "user2",
+			Password: hashedPassword,
+		},
 	}
 
 	var repo mocks.AuthRepository
-	repo.On("GetUserByUsername", mock.Anything, "user").Return(mockGetUserByUsername[0], nil)
-	repo.On("GetUserByUsername", mock.Anything, "user1").Return(mockGetUserByUsername[1], nil)
+	repo.On("GetUserRoles", mock.Anything, id1).Return([]string{"admin"}, nil)
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByLogin", mock.Anything, "user").Return(mockGetUserByLogin[0], nil)
+	repo.On("GetUserByLogin", mock.Anything, "user1").Return(mockGetUserByLogin[1], nil)
+	repo.On("GetUserByLogin", mock.Anything, "user2").Return(mockGetUserByLogin[2], nil)
+	repo.On("GetUserByPhone", mock.Anything, "+60123456789").Return(mockGetUserByLogin[0], nil)
+	repo.On("GetUserTOTP", mock.Anything, id2).Return(entity.User{ID: id2, Username: "user1"}, nil)
+	repo.On("SetTOTPSecret", mock.Anything, id2, mock.Anything).Return(nil)
+	repo.On("GetUserByEmail", mock.Anything, "user3@example.com").
+		Return(entity.User{ID: id4, Username: "user3", Email: sql.NullString{String: "user3@example.com", Valid: true}}, nil)
+	repo.On("GetUserByEmail", mock.Anything, mock.Anything).Return(entity.User{}, sql.ErrNoRows)
+	repo.On("GetUser", mock.Anything, id4).Return(entity.User{ID: id4, Username: "user3"}, nil)
+	repo.On("UpdatePassword", mock.Anything, id4, mock.Anything).Return(nil)
+	repo.On("GetUserByIdentity", mock.Anything, "stub", "123").Return(mockGetUserByLogin[1], nil)
+	repo.On("CreateOAuthClient", mock.Anything, mock.Anything).Return(nil)
+
+	var sender mocks.SMSSender
 
 	l, _ := log.NewForTest()
 	logger := log.NewWithZap(l)
@@ -57,10 +84,50 @@ func TestHandler(t *testing.T) {
 	cfg.Jwt.RefreshSigningKey = "secret"
 	cfg.Jwt.AccessExpiration = 1
 	cfg.Jwt.RefreshExpiration = 1
+	cfg.SMS.CodeLength = 6
+	cfg.SMS.CodeExpiration = 1
+	cfg.SMS.Cooldown = 60
+	cfg.SMS.DailyLimit = 10
+	cfg.SMS.MaxAttempt = 5
+	cfg.Lockout.Threshold = 5
+	cfg.Lockout.Window = 15
+	cfg.Lockout.Duration = 15
+	cfg.TwoFactor.EncryptionKey = "cEa6wwJp/FQNrQ2QYAVgBvbLrwMf3Es+gvjmwZi0eAY="
+	cfg.PasswordReset.TokenExpiration = 30
+	cfg.PasswordReset.Cooldown = 60
+	cfg.PasswordReset.URL = "https://example.com/reset-password"
+
+	cfg.WebAuthn.RPID = "example.com"
+	cfg.WebAuthn.RPName = "Example"
+	cfg.WebAuthn.Origins = []string{"https://example.com"}
+	cfg.WebAuthn.ChallengeExpiration = 300
 
-	refreshToken := mocks.Token(id2.String(), "user1")
+	authenticator := mocks.NewAuthenticator(t, cfg.WebAuthn.RPID, cfg.WebAuthn.Origins[0])
+	passkey := entity.Passkey{
+		ID:           uuid.New(),
+		UserID:       id2,
+		Name:         "laptop",
+		CredentialID: authenticator.CredentialID,
+		PublicKey:    authenticator.PublicKey(),
+	}
+	repo.On("ListPasskeys", mock.Anything, id2).Return([]entity.Passkey{passkey}, nil)
+	repo.On("GetPasskeyByCredentialID", mock.Anything, passkey.CredentialID).Return(entity.Passkey{}, sql.ErrNoRows).Once()
+	repo.On("GetPasskeyByCredentialID", mock.Anything, passkey.CredentialID).Return(passkey, nil)
+	repo.On("CreatePasskey", mock.Anything, mock.Anything).Return(nil)
+	repo.On("UpdatePasskeySignCount", mock.Anything, passkey.ID, int64(1)).Return(nil)
+	repo.On("DeletePasskey", mock.Anything, id2, passkey.ID).Return(nil)
+	repo.On("DeletePasskey", mock.Anything, id2, mock.Anything).Return(sql.ErrNoRows)
 
-	header := mocks.AuthHeader(id2.String(), "user1")
+	stub := mocks.NewOIDCProvider(t)
+	cfg.OIDC.StateExpiration = 10
+	cfg.OIDC.Providers = map[string]config.OIDCProvider{
+		"stub": {
+			Issuer:       stub.Issuer(),
+			ClientID:     stub.ClientID,
+			ClientSecret: stub.ClientSecret,
+			RedirectURL:  "https://example.com/callback",
+		},
+	}
 
 	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
 	if err != nil {
@@ -68,9 +135,111 @@ func TestHandler(t *testing.T) {
 		t.FailNow()
 	}
 
-	rds.Set(context.TODO(), mocks.RefreshTokenKey(id2.String()), refreshToken, -1)
+	var mailer mail.Memory
+
+	s := service.New(
+		&cfg,
+		rds,
+		&repo,
+		nil,
+		tools.NewPasswordHashers(tools.BcryptHasher{Cost: tools.BcryptCost}),
+		password.New(config.PasswordPolicy{}, nil),
+		&sender,
+		&mailer,
+		logger,
+		2*time.Second,
+	)
+
+	loginResp, err := s.Login(context.TODO(), service.LoginRequest{Username: "user1", Password: "secret"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	refreshToken := loginResp.RefreshToken
+
+	header := http.Header{}
+	header.Add("Authorization", fmt.Sprintf("Bearer %s", loginResp.AccessToken))
+
+	_, err = s.Login(context.TODO(), service.LoginRequest{
+		Username:   "user1",
+		Password:   "secret",
+		DeviceInfo: service.DeviceInfo{DeviceName: "phone"},
+	})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	sessions, err := s.ListSessions(context.TODO(), id2, "")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	var phoneSessionID string
+	for _, session := range sessions {
+		if session.DeviceName == "phone" {
+			phoneSessionID = session.ID
+		}
+	}
+
+	adminResp, err := s.Login(context.TODO(), service.LoginRequest{Username: "user", Password: "secret"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	adminHeader := http.Header{}
+	adminHeader.Add("Authorization", fmt.Sprintf("Bearer %s", adminResp.AccessToken))
+
+	for i := 0; i < cfg.Lockout.Threshold; i++ {
+		_, _ = s.Login(context.TODO(), service.LoginRequest{Username: "user2", Password: "xxx"})
+	}
+
+	if err = s.ForgotPassword(context.TODO(), service.ForgotPasswordRequest{Email: "user3@example.com"}); err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
 
-	RegisterHandlers(router.Group("v1"), service.New(&cfg, rds, &repo, logger, 2*time.Second), logger)
+	resetMail, _ := mailer.Last("user3@example.com")
+	resetToken := regexp.MustCompile(`token=([\w-]+)`).FindStringSubmatch(resetMail.Body)[1]
+
+	oidcResp, err := s.OIDCAuthorize(context.TODO(), service.OIDCAuthorizeRequest{Provider: "stub"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	oidcCode, oidcState, err := stub.Authorize(oidcResp.AuthorizationURL, mocks.OIDCClaims{Subject: "123"})
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	registrationOpts, err := s.BeginPasskeyRegistration(context.TODO(), id2, "user1")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	attestation := authenticator.Register(registrationOpts.PublicKey.Challenge, id2[:])
+
+	loginOpts, err := s.BeginPasskeyLogin(context.TODO())
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	assertion := authenticator.Assert(loginOpts.PublicKey.Challenge)
+
+	authHandler := m.Auth(func(ctx context.Context, token string) (m.Principal, error) {
+		return s.VerifyAccessToken(ctx, token)
+	})
+
+	authorizer := mocks.Authorizer(map[string][]string{"admin": {service.PermissionUnlock, service.PermissionManageClients}})
+
+	RegisterHandlers(router.Group("v1"), s, logger, authHandler, authorizer)
 
 	tests := []test.APITestCase{
 		{
@@ -109,6 +278,172 @@ func TestHandler(t *testing.T) {
 			Body:       `{"username":"","password":"secret"}`,
 			WantStatus: http.StatusBadRequest,
 		},
+		{
+			Name:       "login locked",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/login",
+			Body:       `{"username":"user2","password":"secret"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "list locked accounts ok",
+			Method:       http.MethodGet,
+			URL:          "/v1/auth/lockouts",
+			Header:       adminHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: fmt.Sprintf(`*"user_id":"%s"*`, id3),
+		},
+		{
+			Name:       "list locked accounts forbidden",
+			Method:     http.MethodGet,
+			URL:        "/v1/auth/lockouts",
+			Header:     header,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "unlock account ok",
+			Method:       http.MethodDelete,
+			URL:          fmt.Sprintf("/v1/auth/lockouts/%s", id3),
+			Header:       adminHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "unlock account not locked",
+			Method:     http.MethodDelete,
+			URL:        fmt.Sprintf("/v1/auth/lockouts/%s", id3),
+			Header:     adminHeader,
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:       "unlock account validate fail",
+			Method:     http.MethodDelete,
+			URL:        "/v1/auth/lockouts/xxx",
+			Header:     adminHeader,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:   "create oauth client ok",
+			Method: http.MethodPost,
+			URL:    "/v1/auth/oauth/clients",
+			Body: `{"name":"app","redirect_uris":["https://app.example.com/callback"],` +
+				`"grant_types":["authorization_code"],"scopes":["user:list"]}`,
+			Header:       adminHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"client_secret":*`,
+		},
+		{
+			Name:       "create oauth client without scopes",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/oauth/clients",
+			Body:       `{"name":"app","redirect_uris":["https://app.example.com/callback"],"grant_types":["authorization_code"]}`,
+			Header:     adminHeader,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "create oauth client validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/oauth/clients",
+			Body:       `{"name":"app","grant_types":["password"]}`,
+			Header:     adminHeader,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "create oauth client forbidden",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/oauth/clients",
+			Body:       `{"name":"app","grant_types":["client_credentials"]}`,
+			Header:     header,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "login unlocked ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/login",
+			Body:         `{"username":"user2","password":"secret"}`,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:         "enroll two factor ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/2fa/enroll",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"otpauth_uri":"otpauth://totp/*`,
+		},
+		{
+			Name:       "enroll two factor auth error",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/2fa/enroll",
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "confirm two factor not enrolled",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/2fa/confirm",
+			Body:       `{"code":"123456"}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "confirm two factor validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/2fa/confirm",
+			Body:       `{"code":"xxx"}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "verify two factor invalid challenge",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/2fa/verify",
+			Body:       `{"challenge_token":"xxx","code":"123456"}`,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "verify two factor validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/2fa/verify",
+			Body:       `{"challenge_token":"","code":"123456"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "list sessions ok",
+			Method:       http.MethodGet,
+			URL:          "/v1/auth/sessions",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"current":true*`,
+		},
+		{
+			Name:       "list sessions auth error",
+			Method:     http.MethodGet,
+			URL:        "/v1/auth/sessions",
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "revoke session ok",
+			Method:       http.MethodDelete,
+			URL:          fmt.Sprintf("/v1/auth/sessions/%s", phoneSessionID),
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "revoke session not found",
+			Method:     http.MethodDelete,
+			URL:        fmt.Sprintf("/v1/auth/sessions/%s", phoneSessionID),
+			Header:     header,
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:       "revoke session validate fail",
+			Method:     http.MethodDelete,
+			URL:        "/v1/auth/sessions/xxx",
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
 		{
 			Name:         "refresh token ok",
 			Method:       http.MethodPost,
@@ -118,6 +453,14 @@ func TestHandler(t *testing.T) {
 			WantStatus:   http.StatusOK,
 			WantResponse: `*"message":"success"*`,
 		},
+		{
+			Name:       "refresh token reused",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/refresh",
+			Body:       fmt.Sprintf(`{"refresh_token":"%s"}`, refreshToken),
+			Header:     header,
+			WantStatus: http.StatusForbidden,
+		},
 		{
 			Name:       "refresh token fail",
 			Method:     http.MethodPost,
@@ -154,6 +497,273 @@ func TestHandler(t *testing.T) {
 			Header:     header,
 			WantStatus: http.StatusForbidden,
 		},
+		{
+			Name:         "passkey register finish ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/passkeys/register/finish",
+			Body:         fmt.Sprintf(`{"name":"laptop","credential":%s}`, attestation),
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "passkey register finish challenge used",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/passkeys/register/finish",
+			Body:       fmt.Sprintf(`{"name":"laptop","credential":%s}`, attestation),
+			Header:     header,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "passkey register finish validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/passkeys/register/finish",
+			Body:       fmt.Sprintf(`{"name":"","credential":%s}`, attestation),
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "passkey register begin ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/passkeys/register/begin",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"rp":{"id":"example.com","name":"Example"}*`,
+		},
+		{
+			Name:       "passkey register begin missing token",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/passkeys/register/begin",
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "passkey login begin ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/passkeys/login/begin",
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"session":"*`,
+		},
+		{
+			Name:         "passkey login finish ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/passkeys/login/finish",
+			Body:         fmt.Sprintf(`{"session":"%s","credential":%s}`, loginOpts.Session, assertion),
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"access_token":"*`,
+		},
+		{
+			Name:       "passkey login finish session used",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/passkeys/login/finish",
+			Body:       fmt.Sprintf(`{"session":"%s","credential":%s}`, loginOpts.Session, assertion),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "passkey login finish validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/passkeys/login/finish",
+			Body:       fmt.Sprintf(`{"session":"","credential":%s}`, assertion),
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "list passkeys ok",
+			Method:       http.MethodGet,
+			URL:          "/v1/auth/passkeys",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"name":"laptop"*`,
+		},
+		{
+			Name:         "delete passkey ok",
+			Method:       http.MethodDelete,
+			URL:          fmt.Sprintf("/v1/auth/passkeys/%s", passkey.ID),
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "delete passkey not found",
+			Method:     http.MethodDelete,
+			URL:        fmt.Sprintf("/v1/auth/passkeys/%s", uuid.New()),
+			Header:     header,
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:       "delete passkey validate fail",
+			Method:     http.MethodDelete,
+			URL:        "/v1/auth/passkeys/xxx",
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "logout all ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/logout-all",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "logout all auth error",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/logout-all",
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "logout ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/logout",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "logout token denylisted",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/logout",
+			Header:     header,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "logout auth error",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/logout",
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "send sms code ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/sms/send",
+			Body:         `{"phone":"+60123456789"}`,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "send sms code cooldown",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/sms/send",
+			Body:       `{"phone":"+60123456789"}`,
+			WantStatus: http.StatusTooManyRequests,
+		},
+		{
+			Name:       "send sms code validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/sms/send",
+			Body:       `{"phone":"0123456789"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "send sms code bind fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/sms/send",
+			Body:       `"phone":"+60123456789"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "sms login fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/sms/login",
+			Body:       `{"phone":"+60123456789","code":"xxx"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "sms login validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/sms/login",
+			Body:       `{"phone":"+60123456789","code":""}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "sms login bind fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/sms/login",
+			Body:       `"phone":"+60123456789","code":"123456"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "forgot password ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/password/forgot",
+			Body:         `{"email":"user4@example.com"}`,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:         "forgot password cooldown",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/password/forgot",
+			Body:         `{"email":"user3@example.com"}`,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "forgot password validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/password/forgot",
+			Body:       `{"email":"xxx"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "forgot password bind fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/password/forgot",
+			Body:       `"email":"user3@example.com"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "reset password ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/auth/password/reset",
+			Body:         fmt.Sprintf(`{"token":"%s","password":"new-secret"}`, resetToken),
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "reset password token used",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/password/reset",
+			Body:       fmt.Sprintf(`{"token":"%s","password":"new-secret"}`, resetToken),
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "reset password validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/auth/password/reset",
+			Body:       `{"token":"","password":"new-secret"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "oidc authorize ok",
+			Method:       http.MethodGet,
+			URL:          "/v1/auth/oidc/stub/authorize?device_name=phone",
+			WantStatus:   http.StatusOK,
+			WantResponse: fmt.Sprintf(`*"authorization_url":"%s/authorize?*`, stub.Issuer()),
+		},
+		{
+			Name:       "oidc authorize unknown provider",
+			Method:     http.MethodGet,
+			URL:        "/v1/auth/oidc/xxx/authorize",
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "oidc callback ok",
+			Method:       http.MethodGet,
+			URL:          fmt.Sprintf("/v1/auth/oidc/stub/callback?code=%s&state=%s", oidcCode, oidcState),
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"access_token":"*`,
+		},
+		{
+			Name:       "oidc callback state used",
+			Method:     http.MethodGet,
+			URL:        fmt.Sprintf("/v1/auth/oidc/stub/callback?code=%s&state=%s", oidcCode, oidcState),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "oidc callback validate fail",
+			Method:     http.MethodGet,
+			URL:        "/v1/auth/oidc/stub/callback?state=xxx",
+			WantStatus: http.StatusBadRequest,
+		},
 	}
 
 	for _, tc := range tests {
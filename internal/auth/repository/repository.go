@@ -2,7 +2,9 @@ package repository
 
 import (
 	"context"
+	"database/sql"
 
+	"github.com/google/uuid"
 	"github.com/hinccvi/go-ddd/internal/entity"
 	"github.com/hinccvi/go-ddd/pkg/log"
 	"github.com/jmoiron/sqlx"
@@ -10,7 +12,29 @@ import (
 
 type (
 	Repository interface {
-		GetUserByUsername(ctx context.Context, username string) (entity.User, error)
+		GetUser(ctx context.Context, id uuid.UUID) (entity.User, error)
+		GetUserByLogin(ctx context.Context, login string) (entity.User, error)
+		GetUserByPhone(ctx context.Context, phone string) (entity.User, error)
+		GetUserByEmail(ctx context.Context, email string) (entity.User, error)
+		GetUserRoles(ctx context.Context, id uuid.UUID) ([]string, error)
+		GetRolePermissions(ctx context.Context, roles []string) ([]string, error)
+		GetUserTOTP(ctx context.Context, id uuid.UUID) (entity.User, error)
+		SetTOTPSecret(ctx context.Context, id uuid.UUID, secret string) error
+		EnableTOTP(ctx context.Context, id uuid.UUID, recoveryCodeHashes []string) error
+		UseRecoveryCode(ctx context.Context, id uuid.UUID, codeHash string) (bool, error)
+		UpdatePassword(ctx context.Context, id uuid.UUID, password string) error
+		GetUserByIdentity(ctx context.Context, provider, subject string) (entity.User, error)
+		CreateIdentity(ctx context.Context, identity entity.UserIdentity) error
+		CreateUserWithIdentity(ctx context.Context, user entity.User, identity entity.UserIdentity) (uuid.UUID, error)
+		GetOAuthClient(ctx context.Context, clientID string) (entity.OAuthClient, error)
+		CreateOAuthClient(ctx context.Context, client entity.OAuthClient) error
+		GetAPIKeyByPrefix(ctx context.Context, prefix string) (entity.APIKey, error)
+		TouchAPIKey(ctx context.Context, id uuid.UUID) error
+		CreatePasskey(ctx context.Context, passkey entity.Passkey) error
+		ListPasskeys(ctx context.Context, userID uuid.UUID) ([]entity.Passkey, error)
+		GetPasskeyByCredentialID(ctx context.Context, credentialID []byte) (entity.Passkey, error)
+		UpdatePasskeySignCount(ctx context.Context, id uuid.UUID, signCount int64) error
+		DeletePasskey(ctx context.Context, userID, id uuid.UUID) error
 	}
 
 	repository struct {
@@ -20,27 +44,445 @@ type (
 )
 
 const (
-	getUserByUsername string = `SELECT id, username, password 
-                              FROM "user"
-                              WHERE username = $1 AND deleted_at IS NULL 
+	getUser string = `SELECT id, username
+                    FROM "user"
+                    WHERE id = $1 AND deleted_at IS NULL
+                    LIMIT 1`
+	getUserByLogin string = `SELECT id, username, password, email, email_verified_at, totp_enabled_at
+                           FROM "user"
+                           WHERE (LOWER(username) = LOWER($1) OR LOWER(email) = LOWER($1)) AND deleted_at IS NULL
+                           LIMIT 1`
+	getUserByPhone string = `SELECT id, username, phone, email, email_verified_at, totp_enabled_at
+                           FROM "user"
+                           WHERE phone = $1 AND deleted_at IS NULL 
+                           LIMIT 1`
+	getUserByEmail string = `SELECT id, username, email, email_verified_at, totp_enabled_at
+                           FROM "user"
+                           WHERE LOWER(email) = LOWER($1) AND deleted_at IS NULL
+                           LIMIT 1`
+	getUserRoles string = `SELECT r.name
+                         FROM role r
+                         JOIN user_role ur ON ur.role_id = r.id
+                         WHERE ur.user_id = $1
+                         ORDER BY r.name`
+	getRolePermissions string = `SELECT DISTINCT p.name
+                               FROM permission p
+                               JOIN role_permission rp ON rp.permission_id = p.id
+                               JOIN role r ON r.id = rp.role_id
+                               WHERE r.name IN (?)
+                               ORDER BY p.name`
+	getUserTOTP string = `SELECT id, username, totp_secret, totp_enabled_at
+                        FROM "user"
+                        WHERE id = $1 AND deleted_at IS NULL
+                        LIMIT 1`
+	setTOTPSecret string = `UPDATE "user"
+                          SET totp_secret = $2, version = version + 1
+                          WHERE id = $1 AND deleted_at IS NULL AND totp_enabled_at IS NULL`
+	enableTOTP string = `UPDATE "user"
+                       SET totp_enabled_at = (current_timestamp AT TIME ZONE 'UTC'), version = version + 1
+                       WHERE id = $1 AND deleted_at IS NULL AND totp_enabled_at IS NULL AND totp_secret IS NOT NULL`
+	deleteRecoveryCodes string = `DELETE FROM user_recovery_code WHERE user_id = $1`
+	createRecoveryCode  string = `INSERT INTO user_recovery_code (user_id, code_hash) VALUES ($1, $2)`
+	useRecoveryCode     string = `UPDATE user_recovery_code
+                                SET used_at = (current_timestamp AT TIME ZONE 'UTC')
+                                WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+	updatePassword string = `UPDATE "user"
+                           SET password = $2, updated_at = (current_timestamp AT TIME ZONE 'UTC'),
+                               version = version + 1
+                           WHERE id = $1 AND deleted_at IS NULL`
+	getUserByIdentity string = `SELECT u.id, u.username, u.email, u.totp_enabled_at
+                              FROM "user" u
+                              JOIN user_identity ui ON ui.user_id = u.id
+                              WHERE ui.provider = $1 AND ui.subject = $2 AND u.deleted_at IS NULL
                               LIMIT 1`
+	createIdentity string = `INSERT INTO user_identity (user_id, provider, subject, email)
+                           VALUES (:user_id, :provider, :subject, :email)`
+	createUserReturningID string = `INSERT INTO "user" (username, password, email, email_verified_at)
+                                  VALUES (:username, :password, :email, :email_verified_at)
+                                  RETURNING id`
+	getOAuthClient string = `SELECT id, client_id, secret_hash, name, redirect_uris, grant_types, scopes, created_at
+                           FROM oauth_client
+                           WHERE client_id = $1 AND deleted_at IS NULL
+                           LIMIT 1`
+	createOAuthClient string = `INSERT INTO oauth_client (client_id, secret_hash, name, redirect_uris, grant_types, scopes)
+                              VALUES (:client_id, :secret_hash, :name, :redirect_uris, :grant_types, :scopes)`
+	getAPIKeyByPrefix string = `SELECT k.id, k.user_id, k.name, k.prefix, k.key_hash, k.scopes, k.expires_at, k.last_used_at
+                              FROM api_key k
+                              JOIN "user" u ON u.id = k.user_id
+                              WHERE k.prefix = $1 AND u.deleted_at IS NULL
+                              LIMIT 1`
+	touchAPIKey string = `UPDATE api_key
+                        SET last_used_at = (current_timestamp AT TIME ZONE 'UTC')
+                        WHERE id = $1
+                        AND (last_used_at IS NULL OR last_used_at < (current_timestamp AT TIME ZONE 'UTC') - INTERVAL '1 minute')`
+	createPasskey string = `INSERT INTO user_passkey (user_id, name, credential_id, public_key, sign_count, transports)
+                          VALUES (:user_id, :name, :credential_id, :public_key, :sign_count, :transports)`
+	listPasskeys string = `SELECT id, user_id, name, credential_id, public_key, sign_count, transports, last_used_at, created_at
+                         FROM user_passkey
+                         WHERE user_id = $1
+                         ORDER BY created_at`
+	getPasskeyByCredentialID string = `SELECT p.id, p.user_id, p.name, p.credential_id, p.public_key, p.sign_count, p.transports,
+                                     p.last_used_at, p.created_at
+                                     FROM user_passkey p
+                                     JOIN "user" u ON u.id = p.user_id
+                                     WHERE p.credential_id = $1 AND u.deleted_at IS NULL
+                                     LIMIT 1`
+	updatePasskeySignCount string = `UPDATE user_passkey
+                                   SET sign_count = $2, last_used_at = (current_timestamp AT TIME ZONE 'UTC')
+                                   WHERE id = $1`
+	deletePasskey string = `DELETE FROM user_passkey WHERE user_id = $1 AND id = $2`
 )
 
 func New(db *sqlx.DB, logger log.Logger) Repository {
 	return repository{db, logger}
 }
 
-func (r repository) GetUserByUsername(ctx context.Context, username string) (entity.User, error) {
-	getUserStmt, err := r.db.PreparexContext(ctx, getUserByUsername)
+// GetUserByLogin returns the user a login identifies, which is either a username or an email address.
+// Both are compared case-insensitively.
+func (r repository) GetUserByLogin(ctx context.Context, login string) (entity.User, error) {
+	getUserStmt, err := r.db.PreparexContext(ctx, getUserByLogin)
+	if err != nil {
+		return entity.User{}, err
+	}
+	defer getUserStmt.Close()
+
+	var user entity.User
+	if err = getUserStmt.GetContext(ctx, &user, login); err != nil {
+		return entity.User{}, err
+	}
+
+	return user, nil
+}
+
+func (r repository) GetUserByPhone(ctx context.Context, phone string) (entity.User, error) {
+	getUserStmt, err := r.db.PreparexContext(ctx, getUserByPhone)
+	if err != nil {
+		return entity.User{}, err
+	}
+	defer getUserStmt.Close()
+
+	var user entity.User
+	if err = getUserStmt.GetContext(ctx, &user, phone); err != nil {
+		return entity.User{}, err
+	}
+
+	return user, nil
+}
+
+func (r repository) GetUser(ctx context.Context, id uuid.UUID) (entity.User, error) {
+	getUserStmt, err := r.db.PreparexContext(ctx, getUser)
+	if err != nil {
+		return entity.User{}, err
+	}
+	defer getUserStmt.Close()
+
+	var user entity.User
+	if err = getUserStmt.GetContext(ctx, &user, id); err != nil {
+		return entity.User{}, err
+	}
+
+	return user, nil
+}
+
+func (r repository) GetUserByEmail(ctx context.Context, email string) (entity.User, error) {
+	getUserStmt, err := r.db.PreparexContext(ctx, getUserByEmail)
+	if err != nil {
+		return entity.User{}, err
+	}
+	defer getUserStmt.Close()
+
+	var user entity.User
+	if err = getUserStmt.GetContext(ctx, &user, email); err != nil {
+		return entity.User{}, err
+	}
+
+	return user, nil
+}
+
+func (r repository) GetUserRoles(ctx context.Context, id uuid.UUID) ([]string, error) {
+	roles := []string{}
+	if err := r.db.SelectContext(ctx, &roles, getUserRoles, id); err != nil {
+		return []string{}, err
+	}
+
+	return roles, nil
+}
+
+func (r repository) GetRolePermissions(ctx context.Context, roles []string) ([]string, error) {
+	permissions := []string{}
+	if len(roles) == 0 {
+		return permissions, nil
+	}
+
+	query, args, err := sqlx.In(getRolePermissions, roles)
+	if err != nil {
+		return []string{}, err
+	}
+
+	if err = r.db.SelectContext(ctx, &permissions, r.db.Rebind(query), args...); err != nil {
+		return []string{}, err
+	}
+
+	return permissions, nil
+}
+
+func (r repository) GetUserTOTP(ctx context.Context, id uuid.UUID) (entity.User, error) {
+	getUserStmt, err := r.db.PreparexContext(ctx, getUserTOTP)
+	if err != nil {
+		return entity.User{}, err
+	}
+	defer getUserStmt.Close()
+
+	var user entity.User
+	if err = getUserStmt.GetContext(ctx, &user, id); err != nil {
+		return entity.User{}, err
+	}
+
+	return user, nil
+}
+
+// SetTOTPSecret stores the secret of a pending 2FA enrollment.
+// It fails with sql.ErrNoRows if 2FA is already enabled for the user.
+func (r repository) SetTOTPSecret(ctx context.Context, id uuid.UUID, secret string) error {
+	res, err := r.db.ExecContext(ctx, setTOTPSecret, id, secret)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// EnableTOTP enables 2FA with the pending secret and replaces the recovery codes of the user.
+// It fails with sql.ErrNoRows if there is no pending enrollment.
+func (r repository) EnableTOTP(ctx context.Context, id uuid.UUID, recoveryCodeHashes []string) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var res sql.Result
+	if res, err = tx.ExecContext(ctx, enableTOTP, id); err != nil {
+		return err
+	}
+
+	if err = requireAffected(res); err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, deleteRecoveryCodes, id); err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryCodeHashes {
+		if _, err = tx.ExecContext(ctx, createRecoveryCode, id, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused recovery code as used and reports whether there was one.
+func (r repository) UseRecoveryCode(ctx context.Context, id uuid.UUID, codeHash string) (bool, error) {
+	res, err := r.db.ExecContext(ctx, useRecoveryCode, id, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// UpdatePassword replaces the password hash of a user.
+// It fails with sql.ErrNoRows if the user does not exist.
+func (r repository) UpdatePassword(ctx context.Context, id uuid.UUID, password string) error {
+	res, err := r.db.ExecContext(ctx, updatePassword, id, password)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// GetUserByIdentity returns the user linked to the subject of an external provider.
+func (r repository) GetUserByIdentity(ctx context.Context, provider, subject string) (entity.User, error) {
+	getUserStmt, err := r.db.PreparexContext(ctx, getUserByIdentity)
 	if err != nil {
 		return entity.User{}, err
 	}
 	defer getUserStmt.Close()
 
 	var user entity.User
-	if err = getUserStmt.GetContext(ctx, &user, username); err != nil {
+	if err = getUserStmt.GetContext(ctx, &user, provider, subject); err != nil {
 		return entity.User{}, err
 	}
 
 	return user, nil
 }
+
+// CreateIdentity links an existing user to the subject of an external provider.
+func (r repository) CreateIdentity(ctx context.Context, identity entity.UserIdentity) error {
+	_, err := r.db.NamedExecContext(ctx, createIdentity, identity)
+
+	return err
+}
+
+// CreateUserWithIdentity creates a user signing in with an external provider for the first time
+// and links it to the subject of the provider. It returns the ID of the new user.
+func (r repository) CreateUserWithIdentity(
+	ctx context.Context,
+	user entity.User,
+	identity entity.UserIdentity,
+) (uuid.UUID, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var createUserStmt *sqlx.NamedStmt
+	if createUserStmt, err = tx.PrepareNamedContext(ctx, createUserReturningID); err != nil {
+		return uuid.Nil, err
+	}
+	defer createUserStmt.Close()
+
+	var id uuid.UUID
+	if err = createUserStmt.GetContext(ctx, &id, user); err != nil {
+		return uuid.Nil, err
+	}
+
+	identity.UserID = id
+	if _, err = tx.NamedExecContext(ctx, createIdentity, identity); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return uuid.Nil, err
+	}
+
+	return id, nil
+}
+
+func (r repository) GetOAuthClient(ctx context.Context, clientID string) (entity.OAuthClient, error) {
+	getClientStmt, err := r.db.PreparexContext(ctx, getOAuthClient)
+	if err != nil {
+		return entity.OAuthClient{}, err
+	}
+	defer getClientStmt.Close()
+
+	var client entity.OAuthClient
+	if err = getClientStmt.GetContext(ctx, &client, clientID); err != nil {
+		return entity.OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+func (r repository) CreateOAuthClient(ctx context.Context, client entity.OAuthClient) error {
+	_, err := r.db.NamedExecContext(ctx, createOAuthClient, client)
+
+	return err
+}
+
+// GetAPIKeyByPrefix returns the API key with a prefix. Keys of deleted users are not returned.
+func (r repository) GetAPIKeyByPrefix(ctx context.Context, prefix string) (entity.APIKey, error) {
+	getKeyStmt, err := r.db.PreparexContext(ctx, getAPIKeyByPrefix)
+	if err != nil {
+		return entity.APIKey{}, err
+	}
+	defer getKeyStmt.Close()
+
+	var key entity.APIKey
+	if err = getKeyStmt.GetContext(ctx, &key, prefix); err != nil {
+		return entity.APIKey{}, err
+	}
+
+	return key, nil
+}
+
+// TouchAPIKey records that an API key was used. The timestamp is updated at most once a minute
+// so that busy keys do not cause a write on every request.
+func (r repository) TouchAPIKey(ctx context.Context, id uuid.UUID) error {
+	_, err := r.db.ExecContext(ctx, touchAPIKey, id)
+
+	return err
+}
+
+func (r repository) CreatePasskey(ctx context.Context, passkey entity.Passkey) error {
+	_, err := r.db.NamedExecContext(ctx, createPasskey, passkey)
+
+	return err
+}
+
+func (r repository) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]entity.Passkey, error) {
+	passkeys := []entity.Passkey{}
+	if err := r.db.SelectContext(ctx, &passkeys, listPasskeys, userID); err != nil {
+		return []entity.Passkey{}, err
+	}
+
+	return passkeys, nil
+}
+
+// GetPasskeyByCredentialID returns the passkey with a WebAuthn credential ID.
+// Passkeys of deleted users are not returned.
+func (r repository) GetPasskeyByCredentialID(ctx context.Context, credentialID []byte) (entity.Passkey, error) {
+	getPasskeyStmt, err := r.db.PreparexContext(ctx, getPasskeyByCredentialID)
+	if err != nil {
+		return entity.Passkey{}, err
+	}
+	defer getPasskeyStmt.Close()
+
+	var passkey entity.Passkey
+	if err = getPasskeyStmt.GetContext(ctx, &passkey, credentialID); err != nil {
+		return entity.Passkey{}, err
+	}
+
+	return passkey, nil
+}
+
+// UpdatePasskeySignCount records a login with a passkey and the signature counter its authenticator reported.
+func (r repository) UpdatePasskeySignCount(ctx context.Context, id uuid.UUID, signCount int64) error {
+	res, err := r.db.ExecContext(ctx, updatePasskeySignCount, id, signCount)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// DeletePasskey removes a passkey of a user.
+// It fails with sql.ErrNoRows if the user has no passkey with the ID.
+func (r repository) DeletePasskey(ctx context.Context, userID, id uuid.UUID) error {
+	res, err := r.db.ExecContext(ctx, deletePasskey, userID, id)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/hinccvi/go-ddd/internal/entity"
@@ -19,7 +20,43 @@ import (
 
 var errConnectionRefused = errors.New("connection refused")
 
-func TestGetUserByUsername(t *testing.T) {
+func TestGetUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"id", "username"}).AddRow(id.String(), "user")
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getUser)).ExpectQuery().WithArgs(id).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var user entity.User
+		user, err = repo.GetUser(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, id, user.ID)
+		assert.Equal(t, "user", user.Username)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getUser)).ExpectQuery().WithArgs(id).WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUser(context.TODO(), id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestGetUserByLogin(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
@@ -38,31 +75,882 @@ func TestGetUserByUsername(t *testing.T) {
 		rows := sqlmock.NewRows([]string{"id", "username", "password"}).
 			AddRow(id, username, password)
 
-		mock.ExpectPrepare(regexp.QuoteMeta(getUserByUsername)).ExpectQuery().WithArgs(username).WillReturnRows(rows)
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByLogin)).ExpectQuery().WithArgs(username).WillReturnRows(rows)
 
 		repo := New(dbx, logger)
 
 		var user entity.User
-		user, err = repo.GetUserByUsername(context.TODO(), username)
+		user, err = repo.GetUserByLogin(context.TODO(), username)
 		assert.NoError(t, err)
 		assert.Equal(t, id, user.ID.String())
 		assert.Equal(t, username, user.Username)
 		assert.Equal(t, password, user.Password)
 	})
 
+	t.Run("success: email", func(t *testing.T) {
+		id := uuid.NewString()
+		email := "User@Example.com"
+
+		rows := sqlmock.NewRows([]string{"id", "username", "email"}).
+			AddRow(id, "user", "user@example.com")
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByLogin)).ExpectQuery().WithArgs(email).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var user entity.User
+		user, err = repo.GetUserByLogin(context.TODO(), email)
+		assert.NoError(t, err)
+		assert.Equal(t, id, user.ID.String())
+		assert.Equal(t, "user@example.com", user.Email.String)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(getUserByLogin)).WithArgs("xxx").WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUserByLogin(context.TODO(), "xxx")
+		assert.Error(t, err)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(getUserByLogin)).WithArgs("xxx").WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUserByLogin(context.TODO(), "xxx")
+		assert.Error(t, err)
+	})
+}
+
+func TestGetUserByPhone(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	t.Run("success", func(t *testing.T) {
+		id := uuid.NewString()
+		username := "user"
+		phone := "+60123456789"
+
+		rows := sqlmock.NewRows([]string{"id", "username", "phone", "email", "email_verified_at", "totp_enabled_at"}).
+			AddRow(id, username, phone, nil, nil, time.Now())
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByPhone)).ExpectQuery().WithArgs(phone).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var user entity.User
+		user, err = repo.GetUserByPhone(context.TODO(), phone)
+		assert.NoError(t, err)
+		assert.Equal(t, id, user.ID.String())
+		assert.Equal(t, username, user.Username)
+		assert.Equal(t, phone, user.Phone.String)
+		assert.True(t, user.TOTPEnabledAt.Valid)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByPhone)).ExpectQuery().WithArgs("xxx").WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUserByPhone(context.TODO(), "xxx")
+		assert.Error(t, err)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByPhone)).ExpectQuery().WithArgs("xxx").WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUserByPhone(context.TODO(), "xxx")
+		assert.Error(t, err)
+	})
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	t.Run("success", func(t *testing.T) {
+		id := uuid.NewString()
+		username := "user"
+		email := "user@example.com"
+
+		rows := sqlmock.NewRows([]string{"id", "username", "email"}).
+			AddRow(id, username, email)
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByEmail)).ExpectQuery().WithArgs(email).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var user entity.User
+		user, err = repo.GetUserByEmail(context.TODO(), email)
+		assert.NoError(t, err)
+		assert.Equal(t, id, user.ID.String())
+		assert.Equal(t, username, user.Username)
+		assert.Equal(t, email, user.Email.String)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByEmail)).ExpectQuery().WithArgs("xxx").WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUserByEmail(context.TODO(), "xxx")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByEmail)).ExpectQuery().WithArgs("xxx").WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUserByEmail(context.TODO(), "xxx")
+		assert.Error(t, err)
+	})
+}
+
+func TestGetUserRoles(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"name"}).AddRow("admin").AddRow("user")
+
+		mock.ExpectQuery(regexp.QuoteMeta(getUserRoles)).WithArgs(id).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var roles []string
+		roles, err = repo.GetUserRoles(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"admin", "user"}, roles)
+	})
+
+	t.Run("success: no roles", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(getUserRoles)).WithArgs(id).WillReturnRows(sqlmock.NewRows([]string{"name"}))
+
+		repo := New(dbx, logger)
+
+		var roles []string
+		roles, err = repo.GetUserRoles(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Empty(t, roles)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(getUserRoles)).WithArgs(id).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUserRoles(context.TODO(), id)
+		assert.Error(t, err)
+	})
+}
+
+func TestGetRolePermissions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	query, _, _ := sqlx.In(getRolePermissions, []string{"admin", "user"})
+	query = dbx.Rebind(query)
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"name"}).AddRow("user:delete").AddRow("user:list")
+
+		mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs("admin", "user").WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var permissions []string
+		permissions, err = repo.GetRolePermissions(context.TODO(), []string{"admin", "user"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user:delete", "user:list"}, permissions)
+	})
+
+	t.Run("success: no roles", func(t *testing.T) {
+		repo := New(dbx, logger)
+
+		var permissions []string
+		permissions, err = repo.GetRolePermissions(context.TODO(), nil)
+		assert.NoError(t, err)
+		assert.Empty(t, permissions)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs("admin", "user").WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetRolePermissions(context.TODO(), []string{"admin", "user"})
+		assert.Error(t, err)
+	})
+}
+
+func TestGetUserTOTP(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"id", "username", "totp_secret", "totp_enabled_at"}).
+			AddRow(id.String(), "user", "SECRET", nil)
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserTOTP)).ExpectQuery().WithArgs(id).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var user entity.User
+		user, err = repo.GetUserTOTP(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, "SECRET", user.TOTPSecret.String)
+		assert.False(t, user.TOTPEnabledAt.Valid)
+	})
+
 	t.Run("fail: not found", func(t *testing.T) {
-		mock.ExpectQuery(regexp.QuoteMeta(getUserByUsername)).WithArgs("xxx").WillReturnError(sql.ErrNoRows)
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserTOTP)).ExpectQuery().WithArgs(id).WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUserTOTP(context.TODO(), id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestSetTOTPSecret(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(setTOTPSecret)).WithArgs(id, "SECRET").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.SetTOTPSecret(context.TODO(), id, "SECRET")
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: already enabled", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(setTOTPSecret)).WithArgs(id, "SECRET").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.SetTOTPSecret(context.TODO(), id, "SECRET")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(setTOTPSecret)).WithArgs(id, "SECRET").WillReturnError(errConnectionRefused)
 
 		repo := New(dbx, logger)
-		_, err = repo.GetUserByUsername(context.TODO(), "xxx")
+		err = repo.SetTOTPSecret(context.TODO(), id, "SECRET")
 		assert.Error(t, err)
 	})
+}
+
+func TestEnableTOTP(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(enableTOTP)).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(deleteRecoveryCodes)).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(createRecoveryCode)).WithArgs(id, "a").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(createRecoveryCode)).WithArgs(id, "b").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		repo := New(dbx, logger)
+		err = repo.EnableTOTP(context.TODO(), id, []string{"a", "b"})
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("fail: not enrolled", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(enableTOTP)).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		repo := New(dbx, logger)
+		err = repo.EnableTOTP(context.TODO(), id, []string{"a"})
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
 
 	t.Run("fail: db down", func(t *testing.T) {
-		mock.ExpectQuery(regexp.QuoteMeta(getUserByUsername)).WithArgs("xxx").WillReturnError(errConnectionRefused)
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(enableTOTP)).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(deleteRecoveryCodes)).WithArgs(id).WillReturnError(errConnectionRefused)
+		mock.ExpectRollback()
 
 		repo := New(dbx, logger)
-		_, err = repo.GetUserByUsername(context.TODO(), "xxx")
+		err = repo.EnableTOTP(context.TODO(), id, []string{"a"})
 		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestUseRecoveryCode(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(useRecoveryCode)).WithArgs(id, "hash").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+
+		var ok bool
+		ok, err = repo.UseRecoveryCode(context.TODO(), id, "hash")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("success: already used", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(useRecoveryCode)).WithArgs(id, "hash").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+
+		var ok bool
+		ok, err = repo.UseRecoveryCode(context.TODO(), id, "hash")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(useRecoveryCode)).WithArgs(id, "hash").WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.UseRecoveryCode(context.TODO(), id, "hash")
+		assert.Error(t, err)
+	})
+}
+
+func TestUpdatePassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(updatePassword)).WithArgs(id, "hash").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.UpdatePassword(context.TODO(), id, "hash")
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(updatePassword)).WithArgs(id, "hash").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.UpdatePassword(context.TODO(), id, "hash")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(updatePassword)).WithArgs(id, "hash").WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		err = repo.UpdatePassword(context.TODO(), id, "hash")
+		assert.Error(t, err)
+	})
+}
+
+func TestGetUserByIdentity(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	t.Run("success", func(t *testing.T) {
+		id := uuid.NewString()
+
+		rows := sqlmock.NewRows([]string{"id", "username"}).AddRow(id, "user")
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByIdentity)).ExpectQuery().
+			WithArgs("google", "123").WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var user entity.User
+		user, err = repo.GetUserByIdentity(context.TODO(), "google", "123")
+		assert.NoError(t, err)
+		assert.Equal(t, id, user.ID.String())
+		assert.Equal(t, "user", user.Username)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserByIdentity)).ExpectQuery().
+			WithArgs("google", "xxx").WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetUserByIdentity(context.TODO(), "google", "xxx")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestCreateIdentity(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	identity := entity.UserIdentity{UserID: uuid.New(), Provider: "google", Subject: "123"}
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_identity")).
+			WithArgs(identity.UserID, "google", "123", identity.Email).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.CreateIdentity(context.TODO(), identity)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_identity")).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		err = repo.CreateIdentity(context.TODO(), identity)
+		assert.Error(t, err)
+	})
+}
+
+func TestCreateUserWithIdentity(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+	user := entity.User{Username: "user", Password: "hash"}
+	identity := entity.UserIdentity{Provider: "google", Subject: "123"}
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO "user"`)).ExpectQuery().
+			WithArgs("user", "hash", user.Email, user.EmailVerifiedAt).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id.String()))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_identity")).
+			WithArgs(id, "google", "123", identity.Email).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		repo := New(dbx, logger)
+
+		var got uuid.UUID
+		got, err = repo.CreateUserWithIdentity(context.TODO(), user, identity)
+		assert.NoError(t, err)
+		assert.Equal(t, id, got)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("fail: identity already linked", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO "user"`)).ExpectQuery().
+			WithArgs("user", "hash", user.Email, user.EmailVerifiedAt).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id.String()))
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_identity")).WillReturnError(errConnectionRefused)
+		mock.ExpectRollback()
+
+		repo := New(dbx, logger)
+		_, err = repo.CreateUserWithIdentity(context.TODO(), user, identity)
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestGetOAuthClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"id", "client_id", "secret_hash", "name", "redirect_uris", "grant_types", "scopes"}).
+			AddRow(uuid.NewString(), "client", "hash", "app", "https://example.com/cb", "authorization_code", "read write")
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getOAuthClient)).ExpectQuery().WithArgs("client").WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var client entity.OAuthClient
+		client, err = repo.GetOAuthClient(context.TODO(), "client")
+		assert.NoError(t, err)
+		assert.Equal(t, "client", client.ClientID)
+		assert.True(t, client.Confidential())
+		assert.True(t, client.HasRedirectURI("https://example.com/cb"))
+		assert.True(t, client.AllowsGrant("authorization_code"))
+		assert.False(t, client.AllowsGrant("client_credentials"))
+		assert.Equal(t, []string{"read", "write"}, client.AllowedScopes())
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getOAuthClient)).ExpectQuery().WithArgs("xxx").WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetOAuthClient(context.TODO(), "xxx")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestCreateOAuthClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	client := entity.OAuthClient{ClientID: "client", Name: "app", GrantTypes: "client_credentials"}
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO oauth_client")).
+			WithArgs("client", client.SecretHash, "app", "", "client_credentials", "").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.CreateOAuthClient(context.TODO(), client)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO oauth_client")).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		err = repo.CreateOAuthClient(context.TODO(), client)
+		assert.Error(t, err)
+	})
+}
+
+func TestGetAPIKeyByPrefix(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	t.Run("success", func(t *testing.T) {
+		id, userID := uuid.New(), uuid.New()
+		expiresAt := time.Now().Add(time.Hour)
+		rows := sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "key_hash", "scopes", "expires_at", "last_used_at"}).
+			AddRow(id.String(), userID.String(), "ci", "ak_0123456789abcdef", "hash", "user:list", expiresAt, nil)
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getAPIKeyByPrefix)).ExpectQuery().
+			WithArgs("ak_0123456789abcdef").WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var key entity.APIKey
+		key, err = repo.GetAPIKeyByPrefix(context.TODO(), "ak_0123456789abcdef")
+		assert.NoError(t, err)
+		assert.Equal(t, id, key.ID)
+		assert.Equal(t, userID, key.UserID)
+		assert.Equal(t, []string{"user:list"}, key.ScopeList())
+		assert.False(t, key.LastUsedAt.Valid)
+		assert.False(t, key.Expired(time.Now()))
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getAPIKeyByPrefix)).ExpectQuery().WithArgs("xxx").WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetAPIKeyByPrefix(context.TODO(), "xxx")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestTouchAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(touchAPIKey)).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.TouchAPIKey(context.TODO(), id)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(touchAPIKey)).WithArgs(id).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		err = repo.TouchAPIKey(context.TODO(), id)
+		assert.Error(t, err)
+	})
+}
+
+func TestCreatePasskey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	passkey := entity.Passkey{
+		UserID:       uuid.New(),
+		Name:         "laptop",
+		CredentialID: []byte{1, 2, 3},
+		PublicKey:    []byte{4, 5, 6},
+		SignCount:    1,
+		Transports:   "internal hybrid",
+	}
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_passkey")).
+			WithArgs(passkey.UserID, passkey.Name, passkey.CredentialID, passkey.PublicKey, passkey.SignCount, passkey.Transports).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		repo := New(dbx, logger)
+		err = repo.CreatePasskey(context.TODO(), passkey)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO user_passkey")).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		err = repo.CreatePasskey(context.TODO(), passkey)
+		assert.Error(t, err)
+	})
+}
+
+func TestListPasskeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	userID := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{
+			"id", "user_id", "name", "credential_id", "public_key", "sign_count", "transports", "last_used_at", "created_at",
+		}).AddRow(uuid.NewString(), userID.String(), "laptop", []byte{1}, []byte{2}, 3, "usb nfc", nil, time.Now())
+
+		mock.ExpectQuery(regexp.QuoteMeta(listPasskeys)).WithArgs(userID).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var passkeys []entity.Passkey
+		passkeys, err = repo.ListPasskeys(context.TODO(), userID)
+		assert.NoError(t, err)
+		assert.Len(t, passkeys, 1)
+		assert.Equal(t, []string{"usb", "nfc"}, passkeys[0].TransportList())
+		assert.Equal(t, int64(3), passkeys[0].SignCount)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(listPasskeys)).WithArgs(userID).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.ListPasskeys(context.TODO(), userID)
+		assert.Error(t, err)
+	})
+}
+
+func TestGetPasskeyByCredentialID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	t.Run("success", func(t *testing.T) {
+		id, userID := uuid.New(), uuid.New()
+		rows := sqlmock.NewRows([]string{
+			"id", "user_id", "name", "credential_id", "public_key", "sign_count", "transports", "last_used_at", "created_at",
+		}).AddRow(id.String(), userID.String(), "laptop", []byte{1, 2, 3}, []byte{4}, 0, "", nil, time.Now())
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getPasskeyByCredentialID)).ExpectQuery().
+			WithArgs([]byte{1, 2, 3}).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var passkey entity.Passkey
+		passkey, err = repo.GetPasskeyByCredentialID(context.TODO(), []byte{1, 2, 3})
+		assert.NoError(t, err)
+		assert.Equal(t, id, passkey.ID)
+		assert.Equal(t, userID, passkey.UserID)
+		assert.Equal(t, []byte{1, 2, 3}, passkey.CredentialID)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getPasskeyByCredentialID)).ExpectQuery().
+			WithArgs([]byte{9}).WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetPasskeyByCredentialID(context.TODO(), []byte{9})
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestUpdatePasskeySignCount(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(updatePasskeySignCount)).WithArgs(id, int64(5)).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.UpdatePasskeySignCount(context.TODO(), id, 5)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(updatePasskeySignCount)).WithArgs(id, int64(5)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.UpdatePasskeySignCount(context.TODO(), id, 5)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestDeletePasskey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	dbx := sqlx.NewDb(db, "pgx")
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	userID, id := uuid.New(), uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(deletePasskey)).WithArgs(userID, id).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.DeletePasskey(context.TODO(), userID, id)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(deletePasskey)).WithArgs(userID, id).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.DeletePasskey(context.TODO(), userID, id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
 	})
 }
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/tools"
+)
+
+// APIKeyPrincipal is the identity of a request authenticated with an API key.
+// It has the roles of the key owner, restricted to the scopes of the key.
+type APIKeyPrincipal struct {
+	KeyID  uuid.UUID
+	UserID uuid.UUID
+	Roles  []string
+	Scopes []string
+}
+
+func (p *APIKeyPrincipal) GetSubject() string {
+	return p.UserID.String()
+}
+
+func (p *APIKeyPrincipal) GetRoles() []string {
+	return p.Roles
+}
+
+// HasScope reports whether permission is in the scope of the key.
+func (p *APIKeyPrincipal) HasScope(permission string) bool {
+	for _, scope := range p.Scopes {
+		if scope == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VerifyAPIKey validates an API key and records that it was used.
+func (s service) VerifyAPIKey(ctx context.Context, key string) (*APIKeyPrincipal, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	prefix, ok := tools.APIKeyPrefix(key)
+	if !ok {
+		return nil, fmt.Errorf("[VerifyAPIKey] internal error: %w", errs.ErrInvalidAPIKey)
+	}
+
+	apiKey, err := s.repo.GetAPIKeyByPrefix(ctx, prefix)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, fmt.Errorf("[VerifyAPIKey] internal error: %w", errs.ErrInvalidAPIKey)
+	case err != nil:
+		return nil, fmt.Errorf("[VerifyAPIKey] internal error: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(tools.SHA256(key)), []byte(apiKey.KeyHash)) != 1 || apiKey.Expired(time.Now()) {
+		return nil, fmt.Errorf("[VerifyAPIKey] internal error: %w", errs.ErrInvalidAPIKey)
+	}
+
+	roles, err := s.repo.GetUserRoles(ctx, apiKey.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("[VerifyAPIKey] internal error: %w", err)
+	}
+
+	// a failed update only loses a last used timestamp, so it does not fail the request
+	if err = s.repo.TouchAPIKey(ctx, apiKey.ID); err != nil {
+		s.logger.Errorf("touch api key %s: %v", apiKey.ID, err)
+	}
+
+	return &APIKeyPrincipal{
+		KeyID:  apiKey.ID,
+		UserID: apiKey.UserID,
+		Roles:  roles,
+		Scopes: apiKey.ScopeList(),
+	}, nil
+}
@@ -0,0 +1,264 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/hinccvi/go-ddd/internal/config"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+)
+
+type (
+	// KeySet holds the asymmetric keys used to sign and verify access tokens.
+	// Only the active key signs new tokens, every key in the set is accepted during verification
+	// so that keys can be rotated without invalidating tokens that are still in flight.
+	KeySet struct {
+		active *signingKey
+		keys   map[string]*signingKey
+	}
+
+	signingKey struct {
+		id      string
+		method  jwt.SigningMethod
+		private crypto.PrivateKey
+		public  crypto.PublicKey
+	}
+
+	// JWKS is a JSON Web Key Set as defined in RFC 7517.
+	JWKS struct {
+		Keys []JWK `json:"keys"`
+	}
+
+	// JWK is the public part of a signing key as defined in RFC 7517.
+	JWK struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		N   string `json:"n,omitempty"`
+		E   string `json:"e,omitempty"`
+		Crv string `json:"crv,omitempty"`
+		X   string `json:"x,omitempty"`
+		Y   string `json:"y,omitempty"`
+	}
+)
+
+var (
+	errUnsupportedKey   = errors.New("unsupported key type")
+	errInvalidPEM       = errors.New("invalid pem file")
+	errMissingActiveKey = errors.New("active key not found or has no private key")
+	errMissingSecret    = errors.New("signing key not configured")
+	errKeyMismatch      = errors.New("public key does not match private key")
+)
+
+// LoadKeySet loads the access token signing keys listed in the config from PEM files.
+// It returns nil if no keys are configured, in which case access tokens are signed
+// with HS256 and the shared access signing key.
+// The shared signing keys that are in use must be set, so that tokens are never signed with an empty secret.
+func LoadKeySet(cfg *config.Config) (*KeySet, error) {
+	if cfg.Jwt.RefreshSigningKey == "" || (len(cfg.Jwt.Keys) == 0 && cfg.Jwt.AccessSigningKey == "") {
+		return nil, fmt.Errorf("[LoadKeySet] internal error: %w", errMissingSecret)
+	}
+
+	if len(cfg.Jwt.Keys) == 0 {
+		return nil, nil //nolint:nilnil // no key set means symmetric signing
+	}
+
+	ks := &KeySet{keys: make(map[string]*signingKey, len(cfg.Jwt.Keys))}
+	for _, k := range cfg.Jwt.Keys {
+		key, err := loadSigningKey(k.ID, k.PrivateKeyFile, k.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("[LoadKeySet] key %s: %w", k.ID, err)
+		}
+
+		ks.keys[k.ID] = key
+	}
+
+	active, ok := ks.keys[cfg.Jwt.ActiveKeyID]
+	if !ok || active.private == nil {
+		return nil, fmt.Errorf("[LoadKeySet] internal error: %w", errMissingActiveKey)
+	}
+	ks.active = active
+
+	return ks, nil
+}
+
+// sign signs the claims with the active key and sets its id as the kid header.
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.method, claims)
+	token.Header["kid"] = ks.active.id
+
+	return token.SignedString(ks.active.private)
+}
+
+// keyFunc looks up the verification key by the kid header of a token.
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, errs.ErrInvalidJwt
+	}
+
+	key, ok := ks.keys[kid]
+	if !ok || key.method.Alg() != token.Method.Alg() {
+		return nil, errs.ErrInvalidJwt
+	}
+
+	return key.public, nil
+}
+
+// JWKS returns the public keys of the set, sorted by key id.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	if ks == nil {
+		return jwks
+	}
+
+	for _, key := range ks.keys {
+		jwks.Keys = append(jwks.Keys, key.jwk())
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].Kid < jwks.Keys[j].Kid
+	})
+
+	return jwks
+}
+
+func (k *signingKey) jwk() JWK {
+	jwk := JWK{Kid: k.id, Use: "sig", Alg: k.method.Alg()}
+
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encodeBase64(pub.N.Bytes())
+		jwk.E = encodeBase64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8 //nolint:gomnd // bits to bytes
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = encodeBase64(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = encodeBase64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encodeBase64(pub)
+	}
+
+	return jwk
+}
+
+// loadSigningKey reads a key pair from PEM files. The private key file is optional for keys
+// that were rotated out and are only kept to verify tokens issued before the rotation.
+func loadSigningKey(id, privateKeyFile, publicKeyFile string) (*signingKey, error) {
+	key := &signingKey{id: id}
+
+	if privateKeyFile != "" {
+		der, err := readPEM(privateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if key.private, err = parsePrivateKey(der); err != nil {
+			return nil, err
+		}
+
+		signer, ok := key.private.(crypto.Signer)
+		if !ok {
+			return nil, errUnsupportedKey
+		}
+		key.public = signer.Public()
+	}
+
+	if publicKeyFile != "" {
+		der, err := readPEM(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		public, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, err
+		}
+
+		// a public key that does not belong to the private key would publish a JWKS no token verifies against
+		if key.public != nil && !equalPublicKeys(key.public, public) {
+			return nil, errKeyMismatch
+		}
+		key.public = public
+	}
+
+	method, err := signingMethod(key.public)
+	if err != nil {
+		return nil, err
+	}
+	key.method = method
+
+	return key, nil
+}
+
+func equalPublicKeys(a, b crypto.PublicKey) bool {
+	pub, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(b)
+}
+
+func signingMethod(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errUnsupportedKey
+		}
+		return jwt.SigningMethodES256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, errUnsupportedKey
+	}
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	return nil, errUnsupportedKey
+}
+
+func readPEM(file string) ([]byte, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errInvalidPEM
+	}
+
+	return block.Bytes, nil
+}
+
+func encodeBase64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
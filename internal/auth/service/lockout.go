@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+)
+
+type (
+	// LockedAccount is a user that is locked out after too many incorrect passwords or 2FA codes.
+	LockedAccount struct {
+		UserID      string    `json:"user_id"`
+		LockedUntil time.Time `json:"locked_until"`
+	}
+
+	UnlockAccountRequest struct {
+		ID *uuid.UUID `param:"id" validate:"required"`
+	}
+)
+
+const (
+	// PermissionUnlock allows listing and unlocking locked accounts. It is seeded by the unlock permission migration.
+	PermissionUnlock = "user:unlock"
+
+	lockoutStrikeExpiration = 24 * time.Hour
+	lockedAccountsIndex     = "index"
+)
+
+// ListLockedAccounts returns the accounts that are currently locked, the earliest to unlock first.
+func (s service) ListLockedAccounts(ctx context.Context) ([]LockedAccount, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	key := s.getRedisKey(lockedAccounts, lockedAccountsIndex)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// locks expire on their own, drop them from the index as well
+	if err := s.rds.ZRemRangeByScore(ctx, key, "-inf", now).Err(); err != nil {
+		return []LockedAccount{}, fmt.Errorf("[ListLockedAccounts] internal error: %w", err)
+	}
+
+	val, err := s.rds.ZRangeWithScores(ctx, key, 0, -1).Result()
+	if err != nil {
+		return []LockedAccount{}, fmt.Errorf("[ListLockedAccounts] internal error: %w", err)
+	}
+
+	accounts := make([]LockedAccount, 0, len(val))
+	for _, z := range val {
+		id, ok := z.Member.(string)
+		if !ok {
+			continue
+		}
+
+		accounts = append(accounts, LockedAccount{
+			UserID:      id,
+			LockedUntil: time.Unix(int64(z.Score), 0).UTC(),
+		})
+	}
+
+	return accounts, nil
+}
+
+// UnlockAccount lifts the lockout of a user and resets its failure counters.
+func (s service) UnlockAccount(ctx context.Context, userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	id := userID.String()
+
+	var del *redis.IntCmd
+	_, err := s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		del = pipe.Del(ctx, s.getRedisKey(lockout, id))
+		pipe.Del(ctx, s.getRedisKey(incorrectPassword, id), s.getRedisKey(lockoutStrike, id))
+		pipe.ZRem(ctx, s.getRedisKey(lockedAccounts, lockedAccountsIndex), id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("[UnlockAccount] internal error: %w", err)
+	}
+
+	if del.Val() == 0 {
+		return fmt.Errorf("[UnlockAccount] internal error: %w", errs.ErrAccountNotLocked)
+	}
+
+	return nil
+}
+
+// checkLockout fails with ErrMaxAttempt while a user is locked out.
+// It runs before the password is compared so that a locked account cannot be logged into at all.
+func (s service) checkLockout(ctx context.Context, id string) error {
+	if s.cfg.Lockout.Threshold <= 0 {
+		return nil
+	}
+
+	n, err := s.rds.Exists(ctx, s.getRedisKey(lockout, id)).Result()
+	if err != nil {
+		return fmt.Errorf("[checkLockout] internal error: %w", err)
+	}
+
+	if n > 0 {
+		return errs.ErrMaxAttempt
+	}
+
+	return nil
+}
+
+// recordFailedLogin counts an incorrect password or 2FA code within the lockout window
+// and locks the user out once the threshold is reached.
+func (s service) recordFailedLogin(ctx context.Context, id string) error {
+	if s.cfg.Lockout.Threshold <= 0 {
+		return nil
+	}
+
+	key := s.getRedisKey(incorrectPassword, id)
+
+	n, err := s.rds.Incr(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("[recordFailedLogin] internal error: %w", err)
+	}
+
+	if n == 1 {
+		if err = s.rds.Expire(ctx, key, time.Duration(s.cfg.Lockout.Window)*time.Minute).Err(); err != nil {
+			return fmt.Errorf("[recordFailedLogin] internal error: %w", err)
+		}
+	}
+
+	if n < int64(s.cfg.Lockout.Threshold) {
+		return nil
+	}
+
+	strikeKey := s.getRedisKey(lockoutStrike, id)
+
+	strike, err := s.rds.Incr(ctx, strikeKey).Result()
+	if err != nil {
+		return fmt.Errorf("[recordFailedLogin] internal error: %w", err)
+	}
+
+	d := s.lockoutDuration(strike)
+
+	_, err = s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Expire(ctx, strikeKey, lockoutStrikeExpiration)
+		pipe.Set(ctx, s.getRedisKey(lockout, id), strike, d)
+		pipe.Del(ctx, key)
+		pipe.ZAdd(ctx, s.getRedisKey(lockedAccounts, lockedAccountsIndex), redis.Z{
+			Score:  float64(time.Now().Add(d).Unix()),
+			Member: id,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("[recordFailedLogin] internal error: %w", err)
+	}
+
+	s.logger.Warnf("user %s locked out for %s after %d failed logins", id, d, n)
+
+	return nil
+}
+
+// clearFailedLogins resets the failure counters of a user after a successful login.
+func (s service) clearFailedLogins(ctx context.Context, id string) error {
+	return s.rds.Del(ctx, s.getRedisKey(incorrectPassword, id), s.getRedisKey(lockoutStrike, id)).Err()
+}
+
+// lockoutDuration returns how long the nth lockout of a user lasts.
+// Progressive lockouts double with every lockout within a day, up to the max duration.
+func (s service) lockoutDuration(strike int64) time.Duration {
+	d := time.Duration(s.cfg.Lockout.Duration) * time.Minute
+	if !s.cfg.Lockout.Progressive {
+		return d
+	}
+
+	maxDuration := time.Duration(s.cfg.Lockout.MaxDuration) * time.Minute
+	for i := int64(1); i < strike; i++ {
+		d *= 2
+		if maxDuration > 0 && d >= maxDuration {
+			break
+		}
+	}
+
+	if maxDuration > 0 && d > maxDuration {
+		d = maxDuration
+	}
+
+	return d
+}
@@ -0,0 +1,628 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/oidc"
+	"github.com/hinccvi/go-ddd/tools"
+)
+
+type (
+	// OAuthError is an error response of the OAuth2 endpoints as defined in RFC 6749 section 5.2.
+	OAuthError struct {
+		Code        string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+		Status      int    `json:"-"`
+	}
+
+	// OAuthClientCredentials authenticate a client at the token, introspection and revocation endpoints.
+	// They are taken from HTTP basic auth if present, and from the form otherwise.
+	OAuthClientCredentials struct {
+		ClientID     string `form:"client_id"`
+		ClientSecret string `form:"client_secret"`
+	}
+
+	// http request struct.
+	CreateOAuthClientRequest struct {
+		Name         string   `json:"name" validate:"required,max=100"`
+		RedirectURIs []string `json:"redirect_uris" validate:"dive,url"`
+		GrantTypes   []string `json:"grant_types" validate:"required,min=1,dive,oneof=authorization_code client_credentials"`
+		Scopes       []string `json:"scopes" validate:"required,min=1,dive,required,printascii,excludesall= "`
+		Public       bool     `json:"public"`
+	}
+
+	OAuthAuthorizeRequest struct {
+		ResponseType        string `query:"response_type"`
+		ClientID            string `query:"client_id"`
+		RedirectURI         string `query:"redirect_uri"`
+		Scope               string `query:"scope"`
+		State               string `query:"state"`
+		CodeChallenge       string `query:"code_challenge"`
+		CodeChallengeMethod string `query:"code_challenge_method"`
+	}
+
+	OAuthTokenRequest struct {
+		GrantType    string `form:"grant_type"`
+		Code         string `form:"code"`
+		RedirectURI  string `form:"redirect_uri"`
+		CodeVerifier string `form:"code_verifier"`
+		RefreshToken string `form:"refresh_token"`
+		Scope        string `form:"scope"`
+		OAuthClientCredentials
+		IP        string `form:"-"`
+		UserAgent string `form:"-"`
+	}
+
+	OAuthTokenActionRequest struct {
+		Token         string `form:"token"`
+		TokenTypeHint string `form:"token_type_hint"`
+		OAuthClientCredentials
+	}
+
+	// http response struct.
+	// ClientSecret is only returned when the client is created.
+	oauthClientResponse struct {
+		ClientID     string   `json:"client_id"`
+		ClientSecret string   `json:"client_secret,omitempty"`
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		GrantTypes   []string `json:"grant_types"`
+		Scopes       []string `json:"scopes"`
+	}
+
+	oauthTokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		Scope        string `json:"scope,omitempty"`
+	}
+
+	// IntrospectionResponse describes a token as defined in RFC 7662. Only Active is set for inactive tokens.
+	IntrospectionResponse struct {
+		Active    bool     `json:"active"`
+		Scope     string   `json:"scope,omitempty"`
+		ClientID  string   `json:"client_id,omitempty"`
+		Username  string   `json:"username,omitempty"`
+		TokenType string   `json:"token_type,omitempty"`
+		ExpiresAt int64    `json:"exp,omitempty"`
+		IssuedAt  int64    `json:"iat,omitempty"`
+		Subject   string   `json:"sub,omitempty"`
+		Audience  []string `json:"aud,omitempty"`
+		Issuer    string   `json:"iss,omitempty"`
+		ID        string   `json:"jti,omitempty"`
+	}
+)
+
+const (
+	// PermissionManageClients allows registering OAuth2 clients. It is seeded by the oauth client migration.
+	PermissionManageClients = "oauth:client"
+
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+
+	tokenTypeBearer       = "Bearer"
+	tokenHintRefreshToken = "refresh_token"
+	codeChallengeS256     = "S256"
+	clientIDSize          = 16
+)
+
+// Error codes of RFC 6749 section 4.1.2.1 and 5.2.
+const (
+	oauthInvalidRequest          = "invalid_request"
+	oauthInvalidClient           = "invalid_client"
+	oauthInvalidGrant            = "invalid_grant"
+	oauthInvalidScope            = "invalid_scope"
+	oauthUnauthorizedClient      = "unauthorized_client"
+	oauthUnsupportedGrantType    = "unsupported_grant_type"
+	oauthUnsupportedResponseType = "unsupported_response_type"
+)
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+
+	return e.Code + ": " + e.Description
+}
+
+func newOAuthError(code, description string) *OAuthError {
+	status := http.StatusBadRequest
+	if code == oauthInvalidClient {
+		status = http.StatusUnauthorized
+	}
+
+	return &OAuthError{code, description, status}
+}
+
+// CreateOAuthClient registers an OAuth2 client. The secret of a confidential client is only returned here,
+// it is stored hashed. Public clients have no secret and may only use the authorization code grant.
+func (s service) CreateOAuthClient(ctx context.Context, req CreateOAuthClientRequest) (oauthClientResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	grants := strings.Join(req.GrantTypes, " ")
+	client := entity.OAuthClient{
+		Name:         req.Name,
+		RedirectURIs: strings.Join(req.RedirectURIs, " "),
+		GrantTypes:   grants,
+		Scopes:       strings.Join(req.Scopes, " "),
+	}
+
+	switch {
+	case req.Public && client.AllowsGrant(GrantClientCredentials),
+		client.AllowsGrant(GrantAuthorizationCode) && len(req.RedirectURIs) == 0:
+		return oauthClientResponse{}, fmt.Errorf("[CreateOAuthClient] internal error: %w", errs.ErrConditionNotFulfil)
+	}
+
+	var err error
+	if client.ClientID, err = oidc.RandomString(); err != nil {
+		return oauthClientResponse{}, fmt.Errorf("[CreateOAuthClient] internal error: %w", err)
+	}
+	client.ClientID = client.ClientID[:clientIDSize]
+
+	var secret string
+	if !req.Public {
+		if secret, err = oidc.RandomString(); err != nil {
+			return oauthClientResponse{}, fmt.Errorf("[CreateOAuthClient] internal error: %w", err)
+		}
+
+		client.SecretHash = sql.NullString{String: tools.SHA256(secret), Valid: true}
+	}
+
+	if err = s.repo.CreateOAuthClient(ctx, client); err != nil {
+		return oauthClientResponse{}, fmt.Errorf("[CreateOAuthClient] internal error: %w", err)
+	}
+
+	return oauthClientResponse{
+		ClientID:     client.ClientID,
+		ClientSecret: secret,
+		Name:         client.Name,
+		RedirectURIs: strings.Fields(client.RedirectURIs),
+		GrantTypes:   strings.Fields(client.GrantTypes),
+		Scopes:       client.AllowedScopes(),
+	}, nil
+}
+
+// OAuthAuthorize issues an authorization code to a client on behalf of the logged in user and returns the
+// redirect URI to send the code to. First-party clients are trusted, so there is no consent step.
+// An OAuthError is returned if the client or redirect URI is invalid, every other error is sent
+// to the redirect URI as defined in RFC 6749 section 4.1.2.1.
+func (s service) OAuthAuthorize(
+	ctx context.Context,
+	user entity.User,
+	req OAuthAuthorizeRequest,
+) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	client, err := s.repo.GetOAuthClient(ctx, req.ClientID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return "", fmt.Errorf("[OAuthAuthorize] internal error: %w", newOAuthError(oauthInvalidRequest, "unknown client"))
+	case err != nil:
+		return "", fmt.Errorf("[OAuthAuthorize] internal error: %w", err)
+	}
+
+	if !client.HasRedirectURI(req.RedirectURI) {
+		return "", fmt.Errorf("[OAuthAuthorize] internal error: %w",
+			newOAuthError(oauthInvalidRequest, "redirect_uri is not registered"))
+	}
+
+	redirect := func(params url.Values) (string, error) {
+		u, err := url.Parse(req.RedirectURI)
+		if err != nil {
+			return "", fmt.Errorf("[OAuthAuthorize] internal error: %w", err)
+		}
+
+		q := u.Query()
+		for k := range params {
+			q.Set(k, params.Get(k))
+		}
+		if req.State != "" {
+			q.Set("state", req.State)
+		}
+		u.RawQuery = q.Encode()
+
+		return u.String(), nil
+	}
+
+	fail := func(code, description string) (string, error) {
+		return redirect(url.Values{"error": {code}, "error_description": {description}})
+	}
+
+	scope, ok := grantedScope(client, req.Scope)
+
+	switch {
+	case req.ResponseType != "code":
+		return fail(oauthUnsupportedResponseType, "response_type must be code")
+	case !client.AllowsGrant(GrantAuthorizationCode):
+		return fail(oauthUnauthorizedClient, "client may not use the authorization code grant")
+	case req.CodeChallenge == "" || req.CodeChallengeMethod != codeChallengeS256:
+		return fail(oauthInvalidRequest, "PKCE with code_challenge_method S256 is required")
+	case !ok:
+		return fail(oauthInvalidScope, "scope is not allowed for the client")
+	}
+
+	code, err := oidc.RandomString()
+	if err != nil {
+		return "", fmt.Errorf("[OAuthAuthorize] internal error: %w", err)
+	}
+
+	key := s.getRedisKey(oauthCode, tools.SHA256(code))
+
+	_, err = s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"client_id", client.ClientID,
+			"user_id", user.ID.String(),
+			"username", user.Username,
+			"redirect_uri", req.RedirectURI,
+			"scope", scope,
+			"code_challenge", req.CodeChallenge,
+		)
+		pipe.Expire(ctx, key, time.Duration(s.cfg.OAuth.CodeExpiration)*time.Second)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("[OAuthAuthorize] internal error: %w", err)
+	}
+
+	return redirect(url.Values{"code": {code}})
+}
+
+// OAuthToken is the token endpoint. It supports the client_credentials grant for confidential clients,
+// which yields an access token for the client itself, the authorization_code grant with PKCE,
+// which yields a token pair for the user the code was issued to, and the refresh_token grant.
+func (s service) OAuthToken(ctx context.Context, req OAuthTokenRequest) (oauthTokenResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	client, err := s.authenticateClient(ctx, req.OAuthClientCredentials)
+	if err != nil {
+		return oauthTokenResponse{}, fmt.Errorf("[OAuthToken] internal error: %w", err)
+	}
+
+	var res oauthTokenResponse
+	switch req.GrantType {
+	case GrantClientCredentials:
+		res, err = s.clientCredentialsGrant(client, req)
+	case GrantAuthorizationCode:
+		res, err = s.authorizationCodeGrant(ctx, client, req)
+	case GrantRefreshToken:
+		res, err = s.refreshTokenGrant(ctx, client, req)
+	default:
+		err = newOAuthError(oauthUnsupportedGrantType, "")
+	}
+	if err != nil {
+		return oauthTokenResponse{}, fmt.Errorf("[OAuthToken] internal error: %w", err)
+	}
+
+	return res, nil
+}
+
+// OAuthIntrospect describes an access or refresh token to a confidential client as defined in RFC 7662.
+// Tokens that are invalid, expired or revoked are reported as inactive.
+func (s service) OAuthIntrospect(ctx context.Context, req OAuthTokenActionRequest) (IntrospectionResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	client, err := s.authenticateClient(ctx, req.OAuthClientCredentials)
+	if err != nil {
+		return IntrospectionResponse{}, fmt.Errorf("[OAuthIntrospect] internal error: %w", err)
+	}
+
+	if !client.Confidential() {
+		return IntrospectionResponse{}, fmt.Errorf("[OAuthIntrospect] internal error: %w",
+			newOAuthError(oauthInvalidClient, "public clients may not introspect tokens"))
+	}
+
+	claims, tokenType, err := s.activeToken(ctx, req.Token, req.TokenTypeHint)
+	if err != nil {
+		return IntrospectionResponse{}, fmt.Errorf("[OAuthIntrospect] internal error: %w", err)
+	}
+
+	if claims == nil {
+		return IntrospectionResponse{Active: false}, nil
+	}
+
+	res := IntrospectionResponse{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Username:  claims.UserName,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		ID:        claims.ID,
+		ExpiresAt: claims.ExpiresAt.Unix(),
+	}
+	if claims.IssuedAt != nil {
+		res.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if tokenType == Access {
+		res.TokenType = tokenTypeBearer
+	}
+
+	return res, nil
+}
+
+// OAuthRevoke revokes an access or refresh token the client was issued, as defined in RFC 7009.
+// Revoking either token ends the session it belongs to. Unknown tokens and tokens of other
+// clients are ignored, so the response does not reveal whether a token was valid.
+func (s service) OAuthRevoke(ctx context.Context, req OAuthTokenActionRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	client, err := s.authenticateClient(ctx, req.OAuthClientCredentials)
+	if err != nil {
+		return fmt.Errorf("[OAuthRevoke] internal error: %w", err)
+	}
+
+	claims, tokenType, err := s.activeToken(ctx, req.Token, req.TokenTypeHint)
+	if err != nil {
+		return fmt.Errorf("[OAuthRevoke] internal error: %w", err)
+	}
+
+	if claims == nil || claims.ClientID != client.ClientID {
+		return nil
+	}
+
+	if tokenType == Access {
+		if err = s.Logout(ctx, *claims); err != nil {
+			return fmt.Errorf("[OAuthRevoke] internal error: %w", err)
+		}
+
+		return nil
+	}
+
+	sessionID, err := s.rds.Get(ctx, s.getRedisKey(refreshToken, claims.ID)).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return nil
+	case err != nil:
+		return fmt.Errorf("[OAuthRevoke] internal error: %w", err)
+	}
+
+	if err = s.revokeSessions(ctx, claims.Subject, sessionID); err != nil {
+		return fmt.Errorf("[OAuthRevoke] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// authenticateClient checks the credentials of a client. Public clients authenticate with their ID only.
+func (s service) authenticateClient(ctx context.Context, creds OAuthClientCredentials) (entity.OAuthClient, error) {
+	if creds.ClientID == "" {
+		return entity.OAuthClient{}, newOAuthError(oauthInvalidClient, "client authentication is required")
+	}
+
+	client, err := s.repo.GetOAuthClient(ctx, creds.ClientID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return entity.OAuthClient{}, newOAuthError(oauthInvalidClient, "client authentication failed")
+	case err != nil:
+		return entity.OAuthClient{}, fmt.Errorf("[authenticateClient] internal error: %w", err)
+	}
+
+	if client.Confidential() {
+		hash := tools.SHA256(creds.ClientSecret)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(client.SecretHash.String)) != 1 {
+			return entity.OAuthClient{}, newOAuthError(oauthInvalidClient, "client authentication failed")
+		}
+	} else if creds.ClientSecret != "" {
+		return entity.OAuthClient{}, newOAuthError(oauthInvalidClient, "client authentication failed")
+	}
+
+	return client, nil
+}
+
+func (s service) clientCredentialsGrant(client entity.OAuthClient, req OAuthTokenRequest) (oauthTokenResponse, error) {
+	if !client.Confidential() || !client.AllowsGrant(GrantClientCredentials) {
+		return oauthTokenResponse{}, newOAuthError(oauthUnauthorizedClient, "client may not use the client credentials grant")
+	}
+
+	scope, ok := grantedScope(client, req.Scope)
+	if !ok {
+		return oauthTokenResponse{}, newOAuthError(oauthInvalidScope, "scope is not allowed for the client")
+	}
+
+	// the client acts on its own behalf, so it is the subject and there is no session to refresh
+	claims := s.newClaims(uuid.Nil, "", Access)
+	claims.Subject = client.ClientID
+	claims.ClientID = client.ClientID
+	claims.Scope = scope
+
+	accessToken, err := s.generateJWT(claims, Access)
+	if err != nil {
+		return oauthTokenResponse{}, fmt.Errorf("[clientCredentialsGrant] internal error: %w", err)
+	}
+
+	return oauthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   tokenTypeBearer,
+		ExpiresIn:   int(s.getExpiration(Access).Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+func (s service) authorizationCodeGrant(
+	ctx context.Context,
+	client entity.OAuthClient,
+	req OAuthTokenRequest,
+) (oauthTokenResponse, error) {
+	if !client.AllowsGrant(GrantAuthorizationCode) {
+		return oauthTokenResponse{}, newOAuthError(oauthUnauthorizedClient, "client may not use the authorization code grant")
+	}
+
+	// the code is single-use, whoever deletes it first redeems it
+	key := s.getRedisKey(oauthCode, tools.SHA256(req.Code))
+
+	var get *redis.MapStringStringCmd
+	var del *redis.IntCmd
+	_, err := s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HGetAll(ctx, key)
+		del = pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return oauthTokenResponse{}, fmt.Errorf("[authorizationCodeGrant] internal error: %w", err)
+	}
+
+	code := get.Val()
+	challenge := oidc.CodeChallenge(req.CodeVerifier)
+
+	switch {
+	case del.Val() == 0,
+		code["client_id"] != client.ClientID,
+		code["redirect_uri"] != req.RedirectURI,
+		req.CodeVerifier == "",
+		subtle.ConstantTimeCompare([]byte(challenge), []byte(code["code_challenge"])) != 1:
+		return oauthTokenResponse{}, newOAuthError(oauthInvalidGrant, "invalid authorization code")
+	}
+
+	userID, err := uuid.Parse(code["user_id"])
+	if err != nil {
+		return oauthTokenResponse{}, newOAuthError(oauthInvalidGrant, "invalid authorization code")
+	}
+
+	user := entity.User{ID: userID, Username: code["username"]}
+	device := DeviceInfo{DeviceName: client.Name, IP: req.IP, UserAgent: req.UserAgent}
+
+	res, err := s.issueClientTokens(ctx, user, device, client.ClientID, code["scope"])
+	if err != nil {
+		return oauthTokenResponse{}, fmt.Errorf("[authorizationCodeGrant] internal error: %w", err)
+	}
+
+	return oauthTokenResponse{
+		AccessToken:  res.AccessToken,
+		TokenType:    tokenTypeBearer,
+		ExpiresIn:    int(s.getExpiration(Access).Seconds()),
+		RefreshToken: res.RefreshToken,
+		Scope:        code["scope"],
+	}, nil
+}
+
+// refreshTokenGrant exchanges a refresh token issued to the client for a new token pair, as defined in
+// RFC 6749 section 6. The refresh token is rotated like the one of a login and keeps its scope,
+// while the access token may be granted a narrower scope.
+func (s service) refreshTokenGrant(
+	ctx context.Context,
+	client entity.OAuthClient,
+	req OAuthTokenRequest,
+) (oauthTokenResponse, error) {
+	claims, err := s.parseRefreshToken(req.RefreshToken)
+	if err != nil || claims.ClientID == "" || claims.ClientID != client.ClientID {
+		return oauthTokenResponse{}, newOAuthError(oauthInvalidGrant, "invalid refresh token")
+	}
+
+	scope, ok := narrowScope(strings.Fields(claims.Scope), req.Scope)
+	if !ok {
+		return oauthTokenResponse{}, newOAuthError(oauthInvalidScope, "scope exceeds the scope originally granted")
+	}
+
+	res, err := s.rotateTokens(ctx, claims, scope)
+	switch {
+	case errors.Is(err, errs.ErrInvalidRefreshToken):
+		return oauthTokenResponse{}, newOAuthError(oauthInvalidGrant, "invalid refresh token")
+	case err != nil:
+		return oauthTokenResponse{}, fmt.Errorf("[refreshTokenGrant] internal error: %w", err)
+	}
+
+	return oauthTokenResponse{
+		AccessToken:  res.AccessToken,
+		TokenType:    tokenTypeBearer,
+		ExpiresIn:    int(s.getExpiration(Access).Seconds()),
+		RefreshToken: res.RefreshToken,
+		Scope:        scope,
+	}, nil
+}
+
+// activeToken returns the claims of a token that is currently valid, or nil if it is not.
+// Access tokens are tried first unless the hint says otherwise, and a refresh token is only
+// active while it is the current token of its session.
+func (s service) activeToken(ctx context.Context, token, hint string) (*JWTCustomClaims, jwtType, error) {
+	if hint != tokenHintRefreshToken {
+		if claims, err := s.VerifyAccessToken(ctx, token); err == nil {
+			return claims, Access, nil
+		}
+	}
+
+	claims, err := s.parseRefreshToken(token)
+	if err != nil {
+		if hint == tokenHintRefreshToken {
+			if claims, err := s.VerifyAccessToken(ctx, token); err == nil {
+				return claims, Access, nil
+			}
+		}
+
+		return nil, "", nil
+	}
+
+	sessionID, err := s.rds.Get(ctx, s.getRedisKey(refreshToken, claims.ID)).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return nil, "", nil
+	case err != nil:
+		return nil, "", fmt.Errorf("[activeToken] internal error: %w", err)
+	}
+
+	current, err := s.rds.HGet(ctx, s.getRedisKey(session, sessionID), "token").Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return nil, "", nil
+	case err != nil:
+		return nil, "", fmt.Errorf("[activeToken] internal error: %w", err)
+	}
+
+	if current != claims.ID {
+		return nil, "", nil
+	}
+
+	return &claims, Refresh, nil
+}
+
+// grantedScope returns the scope to grant for a requested scope. Every scope of the client is granted
+// if none is requested, and ok is false if a requested scope is not allowed for the client.
+func grantedScope(client entity.OAuthClient, requested string) (string, bool) {
+	return narrowScope(client.AllowedScopes(), requested)
+}
+
+// narrowScope returns the scope to grant out of the allowed scopes for a requested scope. Every allowed scope
+// is granted if none is requested, and ok is false if a requested scope is not allowed.
+func narrowScope(allowed []string, requested string) (string, bool) {
+	if requested == "" {
+		return strings.Join(allowed, " "), true
+	}
+
+	scopes := strings.Fields(requested)
+	for _, scope := range scopes {
+		if !containsString(allowed, scope) {
+			return "", false
+		}
+	}
+
+	return strings.Join(scopes, " "), true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/config"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/oidc"
+)
+
+type (
+	// http request struct.
+	OIDCAuthorizeRequest struct {
+		Provider   string `param:"provider" validate:"required"`
+		DeviceName string `query:"device_name" validate:"max=100"`
+		IP         string `json:"-"`
+		UserAgent  string `json:"-"`
+	}
+
+	OIDCCallbackRequest struct {
+		Provider string `param:"provider" validate:"required"`
+		Code     string `query:"code" validate:"required"`
+		State    string `query:"state" validate:"required"`
+	}
+
+	// http response struct.
+	oidcAuthorizeResponse struct {
+		AuthorizationURL string `json:"authorization_url"`
+		State            string `json:"state"`
+	}
+)
+
+const (
+	usernameMaxBase    = 16
+	usernameSuffixSize = 4
+)
+
+// newOIDCProviders creates the OpenID Connect providers that have a client ID configured.
+func newOIDCProviders(providers map[string]config.OIDCProvider) map[string]*oidc.Provider {
+	res := make(map[string]*oidc.Provider, len(providers))
+	for name, p := range providers {
+		if p.ClientID != "" {
+			res[name] = oidc.NewProvider(p, nil)
+		}
+	}
+
+	return res
+}
+
+// OIDCAuthorize starts a login with an external OpenID Connect provider.
+// It returns the URL of the provider's consent page, which redirects back to the callback with a code.
+func (s service) OIDCAuthorize(ctx context.Context, req OIDCAuthorizeRequest) (oidcAuthorizeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	provider, ok := s.providers[req.Provider]
+	if !ok {
+		return oidcAuthorizeResponse{}, fmt.Errorf("[OIDCAuthorize] internal error: %w", errs.ErrUnknownProvider)
+	}
+
+	// state binds the callback to this request, nonce binds the ID token to it
+	// and the verifier proves that whoever redeems the code started the login
+	var state, nonce, verifier string
+	for _, v := range []*string{&state, &nonce, &verifier} {
+		var err error
+		if *v, err = oidc.RandomString(); err != nil {
+			return oidcAuthorizeResponse{}, fmt.Errorf("[OIDCAuthorize] internal error: %w", err)
+		}
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return oidcAuthorizeResponse{}, fmt.Errorf("[OIDCAuthorize] internal error: %w", err)
+	}
+
+	key := s.getRedisKey(oidcState, state)
+
+	_, err = s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"provider", req.Provider,
+			"nonce", nonce,
+			"verifier", verifier,
+			"device_name", req.DeviceName,
+			"ip", req.IP,
+			"user_agent", req.UserAgent,
+		)
+		pipe.Expire(ctx, key, time.Duration(s.cfg.OIDC.StateExpiration)*time.Minute)
+		return nil
+	})
+	if err != nil {
+		return oidcAuthorizeResponse{}, fmt.Errorf("[OIDCAuthorize] internal error: %w", err)
+	}
+
+	return oidcAuthorizeResponse{authURL, state}, nil
+}
+
+// OIDCCallback completes a login with an external OpenID Connect provider. The user linked to
+// the provider subject is logged in, a verified email links an existing user, and otherwise
+// a new user is created. Users with 2FA enabled get a challenge token, like Login.
+func (s service) OIDCCallback(ctx context.Context, req OIDCCallbackRequest) (loginResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	provider, ok := s.providers[req.Provider]
+	if !ok {
+		return loginResponse{}, fmt.Errorf("[OIDCCallback] internal error: %w", errs.ErrUnknownProvider)
+	}
+
+	// the state is single-use, whoever deletes it first completes the login
+	key := s.getRedisKey(oidcState, req.State)
+
+	var get *redis.MapStringStringCmd
+	var del *redis.IntCmd
+	_, err := s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HGetAll(ctx, key)
+		del = pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[OIDCCallback] internal error: %w", err)
+	}
+
+	state := get.Val()
+	if del.Val() == 0 || state["provider"] != req.Provider {
+		return loginResponse{}, fmt.Errorf("[OIDCCallback] internal error: %w", errs.ErrInvalidOIDCState)
+	}
+
+	token, err := provider.Exchange(ctx, req.Code, state["verifier"])
+	if err != nil {
+		s.logger.Warnf("oidc %s code exchange failed: %v", req.Provider, err)
+		return loginResponse{}, fmt.Errorf("[OIDCCallback] internal error: %w", errs.ErrOIDCLogin)
+	}
+
+	idToken, err := provider.VerifyIDToken(ctx, token.IDToken, state["nonce"])
+	if err != nil {
+		s.logger.Warnf("oidc %s id token rejected: %v", req.Provider, err)
+		return loginResponse{}, fmt.Errorf("[OIDCCallback] internal error: %w", errs.ErrOIDCLogin)
+	}
+
+	user, err := s.identityUser(ctx, req.Provider, idToken)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[OIDCCallback] internal error: %w", err)
+	}
+
+	res, err := s.completeLogin(ctx, user, DeviceInfo{
+		DeviceName: state["device_name"],
+		IP:         state["ip"],
+		UserAgent:  state["user_agent"],
+	})
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[OIDCCallback] internal error: %w", err)
+	}
+
+	return res, nil
+}
+
+// identityUser returns the user linked to the subject of an ID token, linking or creating one if needed.
+// Only an email the provider verified is trusted to link an existing user, and only if the user verified it too.
+func (s service) identityUser(ctx context.Context, provider string, idToken oidc.IDToken) (entity.User, error) {
+	user, err := s.repo.GetUserByIdentity(ctx, provider, idToken.Subject)
+	switch {
+	case err == nil:
+		return user, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return entity.User{}, fmt.Errorf("[identityUser] internal error: %w", err)
+	}
+
+	identity := entity.UserIdentity{Provider: provider, Subject: idToken.Subject}
+	if idToken.Email != "" {
+		identity.Email = sql.NullString{String: idToken.Email, Valid: true}
+	}
+
+	verified := idToken.Email != "" && bool(idToken.EmailVerified)
+	if verified {
+		user, err = s.repo.GetUserByEmail(ctx, idToken.Email)
+		switch {
+		case err == nil && !user.EmailVerified():
+			// anyone can sign up with an email they do not own, so such a user is not linked
+			return entity.User{}, fmt.Errorf("[identityUser] internal error: %w", errs.ErrOIDCAccountExists)
+		case err == nil:
+			identity.UserID = user.ID
+			if err = s.repo.CreateIdentity(ctx, identity); err != nil {
+				return entity.User{}, fmt.Errorf("[identityUser] internal error: %w", err)
+			}
+
+			return user, nil
+		case !errors.Is(err, sql.ErrNoRows):
+			return entity.User{}, fmt.Errorf("[identityUser] internal error: %w", err)
+		}
+	}
+
+	user, err = s.newIdentityUser(provider, idToken)
+	if err != nil {
+		return entity.User{}, fmt.Errorf("[identityUser] internal error: %w", err)
+	}
+
+	// the provider verified the email, so the user does not have to
+	if verified {
+		user.Email = identity.Email
+		user.EmailVerifiedAt = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+	}
+
+	if user.ID, err = s.repo.CreateUserWithIdentity(ctx, user, identity); err != nil {
+		return entity.User{}, fmt.Errorf("[identityUser] internal error: %w", err)
+	}
+
+	return user, nil
+}
+
+// newIdentityUser builds a user for a first login with an external provider. The username is derived
+// from the email or name of the ID token, and the password is random since the user has none.
+func (s service) newIdentityUser(provider string, idToken oidc.IDToken) (entity.User, error) {
+	base := idToken.Email
+	if i := strings.IndexByte(base, '@'); i >= 0 {
+		base = base[:i]
+	}
+	if base == "" {
+		base = idToken.Name
+	}
+
+	base = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		default:
+			return -1
+		}
+	}, base)
+	if base == "" {
+		base = provider
+	}
+	if len(base) > usernameMaxBase {
+		base = base[:usernameMaxBase]
+	}
+
+	b := make([]byte, usernameSuffixSize)
+	if _, err := rand.Read(b); err != nil {
+		return entity.User{}, err
+	}
+
+	password, err := s.hashers.Hash(uuid.NewString())
+	if err != nil {
+		return entity.User{}, err
+	}
+
+	return entity.User{
+		Username: base + "_" + hex.EncodeToString(b),
+		Password: password,
+	}, nil
+}
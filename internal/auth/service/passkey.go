@@ -0,0 +1,270 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/webauthn"
+)
+
+type (
+	// http request struct.
+	FinishPasskeyRegistrationRequest struct {
+		Name       string                       `json:"name" validate:"required,max=100"`
+		Credential webauthn.AttestationResponse `json:"credential"`
+	}
+
+	// FinishPasskeyLoginRequest carries the assertion for the options returned by BeginPasskeyLogin.
+	// Session is the session of those options.
+	FinishPasskeyLoginRequest struct {
+		Session    string                     `json:"session" validate:"required"`
+		Credential webauthn.AssertionResponse `json:"credential"`
+		DeviceInfo
+	}
+
+	PasskeyRequest struct {
+		ID *uuid.UUID `param:"id" validate:"required"`
+	}
+
+	// http response struct.
+	// PublicKey is passed as is to navigator.credentials.create().
+	passkeyRegistrationOptions struct {
+		PublicKey webauthn.CreationOptions `json:"publicKey"`
+	}
+
+	// PublicKey is passed as is to navigator.credentials.get().
+	passkeyLoginOptions struct {
+		Session   string                  `json:"session"`
+		PublicKey webauthn.RequestOptions `json:"publicKey"`
+	}
+)
+
+// BeginPasskeyRegistration returns the options to register a passkey for a user.
+// The challenge is kept until FinishPasskeyRegistration, a new registration replaces a pending one.
+func (s service) BeginPasskeyRegistration(
+	ctx context.Context,
+	userID uuid.UUID,
+	username string,
+) (passkeyRegistrationOptions, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	passkeys, err := s.repo.ListPasskeys(ctx, userID)
+	if err != nil {
+		return passkeyRegistrationOptions{}, fmt.Errorf("[BeginPasskeyRegistration] internal error: %w", err)
+	}
+
+	exclude := make([]webauthn.CredentialDescriptor, 0, len(passkeys))
+	for _, p := range passkeys {
+		exclude = append(exclude, webauthn.CredentialDescriptor{
+			Type:       webauthn.TypePublicKey,
+			ID:         p.CredentialID,
+			Transports: p.TransportList(),
+		})
+	}
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return passkeyRegistrationOptions{}, fmt.Errorf("[BeginPasskeyRegistration] internal error: %w", err)
+	}
+
+	rp := s.relyingParty()
+	key := s.getRedisKey(passkeyRegistration, userID.String())
+
+	if err = s.rds.Set(ctx, key, challenge, rp.Timeout).Err(); err != nil {
+		return passkeyRegistrationOptions{}, fmt.Errorf("[BeginPasskeyRegistration] internal error: %w", err)
+	}
+
+	// the user handle is the user ID, so that it carries no personal information
+	user := webauthn.UserEntity{ID: userID[:], Name: username, DisplayName: username}
+
+	return passkeyRegistrationOptions{rp.CreationOptions(challenge, user, exclude)}, nil
+}
+
+// FinishPasskeyRegistration verifies the credential created with the options of BeginPasskeyRegistration
+// and stores it as a passkey of the user.
+func (s service) FinishPasskeyRegistration(
+	ctx context.Context,
+	userID uuid.UUID,
+	req FinishPasskeyRegistrationRequest,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	// the challenge is single-use, a failed registration has to start over
+	challenge, err := s.rds.GetDel(ctx, s.getRedisKey(passkeyRegistration, userID.String())).Bytes()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return fmt.Errorf("[FinishPasskeyRegistration] internal error: %w", errs.ErrInvalidChallenge)
+	case err != nil:
+		return fmt.Errorf("[FinishPasskeyRegistration] internal error: %w", err)
+	}
+
+	rp := s.relyingParty()
+
+	cred, err := rp.VerifyRegistration(req.Credential, challenge)
+	if err != nil {
+		s.logger.Warnf("passkey registration of user %s rejected: %v", userID, err)
+		return fmt.Errorf("[FinishPasskeyRegistration] internal error: %w", errs.ErrInvalidPasskey)
+	}
+
+	_, err = s.repo.GetPasskeyByCredentialID(ctx, cred.ID)
+	switch {
+	case err == nil:
+		return fmt.Errorf("[FinishPasskeyRegistration] internal error: %w", errs.ErrPasskeyExists)
+	case !errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("[FinishPasskeyRegistration] internal error: %w", err)
+	}
+
+	err = s.repo.CreatePasskey(ctx, entity.Passkey{
+		UserID:       userID,
+		Name:         req.Name,
+		CredentialID: cred.ID,
+		PublicKey:    cred.PublicKey,
+		SignCount:    int64(cred.SignCount),
+		Transports:   strings.Join(cred.Transports, " "),
+	})
+	if err != nil {
+		return fmt.Errorf("[FinishPasskeyRegistration] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// BeginPasskeyLogin returns the options to log in with a passkey. The user is not known until
+// the authenticator returns the user handle of the passkey, so the login is tracked by a session,
+// which is the encoded challenge.
+func (s service) BeginPasskeyLogin(ctx context.Context) (passkeyLoginOptions, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return passkeyLoginOptions{}, fmt.Errorf("[BeginPasskeyLogin] internal error: %w", err)
+	}
+
+	rp := s.relyingParty()
+	session := base64.RawURLEncoding.EncodeToString(challenge)
+
+	if err = s.rds.Set(ctx, s.getRedisKey(passkeyLogin, session), 1, rp.Timeout).Err(); err != nil {
+		return passkeyLoginOptions{}, fmt.Errorf("[BeginPasskeyLogin] internal error: %w", err)
+	}
+
+	return passkeyLoginOptions{session, rp.RequestOptions(challenge)}, nil
+}
+
+// FinishPasskeyLogin verifies the assertion for the options of BeginPasskeyLogin and generates
+// a JWT token pair for the owner of the passkey. The passkey verified the user, so 2FA is not asked for.
+func (s service) FinishPasskeyLogin(ctx context.Context, req FinishPasskeyLoginRequest) (loginResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	challenge, err := base64.RawURLEncoding.DecodeString(req.Session)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", errs.ErrInvalidChallenge)
+	}
+
+	// the session is single-use, whoever deletes it first completes the login
+	n, err := s.rds.Del(ctx, s.getRedisKey(passkeyLogin, req.Session)).Result()
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", err)
+	}
+
+	if n == 0 {
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", errs.ErrInvalidChallenge)
+	}
+
+	passkey, err := s.repo.GetPasskeyByCredentialID(ctx, req.Credential.RawID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", errs.ErrInvalidPasskey)
+	case err != nil:
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", err)
+	}
+
+	if !bytes.Equal(req.Credential.Response.UserHandle, passkey.UserID[:]) {
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", errs.ErrInvalidPasskey)
+	}
+
+	signCount, err := s.relyingParty().VerifyAssertion(req.Credential, challenge, webauthn.Credential{
+		ID:        passkey.CredentialID,
+		PublicKey: passkey.PublicKey,
+		SignCount: uint32(passkey.SignCount),
+	})
+	if err != nil {
+		s.logger.Warnf("passkey login of user %s rejected: %v", passkey.UserID, err)
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", errs.ErrInvalidPasskey)
+	}
+
+	user, err := s.repo.GetUserTOTP(ctx, passkey.UserID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", errs.ErrInvalidPasskey)
+	case err != nil:
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", err)
+	}
+
+	if err = s.checkLockout(ctx, user.ID.String()); err != nil {
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", err)
+	}
+
+	if err = s.repo.UpdatePasskeySignCount(ctx, passkey.ID, int64(signCount)); err != nil {
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", err)
+	}
+
+	res, err := s.issueTokens(ctx, user, req.DeviceInfo)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[FinishPasskeyLogin] internal error: %w", err)
+	}
+
+	return res, nil
+}
+
+// ListPasskeys returns the passkeys of a user, oldest first.
+func (s service) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]entity.Passkey, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	passkeys, err := s.repo.ListPasskeys(ctx, userID)
+	if err != nil {
+		return []entity.Passkey{}, fmt.Errorf("[ListPasskeys] internal error: %w", err)
+	}
+
+	return passkeys, nil
+}
+
+// DeletePasskey removes a passkey of a user. Sessions started with it are not revoked.
+func (s service) DeletePasskey(ctx context.Context, userID, id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	err := s.repo.DeletePasskey(ctx, userID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("[DeletePasskey] internal error: %w", errs.ErrPasskeyNotFound)
+	case err != nil:
+		return fmt.Errorf("[DeletePasskey] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// relyingParty returns the WebAuthn relying party passkeys are registered with.
+func (s service) relyingParty() *webauthn.RelyingParty {
+	return &webauthn.RelyingParty{
+		ID:      s.cfg.WebAuthn.RPID,
+		Name:    s.cfg.WebAuthn.RPName,
+		Origins: s.cfg.WebAuthn.Origins,
+		Timeout: time.Duration(s.cfg.WebAuthn.ChallengeExpiration) * time.Second,
+	}
+}
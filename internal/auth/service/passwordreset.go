@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/tools"
+)
+
+type (
+	// http request struct.
+	ForgotPasswordRequest struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	ResetPasswordRequest struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required"`
+	}
+)
+
+const resetTokenSize = 32
+
+// ForgotPassword emails a single-use password reset token to a registered user.
+// The response is the same whether the email is registered or not, and while the email is in cooldown.
+func (s service) ForgotPassword(ctx context.Context, req ForgotPasswordRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	// emails are matched case-insensitively, so the cooldown must be too
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	ok, err := s.rds.SetNX(
+		ctx,
+		s.getRedisKey(passwordResetCooldown, email),
+		1,
+		time.Duration(s.cfg.PasswordReset.Cooldown)*time.Second,
+	).Result()
+	if err != nil {
+		return fmt.Errorf("[ForgotPassword] internal error: %w", err)
+	}
+
+	if !ok {
+		return nil
+	}
+
+	user, err := s.repo.GetUserByEmail(ctx, email)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return fmt.Errorf("[ForgotPassword] internal error: %w", err)
+	}
+
+	b := make([]byte, resetTokenSize)
+	if _, err = rand.Read(b); err != nil {
+		return fmt.Errorf("[ForgotPassword] internal error: %w", err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	hash := tools.SHA256(token)
+	id := user.ID.String()
+	userKey := s.getRedisKey(passwordResetUser, id)
+	expiration := time.Duration(s.cfg.PasswordReset.TokenExpiration) * time.Minute
+
+	// only the latest token of a user is valid
+	prev, err := s.rds.Get(ctx, userKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("[ForgotPassword] internal error: %w", err)
+	}
+
+	_, err = s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if prev != "" {
+			pipe.Del(ctx, s.getRedisKey(passwordReset, prev))
+		}
+		pipe.Set(ctx, s.getRedisKey(passwordReset, hash), id, expiration)
+		pipe.Set(ctx, userKey, hash, expiration)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("[ForgotPassword] internal error: %w", err)
+	}
+
+	err = s.mail.Send(ctx, mail.Message{
+		To:      user.Email.String,
+		Subject: fmt.Sprintf("[%s] Reset your password", s.cfg.App.Name),
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the link below to reset your password. It expires in %d minutes.\n\n%s\n\n"+
+				"If you did not request a password reset, you can ignore this email.\n",
+			user.Username, s.cfg.PasswordReset.TokenExpiration, s.resetURL(token),
+		),
+	})
+	if err != nil {
+		// failing only for registered emails would reveal which ones are
+		s.logger.Errorf("password reset email to user %s failed: %v", id, err)
+	}
+
+	return nil
+}
+
+// ResetPassword sets a new password with a token issued by ForgotPassword.
+// The token is consumed, and every session of the user is revoked. A password rejected by the policy
+// leaves the token valid, so the user can try again.
+func (s service) ResetPassword(ctx context.Context, req ResetPasswordRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	key := s.getRedisKey(passwordReset, tools.SHA256(req.Token))
+
+	val, err := s.rds.Get(ctx, key).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return fmt.Errorf("[ResetPassword] internal error: %w", errs.ErrInvalidResetToken)
+	case err != nil:
+		return fmt.Errorf("[ResetPassword] internal error: %w", err)
+	}
+
+	id, err := uuid.Parse(val)
+	if err != nil {
+		return fmt.Errorf("[ResetPassword] internal error: %w", errs.ErrInvalidResetToken)
+	}
+
+	user, err := s.repo.GetUser(ctx, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("[ResetPassword] internal error: %w", errs.ErrInvalidResetToken)
+	case err != nil:
+		return fmt.Errorf("[ResetPassword] internal error: %w", err)
+	}
+
+	if err = s.policy.Check(req.Password, user.Username); err != nil {
+		return fmt.Errorf("[ResetPassword] internal error: %w", err)
+	}
+
+	// the token is consumed only now, and only once if used concurrently
+	used, err := s.rds.GetDel(ctx, key).Result()
+	switch {
+	case errors.Is(err, redis.Nil), err == nil && used != val:
+		return fmt.Errorf("[ResetPassword] internal error: %w", errs.ErrInvalidResetToken)
+	case err != nil:
+		return fmt.Errorf("[ResetPassword] internal error: %w", err)
+	}
+
+	if err = s.rds.Del(ctx, s.getRedisKey(passwordResetUser, val)).Err(); err != nil {
+		return fmt.Errorf("[ResetPassword] internal error: %w", err)
+	}
+
+	password, err := s.hashers.Hash(req.Password)
+	if err != nil {
+		return fmt.Errorf("[ResetPassword] internal error: %w", err)
+	}
+
+	err = s.repo.UpdatePassword(ctx, id, password)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("[ResetPassword] internal error: %w", errs.ErrInvalidResetToken)
+	case err != nil:
+		return fmt.Errorf("[ResetPassword] internal error: %w", err)
+	}
+
+	if err = s.revokeAllSessions(ctx, val, ""); err != nil {
+		return fmt.Errorf("[ResetPassword] internal error: %w", err)
+	}
+
+	return nil
+}
+
+func (s service) resetURL(token string) string {
+	u, err := url.Parse(s.cfg.PasswordReset.URL)
+	if err != nil {
+		return s.cfg.PasswordReset.URL + "?token=" + url.QueryEscape(token)
+	}
+
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v9"
@@ -15,6 +16,9 @@ import (
 	"github.com/hinccvi/go-ddd/internal/entity"
 	errs "github.com/hinccvi/go-ddd/internal/errors"
 	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/pkg/oidc"
+	"github.com/hinccvi/go-ddd/pkg/password"
 	"github.com/hinccvi/go-ddd/tools"
 )
 
@@ -25,25 +29,99 @@ type (
 		// It returns a JWT token if authentication succeeds. Otherwise, an error is returned.
 		Login(ctx context.Context, req LoginRequest) (loginResponse, error)
 		Refresh(ctx context.Context, req RefreshTokenRequest) (refreshResponse, error)
+		// SendSMSCode issues a one-time password to the phone number of a registered user.
+		SendSMSCode(ctx context.Context, req SendSMSCodeRequest) error
+		// SMSLogin verifies a one-time password and generates a JWT token pair if it matches.
+		SMSLogin(ctx context.Context, req SMSLoginRequest) (loginResponse, error)
+		// ListSessions returns the active sessions of a user.
+		ListSessions(ctx context.Context, userID uuid.UUID, currentID string) ([]Session, error)
+		// RevokeSession ends a single session of a user.
+		RevokeSession(ctx context.Context, userID uuid.UUID, sessionID string) error
+		// LogoutAll ends every session of a user.
+		LogoutAll(ctx context.Context, userID uuid.UUID) error
+		// RevokeOtherSessions ends every session of a user but the current one.
+		RevokeOtherSessions(ctx context.Context, userID uuid.UUID, currentID string) error
+		// Logout ends the session of an access token and denylists the token until it expires.
+		Logout(ctx context.Context, claims JWTCustomClaims) error
+		// VerifyAccessToken validates an access token and checks that it was not denylisted.
+		VerifyAccessToken(ctx context.Context, accessToken string) (*JWTCustomClaims, error)
+		// VerifyAPIKey validates an API key and returns the identity of its owner.
+		VerifyAPIKey(ctx context.Context, key string) (*APIKeyPrincipal, error)
+		// JWKS returns the public keys access tokens can be verified with.
+		JWKS() JWKS
+		// HasPermission reports whether any of the given roles grants a permission.
+		HasPermission(ctx context.Context, roles []string, permission string) (bool, error)
+		// ListLockedAccounts returns the accounts that are currently locked.
+		ListLockedAccounts(ctx context.Context) ([]LockedAccount, error)
+		// UnlockAccount lifts the lockout of a user.
+		UnlockAccount(ctx context.Context, userID uuid.UUID) error
+		// EnrollTwoFactor generates a new TOTP secret for a user.
+		EnrollTwoFactor(ctx context.Context, userID uuid.UUID) (TwoFactorEnrollment, error)
+		// ConfirmTwoFactor enables 2FA and returns single-use recovery codes.
+		ConfirmTwoFactor(ctx context.Context, userID uuid.UUID, req ConfirmTwoFactorRequest) (recoveryCodesResponse, error)
+		// VerifyTwoFactor exchanges a login challenge and a TOTP or recovery code for a JWT token pair.
+		VerifyTwoFactor(ctx context.Context, req VerifyTwoFactorRequest) (loginResponse, error)
+		// ForgotPassword emails a single-use password reset token to a registered user.
+		ForgotPassword(ctx context.Context, req ForgotPasswordRequest) error
+		// ResetPassword sets a new password with a reset token and revokes every session of the user.
+		ResetPassword(ctx context.Context, req ResetPasswordRequest) error
+		// OIDCAuthorize starts a login with an external OpenID Connect provider.
+		OIDCAuthorize(ctx context.Context, req OIDCAuthorizeRequest) (oidcAuthorizeResponse, error)
+		// OIDCCallback completes a login with an external OpenID Connect provider.
+		OIDCCallback(ctx context.Context, req OIDCCallbackRequest) (loginResponse, error)
+		// CreateOAuthClient registers an OAuth2 client.
+		CreateOAuthClient(ctx context.Context, req CreateOAuthClientRequest) (oauthClientResponse, error)
+		// OAuthAuthorize issues an authorization code to a client on behalf of a user.
+		OAuthAuthorize(ctx context.Context, user entity.User, req OAuthAuthorizeRequest) (string, error)
+		// OAuthToken exchanges a grant for tokens.
+		OAuthToken(ctx context.Context, req OAuthTokenRequest) (oauthTokenResponse, error)
+		// OAuthIntrospect describes a token to a confidential client.
+		OAuthIntrospect(ctx context.Context, req OAuthTokenActionRequest) (IntrospectionResponse, error)
+		// OAuthRevoke revokes a token issued to a client.
+		OAuthRevoke(ctx context.Context, req OAuthTokenActionRequest) error
+		// BeginPasskeyRegistration returns the options to register a passkey for a user.
+		BeginPasskeyRegistration(ctx context.Context, userID uuid.UUID, username string) (passkeyRegistrationOptions, error)
+		// FinishPasskeyRegistration verifies and stores a passkey created with the registration options.
+		FinishPasskeyRegistration(ctx context.Context, userID uuid.UUID, req FinishPasskeyRegistrationRequest) error
+		// BeginPasskeyLogin returns the options to log in with a passkey.
+		BeginPasskeyLogin(ctx context.Context) (passkeyLoginOptions, error)
+		// FinishPasskeyLogin verifies a passkey assertion and generates a JWT token pair.
+		FinishPasskeyLogin(ctx context.Context, req FinishPasskeyLoginRequest) (loginResponse, error)
+		// ListPasskeys returns the passkeys of a user.
+		ListPasskeys(ctx context.Context, userID uuid.UUID) ([]entity.Passkey, error)
+		// DeletePasskey removes a passkey of a user.
+		DeletePasskey(ctx context.Context, userID, id uuid.UUID) error
 	}
 
 	service struct {
-		cfg     *config.Config
-		rds     redis.Client
-		logger  log.Logger
-		repo    repository.Repository
-		timeout time.Duration
+		cfg       *config.Config
+		rds       redis.Client
+		logger    log.Logger
+		repo      repository.Repository
+		timeout   time.Duration
+		sms       SMSSender
+		keys      *KeySet
+		mail      mail.Mailer
+		providers map[string]*oidc.Provider
+		hashers   *tools.PasswordHashers
+		policy    *password.Policy
 	}
 
 	JWTCustomClaims struct {
-		UserName string `json:"username"`
+		UserName  string   `json:"username"`
+		SessionID string   `json:"sid,omitempty"`
+		Roles     []string `json:"roles,omitempty"`
+		ClientID  string   `json:"client_id,omitempty"`
+		Scope     string   `json:"scope,omitempty"`
 		jwt.RegisteredClaims
 	}
 
 	// http request struct.
 	LoginRequest struct {
+		// Username is the username or the email address of the user.
 		Username string `json:"username" validate:"required"`
 		Password string `json:"password" validate:"required"`
+		DeviceInfo
 	}
 
 	RefreshTokenRequest struct {
@@ -52,12 +130,15 @@ type (
 	}
 
 	// http response struct.
+	// Only ChallengeToken is set when the user has 2FA enabled.
 	loginResponse struct {
-		AccessToken  string `json:"access_token"`
-		RefreshToken string `json:"refresh_token"`
+		AccessToken    string `json:"access_token,omitempty"`
+		RefreshToken   string `json:"refresh_token,omitempty"`
+		ChallengeToken string `json:"challenge_token,omitempty"`
 	}
 
 	refreshResponse struct {
+		AccessToken  string `json:"access_token"`
 		RefreshToken string `json:"refresh_token"`
 	}
 
@@ -72,27 +153,47 @@ const (
 	Access  jwtType = "access"
 	Refresh jwtType = "refresh"
 
-	jwtRemainingTime                     = 60 * time.Second
-	maxLoginAttempt                      = 5
-	incorrectPasswordExpiration          = 24 * time.Hour
-	prefix                      RedisKey = "app"
-	refreshToken                RedisKey = "refresh_token"
-	incorrectPassword           RedisKey = "incorrect_password"
-	smsCooldown                 RedisKey = "sms_cooldown"
-	smsCode                     RedisKey = "sms_code"
-	smsLimit                    RedisKey = "sms_limit"
-	smsAttempt                  RedisKey = "sms_attempt"
+	jwtRemainingTime               = 60 * time.Second
+	prefix                RedisKey = "app"
+	refreshToken          RedisKey = "refresh_token"
+	session               RedisKey = "session"
+	accessDenylist        RedisKey = "access_denylist"
+	userSession           RedisKey = "user_session"
+	incorrectPassword     RedisKey = "incorrect_password"
+	lockout               RedisKey = "lockout"
+	lockoutStrike         RedisKey = "lockout_strike"
+	lockedAccounts        RedisKey = "locked_accounts"
+	smsCooldown           RedisKey = "sms_cooldown"
+	smsCode               RedisKey = "sms_code"
+	smsLimit              RedisKey = "sms_limit"
+	smsAttempt            RedisKey = "sms_attempt"
+	twoFactorChallenge    RedisKey = "two_factor_challenge"
+	totpUsed              RedisKey = "totp_used"
+	passwordReset         RedisKey = "password_reset"
+	passwordResetUser     RedisKey = "password_reset_user"
+	passwordResetCooldown RedisKey = "password_reset_cooldown"
+	oidcState             RedisKey = "oidc_state"
+	oauthCode             RedisKey = "oauth_code"
+	passkeyRegistration   RedisKey = "webauthn_registration"
+	passkeyLogin          RedisKey = "webauthn_login"
 )
 
-// New creates a new authentication service.
+// New creates a new authentication service. Passwords set with a reset token are checked against policy.
 func New(
 	cfg *config.Config,
 	rds redis.Client,
 	repo repository.Repository,
+	keys *KeySet,
+	hashers *tools.PasswordHashers,
+	policy *password.Policy,
+	sms SMSSender,
+	mailer mail.Mailer,
 	logger log.Logger,
 	timeout time.Duration,
 ) Service {
-	return service{cfg, rds, logger, repo, timeout}
+	providers := newOIDCProviders(cfg.OIDC.Providers)
+
+	return service{cfg, rds, logger, repo, timeout, sms, keys, mailer, providers, hashers, policy}
 }
 
 // Login authenticates a user and generates a JWT token if authentication succeeds.
@@ -106,28 +207,21 @@ func (s service) Login(ctx context.Context, req LoginRequest) (loginResponse, er
 		return loginResponse{}, fmt.Errorf("[Login] internal error: %w", err)
 	}
 
-	accessToken, err := s.generateJWT(user.ID, user.Username, Access)
+	res, err := s.completeLogin(ctx, user, req.DeviceInfo)
 	if err != nil {
 		return loginResponse{}, fmt.Errorf("[Login] internal error: %w", err)
 	}
 
-	refreshToken, err := s.generateJWT(user.ID, user.Username, Refresh)
-	if err != nil {
-		return loginResponse{}, fmt.Errorf("[Login] internal error: %w", err)
-	}
-
-	if err = s.cacheRefreshToken(ctx, user.ID.String(), refreshToken); err != nil {
-		return loginResponse{}, fmt.Errorf("[Login] internal error: %w", err)
-	}
-
-	return loginResponse{accessToken, refreshToken}, nil
+	return res, nil
 }
 
+// Refresh exchanges a refresh token for a new access and refresh token pair.
+// The presented refresh token is rotated out, and presenting it again revokes its whole token family.
 func (s service) Refresh(ctx context.Context, req RefreshTokenRequest) (refreshResponse, error) {
 	ctx, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
-	_, err := s.parseRefreshToken(req.RefreshToken)
+	refreshClaims, err := s.parseRefreshToken(req.RefreshToken)
 	if err != nil {
 		return refreshResponse{}, fmt.Errorf("[Refresh] internal error: %w", err)
 	}
@@ -137,74 +231,349 @@ func (s service) Refresh(ctx context.Context, req RefreshTokenRequest) (refreshR
 		return refreshResponse{}, fmt.Errorf("[Refresh] internal error: %w", err)
 	}
 
-	id, err := uuid.Parse(accessClaims.Subject)
+	if refreshClaims.Subject != accessClaims.Subject {
+		return refreshResponse{}, fmt.Errorf("[Refresh] internal error: %w", errs.ErrInvalidRefreshToken)
+	}
+
+	res, err := s.rotateTokens(ctx, refreshClaims, refreshClaims.Scope)
 	if err != nil {
 		return refreshResponse{}, fmt.Errorf("[Refresh] internal error: %w", err)
 	}
 
-	if err = s.validateRefreshToken(ctx, id.String(), req.RefreshToken); err != nil {
-		return refreshResponse{}, fmt.Errorf("[Refresh] internal error: %w", err)
+	return res, nil
+}
+
+// rotateTokens replaces the refresh token of a session with a new token pair. The client and scope
+// of the refresh token are carried over, the access token may be granted a narrower scope.
+func (s service) rotateTokens(
+	ctx context.Context,
+	refreshClaims JWTCustomClaims,
+	scope string,
+) (refreshResponse, error) {
+	id, err := uuid.Parse(refreshClaims.Subject)
+	if err != nil {
+		return refreshResponse{}, fmt.Errorf("[rotateTokens] internal error: %w", err)
 	}
 
-	accessToken, err := s.generateJWT(id, accessClaims.UserName, Access)
+	newRefreshClaims := s.newClaims(id, refreshClaims.UserName, Refresh)
+	newRefreshClaims.ClientID = refreshClaims.ClientID
+	newRefreshClaims.Scope = refreshClaims.Scope
+
+	sessionID, err := s.rotateRefreshToken(ctx, refreshClaims.ID, newRefreshClaims.ID)
 	if err != nil {
-		return refreshResponse{}, fmt.Errorf("[Refresh] internal error: %w", err)
+		return refreshResponse{}, fmt.Errorf("[rotateTokens] internal error: %w", err)
+	}
+
+	// roles are reloaded so that role changes take effect on the next refresh
+	roles, err := s.repo.GetUserRoles(ctx, id)
+	if err != nil {
+		return refreshResponse{}, fmt.Errorf("[rotateTokens] internal error: %w", err)
+	}
+
+	newAccessClaims := s.newClaims(id, refreshClaims.UserName, Access)
+	newAccessClaims.SessionID = sessionID
+	newAccessClaims.Roles = roles
+	newAccessClaims.ClientID = refreshClaims.ClientID
+	newAccessClaims.Scope = scope
+
+	accessToken, err := s.generateJWT(newAccessClaims, Access)
+	if err != nil {
+		return refreshResponse{}, fmt.Errorf("[rotateTokens] internal error: %w", err)
+	}
+
+	refreshToken, err := s.generateJWT(newRefreshClaims, Refresh)
+	if err != nil {
+		return refreshResponse{}, fmt.Errorf("[rotateTokens] internal error: %w", err)
+	}
+
+	return refreshResponse{accessToken, refreshToken}, nil
+}
+
+// Logout ends the session of an access token and denylists the token until it expires.
+func (s service) Logout(ctx context.Context, claims JWTCustomClaims) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if claims.SessionID != "" {
+		if err := s.revokeSessions(ctx, claims.Subject, claims.SessionID); err != nil {
+			return fmt.Errorf("[Logout] internal error: %w", err)
+		}
+	}
+
+	exp := time.Until(claims.ExpiresAt.Time)
+	if exp <= 0 {
+		return nil
+	}
+
+	if err := s.rds.Set(ctx, s.getRedisKey(accessDenylist, claims.ID), 1, exp).Err(); err != nil {
+		return fmt.Errorf("[Logout] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// VerifyAccessToken validates the signature and expiry of an access token
+// and checks that it was not denylisted by Logout.
+func (s service) VerifyAccessToken(ctx context.Context, accessToken string) (*JWTCustomClaims, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	claims := new(JWTCustomClaims)
+	token, err := jwt.ParseWithClaims(accessToken, claims, s.accessKeyFunc)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("[VerifyAccessToken] internal error: %w", errs.ErrInvalidJwt)
+	}
+
+	n, err := s.rds.Exists(ctx, s.getRedisKey(accessDenylist, claims.ID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("[VerifyAccessToken] internal error: %w", err)
+	}
+
+	if n > 0 {
+		return nil, fmt.Errorf("[VerifyAccessToken] internal error: %w", errs.ErrInvalidJwt)
+	}
+
+	return claims, nil
+}
+
+// JWKS returns the public keys access tokens can be verified with.
+// The set is empty when access tokens are signed with a shared secret.
+func (s service) JWKS() JWKS {
+	return s.keys.JWKS()
+}
+
+// HasPermission reports whether any of the given roles grants a permission.
+func (s service) HasPermission(ctx context.Context, roles []string, permission string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	permissions, err := s.repo.GetRolePermissions(ctx, roles)
+	if err != nil {
+		return false, fmt.Errorf("[HasPermission] internal error: %w", err)
+	}
+
+	for _, p := range permissions {
+		if p == permission {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// GetSubject returns the id of the user the token was issued to.
+func (c *JWTCustomClaims) GetSubject() string {
+	return c.Subject
+}
+
+// GetRoles returns the roles of the user at the time the token was issued.
+func (c *JWTCustomClaims) GetRoles() []string {
+	return c.Roles
+}
+
+// HasScope reports whether permission is in the scope granted to the OAuth2 client the token was issued to.
+// Tokens of a login have no scope and are not restricted, tokens of a client without a scope grant nothing.
+func (c *JWTCustomClaims) HasScope(permission string) bool {
+	if c.Scope == "" {
+		return c.ClientID == ""
+	}
+
+	for _, scope := range strings.Fields(c.Scope) {
+		if scope == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetSessionID returns the login session the token belongs to. It is empty for tokens issued to OAuth2 clients.
+func (c *JWTCustomClaims) GetSessionID() string {
+	if c.ClientID != "" {
+		return ""
 	}
 
-	return refreshResponse{accessToken}, nil
+	return c.SessionID
 }
 
-// authenticate authenticates a user using username and password.
+// authenticate authenticates a user using a username or email address and a password.
 // If name and password are correct, an identity is returned. Otherwise, nil is returned.
-func (s service) authenticate(ctx context.Context, username, password string) (entity.User, error) {
-	user, err := s.repo.GetUserByUsername(ctx, username)
+// Locked out users are rejected before their password is compared.
+func (s service) authenticate(ctx context.Context, login, password string) (entity.User, error) {
+	user, err := s.repo.GetUserByLogin(ctx, login)
 	if errors.Is(err, sql.ErrNoRows) {
 		return entity.User{}, errs.ErrInvalidCredentials
 	} else if err != nil {
 		return entity.User{}, err
 	}
 
-	if err = tools.BcryptCompare(password, user.Password); err != nil {
-		if err = s.cacheIncorrectPassword(ctx, user.ID.String()); err != nil {
+	id := user.ID.String()
+
+	if err = s.checkLockout(ctx, id); err != nil {
+		return entity.User{}, fmt.Errorf("[authenticate] internal error: %w", err)
+	}
+
+	// a hash no hasher recognizes cannot match, so it counts as a failed attempt
+	ok, rehash, err := s.hashers.Verify(password, user.Password)
+	if err != nil && !errors.Is(err, tools.ErrUnknownPasswordHash) {
+		return entity.User{}, fmt.Errorf("[authenticate] internal error: %w", err)
+	}
+
+	if !ok {
+		if err = s.recordFailedLogin(ctx, id); err != nil {
 			return entity.User{}, fmt.Errorf("[authenticate] internal error: %w", err)
 		}
 
 		return entity.User{}, errs.ErrInvalidCredentials
 	}
 
+	if rehash {
+		s.rehashPassword(ctx, user, password)
+	}
+
+	// with 2FA the login is not complete yet, VerifyTwoFactor clears the counters once the code is correct
+	if !user.TOTPEnabledAt.Valid {
+		if err = s.clearFailedLogins(ctx, id); err != nil {
+			return entity.User{}, fmt.Errorf("[authenticate] internal error: %w", err)
+		}
+	}
+
+	if s.cfg.EmailVerification.Requires(config.VerifyEmailForLogin) && !user.EmailVerified() {
+		return entity.User{}, fmt.Errorf("[authenticate] internal error: %w", errs.ErrEmailNotVerified)
+	}
+
 	return user, nil
 }
 
-// generateJWT generates a JWT that encodes an identity.
-func (s service) generateJWT(id uuid.UUID, username string, t jwtType) (string, error) {
+// rehashPassword replaces an outdated password hash with a hash of the current algorithm and parameters.
+// The login does not depend on it, so a failure is only logged and retried on the next login.
+func (s service) rehashPassword(ctx context.Context, user entity.User, password string) {
+	hash, err := s.hashers.Hash(password)
+	if err == nil {
+		err = s.repo.UpdatePassword(ctx, user.ID, hash)
+	}
+
+	if err != nil {
+		s.logger.Warnf("rehashing password of user %s failed: %v", user.ID, err)
+	}
+}
+
+// completeLogin issues a token pair for an authenticated user, or a challenge token
+// if the user has 2FA enabled, in which case the tokens come from VerifyTwoFactor.
+func (s service) completeLogin(ctx context.Context, user entity.User, device DeviceInfo) (loginResponse, error) {
+	if user.TOTPEnabledAt.Valid {
+		token, err := s.createChallenge(ctx, user, device)
+		if err != nil {
+			return loginResponse{}, fmt.Errorf("[completeLogin] internal error: %w", err)
+		}
+
+		return loginResponse{ChallengeToken: token}, nil
+	}
+
+	return s.issueTokens(ctx, user, device)
+}
+
+// issueTokens generates an access and refresh token pair for an authenticated user.
+// The refresh token starts a new session on the given device.
+func (s service) issueTokens(ctx context.Context, user entity.User, device DeviceInfo) (loginResponse, error) {
+	return s.issueClientTokens(ctx, user, device, "", "")
+}
+
+// issueClientTokens is issueTokens for tokens an OAuth2 client obtained on behalf of a user.
+// The client and the granted scope are recorded in both tokens and carried over on refresh.
+func (s service) issueClientTokens(
+	ctx context.Context,
+	user entity.User,
+	device DeviceInfo,
+	clientID, scope string,
+) (loginResponse, error) {
+	refreshClaims := s.newClaims(user.ID, user.Username, Refresh)
+	refreshClaims.ClientID = clientID
+	refreshClaims.Scope = scope
+
+	refreshToken, err := s.generateJWT(refreshClaims, Refresh)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[issueClientTokens] internal error: %w", err)
+	}
+
+	roles, err := s.repo.GetUserRoles(ctx, user.ID)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[issueClientTokens] internal error: %w", err)
+	}
+
+	sessionID, err := s.createSession(ctx, user.ID.String(), refreshClaims.ID, device)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[issueClientTokens] internal error: %w", err)
+	}
+
+	accessClaims := s.newClaims(user.ID, user.Username, Access)
+	accessClaims.SessionID = sessionID
+	accessClaims.Roles = roles
+	accessClaims.ClientID = clientID
+	accessClaims.Scope = scope
+
+	accessToken, err := s.generateJWT(accessClaims, Access)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[issueClientTokens] internal error: %w", err)
+	}
+
+	return loginResponse{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+// newClaims creates the claims of a JWT that encodes an identity.
+func (s service) newClaims(id uuid.UUID, username string, t jwtType) JWTCustomClaims {
 	issuedAt := time.Now()
-	var expiresAt time.Time
-	var signingKey []byte
+	expiresAt := issuedAt.Add(s.getExpiration(t))
+
+	return JWTCustomClaims{
+		UserName: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.cfg.App.Name,
+			Subject:   id.String(),
+			Audience:  jwt.ClaimStrings{"all"},
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			ID:        uuid.NewString(),
+		},
+	}
+}
 
+// generateJWT generates a JWT that encodes an identity.
+// Access tokens are signed with the active key of the key set if one is configured.
+// Refresh tokens are only ever verified by this service and always use HS256.
+func (s service) generateJWT(claims JWTCustomClaims, t jwtType) (string, error) {
+	if t == Access && s.keys != nil {
+		return s.keys.sign(&claims)
+	}
+
+	signingKey := []byte(s.cfg.Jwt.AccessSigningKey)
 	if t == Refresh {
-		expiresAt = issuedAt.Add(time.Duration(s.cfg.Jwt.RefreshExpiration) * time.Minute)
 		signingKey = []byte(s.cfg.Jwt.RefreshSigningKey)
-	} else {
-		expiresAt = issuedAt.Add(time.Duration(s.cfg.Jwt.AccessExpiration) * time.Minute)
-		signingKey = []byte(s.cfg.Jwt.AccessSigningKey)
-	}
-
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		&JWTCustomClaims{
-			username,
-			jwt.RegisteredClaims{
-				Issuer:    s.cfg.App.Name,
-				Subject:   id.String(),
-				Audience:  jwt.ClaimStrings{"all"},
-				IssuedAt:  jwt.NewNumericDate(issuedAt),
-				ExpiresAt: jwt.NewNumericDate(expiresAt),
-				ID:        uuid.NewString(),
-			},
-		},
-	)
+	}
 
-	return token.SignedString(signingKey)
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &claims).SignedString(signingKey)
+}
+
+// accessKeyFunc returns the key to verify an access token with.
+// HMAC tokens are rejected once asymmetric keys are configured.
+func (s service) accessKeyFunc(token *jwt.Token) (interface{}, error) {
+	if s.keys != nil {
+		return s.keys.keyFunc(token)
+	}
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, errs.ErrInvalidJwt
+	}
+
+	return []byte(s.cfg.Jwt.AccessSigningKey), nil
+}
+
+func (s service) getExpiration(t jwtType) time.Duration {
+	if t == Refresh {
+		return time.Duration(s.cfg.Jwt.RefreshExpiration) * time.Minute
+	}
+
+	return time.Duration(s.cfg.Jwt.AccessExpiration) * time.Minute
 }
 
 func (s service) parseRefreshToken(refreshToken string) (JWTCustomClaims, error) {
@@ -229,13 +598,7 @@ func (s service) parseRefreshToken(refreshToken string) (JWTCustomClaims, error)
 
 // parseAccessToken extract value from validated token that failed on expired err.
 func (s service) parseAccessToken(accessToken string) (JWTCustomClaims, error) {
-	_, err := jwt.Parse(accessToken, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errs.ErrInvalidJwt
-		}
-
-		return []byte(s.cfg.Jwt.AccessSigningKey), nil
-	})
+	_, err := jwt.Parse(accessToken, s.accessKeyFunc)
 
 	if err != nil && !errors.Is(err, jwt.ErrTokenExpired) {
 		return JWTCustomClaims{}, fmt.Errorf("[parseAccessToken] internal error: %w", err)
@@ -259,48 +622,6 @@ func (s service) parseAccessToken(accessToken string) (JWTCustomClaims, error) {
 	return *claims, nil
 }
 
-func (s service) cacheRefreshToken(ctx context.Context, id, token string) error {
-	key := s.getRedisKey(refreshToken, id)
-
-	return s.rds.Set(ctx, key, token, -1).Err()
-}
-
-func (s service) cacheIncorrectPassword(ctx context.Context, id string) error {
-	key := s.getRedisKey(incorrectPassword, id)
-
-	val, err := s.rds.Get(ctx, key).Int()
-	switch {
-	case errors.Is(err, redis.Nil):
-		return s.rds.Set(ctx, key, 1, incorrectPasswordExpiration).Err()
-	case err != nil:
-		return fmt.Errorf("[cacheIncorrectPassword] internal error: %w", err)
-	default:
-		if val >= maxLoginAttempt {
-			return errs.ErrMaxAttempt
-		}
-
-		return s.rds.Incr(ctx, key).Err()
-	}
-}
-
-func (s service) validateRefreshToken(ctx context.Context, id, token string) error {
-	key := s.getRedisKey(refreshToken, id)
-
-	val, err := s.rds.Get(ctx, key).Result()
-	switch {
-	case errors.Is(err, redis.Nil):
-		return errs.ErrInvalidRefreshToken
-	case err != nil:
-		return fmt.Errorf("[validateRefreshToken] internal error: %w", err)
-	default:
-		if token != val {
-			return errs.ErrInvalidRefreshToken
-		}
-
-		return nil
-	}
-}
-
 func (s service) getRedisKey(key RedisKey, field string) string {
 	return fmt.Sprintf("%s:%s:%s", s.cfg.App.Name, string(key), field)
 }
@@ -2,8 +2,22 @@ package service
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"database/sql"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -15,11 +29,25 @@ import (
 	errs "github.com/hinccvi/go-ddd/internal/errors"
 	"github.com/hinccvi/go-ddd/internal/mocks"
 	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/pkg/oidc"
+	"github.com/hinccvi/go-ddd/pkg/password"
+	"github.com/hinccvi/go-ddd/pkg/totp"
 	"github.com/hinccvi/go-ddd/tools"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
+// testHashers verifies the bcrypt hashes of the fixtures without rehashing them.
+//
+//nolint:gochecknoglobals // test fixture
+var testHashers = tools.NewPasswordHashers(tools.BcryptHasher{Cost: tools.BcryptCost})
+
+// testPolicy accepts any password.
+//
+//nolint:gochecknoglobals // test fixture
+var testPolicy = password.New(config.PasswordPolicy{}, nil)
+
 func TestLogin(t *testing.T) {
 	cfg, err := config.Load("local")
 	assert.NoError(t, err)
@@ -32,17 +60,20 @@ func TestLogin(t *testing.T) {
 	logger := log.NewWithZap(l)
 
 	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
 
 	t.Run("success", func(t *testing.T) {
 		password, _ := tools.Bcrypt("secret")
 
-		mockGetUserByUsername := entity.User{
+		mockGetUserByLogin := entity.User{
 			ID:       uuid.New(),
 			Username: "user",
 			Password: password,
 		}
-		repo.On("GetUserByUsername", mock.Anything, "user").Return(mockGetUserByUsername, nil).Once()
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		repo.On("GetUserByLogin", mock.Anything, "user").Return(mockGetUserByLogin, nil).Once()
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		req := LoginRequest{
 			Username: "user",
@@ -52,18 +83,117 @@ func TestLogin(t *testing.T) {
 		resp, err = s.Login(context.TODO(), req)
 		assert.NoError(t, err)
 		assert.NotNil(t, resp)
+
+		var claims *JWTCustomClaims
+		claims, err = s.VerifyAccessToken(context.TODO(), resp.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user"}, claims.GetRoles())
+	})
+
+	t.Run("success: outdated hash is rehashed", func(t *testing.T) {
+		password, _ := tools.Bcrypt("secret")
+
+		id := uuid.New()
+		repo.On("GetUserByLogin", mock.Anything, "user").Return(entity.User{
+			ID:       id,
+			Username: "user",
+			Password: password,
+		}, nil).Once()
+		repo.On("UpdatePassword", mock.Anything, id, mock.MatchedBy(func(hash string) bool {
+			return strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$")
+		})).Return(nil).Once()
+
+		hashers := tools.NewPasswordHashers(
+			tools.Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1},
+			tools.BcryptHasher{Cost: tools.BcryptCost},
+		)
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, hashers, testPolicy,
+		}
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.NoError(t, err)
+		repo.AssertCalled(t, "UpdatePassword", mock.Anything, id, mock.Anything)
+	})
+
+	t.Run("success: rehash failure does not fail login", func(t *testing.T) {
+		password, _ := tools.Bcrypt("secret")
+
+		id := uuid.New()
+		repo.On("GetUserByLogin", mock.Anything, "user").Return(entity.User{
+			ID:       id,
+			Username: "user",
+			Password: password,
+		}, nil).Once()
+		repo.On("UpdatePassword", mock.Anything, id, mock.Anything).Return(sql.ErrConnDone).Once()
+
+		hashers := tools.NewPasswordHashers(tools.BcryptHasher{Cost: tools.BcryptCost + 1})
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, hashers, testPolicy,
+		}
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.NoError(t, err)
+		repo.AssertCalled(t, "UpdatePassword", mock.Anything, id, mock.Anything)
+	})
+
+	t.Run("success: email", func(t *testing.T) {
+		password, _ := tools.Bcrypt("secret")
+
+		repo.On("GetUserByLogin", mock.Anything, "User@Example.com").Return(entity.User{
+			ID:       uuid.New(),
+			Username: "user",
+			Password: password,
+			Email:    sql.NullString{String: "user@example.com", Valid: true},
+		}, nil).Once()
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "User@Example.com", Password: "secret"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: email not verified", func(t *testing.T) {
+		password, _ := tools.Bcrypt("secret")
+
+		user := entity.User{
+			ID:       uuid.New(),
+			Username: "user",
+			Password: password,
+			Email:    sql.NullString{String: "user@example.com", Valid: true},
+		}
+		repo.On("GetUserByLogin", mock.Anything, "user").Return(user, nil).Once()
+
+		verifyCfg := cfg
+		verifyCfg.EmailVerification.RequiredFor = []string{config.VerifyEmailForLogin}
+		s := service{
+			&verifyCfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers,
+			testPolicy,
+		}
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.ErrorIs(t, err, errs.ErrEmailNotVerified)
+
+		user.EmailVerifiedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		repo.On("GetUserByLogin", mock.Anything, "user").Return(user, nil).Once()
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.NoError(t, err)
 	})
 
 	t.Run("fail: incorrect credential", func(t *testing.T) {
 		password, _ := tools.Bcrypt("anothersecret")
 
-		mockGetUserByUsername := entity.User{
+		mockGetUserByLogin := entity.User{
 			ID:       uuid.New(),
 			Username: "user",
 			Password: password,
 		}
-		repo.On("GetUserByUsername", mock.Anything, "user").Return(mockGetUserByUsername, nil).Once()
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		repo.On("GetUserByLogin", mock.Anything, "user").Return(mockGetUserByLogin, nil).Once()
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		req := LoginRequest{
 			Username: "user",
@@ -74,8 +204,10 @@ func TestLogin(t *testing.T) {
 	})
 
 	t.Run("fail: invalid username", func(t *testing.T) {
-		repo.On("GetUserByUsername", mock.Anything, "user").Return(entity.User{}, sql.ErrNoRows).Once()
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		repo.On("GetUserByLogin", mock.Anything, "user").Return(entity.User{}, sql.ErrNoRows).Once()
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		req := LoginRequest{
 			Username: "user",
@@ -86,14 +218,16 @@ func TestLogin(t *testing.T) {
 	})
 
 	t.Run("fail: max attempt", func(t *testing.T) {
-		mockGetUserByUsername := entity.User{
+		mockGetUserByLogin := entity.User{
 			ID:       uuid.New(),
 			Username: "user",
 			Password: "secret",
 		}
 
-		repo.On("GetUserByUsername", mock.Anything, "user").Return(mockGetUserByUsername, nil)
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		repo.On("GetUserByLogin", mock.Anything, "user").Return(mockGetUserByLogin, nil)
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		i := 0
 		for i < 6 {
@@ -131,9 +265,10 @@ func TestRefresh(t *testing.T) {
 	logger := log.NewWithZap(l)
 
 	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
 
 	password, _ := tools.Bcrypt("secret")
-	repo.On("GetUserByUsername", mock.Anything, "user").Return(
+	repo.On("GetUserByLogin", mock.Anything, "user").Return(
 		entity.User{
 			ID:       uuid.New(),
 			Username: "user",
@@ -143,13 +278,43 @@ func TestRefresh(t *testing.T) {
 	)
 
 	t.Run("success", func(t *testing.T) {
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
+
+		var loginResp loginResponse
+		loginResp, err = s.Login(context.TODO(), LoginRequest{
+			Username: "user",
+			Password: "secret",
+		})
+
+		var refreshResp refreshResponse
+		refreshResp, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  loginResp.AccessToken,
+			RefreshToken: loginResp.RefreshToken,
+		})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, refreshResp.AccessToken)
+		assert.NotEmpty(t, refreshResp.RefreshToken)
+		assert.NotEqual(t, loginResp.RefreshToken, refreshResp.RefreshToken)
+
+		var claims JWTCustomClaims
+		claims, err = s.parseRefreshToken(refreshResp.RefreshToken)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(cfg.Jwt.RefreshExpiration)*time.Minute, mr.TTL(s.getRedisKey(refreshToken, claims.ID)))
+	})
+
+	t.Run("fail: reused refresh token revokes family", func(t *testing.T) {
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		var loginResp loginResponse
 		loginResp, err = s.Login(context.TODO(), LoginRequest{
 			Username: "user",
 			Password: "secret",
 		})
+		assert.NoError(t, err)
 
 		var refreshResp refreshResponse
 		refreshResp, err = s.Refresh(context.TODO(), RefreshTokenRequest{
@@ -157,21 +322,60 @@ func TestRefresh(t *testing.T) {
 			RefreshToken: loginResp.RefreshToken,
 		})
 		assert.NoError(t, err)
-		assert.NotNil(t, refreshResp)
+
+		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  loginResp.AccessToken,
+			RefreshToken: loginResp.RefreshToken,
+		})
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrInvalidRefreshToken, tools.UnwrapRecursive(err))
+
+		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  refreshResp.AccessToken,
+			RefreshToken: refreshResp.RefreshToken,
+		})
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrInvalidRefreshToken, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: refresh token of another user", func(t *testing.T) {
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
+
+		var loginResp loginResponse
+		loginResp, err = s.Login(context.TODO(), LoginRequest{
+			Username: "user",
+			Password: "secret",
+		})
+		assert.NoError(t, err)
+
+		var accessJWT string
+		accessJWT, err = s.generateJWT(s.newClaims(uuid.New(), "another", Access), Access)
+		assert.NoError(t, err)
+
+		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  accessJWT,
+			RefreshToken: loginResp.RefreshToken,
+		})
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrInvalidRefreshToken, tools.UnwrapRecursive(err))
 	})
 
 	t.Run("fail: token not found in cache", func(t *testing.T) {
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		var user entity.User
-		user, err = s.repo.GetUserByUsername(context.TODO(), "user")
+		user, err = s.repo.GetUserByLogin(context.TODO(), "user")
 		assert.NoError(t, err)
 
 		var accessJWT, refreshJWT string
-		accessJWT, err = s.generateJWT(user.ID, user.Username, Access)
+		accessJWT, err = s.generateJWT(s.newClaims(user.ID, user.Username, Access), Access)
 		assert.NoError(t, err)
 
-		refreshJWT, err = s.generateJWT(user.ID, user.Username, Refresh)
+		refreshJWT, err = s.generateJWT(s.newClaims(user.ID, user.Username, Refresh), Refresh)
 		assert.NoError(t, err)
 
 		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
@@ -185,7 +389,9 @@ func TestRefresh(t *testing.T) {
 	t.Run("fail: access token still valid", func(t *testing.T) {
 		cfg.Jwt.AccessExpiration = 5
 
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		var loginResp loginResponse
 		loginResp, err = s.Login(context.TODO(), LoginRequest{
@@ -202,7 +408,9 @@ func TestRefresh(t *testing.T) {
 	})
 
 	t.Run("fail: invalid access token", func(t *testing.T) {
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		var loginResp loginResponse
 		loginResp, err = s.Login(context.TODO(), LoginRequest{
@@ -219,7 +427,9 @@ func TestRefresh(t *testing.T) {
 	})
 
 	t.Run("fail: invalid refresh token", func(t *testing.T) {
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		var loginResp loginResponse
 		loginResp, err = s.Login(context.TODO(), LoginRequest{
@@ -236,7 +446,9 @@ func TestRefresh(t *testing.T) {
 	})
 
 	t.Run("fail: redis error", func(t *testing.T) {
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		mr.Close()
 
@@ -248,7 +460,9 @@ func TestRefresh(t *testing.T) {
 	})
 
 	t.Run("fail: redis error", func(t *testing.T) {
-		s := service{&cfg, rds, logger, &repo, 2 * time.Second}
+		s := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
 
 		var loginResp loginResponse
 		loginResp, err = s.Login(context.TODO(), LoginRequest{
@@ -265,3 +479,2026 @@ func TestRefresh(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestSendSMSCode(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	mr := miniredis.RunT(t)
+	rds, err := mocks.Redis(mr.Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByPhone", mock.Anything, "+60123456789").Return(entity.User{ID: uuid.New(), Username: "user"}, nil)
+	repo.On("GetUserByPhone", mock.Anything, "+60111111111").Return(entity.User{}, sql.ErrNoRows)
+	repo.On("GetUserByPhone", mock.Anything, "+10000000000").Return(entity.User{ID: uuid.New(), Username: "user"}, nil)
+
+	var sender mocks.SMSSender
+
+	t.Run("success", func(t *testing.T) {
+		s := service{&cfg, rds, logger, &repo, 2 * time.Second, &sender, nil, &mail.Memory{}, nil, testHashers, testPolicy}
+
+		err = s.SendSMSCode(context.TODO(), SendSMSCodeRequest{Phone: "+60123456789"})
+		assert.NoError(t, err)
+
+		var code string
+		code, err = mr.Get(s.getRedisKey(smsCode, "+60123456789"))
+		assert.NoError(t, err)
+		assert.Len(t, code, cfg.SMS.CodeLength)
+		assert.Contains(t, sender.Message("+60123456789"), code)
+	})
+
+	t.Run("fail: cooldown", func(t *testing.T) {
+		s := service{&cfg, rds, logger, &repo, 2 * time.Second, &sender, nil, &mail.Memory{}, nil, testHashers, testPolicy}
+
+		err = s.SendSMSCode(context.TODO(), SendSMSCodeRequest{Phone: "+60123456789"})
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrSMSCooldown, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: daily limit", func(t *testing.T) {
+		s := service{&cfg, rds, logger, &repo, 2 * time.Second, &sender, nil, &mail.Memory{}, nil, testHashers, testPolicy}
+
+		for i := 0; i < cfg.SMS.DailyLimit; i++ {
+			mr.Del(s.getRedisKey(smsCooldown, "+60123456789"))
+			err = s.SendSMSCode(context.TODO(), SendSMSCodeRequest{Phone: "+60123456789"})
+		}
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrSMSLimit, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: unknown phone is not sent", func(t *testing.T) {
+		s := service{&cfg, rds, logger, &repo, 2 * time.Second, &sender, nil, &mail.Memory{}, nil, testHashers, testPolicy}
+
+		err = s.SendSMSCode(context.TODO(), SendSMSCodeRequest{Phone: "+60111111111"})
+		assert.NoError(t, err)
+		assert.Empty(t, sender.Message("+60111111111"))
+		assert.False(t, mr.Exists(s.getRedisKey(smsCode, "+60111111111")))
+	})
+
+	t.Run("fail: sender error", func(t *testing.T) {
+		s := service{&cfg, rds, logger, &repo, 2 * time.Second, &sender, nil, &mail.Memory{}, nil, testHashers, testPolicy}
+
+		err = s.SendSMSCode(context.TODO(), SendSMSCodeRequest{Phone: "+10000000000"})
+		assert.Error(t, err)
+		assert.Equal(t, mocks.ErrSMS, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: redis error", func(t *testing.T) {
+		s := service{&cfg, rds, logger, &repo, 2 * time.Second, &sender, nil, &mail.Memory{}, nil, testHashers, testPolicy}
+
+		mr.Close()
+
+		err = s.SendSMSCode(context.TODO(), SendSMSCodeRequest{Phone: "+60123456789"})
+		assert.Error(t, err)
+	})
+}
+
+func TestSMSLogin(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	mr := miniredis.RunT(t)
+	rds, err := mocks.Redis(mr.Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByPhone", mock.Anything, "+60123456789").Return(entity.User{ID: uuid.New(), Username: "user"}, nil)
+	repo.On("GetUserByPhone", mock.Anything, "+60122222222").Return(entity.User{
+		ID:            uuid.New(),
+		Username:      "2fa",
+		TOTPEnabledAt: sql.NullTime{Time: time.Now(), Valid: true},
+	}, nil)
+	lockedID := uuid.New()
+	repo.On("GetUserByPhone", mock.Anything, "+60133333333").Return(entity.User{ID: lockedID, Username: "locked"}, nil)
+
+	var sender mocks.SMSSender
+	s := service{&cfg, rds, logger, &repo, 2 * time.Second, &sender, nil, &mail.Memory{}, nil, testHashers, testPolicy}
+	key := s.getRedisKey(smsCode, "+60123456789")
+
+	t.Run("success", func(t *testing.T) {
+		assert.NoError(t, mr.Set(key, "123456"))
+
+		var resp loginResponse
+		resp, err = s.SMSLogin(context.TODO(), SMSLoginRequest{Phone: "+60123456789", Code: "123456"})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, resp.AccessToken)
+		assert.NotEmpty(t, resp.RefreshToken)
+		assert.False(t, mr.Exists(key))
+	})
+
+	t.Run("success: 2fa challenge", func(t *testing.T) {
+		assert.NoError(t, mr.Set(s.getRedisKey(smsCode, "+60122222222"), "123456"))
+
+		var resp loginResponse
+		resp, err = s.SMSLogin(context.TODO(), SMSLoginRequest{Phone: "+60122222222", Code: "123456"})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, resp.ChallengeToken)
+		assert.Empty(t, resp.AccessToken)
+	})
+
+	t.Run("fail: locked out", func(t *testing.T) {
+		assert.NoError(t, mr.Set(s.getRedisKey(smsCode, "+60133333333"), "123456"))
+		assert.NoError(t, mr.Set(s.getRedisKey(lockout, lockedID.String()), "1"))
+
+		_, err = s.SMSLogin(context.TODO(), SMSLoginRequest{Phone: "+60133333333", Code: "123456"})
+		assert.Equal(t, errs.ErrMaxAttempt, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: email not verified", func(t *testing.T) {
+		cfg := cfg
+		cfg.EmailVerification.RequiredFor = []string{config.VerifyEmailForLogin}
+		s := s
+		s.cfg = &cfg
+		assert.NoError(t, mr.Set(s.getRedisKey(smsCode, "+60123456789"), "123456"))
+
+		_, err = s.SMSLogin(context.TODO(), SMSLoginRequest{Phone: "+60123456789", Code: "123456"})
+		assert.Equal(t, errs.ErrEmailNotVerified, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: code already used", func(t *testing.T) {
+		_, err = s.SMSLogin(context.TODO(), SMSLoginRequest{Phone: "+60123456789", Code: "123456"})
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrInvalidSMSCode, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: incorrect code", func(t *testing.T) {
+		assert.NoError(t, mr.Set(key, "123456"))
+
+		_, err = s.SMSLogin(context.TODO(), SMSLoginRequest{Phone: "+60123456789", Code: "654321"})
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrInvalidSMSCode, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: max attempt", func(t *testing.T) {
+		assert.NoError(t, mr.Set(key, "123456"))
+		mr.Del(s.getRedisKey(smsAttempt, "+60123456789"))
+
+		for i := 0; i <= cfg.SMS.MaxAttempt; i++ {
+			_, err = s.SMSLogin(context.TODO(), SMSLoginRequest{Phone: "+60123456789", Code: "654321"})
+		}
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrMaxAttempt, tools.UnwrapRecursive(err))
+
+		_, err = s.SMSLogin(context.TODO(), SMSLoginRequest{Phone: "+60123456789", Code: "123456"})
+		assert.Equal(t, errs.ErrInvalidSMSCode, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: redis error", func(t *testing.T) {
+		mr.Close()
+
+		_, err = s.SMSLogin(context.TODO(), SMSLoginRequest{Phone: "+60123456789", Code: "123456"})
+		assert.Error(t, err)
+	})
+}
+
+func TestSessions(t *testing.T) {
+	var cfg config.Config
+	cfg.App.Name = "test"
+	cfg.Jwt.AccessExpiration = 1
+	cfg.Jwt.AccessSigningKey = "secret"
+	cfg.Jwt.RefreshExpiration = 1
+	cfg.Jwt.RefreshSigningKey = "secret"
+
+	mr := miniredis.RunT(t)
+	rds, err := mocks.Redis(mr.Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+	password, _ := tools.Bcrypt("secret")
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByLogin", mock.Anything, "user").Return(
+		entity.User{
+			ID:       id,
+			Username: "user",
+			Password: password,
+		},
+		nil,
+	)
+
+	s := service{
+		&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+	}
+
+	login := func(device string) (loginResponse, JWTCustomClaims) {
+		resp, loginErr := s.Login(context.TODO(), LoginRequest{
+			Username: "user",
+			Password: "secret",
+			DeviceInfo: DeviceInfo{
+				DeviceName: device,
+				IP:         "127.0.0.1",
+				UserAgent:  "test",
+			},
+		})
+		assert.NoError(t, loginErr)
+
+		claims, _, parseErr := new(jwt.Parser).ParseUnverified(resp.AccessToken, &JWTCustomClaims{})
+		assert.NoError(t, parseErr)
+
+		return resp, *claims.Claims.(*JWTCustomClaims)
+	}
+
+	laptopResp, laptop := login("laptop")
+	_, phone := login("phone")
+
+	t.Run("success: list", func(t *testing.T) {
+		var sessions []Session
+		sessions, err = s.ListSessions(context.TODO(), id, laptop.SessionID)
+		assert.NoError(t, err)
+		assert.Len(t, sessions, 2)
+
+		for _, session := range sessions {
+			assert.Equal(t, "127.0.0.1", session.IP)
+			assert.Equal(t, "test", session.UserAgent)
+			assert.Equal(t, session.ID == laptop.SessionID, session.Current)
+			assert.Equal(t, session.ID == laptop.SessionID, session.DeviceName == "laptop")
+		}
+	})
+
+	t.Run("success: refresh keeps session", func(t *testing.T) {
+		var refreshResp refreshResponse
+		refreshResp, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  laptopResp.AccessToken,
+			RefreshToken: laptopResp.RefreshToken,
+		})
+		assert.NoError(t, err)
+
+		claims, _, parseErr := new(jwt.Parser).ParseUnverified(refreshResp.AccessToken, &JWTCustomClaims{})
+		assert.NoError(t, parseErr)
+		assert.Equal(t, laptop.SessionID, claims.Claims.(*JWTCustomClaims).SessionID)
+
+		var sessions []Session
+		sessions, err = s.ListSessions(context.TODO(), id, laptop.SessionID)
+		assert.NoError(t, err)
+		assert.Len(t, sessions, 2)
+	})
+
+	t.Run("fail: revoke session of another user", func(t *testing.T) {
+		err = s.RevokeSession(context.TODO(), uuid.New(), phone.SessionID)
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrSessionNotFound, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: revoke", func(t *testing.T) {
+		err = s.RevokeSession(context.TODO(), id, phone.SessionID)
+		assert.NoError(t, err)
+
+		var sessions []Session
+		sessions, err = s.ListSessions(context.TODO(), id, laptop.SessionID)
+		assert.NoError(t, err)
+		assert.Len(t, sessions, 1)
+		assert.Equal(t, laptop.SessionID, sessions[0].ID)
+	})
+
+	t.Run("fail: revoke unknown session", func(t *testing.T) {
+		err = s.RevokeSession(context.TODO(), id, phone.SessionID)
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrSessionNotFound, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: revoke other sessions", func(t *testing.T) {
+		resp, _ := login("tablet")
+
+		err = s.RevokeOtherSessions(context.TODO(), id, laptop.SessionID)
+		assert.NoError(t, err)
+
+		var sessions []Session
+		sessions, err = s.ListSessions(context.TODO(), id, laptop.SessionID)
+		assert.NoError(t, err)
+		assert.Len(t, sessions, 1)
+		assert.True(t, sessions[0].Current)
+
+		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  resp.AccessToken,
+			RefreshToken: resp.RefreshToken,
+		})
+		assert.Equal(t, errs.ErrInvalidRefreshToken, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: logout all", func(t *testing.T) {
+		resp, _ := login("tablet")
+
+		err = s.LogoutAll(context.TODO(), id)
+		assert.NoError(t, err)
+
+		var sessions []Session
+		sessions, err = s.ListSessions(context.TODO(), id, "")
+		assert.NoError(t, err)
+		assert.Empty(t, sessions)
+
+		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  resp.AccessToken,
+			RefreshToken: resp.RefreshToken,
+		})
+		assert.Equal(t, errs.ErrInvalidRefreshToken, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: logout all after refreshing past the login expiry", func(t *testing.T) {
+		resp, desktop := login("desktop")
+		half := time.Duration(cfg.Jwt.RefreshExpiration) * time.Minute * 2 / 3
+
+		for i := 0; i < 2; i++ {
+			mr.FastForward(half)
+
+			var refreshResp refreshResponse
+			refreshResp, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+				AccessToken:  resp.AccessToken,
+				RefreshToken: resp.RefreshToken,
+			})
+			assert.NoError(t, err)
+			resp.AccessToken, resp.RefreshToken = refreshResp.AccessToken, refreshResp.RefreshToken
+		}
+
+		var sessions []Session
+		sessions, err = s.ListSessions(context.TODO(), id, desktop.SessionID)
+		assert.NoError(t, err)
+		assert.Len(t, sessions, 1)
+
+		err = s.LogoutAll(context.TODO(), id)
+		assert.NoError(t, err)
+
+		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  resp.AccessToken,
+			RefreshToken: resp.RefreshToken,
+		})
+		assert.Equal(t, errs.ErrInvalidRefreshToken, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: redis error", func(t *testing.T) {
+		mr.Close()
+
+		_, err = s.ListSessions(context.TODO(), id, "")
+		assert.Error(t, err)
+
+		err = s.RevokeSession(context.TODO(), id, laptop.SessionID)
+		assert.Error(t, err)
+
+		err = s.LogoutAll(context.TODO(), id)
+		assert.Error(t, err)
+	})
+}
+
+func TestLogout(t *testing.T) {
+	var cfg config.Config
+	cfg.App.Name = "test"
+	cfg.Jwt.AccessExpiration = 1
+	cfg.Jwt.AccessSigningKey = "secret"
+	cfg.Jwt.RefreshExpiration = 1
+	cfg.Jwt.RefreshSigningKey = "secret"
+
+	mr := miniredis.RunT(t)
+	rds, err := mocks.Redis(mr.Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+	password, _ := tools.Bcrypt("secret")
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByLogin", mock.Anything, "user").Return(
+		entity.User{
+			ID:       id,
+			Username: "user",
+			Password: password,
+		},
+		nil,
+	)
+
+	s := service{
+		&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+	}
+
+	var loginResp loginResponse
+	loginResp, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+	assert.NoError(t, err)
+
+	t.Run("success: verify", func(t *testing.T) {
+		var claims *JWTCustomClaims
+		claims, err = s.VerifyAccessToken(context.TODO(), loginResp.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, id.String(), claims.GetSubject())
+		assert.NotEmpty(t, claims.SessionID)
+	})
+
+	t.Run("fail: verify invalid token", func(t *testing.T) {
+		_, err = s.VerifyAccessToken(context.TODO(), loginResp.AccessToken+"x")
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrInvalidJwt, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: verify refresh token", func(t *testing.T) {
+		cfg.Jwt.RefreshSigningKey = "another secret"
+		defer func() { cfg.Jwt.RefreshSigningKey = "secret" }()
+
+		var refreshJWT string
+		refreshJWT, err = s.generateJWT(s.newClaims(id, "user", Refresh), Refresh)
+		assert.NoError(t, err)
+
+		_, err = s.VerifyAccessToken(context.TODO(), refreshJWT)
+		assert.Equal(t, errs.ErrInvalidJwt, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: logout", func(t *testing.T) {
+		var claims *JWTCustomClaims
+		claims, err = s.VerifyAccessToken(context.TODO(), loginResp.AccessToken)
+		assert.NoError(t, err)
+
+		err = s.Logout(context.TODO(), *claims)
+		assert.NoError(t, err)
+
+		denylistKey := s.getRedisKey(accessDenylist, claims.ID)
+		assert.True(t, mr.Exists(denylistKey))
+		assert.LessOrEqual(t, mr.TTL(denylistKey), time.Duration(cfg.Jwt.AccessExpiration)*time.Minute)
+
+		_, err = s.VerifyAccessToken(context.TODO(), loginResp.AccessToken)
+		assert.Equal(t, errs.ErrInvalidJwt, tools.UnwrapRecursive(err))
+
+		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  loginResp.AccessToken,
+			RefreshToken: loginResp.RefreshToken,
+		})
+		assert.Equal(t, errs.ErrInvalidRefreshToken, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: redis error", func(t *testing.T) {
+		claims := s.newClaims(id, "user", Access)
+		claims.SessionID = uuid.NewString()
+
+		accessJWT, _ := s.generateJWT(claims, Access)
+
+		mr.Close()
+
+		_, err = s.VerifyAccessToken(context.TODO(), accessJWT)
+		assert.Error(t, err)
+
+		err = s.Logout(context.TODO(), claims)
+		assert.Error(t, err)
+	})
+}
+
+func TestLockout(t *testing.T) {
+	var cfg config.Config
+	cfg.App.Name = "test"
+	cfg.Jwt.AccessExpiration = 1
+	cfg.Jwt.AccessSigningKey = "secret"
+	cfg.Jwt.RefreshExpiration = 1
+	cfg.Jwt.RefreshSigningKey = "secret"
+	cfg.Lockout.Threshold = 3
+	cfg.Lockout.Window = 15
+	cfg.Lockout.Duration = 15
+	cfg.Lockout.Progressive = true
+	cfg.Lockout.MaxDuration = 45
+
+	mr := miniredis.RunT(t)
+	rds, err := mocks.Redis(mr.Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+	password, _ := tools.Bcrypt("secret")
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByLogin", mock.Anything, "user").Return(
+		entity.User{
+			ID:       id,
+			Username: "user",
+			Password: password,
+		},
+		nil,
+	)
+
+	s := service{
+		&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+	}
+
+	lock := func(t *testing.T) {
+		for i := 0; i < cfg.Lockout.Threshold; i++ {
+			_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "xxx"})
+			assert.Equal(t, errs.ErrInvalidCredentials, tools.UnwrapRecursive(err))
+		}
+	}
+
+	t.Run("success: correct password clears counter", func(t *testing.T) {
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "xxx"})
+		assert.Equal(t, errs.ErrInvalidCredentials, tools.UnwrapRecursive(err))
+		assert.True(t, mr.Exists(s.getRedisKey(incorrectPassword, id.String())))
+		assert.Equal(t, 15*time.Minute, mr.TTL(s.getRedisKey(incorrectPassword, id.String())))
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.NoError(t, err)
+		assert.False(t, mr.Exists(s.getRedisKey(incorrectPassword, id.String())))
+	})
+
+	t.Run("fail: correct password while locked", func(t *testing.T) {
+		lock(t)
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.Equal(t, errs.ErrMaxAttempt, tools.UnwrapRecursive(err))
+		assert.Equal(t, 15*time.Minute, mr.TTL(s.getRedisKey(lockout, id.String())))
+	})
+
+	t.Run("success: list locked accounts", func(t *testing.T) {
+		var accounts []LockedAccount
+		accounts, err = s.ListLockedAccounts(context.TODO())
+		assert.NoError(t, err)
+		assert.Len(t, accounts, 1)
+		assert.Equal(t, id.String(), accounts[0].UserID)
+		assert.WithinDuration(t, time.Now().Add(15*time.Minute), accounts[0].LockedUntil, 2*time.Second)
+	})
+
+	t.Run("success: lockout grows progressively", func(t *testing.T) {
+		mr.FastForward(15 * time.Minute)
+
+		lock(t)
+		assert.Equal(t, 30*time.Minute, mr.TTL(s.getRedisKey(lockout, id.String())))
+
+		mr.FastForward(30 * time.Minute)
+
+		lock(t)
+		assert.Equal(t, 45*time.Minute, mr.TTL(s.getRedisKey(lockout, id.String())))
+	})
+
+	t.Run("success: unlock", func(t *testing.T) {
+		err = s.UnlockAccount(context.TODO(), id)
+		assert.NoError(t, err)
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.NoError(t, err)
+
+		var accounts []LockedAccount
+		accounts, err = s.ListLockedAccounts(context.TODO())
+		assert.NoError(t, err)
+		assert.Empty(t, accounts)
+	})
+
+	t.Run("fail: unlock account not locked", func(t *testing.T) {
+		err = s.UnlockAccount(context.TODO(), id)
+		assert.Equal(t, errs.ErrAccountNotLocked, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: disabled", func(t *testing.T) {
+		cfg.Lockout.Threshold = 0
+		defer func() { cfg.Lockout.Threshold = 3 }()
+
+		for i := 0; i < 5; i++ {
+			_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "xxx"})
+			assert.Equal(t, errs.ErrInvalidCredentials, tools.UnwrapRecursive(err))
+		}
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.NoError(t, err)
+	})
+}
+
+func TestTwoFactor(t *testing.T) {
+	var cfg config.Config
+	cfg.App.Name = "test"
+	cfg.Jwt.AccessExpiration = 1
+	cfg.Jwt.AccessSigningKey = "secret"
+	cfg.Jwt.RefreshExpiration = 1
+	cfg.Jwt.RefreshSigningKey = "secret"
+	cfg.TwoFactor.ChallengeExpiration = 5
+	cfg.TwoFactor.MaxAttempt = 2
+	cfg.TwoFactor.Skew = 1
+	cfg.TwoFactor.RecoveryCodes = 3
+	cfg.TwoFactor.EncryptionKey = "cEa6wwJp/FQNrQ2QYAVgBvbLrwMf3Es+gvjmwZi0eAY="
+
+	mr := miniredis.RunT(t)
+	rds, err := mocks.Redis(mr.Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	password, _ := tools.Bcrypt("secret")
+	user := entity.User{
+		ID:       uuid.New(),
+		Username: "user",
+		Password: password,
+	}
+	getUser := func(context.Context, uuid.UUID) entity.User { return user }
+
+	var recoveryHashes []string
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByLogin", mock.Anything, "user").Return(
+		func(context.Context, string) entity.User { return user },
+		nil,
+	)
+	repo.On("GetUserTOTP", mock.Anything, user.ID).Return(getUser, nil)
+	repo.On("SetTOTPSecret", mock.Anything, user.ID, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		user.TOTPSecret = sql.NullString{String: args.String(2), Valid: true}
+	})
+	repo.On("EnableTOTP", mock.Anything, user.ID, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		user.TOTPEnabledAt = sql.NullTime{Time: time.Now(), Valid: true}
+		recoveryHashes, _ = args.Get(2).([]string)
+	})
+	repo.On("UseRecoveryCode", mock.Anything, user.ID, mock.Anything).Return(
+		func(_ context.Context, _ uuid.UUID, hash string) bool {
+			for i, h := range recoveryHashes {
+				if h == hash {
+					recoveryHashes = append(recoveryHashes[:i], recoveryHashes[i+1:]...)
+					return true
+				}
+			}
+			return false
+		},
+		nil,
+	)
+
+	s := service{
+		&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+	}
+
+	var secret string
+	currentCode := func() string {
+		code, _ := totp.Code(secret, totp.Step(time.Now()))
+		return code
+	}
+
+	var recoveryCodes []string
+	var confirmCode string
+
+	t.Run("fail: confirm without enrollment", func(t *testing.T) {
+		_, err = s.ConfirmTwoFactor(context.TODO(), user.ID, ConfirmTwoFactorRequest{Code: "123456"})
+		assert.Equal(t, errs.ErrTwoFactorNotEnrolled, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: enroll", func(t *testing.T) {
+		var res TwoFactorEnrollment
+		res, err = s.EnrollTwoFactor(context.TODO(), user.ID)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(user.TOTPSecret.String, totpSecretPrefix))
+		assert.NotContains(t, user.TOTPSecret.String, res.Secret)
+		secret = res.Secret
+		assert.Contains(t, res.URI, "otpauth://totp/test:user?")
+		assert.NotEmpty(t, res.QRCode)
+	})
+
+	t.Run("fail: confirm incorrect code", func(t *testing.T) {
+		_, err = s.ConfirmTwoFactor(context.TODO(), user.ID, ConfirmTwoFactorRequest{Code: "xxxxxx"})
+		assert.Equal(t, errs.ErrInvalidTwoFactorCode, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: confirm", func(t *testing.T) {
+		confirmCode = currentCode()
+
+		var res recoveryCodesResponse
+		res, err = s.ConfirmTwoFactor(context.TODO(), user.ID, ConfirmTwoFactorRequest{Code: confirmCode})
+		assert.NoError(t, err)
+		assert.Len(t, res.RecoveryCodes, 3)
+		assert.Len(t, recoveryHashes, 3)
+		assert.NotContains(t, recoveryHashes, res.RecoveryCodes[0])
+		assert.NotContains(t, recoveryHashes, tools.SHA256(normalizeRecoveryCode(res.RecoveryCodes[0])))
+
+		recoveryCodes = res.RecoveryCodes
+	})
+
+	t.Run("fail: enroll twice", func(t *testing.T) {
+		_, err = s.EnrollTwoFactor(context.TODO(), user.ID)
+		assert.Equal(t, errs.ErrTwoFactorEnabled, tools.UnwrapRecursive(err))
+	})
+
+	login := func(t *testing.T) string {
+		var res loginResponse
+		res, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.NoError(t, err)
+		assert.Empty(t, res.AccessToken)
+		assert.Empty(t, res.RefreshToken)
+		assert.NotEmpty(t, res.ChallengeToken)
+
+		return res.ChallengeToken
+	}
+
+	t.Run("fail: code used by confirm", func(t *testing.T) {
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: login(t), Code: confirmCode})
+		assert.Equal(t, errs.ErrInvalidTwoFactorCode, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: verify with recovery code", func(t *testing.T) {
+		challenge := login(t)
+
+		var res loginResponse
+		res, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{
+			ChallengeToken: challenge,
+			Code:           strings.ToLower(recoveryCodes[0]),
+		})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, res.AccessToken)
+		assert.NotEmpty(t, res.RefreshToken)
+		assert.Empty(t, res.ChallengeToken)
+
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: challenge, Code: recoveryCodes[1]})
+		assert.Equal(t, errs.ErrInvalidChallenge, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: recovery code reused", func(t *testing.T) {
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: login(t), Code: recoveryCodes[0]})
+		assert.Equal(t, errs.ErrInvalidTwoFactorCode, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: verify with totp", func(t *testing.T) {
+		// the code of the current step was used by confirm
+		code, _ := totp.Code(secret, totp.Step(time.Now())+1)
+
+		var res loginResponse
+		res, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: login(t), Code: code})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, res.AccessToken)
+	})
+
+	t.Run("fail: max attempt", func(t *testing.T) {
+		challenge := login(t)
+
+		for i := 0; i < cfg.TwoFactor.MaxAttempt; i++ {
+			_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: challenge, Code: "000000"})
+			assert.Equal(t, errs.ErrInvalidTwoFactorCode, tools.UnwrapRecursive(err))
+		}
+
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: challenge, Code: recoveryCodes[1]})
+		assert.Equal(t, errs.ErrMaxAttempt, tools.UnwrapRecursive(err))
+
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: challenge, Code: recoveryCodes[1]})
+		assert.Equal(t, errs.ErrInvalidChallenge, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: expired challenge", func(t *testing.T) {
+		challenge := login(t)
+
+		mr.FastForward(time.Duration(cfg.TwoFactor.ChallengeExpiration) * time.Minute)
+
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: challenge, Code: recoveryCodes[1]})
+		assert.Equal(t, errs.ErrInvalidChallenge, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: secret stored before encryption", func(t *testing.T) {
+		sealed := user.TOTPSecret
+		defer func() { user.TOTPSecret = sealed }()
+		user.TOTPSecret = sql.NullString{String: secret, Valid: true}
+
+		step := totp.Step(time.Now())
+		mr.Del(s.getRedisKey(totpUsed, fmt.Sprintf("%s:%d", user.ID, step)))
+
+		code, _ := totp.Code(secret, step)
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: login(t), Code: code})
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: secret stored before encryption", func(t *testing.T) {
+		sealed := user.TOTPSecret
+		defer func() { user.TOTPSecret = sealed }()
+		user.TOTPSecret = sql.NullString{String: secret, Valid: true}
+
+		step := totp.Step(time.Now())
+		mr.Del(s.getRedisKey(totpUsed, fmt.Sprintf("%s:%d", user.ID, step)))
+
+		code, _ := totp.Code(secret, step)
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: login(t), Code: code})
+		assert.NoError(t, err)
+	})
+
+	cfg.Lockout.Threshold = 3
+	cfg.Lockout.Window = 15
+	cfg.Lockout.Duration = 15
+	failedLogins := s.getRedisKey(incorrectPassword, user.ID.String())
+
+	t.Run("success: verify clears failed logins", func(t *testing.T) {
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: login(t), Code: "000000"})
+		assert.Equal(t, errs.ErrInvalidTwoFactorCode, tools.UnwrapRecursive(err))
+
+		// the password alone does not clear them
+		challenge := login(t)
+		assert.True(t, mr.Exists(failedLogins))
+
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: challenge, Code: recoveryCodes[1]})
+		assert.NoError(t, err)
+		assert.False(t, mr.Exists(failedLogins))
+	})
+
+	t.Run("fail: incorrect codes lock out the user", func(t *testing.T) {
+		var pending string
+		for i := 0; i < cfg.Lockout.Threshold; i++ {
+			if i == cfg.Lockout.Threshold-1 {
+				pending = login(t)
+			}
+
+			_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: login(t), Code: "000000"})
+			assert.Equal(t, errs.ErrInvalidTwoFactorCode, tools.UnwrapRecursive(err))
+		}
+
+		_, err = s.VerifyTwoFactor(context.TODO(), VerifyTwoFactorRequest{ChallengeToken: pending, Code: recoveryCodes[2]})
+		assert.Equal(t, errs.ErrMaxAttempt, tools.UnwrapRecursive(err))
+
+		_, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.Equal(t, errs.ErrMaxAttempt, tools.UnwrapRecursive(err))
+	})
+}
+
+func TestPasswordReset(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	mr := miniredis.RunT(t)
+	rds, err := mocks.Redis(mr.Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+	email := "user@example.com"
+	hash, _ := tools.Bcrypt("secret")
+	user := entity.User{ID: id, Username: "user", Password: hash, Email: sql.NullString{String: email, Valid: true}}
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByLogin", mock.Anything, "user").Return(user, nil)
+	repo.On("GetUserByEmail", mock.Anything, email).Return(user, nil)
+	repo.On("GetUserByEmail", mock.Anything, mock.Anything).Return(entity.User{}, sql.ErrNoRows)
+	repo.On("UpdatePassword", mock.Anything, id, mock.Anything).Return(nil)
+	repo.On("GetUser", mock.Anything, id).Return(user, nil)
+
+	var mailer mail.Memory
+	s := service{&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mailer, nil, testHashers, testPolicy}
+
+	tokenFromMail := func(t *testing.T) string {
+		msg, ok := mailer.Last(email)
+		assert.True(t, ok)
+
+		_, token, found := strings.Cut(msg.Body, "token=")
+		assert.True(t, found)
+
+		return strings.Fields(token)[0]
+	}
+
+	var token string
+
+	t.Run("success: forgot", func(t *testing.T) {
+		err = s.ForgotPassword(context.TODO(), ForgotPasswordRequest{Email: email})
+		assert.NoError(t, err)
+
+		token = tokenFromMail(t)
+		assert.True(t, mr.Exists(s.getRedisKey(passwordReset, tools.SHA256(token))))
+		assert.False(t, mr.Exists(s.getRedisKey(passwordReset, token)))
+	})
+
+	t.Run("success: cooldown is silent", func(t *testing.T) {
+		sent := len(mailer.Messages)
+
+		err = s.ForgotPassword(context.TODO(), ForgotPasswordRequest{Email: email})
+		assert.NoError(t, err)
+		assert.Len(t, mailer.Messages, sent)
+	})
+
+	t.Run("success: cooldown ignores case", func(t *testing.T) {
+		sent := len(mailer.Messages)
+
+		err = s.ForgotPassword(context.TODO(), ForgotPasswordRequest{Email: " USER@Example.com "})
+		assert.NoError(t, err)
+		assert.Len(t, mailer.Messages, sent)
+	})
+
+	t.Run("success: send error is silent", func(t *testing.T) {
+		s := s
+		s.mail = mocks.FailingMailer{}
+		mr.Del(s.getRedisKey(passwordResetCooldown, email))
+
+		err = s.ForgotPassword(context.TODO(), ForgotPasswordRequest{Email: email})
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: unknown email is not sent", func(t *testing.T) {
+		sent := len(mailer.Messages)
+
+		err = s.ForgotPassword(context.TODO(), ForgotPasswordRequest{Email: "xxx@example.com"})
+		assert.NoError(t, err)
+		assert.Len(t, mailer.Messages, sent)
+	})
+
+	t.Run("success: new token replaces previous", func(t *testing.T) {
+		mr.Del(s.getRedisKey(passwordResetCooldown, email))
+
+		err = s.ForgotPassword(context.TODO(), ForgotPasswordRequest{Email: email})
+		assert.NoError(t, err)
+
+		prev := token
+		token = tokenFromMail(t)
+		assert.NotEqual(t, prev, token)
+
+		err = s.ResetPassword(context.TODO(), ResetPasswordRequest{Token: prev, Password: "new-secret"})
+		assert.Equal(t, errs.ErrInvalidResetToken, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: password policy", func(t *testing.T) {
+		s := s
+		s.policy = password.New(config.PasswordPolicy{MinLength: 12}, nil)
+
+		err = s.ResetPassword(context.TODO(), ResetPasswordRequest{Token: token, Password: "new-secret"})
+		assert.ErrorIs(t, err, password.ErrPolicy)
+		assert.True(t, mr.Exists(s.getRedisKey(passwordReset, tools.SHA256(token))))
+	})
+
+	t.Run("success: reset revokes sessions", func(t *testing.T) {
+		var resp loginResponse
+		resp, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.NoError(t, err)
+
+		err = s.ResetPassword(context.TODO(), ResetPasswordRequest{Token: token, Password: "new-secret"})
+		assert.NoError(t, err)
+		repo.AssertCalled(t, "UpdatePassword", mock.Anything, id, mock.Anything)
+
+		var sessions []Session
+		sessions, err = s.ListSessions(context.TODO(), id, "")
+		assert.NoError(t, err)
+		assert.Empty(t, sessions)
+
+		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  resp.AccessToken,
+			RefreshToken: resp.RefreshToken,
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("fail: token already used", func(t *testing.T) {
+		err = s.ResetPassword(context.TODO(), ResetPasswordRequest{Token: token, Password: "new-secret"})
+		assert.Error(t, err)
+		assert.Equal(t, errs.ErrInvalidResetToken, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: token expired", func(t *testing.T) {
+		mr.Del(s.getRedisKey(passwordResetCooldown, email))
+
+		err = s.ForgotPassword(context.TODO(), ForgotPasswordRequest{Email: email})
+		assert.NoError(t, err)
+
+		mr.FastForward(time.Duration(cfg.PasswordReset.TokenExpiration) * time.Minute)
+
+		err = s.ResetPassword(context.TODO(), ResetPasswordRequest{Token: tokenFromMail(t), Password: "new-secret"})
+		assert.Equal(t, errs.ErrInvalidResetToken, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: redis error", func(t *testing.T) {
+		mr.Close()
+
+		err = s.ForgotPassword(context.TODO(), ForgotPasswordRequest{Email: email})
+		assert.Error(t, err)
+	})
+}
+
+func TestOIDC(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	stub := mocks.NewOIDCProvider(t)
+	cfg.OIDC.Providers = map[string]config.OIDCProvider{
+		"stub": {
+			Issuer:       stub.Issuer(),
+			ClientID:     stub.ClientID,
+			ClientSecret: stub.ClientSecret,
+			RedirectURL:  "https://example.com/callback",
+		},
+		"disabled": {Issuer: stub.Issuer()},
+	}
+
+	linked := entity.User{ID: uuid.New(), Username: "linked"}
+	existing := entity.User{
+		ID:              uuid.New(),
+		Username:        "existing",
+		Email:           sql.NullString{String: "existing@example.com", Valid: true},
+		EmailVerifiedAt: sql.NullTime{Time: time.Now(), Valid: true},
+	}
+	unverified := entity.User{
+		ID:       uuid.New(),
+		Username: "unverified",
+		Email:    sql.NullString{String: "unverified@example.com", Valid: true},
+	}
+	twoFactor := entity.User{ID: uuid.New(), Username: "2fa", TOTPEnabledAt: sql.NullTime{Time: time.Now(), Valid: true}}
+	created := uuid.New()
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByIdentity", mock.Anything, "stub", "linked").Return(linked, nil)
+	repo.On("GetUserByIdentity", mock.Anything, "stub", "2fa").Return(twoFactor, nil)
+	repo.On("GetUserByIdentity", mock.Anything, "stub", mock.Anything).Return(entity.User{}, sql.ErrNoRows)
+	repo.On("GetUserByEmail", mock.Anything, "existing@example.com").Return(existing, nil)
+	repo.On("GetUserByEmail", mock.Anything, "unverified@example.com").Return(unverified, nil)
+	repo.On("GetUserByEmail", mock.Anything, mock.Anything).Return(entity.User{}, sql.ErrNoRows)
+	repo.On("CreateIdentity", mock.Anything, mock.Anything).Return(nil)
+	repo.On("CreateUserWithIdentity", mock.Anything, mock.Anything, mock.Anything).Return(created, nil)
+
+	s := service{
+		&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{},
+		newOIDCProviders(cfg.OIDC.Providers), testHashers, testPolicy,
+	}
+
+	login := func(claims mocks.OIDCClaims) (loginResponse, error) {
+		res, err := s.OIDCAuthorize(context.TODO(), OIDCAuthorizeRequest{Provider: "stub", DeviceName: "phone"})
+		if err != nil {
+			return loginResponse{}, err
+		}
+
+		code, state, err := stub.Authorize(res.AuthorizationURL, claims)
+		if err != nil {
+			return loginResponse{}, err
+		}
+
+		return s.OIDCCallback(context.TODO(), OIDCCallbackRequest{Provider: "stub", Code: code, State: state})
+	}
+
+	subject := func(t *testing.T, res loginResponse) string {
+		claims, err := s.VerifyAccessToken(context.TODO(), res.AccessToken)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+
+		return claims.Subject
+	}
+
+	t.Run("success: linked identity", func(t *testing.T) {
+		var res loginResponse
+		res, err = login(mocks.OIDCClaims{Subject: "linked"})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, res.RefreshToken)
+		assert.Equal(t, linked.ID.String(), subject(t, res))
+
+		var sessions []Session
+		sessions, err = s.ListSessions(context.TODO(), linked.ID, "")
+		assert.NoError(t, err)
+		assert.Len(t, sessions, 1)
+		assert.Equal(t, "phone", sessions[0].DeviceName)
+	})
+
+	t.Run("success: verified email links existing user", func(t *testing.T) {
+		var res loginResponse
+		res, err = login(mocks.OIDCClaims{Subject: "new1", Email: "existing@example.com", EmailVerified: true})
+		assert.NoError(t, err)
+		assert.Equal(t, existing.ID.String(), subject(t, res))
+		repo.AssertCalled(t, "CreateIdentity", mock.Anything, mock.MatchedBy(func(i entity.UserIdentity) bool {
+			return i.UserID == existing.ID && i.Provider == "stub" && i.Subject == "new1"
+		}))
+	})
+
+	t.Run("fail: verified email of unverified user", func(t *testing.T) {
+		_, err = login(mocks.OIDCClaims{Subject: "new3", Email: "unverified@example.com", EmailVerified: true})
+		assert.Equal(t, errs.ErrOIDCAccountExists, tools.UnwrapRecursive(err))
+		repo.AssertNotCalled(t, "CreateIdentity", mock.Anything, mock.MatchedBy(func(i entity.UserIdentity) bool {
+			return i.Subject == "new3"
+		}))
+	})
+
+	t.Run("success: unverified email creates new user", func(t *testing.T) {
+		var res loginResponse
+		res, err = login(mocks.OIDCClaims{Subject: "new2", Email: "Existing.User@example.com"})
+		assert.NoError(t, err)
+		assert.Equal(t, created.String(), subject(t, res))
+		repo.AssertCalled(t, "CreateUserWithIdentity", mock.Anything, mock.MatchedBy(func(u entity.User) bool {
+			return strings.HasPrefix(u.Username, "existinguser_") && len(u.Username) <= 25 && !u.Email.Valid
+		}), mock.MatchedBy(func(i entity.UserIdentity) bool {
+			return i.Subject == "new2" && i.Email.String == "Existing.User@example.com"
+		}))
+	})
+
+	t.Run("success: 2fa user gets challenge", func(t *testing.T) {
+		var res loginResponse
+		res, err = login(mocks.OIDCClaims{Subject: "2fa"})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, res.ChallengeToken)
+		assert.Empty(t, res.AccessToken)
+	})
+
+	t.Run("fail: unknown provider", func(t *testing.T) {
+		_, err = s.OIDCAuthorize(context.TODO(), OIDCAuthorizeRequest{Provider: "disabled"})
+		assert.Equal(t, errs.ErrUnknownProvider, tools.UnwrapRecursive(err))
+
+		_, err = s.OIDCCallback(context.TODO(), OIDCCallbackRequest{Provider: "xxx", Code: "code", State: "state"})
+		assert.Equal(t, errs.ErrUnknownProvider, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: state reused", func(t *testing.T) {
+		var res oidcAuthorizeResponse
+		res, err = s.OIDCAuthorize(context.TODO(), OIDCAuthorizeRequest{Provider: "stub"})
+		assert.NoError(t, err)
+
+		code, state, _ := stub.Authorize(res.AuthorizationURL, mocks.OIDCClaims{Subject: "linked"})
+
+		_, err = s.OIDCCallback(context.TODO(), OIDCCallbackRequest{Provider: "stub", Code: code, State: state})
+		assert.NoError(t, err)
+
+		_, err = s.OIDCCallback(context.TODO(), OIDCCallbackRequest{Provider: "stub", Code: code, State: state})
+		assert.Equal(t, errs.ErrInvalidOIDCState, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: unknown state", func(t *testing.T) {
+		_, err = s.OIDCCallback(context.TODO(), OIDCCallbackRequest{Provider: "stub", Code: "code", State: "xxx"})
+		assert.Equal(t, errs.ErrInvalidOIDCState, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: invalid code", func(t *testing.T) {
+		var res oidcAuthorizeResponse
+		res, err = s.OIDCAuthorize(context.TODO(), OIDCAuthorizeRequest{Provider: "stub"})
+		assert.NoError(t, err)
+
+		_, err = s.OIDCCallback(context.TODO(), OIDCCallbackRequest{Provider: "stub", Code: "xxx", State: res.State})
+		assert.Equal(t, errs.ErrOIDCLogin, tools.UnwrapRecursive(err))
+	})
+}
+
+func TestHasScope(t *testing.T) {
+	login := JWTCustomClaims{SessionID: "session"}
+	assert.True(t, login.HasScope("user:update"))
+
+	client := JWTCustomClaims{ClientID: "spa", Scope: "user:list user:search"}
+	assert.True(t, client.HasScope("user:list"))
+	assert.False(t, client.HasScope("user:update"))
+	assert.Empty(t, client.GetSessionID())
+
+	unscoped := JWTCustomClaims{ClientID: "spa"}
+	assert.False(t, unscoped.HasScope("user:list"))
+}
+
+func TestOAuth(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	confidential := entity.OAuthClient{
+		ClientID:     "backend",
+		SecretHash:   sql.NullString{String: tools.SHA256("secret"), Valid: true},
+		Name:         "backend",
+		RedirectURIs: "https://app.example.com/callback",
+		GrantTypes:   "client_credentials authorization_code",
+		Scopes:       "read write",
+	}
+	public := entity.OAuthClient{
+		ClientID:     "spa",
+		Name:         "spa",
+		RedirectURIs: "https://spa.example.com/callback",
+		GrantTypes:   "authorization_code",
+		Scopes:       "read",
+	}
+	user := entity.User{ID: uuid.New(), Username: "user"}
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetOAuthClient", mock.Anything, "backend").Return(confidential, nil)
+	repo.On("GetOAuthClient", mock.Anything, "spa").Return(public, nil)
+	repo.On("GetOAuthClient", mock.Anything, mock.Anything).Return(entity.OAuthClient{}, sql.ErrNoRows)
+	repo.On("CreateOAuthClient", mock.Anything, mock.Anything).Return(nil)
+
+	s := service{
+		&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+	}
+
+	backend := OAuthClientCredentials{ClientID: "backend", ClientSecret: "secret"}
+	spa := OAuthClientCredentials{ClientID: "spa"}
+
+	oauthErr := func(err error) string {
+		var oe *OAuthError
+		if !errors.As(err, &oe) {
+			return ""
+		}
+
+		return oe.Code
+	}
+
+	authorize := func(req OAuthAuthorizeRequest) url.Values {
+		redirect, err := s.OAuthAuthorize(context.TODO(), user, req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+
+		u, err := url.Parse(redirect)
+		assert.NoError(t, err)
+
+		return u.Query()
+	}
+
+	verifier := "verifier-verifier-verifier-verifier-verifier"
+	codeRequest := OAuthAuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            "spa",
+		RedirectURI:         "https://spa.example.com/callback",
+		State:               "state",
+		CodeChallenge:       oidc.CodeChallenge(verifier),
+		CodeChallengeMethod: "S256",
+	}
+
+	t.Run("success: client credentials", func(t *testing.T) {
+		var res oauthTokenResponse
+		res, err = s.OAuthToken(context.TODO(), OAuthTokenRequest{
+			GrantType:              GrantClientCredentials,
+			Scope:                  "read",
+			OAuthClientCredentials: backend,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "Bearer", res.TokenType)
+		assert.Equal(t, "read", res.Scope)
+		assert.Empty(t, res.RefreshToken)
+
+		var claims *JWTCustomClaims
+		claims, err = s.VerifyAccessToken(context.TODO(), res.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, "backend", claims.Subject)
+		assert.Equal(t, "backend", claims.ClientID)
+		assert.Equal(t, "read", claims.Scope)
+	})
+
+	t.Run("fail: client credentials", func(t *testing.T) {
+		tests := []struct {
+			name string
+			req  OAuthTokenRequest
+			want string
+		}{
+			{"wrong secret", OAuthTokenRequest{GrantType: GrantClientCredentials,
+				OAuthClientCredentials: OAuthClientCredentials{ClientID: "backend", ClientSecret: "xxx"}}, "invalid_client"},
+			{"unknown client", OAuthTokenRequest{GrantType: GrantClientCredentials,
+				OAuthClientCredentials: OAuthClientCredentials{ClientID: "xxx"}}, "invalid_client"},
+			{"public client", OAuthTokenRequest{GrantType: GrantClientCredentials,
+				OAuthClientCredentials: spa}, "unauthorized_client"},
+			{"scope", OAuthTokenRequest{GrantType: GrantClientCredentials, Scope: "admin",
+				OAuthClientCredentials: backend}, "invalid_scope"},
+			{"grant type", OAuthTokenRequest{GrantType: "password", OAuthClientCredentials: backend}, "unsupported_grant_type"},
+		}
+
+		for _, tc := range tests {
+			_, err = s.OAuthToken(context.TODO(), tc.req)
+			assert.Equal(t, tc.want, oauthErr(err), tc.name)
+		}
+	})
+
+	t.Run("success: authorization code with pkce", func(t *testing.T) {
+		q := authorize(codeRequest)
+		assert.Equal(t, "state", q.Get("state"))
+		assert.NotEmpty(t, q.Get("code"))
+
+		var res oauthTokenResponse
+		res, err = s.OAuthToken(context.TODO(), OAuthTokenRequest{
+			GrantType:              GrantAuthorizationCode,
+			Code:                   q.Get("code"),
+			RedirectURI:            codeRequest.RedirectURI,
+			CodeVerifier:           verifier,
+			OAuthClientCredentials: spa,
+		})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, res.RefreshToken)
+		assert.Equal(t, "read", res.Scope)
+
+		var claims *JWTCustomClaims
+		claims, err = s.VerifyAccessToken(context.TODO(), res.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, user.ID.String(), claims.Subject)
+		assert.Equal(t, "spa", claims.ClientID)
+		assert.NotEmpty(t, claims.SessionID)
+
+		// the code is single-use
+		_, err = s.OAuthToken(context.TODO(), OAuthTokenRequest{
+			GrantType:              GrantAuthorizationCode,
+			Code:                   q.Get("code"),
+			RedirectURI:            codeRequest.RedirectURI,
+			CodeVerifier:           verifier,
+			OAuthClientCredentials: spa,
+		})
+		assert.Equal(t, "invalid_grant", oauthErr(err))
+	})
+
+	t.Run("fail: authorization code", func(t *testing.T) {
+		tests := []struct {
+			name string
+			req  OAuthTokenRequest
+		}{
+			{"wrong verifier", OAuthTokenRequest{CodeVerifier: "xxx", RedirectURI: codeRequest.RedirectURI,
+				OAuthClientCredentials: spa}},
+			{"wrong redirect uri", OAuthTokenRequest{CodeVerifier: verifier, RedirectURI: "https://spa.example.com/other",
+				OAuthClientCredentials: spa}},
+			{"other client", OAuthTokenRequest{CodeVerifier: verifier, RedirectURI: codeRequest.RedirectURI,
+				OAuthClientCredentials: backend}},
+		}
+
+		for _, tc := range tests {
+			tc.req.GrantType = GrantAuthorizationCode
+			tc.req.Code = authorize(codeRequest).Get("code")
+
+			_, err = s.OAuthToken(context.TODO(), tc.req)
+			assert.Equal(t, "invalid_grant", oauthErr(err), tc.name)
+		}
+	})
+
+	t.Run("success: refresh token", func(t *testing.T) {
+		req := codeRequest
+		req.ClientID = "backend"
+		req.RedirectURI = "https://app.example.com/callback"
+
+		var res oauthTokenResponse
+		res, err = s.OAuthToken(context.TODO(), OAuthTokenRequest{
+			GrantType:              GrantAuthorizationCode,
+			Code:                   authorize(req).Get("code"),
+			RedirectURI:            req.RedirectURI,
+			CodeVerifier:           verifier,
+			OAuthClientCredentials: backend,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "read write", res.Scope)
+
+		refresh := func(token, scope string, creds OAuthClientCredentials) (oauthTokenResponse, error) {
+			return s.OAuthToken(context.TODO(), OAuthTokenRequest{
+				GrantType:              GrantRefreshToken,
+				RefreshToken:           token,
+				Scope:                  scope,
+				OAuthClientCredentials: creds,
+			})
+		}
+
+		_, err = refresh(res.RefreshToken, "read admin", backend)
+		assert.Equal(t, "invalid_scope", oauthErr(err))
+
+		_, err = refresh(res.RefreshToken, "", spa)
+		assert.Equal(t, "invalid_grant", oauthErr(err))
+
+		// the access token may be narrowed, the refresh token keeps the scope originally granted
+		var narrowed oauthTokenResponse
+		narrowed, err = refresh(res.RefreshToken, "read", backend)
+		assert.NoError(t, err)
+		assert.Equal(t, "read", narrowed.Scope)
+		assert.NotEqual(t, res.RefreshToken, narrowed.RefreshToken)
+
+		var claims *JWTCustomClaims
+		claims, err = s.VerifyAccessToken(context.TODO(), narrowed.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, user.ID.String(), claims.Subject)
+		assert.Equal(t, "backend", claims.ClientID)
+		assert.Equal(t, "read", claims.Scope)
+		assert.Equal(t, []string{"user"}, claims.Roles)
+
+		var renewed oauthTokenResponse
+		renewed, err = refresh(narrowed.RefreshToken, "", backend)
+		assert.NoError(t, err)
+		assert.Equal(t, "read write", renewed.Scope)
+
+		// a rotated refresh token cannot be used again
+		_, err = refresh(res.RefreshToken, "", backend)
+		assert.Equal(t, "invalid_grant", oauthErr(err))
+
+		_, err = refresh("xxx", "", backend)
+		assert.Equal(t, "invalid_grant", oauthErr(err))
+	})
+
+	t.Run("fail: authorize", func(t *testing.T) {
+		_, err = s.OAuthAuthorize(context.TODO(), user, OAuthAuthorizeRequest{ClientID: "spa", RedirectURI: "https://evil.example.com"})
+		assert.Equal(t, "invalid_request", oauthErr(err))
+
+		_, err = s.OAuthAuthorize(context.TODO(), user, OAuthAuthorizeRequest{ClientID: "xxx"})
+		assert.Equal(t, "invalid_request", oauthErr(err))
+
+		tests := []struct {
+			name   string
+			modify func(*OAuthAuthorizeRequest)
+			want   string
+		}{
+			{"response type", func(r *OAuthAuthorizeRequest) { r.ResponseType = "token" }, "unsupported_response_type"},
+			{"no pkce", func(r *OAuthAuthorizeRequest) { r.CodeChallenge = "" }, "invalid_request"},
+			{"plain pkce", func(r *OAuthAuthorizeRequest) { r.CodeChallengeMethod = "plain" }, "invalid_request"},
+			{"scope", func(r *OAuthAuthorizeRequest) { r.Scope = "write" }, "invalid_scope"},
+		}
+
+		for _, tc := range tests {
+			req := codeRequest
+			tc.modify(&req)
+
+			q := authorize(req)
+			assert.Equal(t, tc.want, q.Get("error"), tc.name)
+			assert.Equal(t, "state", q.Get("state"), tc.name)
+			assert.Empty(t, q.Get("code"), tc.name)
+		}
+	})
+
+	t.Run("success: introspect and revoke", func(t *testing.T) {
+		var res oauthTokenResponse
+		res, err = s.OAuthToken(context.TODO(), OAuthTokenRequest{
+			GrantType:              GrantAuthorizationCode,
+			Code:                   authorize(codeRequest).Get("code"),
+			RedirectURI:            codeRequest.RedirectURI,
+			CodeVerifier:           verifier,
+			OAuthClientCredentials: spa,
+		})
+		assert.NoError(t, err)
+
+		introspect := func(token, hint string) IntrospectionResponse {
+			var info IntrospectionResponse
+			info, err = s.OAuthIntrospect(context.TODO(), OAuthTokenActionRequest{
+				Token:                  token,
+				TokenTypeHint:          hint,
+				OAuthClientCredentials: backend,
+			})
+			assert.NoError(t, err)
+
+			return info
+		}
+
+		info := introspect(res.AccessToken, "")
+		assert.True(t, info.Active)
+		assert.Equal(t, "spa", info.ClientID)
+		assert.Equal(t, "user", info.Username)
+		assert.Equal(t, "Bearer", info.TokenType)
+		assert.Equal(t, user.ID.String(), info.Subject)
+
+		info = introspect(res.RefreshToken, "refresh_token")
+		assert.True(t, info.Active)
+		assert.Empty(t, info.TokenType)
+
+		assert.False(t, introspect("xxx", "").Active)
+
+		_, err = s.OAuthIntrospect(context.TODO(), OAuthTokenActionRequest{Token: res.AccessToken, OAuthClientCredentials: spa})
+		assert.Equal(t, "invalid_client", oauthErr(err))
+
+		// tokens of other clients are ignored
+		err = s.OAuthRevoke(context.TODO(), OAuthTokenActionRequest{Token: res.RefreshToken, OAuthClientCredentials: backend})
+		assert.NoError(t, err)
+		assert.True(t, introspect(res.RefreshToken, "").Active)
+
+		err = s.OAuthRevoke(context.TODO(), OAuthTokenActionRequest{Token: res.RefreshToken, OAuthClientCredentials: spa})
+		assert.NoError(t, err)
+		assert.False(t, introspect(res.RefreshToken, "").Active)
+
+		err = s.OAuthRevoke(context.TODO(), OAuthTokenActionRequest{Token: res.AccessToken, OAuthClientCredentials: spa})
+		assert.NoError(t, err)
+		assert.False(t, introspect(res.AccessToken, "").Active)
+
+		err = s.OAuthRevoke(context.TODO(), OAuthTokenActionRequest{Token: "xxx", OAuthClientCredentials: spa})
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: create client", func(t *testing.T) {
+		var res oauthClientResponse
+		res, err = s.CreateOAuthClient(context.TODO(), CreateOAuthClientRequest{
+			Name:         "service",
+			RedirectURIs: []string{"https://service.example.com/callback"},
+			GrantTypes:   []string{GrantClientCredentials, GrantAuthorizationCode},
+			Scopes:       []string{"read"},
+		})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, res.ClientID)
+		assert.NotEmpty(t, res.ClientSecret)
+		repo.AssertCalled(t, "CreateOAuthClient", mock.Anything, mock.MatchedBy(func(c entity.OAuthClient) bool {
+			return c.ClientID == res.ClientID && c.SecretHash.String == tools.SHA256(res.ClientSecret)
+		}))
+
+		res, err = s.CreateOAuthClient(context.TODO(), CreateOAuthClientRequest{
+			Name:         "app",
+			RedirectURIs: []string{"https://app.example.com/callback"},
+			GrantTypes:   []string{GrantAuthorizationCode},
+			Scopes:       []string{"read"},
+			Public:       true,
+		})
+		assert.NoError(t, err)
+		assert.Empty(t, res.ClientSecret)
+	})
+
+	t.Run("fail: create client", func(t *testing.T) {
+		_, err = s.CreateOAuthClient(context.TODO(), CreateOAuthClientRequest{
+			Name:       "app",
+			GrantTypes: []string{GrantClientCredentials},
+			Public:     true,
+		})
+		assert.Equal(t, errs.ErrConditionNotFulfil, tools.UnwrapRecursive(err))
+
+		_, err = s.CreateOAuthClient(context.TODO(), CreateOAuthClientRequest{
+			Name:       "app",
+			GrantTypes: []string{GrantAuthorizationCode},
+		})
+		assert.Equal(t, errs.ErrConditionNotFulfil, tools.UnwrapRecursive(err))
+	})
+}
+
+func TestVerifyAPIKey(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	key, prefix, err := tools.GenerateAPIKey()
+	assert.NoError(t, err)
+
+	expired, expiredPrefix, err := tools.GenerateAPIKey()
+	assert.NoError(t, err)
+
+	userID := uuid.New()
+	apiKey := entity.APIKey{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Prefix:    prefix,
+		KeyHash:   tools.SHA256(key),
+		Scopes:    "user:list",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, userID).Return([]string{"admin"}, nil)
+	repo.On("GetAPIKeyByPrefix", mock.Anything, prefix).Return(apiKey, nil)
+	repo.On("GetAPIKeyByPrefix", mock.Anything, expiredPrefix).Return(entity.APIKey{
+		UserID:    userID,
+		Prefix:    expiredPrefix,
+		KeyHash:   tools.SHA256(expired),
+		ExpiresAt: time.Now().Add(-time.Minute),
+	}, nil)
+	repo.On("GetAPIKeyByPrefix", mock.Anything, mock.Anything).Return(entity.APIKey{}, sql.ErrNoRows)
+	repo.On("TouchAPIKey", mock.Anything, apiKey.ID).Return(errors.New("db down")).Once()
+	repo.On("TouchAPIKey", mock.Anything, apiKey.ID).Return(nil)
+
+	s := service{
+		&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+	}
+
+	t.Run("success", func(t *testing.T) {
+		// failing to record the use does not fail the request
+		for i := 0; i < 2; i++ {
+			var principal *APIKeyPrincipal
+			principal, err = s.VerifyAPIKey(context.TODO(), key)
+			assert.NoError(t, err)
+			assert.Equal(t, userID.String(), principal.GetSubject())
+			assert.Equal(t, []string{"admin"}, principal.GetRoles())
+			assert.True(t, principal.HasScope("user:list"))
+			assert.False(t, principal.HasScope("user:delete"))
+		}
+
+		repo.AssertNumberOfCalls(t, "TouchAPIKey", 2)
+	})
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"malformed", "xxx"},
+		{"unknown prefix", "ak_0123456789abcdef_secret"},
+		{"wrong secret", prefix + "_secret"},
+		{"expired", expired},
+	}
+
+	for _, tc := range tests {
+		t.Run("fail: "+tc.name, func(t *testing.T) {
+			_, err = s.VerifyAPIKey(context.TODO(), tc.key)
+			assert.Equal(t, errs.ErrInvalidAPIKey, tools.UnwrapRecursive(err))
+		})
+	}
+}
+
+func TestHasPermission(t *testing.T) {
+	var cfg config.Config
+	cfg.App.Name = "test"
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	var repo mocks.AuthRepository
+	repo.On("GetRolePermissions", mock.Anything, []string{"admin"}).Return([]string{"user:delete", "user:list"}, nil)
+	repo.On("GetRolePermissions", mock.Anything, []string{"user"}).Return([]string{}, nil)
+	repo.On("GetRolePermissions", mock.Anything, []string{"error"}).Return(nil, errors.New("db down"))
+
+	s := service{
+		&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+	}
+
+	t.Run("success: granted", func(t *testing.T) {
+		var ok bool
+		ok, err = s.HasPermission(context.TODO(), []string{"admin"}, "user:delete")
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+
+	t.Run("success: not granted", func(t *testing.T) {
+		var ok bool
+		ok, err = s.HasPermission(context.TODO(), []string{"user"}, "user:delete")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("fail: repository error", func(t *testing.T) {
+		_, err = s.HasPermission(context.TODO(), []string{"error"}, "user:delete")
+		assert.Error(t, err)
+	})
+}
+
+func TestKeySet(t *testing.T) {
+	dir := t.TempDir()
+
+	writeKey := func(name string, key crypto.Signer) config.JwtKey {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		assert.NoError(t, err)
+
+		file := filepath.Join(dir, name+".pem")
+		err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+		assert.NoError(t, err)
+
+		return config.JwtKey{ID: name, PrivateKeyFile: file}
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	keys := []config.JwtKey{writeKey("rsa", rsaKey), writeKey("ec", ecKey), writeKey("ed", edKey)}
+
+	var cfg config.Config
+	cfg.App.Name = "test"
+	cfg.Jwt.AccessExpiration = 1
+	cfg.Jwt.AccessSigningKey = "secret"
+	cfg.Jwt.RefreshExpiration = 1
+	cfg.Jwt.RefreshSigningKey = "secret"
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	password, _ := tools.Bcrypt("secret")
+	id := uuid.New()
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserByLogin", mock.Anything, "user").Return(
+		entity.User{
+			ID:       id,
+			Username: "user",
+			Password: password,
+		},
+		nil,
+	)
+
+	newService := func(active string, keys ...config.JwtKey) service {
+		cfg := cfg
+		cfg.Jwt.ActiveKeyID = active
+		cfg.Jwt.Keys = keys
+
+		ks, err := LoadKeySet(&cfg)
+		assert.NoError(t, err)
+
+		return service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, ks, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
+	}
+
+	for _, key := range keys {
+		key := key
+		t.Run("success: sign and verify "+key.ID, func(t *testing.T) {
+			s := newService(key.ID, key)
+
+			var loginResp loginResponse
+			loginResp, err = s.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+			assert.NoError(t, err)
+
+			var token *jwt.Token
+			token, _, err = new(jwt.Parser).ParseUnverified(loginResp.AccessToken, &JWTCustomClaims{})
+			assert.NoError(t, err)
+			assert.Equal(t, key.ID, token.Header["kid"])
+
+			var claims *JWTCustomClaims
+			claims, err = s.VerifyAccessToken(context.TODO(), loginResp.AccessToken)
+			assert.NoError(t, err)
+			assert.Equal(t, id.String(), claims.GetSubject())
+		})
+	}
+
+	t.Run("success: rotation keeps old tokens valid", func(t *testing.T) {
+		old := newService("rsa", keys[0])
+
+		var loginResp loginResponse
+		loginResp, err = old.Login(context.TODO(), LoginRequest{Username: "user", Password: "secret"})
+		assert.NoError(t, err)
+
+		retired := keys[0]
+		retired.PublicKeyFile = filepath.Join(dir, "rsa.pub.pem")
+		der, _ := x509.MarshalPKIXPublicKey(rsaKey.Public())
+		err = os.WriteFile(retired.PublicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+		assert.NoError(t, err)
+		retired.PrivateKeyFile = ""
+
+		s := newService("ec", retired, keys[1])
+
+		_, err = s.VerifyAccessToken(context.TODO(), loginResp.AccessToken)
+		assert.NoError(t, err)
+
+		_, err = s.Refresh(context.TODO(), RefreshTokenRequest{
+			AccessToken:  loginResp.AccessToken,
+			RefreshToken: loginResp.RefreshToken,
+		})
+		assert.NoError(t, err)
+
+		rotated := newService("ec", keys[1])
+		_, err = rotated.VerifyAccessToken(context.TODO(), loginResp.AccessToken)
+		assert.Equal(t, errs.ErrInvalidJwt, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: hmac token rejected", func(t *testing.T) {
+		s := newService("rsa", keys[0])
+
+		hmac := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
+
+		var accessJWT string
+		accessJWT, err = hmac.generateJWT(s.newClaims(id, "user", Access), Access)
+		assert.NoError(t, err)
+
+		_, err = s.VerifyAccessToken(context.TODO(), accessJWT)
+		assert.Equal(t, errs.ErrInvalidJwt, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: jwks", func(t *testing.T) {
+		s := newService("rsa", keys...)
+
+		jwks := s.JWKS()
+		assert.Len(t, jwks.Keys, 3)
+		assert.Equal(t, "ec", jwks.Keys[0].Kid)
+		assert.Equal(t, "EC", jwks.Keys[0].Kty)
+		assert.Equal(t, "ES256", jwks.Keys[0].Alg)
+		assert.Equal(t, "P-256", jwks.Keys[0].Crv)
+		assert.Equal(t, "OKP", jwks.Keys[1].Kty)
+		assert.Equal(t, "EdDSA", jwks.Keys[1].Alg)
+		assert.Equal(t, "RSA", jwks.Keys[2].Kty)
+		assert.Equal(t, "RS256", jwks.Keys[2].Alg)
+		assert.Equal(t, "AQAB", jwks.Keys[2].E)
+
+		hmac := service{
+			&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+		}
+		assert.Empty(t, hmac.JWKS().Keys)
+	})
+
+	t.Run("fail: active key without private key", func(t *testing.T) {
+		cfg := cfg
+		cfg.Jwt.ActiveKeyID = "missing"
+		cfg.Jwt.Keys = keys
+
+		_, err = LoadKeySet(&cfg)
+		assert.Error(t, err)
+	})
+
+	writePublicKey := func(name string, key crypto.Signer) string {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		assert.NoError(t, err)
+
+		file := filepath.Join(dir, name+".pub.pem")
+		err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+		assert.NoError(t, err)
+
+		return file
+	}
+
+	t.Run("success: matching public key", func(t *testing.T) {
+		key := keys[0]
+		key.PublicKeyFile = writePublicKey("rsa", rsaKey)
+
+		cfg := cfg
+		cfg.Jwt.ActiveKeyID = "rsa"
+		cfg.Jwt.Keys = []config.JwtKey{key}
+
+		_, err = LoadKeySet(&cfg)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: public key of another key", func(t *testing.T) {
+		key := keys[0]
+		key.PublicKeyFile = writePublicKey("ec", ecKey)
+
+		cfg := cfg
+		cfg.Jwt.ActiveKeyID = "rsa"
+		cfg.Jwt.Keys = []config.JwtKey{key}
+
+		_, err = LoadKeySet(&cfg)
+		assert.ErrorIs(t, err, errKeyMismatch)
+	})
+
+	t.Run("fail: signing key not configured", func(t *testing.T) {
+		cfg := cfg
+		cfg.Jwt.AccessSigningKey = ""
+
+		_, err = LoadKeySet(&cfg)
+		assert.ErrorIs(t, err, errMissingSecret)
+
+		// the access signing key is unused with a key set, the refresh signing key is not
+		cfg.Jwt.ActiveKeyID = "rsa"
+		cfg.Jwt.Keys = keys
+
+		_, err = LoadKeySet(&cfg)
+		assert.NoError(t, err)
+
+		cfg.Jwt.RefreshSigningKey = ""
+
+		_, err = LoadKeySet(&cfg)
+		assert.ErrorIs(t, err, errMissingSecret)
+	})
+}
+
+func TestPasskey(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	userID := uuid.New()
+	authenticator := mocks.NewAuthenticator(t, cfg.WebAuthn.RPID, cfg.WebAuthn.Origins[0])
+
+	// the repository keeps the registered passkey
+	var stored []entity.Passkey
+	findPasskey := func(_ context.Context, id []byte) (entity.Passkey, error) {
+		for _, p := range stored {
+			if string(p.CredentialID) == string(id) {
+				return p, nil
+			}
+		}
+
+		return entity.Passkey{}, sql.ErrNoRows
+	}
+
+	var repo mocks.AuthRepository
+	repo.On("GetUserRoles", mock.Anything, mock.Anything).Return([]string{"user"}, nil)
+	repo.On("GetUserTOTP", mock.Anything, userID).Return(entity.User{ID: userID, Username: "user"}, nil)
+	repo.On("ListPasskeys", mock.Anything, userID).Return(func(context.Context, uuid.UUID) []entity.Passkey {
+		return stored
+	}, nil)
+	repo.On("GetPasskeyByCredentialID", mock.Anything, mock.Anything).Return(
+		func(ctx context.Context, id []byte) entity.Passkey { p, _ := findPasskey(ctx, id); return p },
+		func(ctx context.Context, id []byte) error { _, err := findPasskey(ctx, id); return err },
+	)
+	repo.On("CreatePasskey", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		p := args.Get(1).(entity.Passkey)
+		p.ID = uuid.New()
+		stored = append(stored, p)
+	}).Return(nil)
+	repo.On("UpdatePasskeySignCount", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		stored[0].SignCount = args.Get(2).(int64)
+	}).Return(nil)
+	repo.On("DeletePasskey", mock.Anything, userID, mock.Anything).Return(func(_ context.Context, _, id uuid.UUID) error {
+		if len(stored) == 0 || stored[0].ID != id {
+			return sql.ErrNoRows
+		}
+		stored = nil
+		return nil
+	})
+
+	s := service{
+		&cfg, rds, logger, &repo, 2 * time.Second, &mocks.SMSSender{}, nil, &mail.Memory{}, nil, testHashers, testPolicy,
+	}
+
+	finishRegistration := func(challenge []byte) error {
+		req := FinishPasskeyRegistrationRequest{Name: "laptop"}
+		if err := json.Unmarshal([]byte(authenticator.Register(challenge, userID[:])), &req.Credential); err != nil {
+			t.Fatal(err)
+		}
+
+		return s.FinishPasskeyRegistration(context.TODO(), userID, req)
+	}
+
+	finishLogin := func(session string, challenge []byte) (loginResponse, error) {
+		req := FinishPasskeyLoginRequest{Session: session}
+		if err := json.Unmarshal([]byte(authenticator.Assert(challenge)), &req.Credential); err != nil {
+			t.Fatal(err)
+		}
+
+		return s.FinishPasskeyLogin(context.TODO(), req)
+	}
+
+	t.Run("register", func(t *testing.T) {
+		opts, err := s.BeginPasskeyRegistration(context.TODO(), userID, "user")
+		assert.NoError(t, err)
+		assert.Equal(t, cfg.WebAuthn.RPID, opts.PublicKey.RP.ID)
+		assert.Equal(t, userID[:], []byte(opts.PublicKey.User.ID))
+		assert.Empty(t, opts.PublicKey.ExcludeCredentials)
+
+		assert.NoError(t, finishRegistration(opts.PublicKey.Challenge))
+		assert.Len(t, stored, 1)
+		assert.Equal(t, "laptop", stored[0].Name)
+		assert.Equal(t, "internal", stored[0].Transports)
+
+		// the challenge is single-use
+		assert.ErrorIs(t, finishRegistration(opts.PublicKey.Challenge), errs.ErrInvalidChallenge)
+	})
+
+	t.Run("register twice", func(t *testing.T) {
+		opts, err := s.BeginPasskeyRegistration(context.TODO(), userID, "user")
+		assert.NoError(t, err)
+		assert.Len(t, opts.PublicKey.ExcludeCredentials, 1)
+
+		assert.ErrorIs(t, finishRegistration(opts.PublicKey.Challenge), errs.ErrPasskeyExists)
+	})
+
+	t.Run("register wrong challenge", func(t *testing.T) {
+		_, err := s.BeginPasskeyRegistration(context.TODO(), userID, "user")
+		assert.NoError(t, err)
+
+		assert.ErrorIs(t, finishRegistration([]byte("xxx")), errs.ErrInvalidPasskey)
+	})
+
+	t.Run("login", func(t *testing.T) {
+		opts, err := s.BeginPasskeyLogin(context.TODO())
+		assert.NoError(t, err)
+		assert.Equal(t, cfg.WebAuthn.RPID, opts.PublicKey.RPID)
+
+		res, err := finishLogin(opts.Session, opts.PublicKey.Challenge)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, res.AccessToken)
+		assert.NotEmpty(t, res.RefreshToken)
+		assert.Equal(t, int64(1), stored[0].SignCount)
+
+		claims, err := s.VerifyAccessToken(context.TODO(), res.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, userID.String(), claims.Subject)
+
+		// the session is single-use
+		_, err = finishLogin(opts.Session, opts.PublicKey.Challenge)
+		assert.ErrorIs(t, err, errs.ErrInvalidChallenge)
+	})
+
+	t.Run("login cloned authenticator", func(t *testing.T) {
+		opts, err := s.BeginPasskeyLogin(context.TODO())
+		assert.NoError(t, err)
+
+		authenticator.SignCount = 0
+		_, err = finishLogin(opts.Session, opts.PublicKey.Challenge)
+		assert.ErrorIs(t, err, errs.ErrInvalidPasskey)
+		authenticator.SignCount = 1
+	})
+
+	t.Run("login wrong user handle", func(t *testing.T) {
+		opts, err := s.BeginPasskeyLogin(context.TODO())
+		assert.NoError(t, err)
+
+		authenticator.UserHandle = []byte("other")
+		_, err = finishLogin(opts.Session, opts.PublicKey.Challenge)
+		assert.ErrorIs(t, err, errs.ErrInvalidPasskey)
+		authenticator.UserHandle = userID[:]
+	})
+
+	t.Run("login unknown session", func(t *testing.T) {
+		_, err := finishLogin("xxx", []byte("xxx"))
+		assert.ErrorIs(t, err, errs.ErrInvalidChallenge)
+	})
+
+	t.Run("list and delete", func(t *testing.T) {
+		passkeys, err := s.ListPasskeys(context.TODO(), userID)
+		assert.NoError(t, err)
+		assert.Len(t, passkeys, 1)
+
+		assert.NoError(t, s.DeletePasskey(context.TODO(), userID, passkeys[0].ID))
+		assert.ErrorIs(t, s.DeletePasskey(context.TODO(), userID, passkeys[0].ID), errs.ErrPasskeyNotFound)
+
+		// a deleted passkey no longer logs in
+		opts, err := s.BeginPasskeyLogin(context.TODO())
+		assert.NoError(t, err)
+
+		_, err = finishLogin(opts.Session, opts.PublicKey.Challenge)
+		assert.ErrorIs(t, err, errs.ErrInvalidPasskey)
+	})
+}
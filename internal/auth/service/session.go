@@ -0,0 +1,288 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+)
+
+type (
+	// DeviceInfo describes the device a session is created from.
+	// IP and UserAgent are filled in by the http handler, not by the client.
+	DeviceInfo struct {
+		DeviceName string `json:"device_name" validate:"max=100"`
+		IP         string `json:"-"`
+		UserAgent  string `json:"-"`
+	}
+
+	// Session is a login on a single device. It lives as long as its refresh token family.
+	Session struct {
+		ID         string    `json:"id"`
+		DeviceName string    `json:"device_name"`
+		IP         string    `json:"ip"`
+		UserAgent  string    `json:"user_agent"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastUsedAt time.Time `json:"last_used_at"`
+		Current    bool      `json:"current"`
+	}
+
+	RevokeSessionRequest struct {
+		ID string `param:"id" validate:"required,uuid"`
+	}
+)
+
+const (
+	sessionNotFound = 0
+	sessionReused   = -1
+)
+
+// rotateRefreshTokenScript atomically swaps the current refresh token of a session.
+// It returns 0 if the session does not exist, -1 if the presented token is not the current one
+// (the session is deleted in that case) and 1 if the token was rotated. The index of the sessions of the user
+// is kept alive with the session, otherwise it could expire first and hide the session from LogoutAll.
+//
+//nolint:gochecknoglobals // compiled script shared by all service instances
+var rotateRefreshTokenScript = redis.NewScript(`
+local current = redis.call("HGET", KEYS[1], "token")
+if not current then
+	return 0
+end
+if current ~= ARGV[1] then
+	redis.call("DEL", KEYS[1])
+	redis.call("SREM", KEYS[2], ARGV[5])
+	return -1
+end
+redis.call("HSET", KEYS[1], "token", ARGV[2], "last_used_at", ARGV[4])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+redis.call("PEXPIRE", KEYS[2], ARGV[3])
+return 1
+`)
+
+// ListSessions returns the active sessions of a user, most recently used first.
+// The session with currentID is flagged as the current one.
+func (s service) ListSessions(ctx context.Context, userID uuid.UUID, currentID string) ([]Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	setKey := s.getRedisKey(userSession, userID.String())
+
+	ids, err := s.rds.SMembers(ctx, setKey).Result()
+	if err != nil {
+		return []Session{}, fmt.Errorf("[ListSessions] internal error: %w", err)
+	}
+
+	sessions := make([]Session, 0, len(ids))
+	for _, id := range ids {
+		var val map[string]string
+		val, err = s.rds.HGetAll(ctx, s.getRedisKey(session, id)).Result()
+		if err != nil {
+			return []Session{}, fmt.Errorf("[ListSessions] internal error: %w", err)
+		}
+
+		// the session expired or was revoked by reuse detection
+		if len(val) == 0 {
+			if err = s.rds.SRem(ctx, setKey, id).Err(); err != nil {
+				return []Session{}, fmt.Errorf("[ListSessions] internal error: %w", err)
+			}
+
+			continue
+		}
+
+		sessions = append(sessions, Session{
+			ID:         id,
+			DeviceName: val["device_name"],
+			IP:         val["ip"],
+			UserAgent:  val["user_agent"],
+			CreatedAt:  parseUnix(val["created_at"]),
+			LastUsedAt: parseUnix(val["last_used_at"]),
+			Current:    id == currentID,
+		})
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+// RevokeSession ends a single session of a user.
+// Its refresh token can no longer be used, and the session disappears from the list.
+func (s service) RevokeSession(ctx context.Context, userID uuid.UUID, sessionID string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	owner, err := s.rds.HGet(ctx, s.getRedisKey(session, sessionID), "user_id").Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return fmt.Errorf("[RevokeSession] internal error: %w", errs.ErrSessionNotFound)
+	case err != nil:
+		return fmt.Errorf("[RevokeSession] internal error: %w", err)
+	case owner != userID.String():
+		return fmt.Errorf("[RevokeSession] internal error: %w", errs.ErrSessionNotFound)
+	}
+
+	if err = s.revokeSessions(ctx, userID.String(), sessionID); err != nil {
+		return fmt.Errorf("[RevokeSession] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// LogoutAll ends every session of a user.
+func (s service) LogoutAll(ctx context.Context, userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.revokeAllSessions(ctx, userID.String(), ""); err != nil {
+		return fmt.Errorf("[LogoutAll] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeOtherSessions ends every session of a user but the current one, such as after a password change.
+func (s service) RevokeOtherSessions(ctx context.Context, userID uuid.UUID, currentID string) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.revokeAllSessions(ctx, userID.String(), currentID); err != nil {
+		return fmt.Errorf("[RevokeOtherSessions] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// createSession starts a new session whose first refresh token is jti.
+// The session is identified by the JWT ID of its first refresh token.
+func (s service) createSession(ctx context.Context, userID, jti string, device DeviceInfo) (string, error) {
+	exp := s.getExpiration(Refresh)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	sessionKey := s.getRedisKey(session, jti)
+	setKey := s.getRedisKey(userSession, userID)
+
+	_, err := s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.getRedisKey(refreshToken, jti), jti, exp)
+		pipe.HSet(ctx, sessionKey,
+			"user_id", userID,
+			"token", jti,
+			"device_name", device.DeviceName,
+			"ip", device.IP,
+			"user_agent", device.UserAgent,
+			"created_at", now,
+			"last_used_at", now,
+		)
+		pipe.Expire(ctx, sessionKey, exp)
+		pipe.SAdd(ctx, setKey, jti)
+		pipe.Expire(ctx, setKey, exp)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return jti, nil
+}
+
+// rotateRefreshToken replaces the current refresh token of a session with a new one and returns the session ID.
+// If the presented token was already rotated out, the whole session is revoked.
+func (s service) rotateRefreshToken(ctx context.Context, jti, newJTI string) (string, error) {
+	sessionID, err := s.rds.Get(ctx, s.getRedisKey(refreshToken, jti)).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return "", errs.ErrInvalidRefreshToken
+	case err != nil:
+		return "", fmt.Errorf("[rotateRefreshToken] internal error: %w", err)
+	}
+
+	sessionKey := s.getRedisKey(session, sessionID)
+
+	userID, err := s.rds.HGet(ctx, sessionKey, "user_id").Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return "", errs.ErrInvalidRefreshToken
+	case err != nil:
+		return "", fmt.Errorf("[rotateRefreshToken] internal error: %w", err)
+	}
+
+	exp := s.getExpiration(Refresh)
+
+	res, err := rotateRefreshTokenScript.Run(
+		ctx,
+		s.rds,
+		[]string{sessionKey, s.getRedisKey(userSession, userID)},
+		jti, newJTI, exp.Milliseconds(), time.Now().Unix(), sessionID,
+	).Int()
+	if err != nil {
+		return "", fmt.Errorf("[rotateRefreshToken] internal error: %w", err)
+	}
+
+	switch res {
+	case sessionNotFound:
+		return "", errs.ErrInvalidRefreshToken
+	case sessionReused:
+		s.logger.Warnf("refresh token %s of session %s was reused, session revoked", jti, sessionID)
+		return "", errs.ErrInvalidRefreshToken
+	}
+
+	if err = s.rds.Set(ctx, s.getRedisKey(refreshToken, newJTI), sessionID, exp).Err(); err != nil {
+		return "", fmt.Errorf("[rotateRefreshToken] internal error: %w", err)
+	}
+
+	return sessionID, nil
+}
+
+// revokeSessions deletes the given sessions of a user.
+func (s service) revokeSessions(ctx context.Context, userID string, sessionIDs ...string) error {
+	if len(sessionIDs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(sessionIDs))
+	members := make([]interface{}, 0, len(sessionIDs))
+	for _, id := range sessionIDs {
+		keys = append(keys, s.getRedisKey(session, id))
+		members = append(members, id)
+	}
+
+	_, err := s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, keys...)
+		pipe.SRem(ctx, s.getRedisKey(userSession, userID), members...)
+		return nil
+	})
+
+	return err
+}
+
+// revokeAllSessions deletes every session of a user except the one with exceptID.
+func (s service) revokeAllSessions(ctx context.Context, userID, exceptID string) error {
+	ids, err := s.rds.SMembers(ctx, s.getRedisKey(userSession, userID)).Result()
+	if err != nil {
+		return err
+	}
+
+	revoked := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != exceptID {
+			revoked = append(revoked, id)
+		}
+	}
+
+	return s.revokeSessions(ctx, userID, revoked...)
+}
+
+func parseUnix(val string) time.Time {
+	sec, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(sec, 0).UTC()
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/hinccvi/go-ddd/internal/config"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/log"
+)
+
+type (
+	// SMSSender delivers text messages to a phone number.
+	SMSSender interface {
+		Send(ctx context.Context, phone, message string) error
+	}
+
+	logSMSSender struct {
+		logger log.Logger
+	}
+
+	// http request struct.
+	SendSMSCodeRequest struct {
+		Phone string `json:"phone" validate:"required,e164"`
+	}
+
+	SMSLoginRequest struct {
+		Phone string `json:"phone" validate:"required,e164"`
+		Code  string `json:"code" validate:"required,numeric"`
+		DeviceInfo
+	}
+)
+
+const (
+	smsLimitExpiration = 24 * time.Hour
+	smsDateFormat      = "20060102"
+	smsDigits          = 10
+)
+
+// NewLogSMSSender creates a SMSSender that writes messages to the log instead of delivering them.
+// It is intended for local development only.
+func NewLogSMSSender(logger log.Logger) SMSSender {
+	return logSMSSender{logger}
+}
+
+func (l logSMSSender) Send(_ context.Context, phone, message string) error {
+	l.logger.Infof("sms to %s: %s", phone, message)
+
+	return nil
+}
+
+// SendSMSCode issues a one-time password to the phone number of a registered user.
+// The response is the same whether the phone number is registered or not.
+func (s service) SendSMSCode(ctx context.Context, req SendSMSCodeRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.checkSMSCooldown(ctx, req.Phone); err != nil {
+		return fmt.Errorf("[SendSMSCode] internal error: %w", err)
+	}
+
+	if err := s.checkSMSLimit(ctx, req.Phone); err != nil {
+		return fmt.Errorf("[SendSMSCode] internal error: %w", err)
+	}
+
+	_, err := s.repo.GetUserByPhone(ctx, req.Phone)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return fmt.Errorf("[SendSMSCode] internal error: %w", err)
+	}
+
+	code, err := generateSMSCode(s.cfg.SMS.CodeLength)
+	if err != nil {
+		return fmt.Errorf("[SendSMSCode] internal error: %w", err)
+	}
+
+	expiration := time.Duration(s.cfg.SMS.CodeExpiration) * time.Minute
+
+	_, err = s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, s.getRedisKey(smsCode, req.Phone), code, expiration)
+		pipe.Del(ctx, s.getRedisKey(smsAttempt, req.Phone))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("[SendSMSCode] internal error: %w", err)
+	}
+
+	msg := fmt.Sprintf("[%s] Your verification code is %s. It expires in %d minutes.",
+		s.cfg.App.Name, code, s.cfg.SMS.CodeExpiration)
+	if err = s.sms.Send(ctx, req.Phone, msg); err != nil {
+		return fmt.Errorf("[SendSMSCode] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// SMSLogin verifies a one-time password and generates a JWT token pair if it matches, or a challenge token
+// if the user has 2FA enabled. The code is discarded once it is used or too many incorrect attempts were made.
+func (s service) SMSLogin(ctx context.Context, req SMSLoginRequest) (loginResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.verifySMSCode(ctx, req.Phone, req.Code); err != nil {
+		return loginResponse{}, fmt.Errorf("[SMSLogin] internal error: %w", err)
+	}
+
+	user, err := s.repo.GetUserByPhone(ctx, req.Phone)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return loginResponse{}, fmt.Errorf("[SMSLogin] internal error: %w", errs.ErrInvalidSMSCode)
+	case err != nil:
+		return loginResponse{}, fmt.Errorf("[SMSLogin] internal error: %w", err)
+	}
+
+	// a code replaces the password only, the rest of the login rules still apply
+	if err = s.checkLockout(ctx, user.ID.String()); err != nil {
+		return loginResponse{}, fmt.Errorf("[SMSLogin] internal error: %w", err)
+	}
+
+	if s.cfg.EmailVerification.Requires(config.VerifyEmailForLogin) && !user.EmailVerified() {
+		return loginResponse{}, fmt.Errorf("[SMSLogin] internal error: %w", errs.ErrEmailNotVerified)
+	}
+
+	res, err := s.completeLogin(ctx, user, req.DeviceInfo)
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[SMSLogin] internal error: %w", err)
+	}
+
+	return res, nil
+}
+
+// checkSMSCooldown reserves the cooldown window of a phone number.
+// It fails if a code was already sent within the window.
+func (s service) checkSMSCooldown(ctx context.Context, phone string) error {
+	key := s.getRedisKey(smsCooldown, phone)
+
+	ok, err := s.rds.SetNX(ctx, key, 1, time.Duration(s.cfg.SMS.Cooldown)*time.Second).Result()
+	if err != nil {
+		return fmt.Errorf("[checkSMSCooldown] internal error: %w", err)
+	}
+
+	if !ok {
+		return errs.ErrSMSCooldown
+	}
+
+	return nil
+}
+
+// checkSMSLimit counts the codes sent to a phone number today.
+func (s service) checkSMSLimit(ctx context.Context, phone string) error {
+	key := s.getRedisKey(smsLimit, fmt.Sprintf("%s:%s", phone, time.Now().UTC().Format(smsDateFormat)))
+
+	val, err := s.rds.Incr(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("[checkSMSLimit] internal error: %w", err)
+	}
+
+	if val == 1 {
+		if err = s.rds.Expire(ctx, key, smsLimitExpiration).Err(); err != nil {
+			return fmt.Errorf("[checkSMSLimit] internal error: %w", err)
+		}
+	}
+
+	if val > int64(s.cfg.SMS.DailyLimit) {
+		return errs.ErrSMSLimit
+	}
+
+	return nil
+}
+
+func (s service) verifySMSCode(ctx context.Context, phone, code string) error {
+	codeKey := s.getRedisKey(smsCode, phone)
+	attemptKey := s.getRedisKey(smsAttempt, phone)
+
+	val, err := s.rds.Get(ctx, codeKey).Result()
+	switch {
+	case errors.Is(err, redis.Nil):
+		return errs.ErrInvalidSMSCode
+	case err != nil:
+		return fmt.Errorf("[verifySMSCode] internal error: %w", err)
+	}
+
+	attempt, err := s.rds.Incr(ctx, attemptKey).Result()
+	if err != nil {
+		return fmt.Errorf("[verifySMSCode] internal error: %w", err)
+	}
+
+	if attempt == 1 {
+		expiration := time.Duration(s.cfg.SMS.CodeExpiration) * time.Minute
+		if err = s.rds.Expire(ctx, attemptKey, expiration).Err(); err != nil {
+			return fmt.Errorf("[verifySMSCode] internal error: %w", err)
+		}
+	}
+
+	if attempt > int64(s.cfg.SMS.MaxAttempt) {
+		if err = s.rds.Del(ctx, codeKey, attemptKey).Err(); err != nil {
+			return fmt.Errorf("[verifySMSCode] internal error: %w", err)
+		}
+
+		return errs.ErrMaxAttempt
+	}
+
+	if subtle.ConstantTimeCompare([]byte(val), []byte(code)) != 1 {
+		return errs.ErrInvalidSMSCode
+	}
+
+	return s.rds.Del(ctx, codeKey, attemptKey).Err()
+}
+
+// generateSMSCode generates a random numeric code of the given length.
+func generateSMSCode(length int) (string, error) {
+	var b strings.Builder
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(smsDigits))
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString(n.String())
+	}
+
+	return b.String(), nil
+}
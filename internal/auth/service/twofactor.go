@@ -0,0 +1,372 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/totp"
+	"github.com/hinccvi/go-ddd/tools"
+)
+
+type (
+	// TwoFactorEnrollment is what an authenticator app needs to enroll a TOTP secret.
+	// QRCode is a PNG image of URI.
+	TwoFactorEnrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+		QRCode []byte `json:"qr_png"`
+	}
+
+	// http request struct.
+	ConfirmTwoFactorRequest struct {
+		Code string `json:"code" validate:"required,numeric,len=6"`
+	}
+
+	VerifyTwoFactorRequest struct {
+		ChallengeToken string `json:"challenge_token" validate:"required"`
+		Code           string `json:"code" validate:"required,max=20"`
+	}
+
+	// http response struct.
+	recoveryCodesResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+)
+
+const (
+	challengeTokenSize   = 32
+	recoveryCodeSize     = 5
+	recoveryCodeHalf     = 4
+	challengeAttemptsKey = "attempts"
+	// totpSecretPrefix marks an encrypted TOTP secret. Secrets stored before they were encrypted are base32
+	// and cannot start with it.
+	totpSecretPrefix = "enc:"
+)
+
+// EnrollTwoFactor generates a new TOTP secret for a user. 2FA is not enabled until
+// ConfirmTwoFactor receives a code generated from the secret.
+func (s service) EnrollTwoFactor(ctx context.Context, userID uuid.UUID) (TwoFactorEnrollment, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	user, err := s.repo.GetUserTOTP(ctx, userID)
+	if err != nil {
+		return TwoFactorEnrollment{}, fmt.Errorf("[EnrollTwoFactor] internal error: %w", err)
+	}
+
+	if user.TOTPEnabledAt.Valid {
+		return TwoFactorEnrollment{}, fmt.Errorf("[EnrollTwoFactor] internal error: %w", errs.ErrTwoFactorEnabled)
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return TwoFactorEnrollment{}, fmt.Errorf("[EnrollTwoFactor] internal error: %w", err)
+	}
+
+	sealed, err := s.sealTOTPSecret(secret)
+	if err != nil {
+		return TwoFactorEnrollment{}, fmt.Errorf("[EnrollTwoFactor] internal error: %w", err)
+	}
+
+	err = s.repo.SetTOTPSecret(ctx, userID, sealed)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return TwoFactorEnrollment{}, fmt.Errorf("[EnrollTwoFactor] internal error: %w", errs.ErrTwoFactorEnabled)
+	case err != nil:
+		return TwoFactorEnrollment{}, fmt.Errorf("[EnrollTwoFactor] internal error: %w", err)
+	}
+
+	uri := totp.URI(s.twoFactorIssuer(), user.Username, secret)
+
+	png, err := totp.QRCode(uri)
+	if err != nil {
+		return TwoFactorEnrollment{}, fmt.Errorf("[EnrollTwoFactor] internal error: %w", err)
+	}
+
+	return TwoFactorEnrollment{secret, uri, png}, nil
+}
+
+// ConfirmTwoFactor enables 2FA once the user proves the authenticator app was set up
+// and returns single-use recovery codes. The codes are only stored hashed and cannot be shown again.
+func (s service) ConfirmTwoFactor(
+	ctx context.Context,
+	userID uuid.UUID,
+	req ConfirmTwoFactorRequest,
+) (recoveryCodesResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	user, err := s.repo.GetUserTOTP(ctx, userID)
+	if err != nil {
+		return recoveryCodesResponse{}, fmt.Errorf("[ConfirmTwoFactor] internal error: %w", err)
+	}
+
+	switch {
+	case user.TOTPEnabledAt.Valid:
+		return recoveryCodesResponse{}, fmt.Errorf("[ConfirmTwoFactor] internal error: %w", errs.ErrTwoFactorEnabled)
+	case !user.TOTPSecret.Valid:
+		return recoveryCodesResponse{}, fmt.Errorf("[ConfirmTwoFactor] internal error: %w", errs.ErrTwoFactorNotEnrolled)
+	}
+
+	if err = s.verifyTOTP(ctx, user, req.Code); err != nil {
+		return recoveryCodesResponse{}, fmt.Errorf("[ConfirmTwoFactor] internal error: %w", err)
+	}
+
+	codes := make([]string, s.cfg.TwoFactor.RecoveryCodes)
+	hashes := make([]string, len(codes))
+	for i := range codes {
+		if codes[i], err = generateRecoveryCode(); err != nil {
+			return recoveryCodesResponse{}, fmt.Errorf("[ConfirmTwoFactor] internal error: %w", err)
+		}
+
+		if hashes[i], err = s.hashRecoveryCode(codes[i]); err != nil {
+			return recoveryCodesResponse{}, fmt.Errorf("[ConfirmTwoFactor] internal error: %w", err)
+		}
+	}
+
+	err = s.repo.EnableTOTP(ctx, userID, hashes)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return recoveryCodesResponse{}, fmt.Errorf("[ConfirmTwoFactor] internal error: %w", errs.ErrTwoFactorNotEnrolled)
+	case err != nil:
+		return recoveryCodesResponse{}, fmt.Errorf("[ConfirmTwoFactor] internal error: %w", err)
+	}
+
+	return recoveryCodesResponse{codes}, nil
+}
+
+// VerifyTwoFactor completes a login of a user with 2FA enabled. It exchanges the challenge token
+// returned by Login and a TOTP or recovery code for a JWT token pair.
+func (s service) VerifyTwoFactor(ctx context.Context, req VerifyTwoFactorRequest) (loginResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	key := s.getRedisKey(twoFactorChallenge, req.ChallengeToken)
+
+	challenge, err := s.rds.HGetAll(ctx, key).Result()
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", err)
+	}
+
+	if len(challenge) == 0 {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", errs.ErrInvalidChallenge)
+	}
+
+	userID, err := uuid.Parse(challenge["user_id"])
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", errs.ErrInvalidChallenge)
+	}
+
+	id := userID.String()
+
+	// incorrect codes count toward the lockout of the user, as a new challenge is only a password away
+	if err = s.checkLockout(ctx, id); err != nil {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", err)
+	}
+
+	attempt, err := s.rds.HIncrBy(ctx, key, challengeAttemptsKey, 1).Result()
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", err)
+	}
+
+	if attempt > int64(s.cfg.TwoFactor.MaxAttempt) {
+		if err = s.rds.Del(ctx, key).Err(); err != nil {
+			return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", err)
+		}
+
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", errs.ErrMaxAttempt)
+	}
+
+	user, err := s.repo.GetUserTOTP(ctx, userID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", errs.ErrInvalidChallenge)
+	case err != nil:
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", err)
+	}
+
+	if isTOTPCode(req.Code) {
+		err = s.verifyTOTP(ctx, user, req.Code)
+	} else {
+		err = s.useRecoveryCode(ctx, user.ID, req.Code)
+	}
+	if errors.Is(err, errs.ErrInvalidTwoFactorCode) {
+		if lockErr := s.recordFailedLogin(ctx, id); lockErr != nil {
+			return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", lockErr)
+		}
+	}
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", err)
+	}
+
+	// the challenge is single-use, whoever deletes it first completes the login
+	n, err := s.rds.Del(ctx, key).Result()
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", err)
+	}
+
+	if n == 0 {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", errs.ErrInvalidChallenge)
+	}
+
+	if err = s.clearFailedLogins(ctx, id); err != nil {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", err)
+	}
+
+	res, err := s.issueTokens(ctx, user, DeviceInfo{
+		DeviceName: challenge["device_name"],
+		IP:         challenge["ip"],
+		UserAgent:  challenge["user_agent"],
+	})
+	if err != nil {
+		return loginResponse{}, fmt.Errorf("[VerifyTwoFactor] internal error: %w", err)
+	}
+
+	return res, nil
+}
+
+// createChallenge stores the pending login of a user with 2FA enabled and returns its token.
+func (s service) createChallenge(ctx context.Context, user entity.User, device DeviceInfo) (string, error) {
+	b := make([]byte, challengeTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	key := s.getRedisKey(twoFactorChallenge, token)
+
+	_, err := s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"user_id", user.ID.String(),
+			"device_name", device.DeviceName,
+			"ip", device.IP,
+			"user_agent", device.UserAgent,
+		)
+		pipe.Expire(ctx, key, time.Duration(s.cfg.TwoFactor.ChallengeExpiration)*time.Minute)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// verifyTOTP checks a TOTP code against the secret of a user.
+// A code is accepted only once, even though it stays valid for the whole time step.
+func (s service) verifyTOTP(ctx context.Context, user entity.User, code string) error {
+	skew := int64(s.cfg.TwoFactor.Skew)
+
+	secret, err := s.openTOTPSecret(user.TOTPSecret.String)
+	if err != nil {
+		return fmt.Errorf("[verifyTOTP] internal error: %w", err)
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now(), skew)
+	if !ok {
+		return errs.ErrInvalidTwoFactorCode
+	}
+
+	key := s.getRedisKey(totpUsed, fmt.Sprintf("%s:%s", user.ID, strconv.FormatInt(step, 10)))
+
+	ok, err = s.rds.SetNX(ctx, key, 1, time.Duration(2*skew+1)*totp.Period).Result()
+	if err != nil {
+		return fmt.Errorf("[verifyTOTP] internal error: %w", err)
+	}
+
+	if !ok {
+		return errs.ErrInvalidTwoFactorCode
+	}
+
+	return nil
+}
+
+// sealTOTPSecret encrypts a TOTP secret to be stored.
+func (s service) sealTOTPSecret(secret string) (string, error) {
+	sealed, err := tools.Encrypt(s.cfg.TwoFactor.EncryptionKey, secret)
+	if err != nil {
+		return "", err
+	}
+
+	return totpSecretPrefix + sealed, nil
+}
+
+// openTOTPSecret decrypts a stored TOTP secret. Secrets stored before they were encrypted are returned as is.
+func (s service) openTOTPSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, totpSecretPrefix) {
+		return stored, nil
+	}
+
+	return tools.Decrypt(s.cfg.TwoFactor.EncryptionKey, strings.TrimPrefix(stored, totpSecretPrefix))
+}
+
+// hashRecoveryCode keys the digest of a recovery code with the encryption key,
+// so the short codes can't be brute forced from a leaked database.
+func (s service) hashRecoveryCode(code string) (string, error) {
+	return tools.HMACSHA256(s.cfg.TwoFactor.EncryptionKey, normalizeRecoveryCode(code))
+}
+
+func (s service) useRecoveryCode(ctx context.Context, userID uuid.UUID, code string) error {
+	hash, err := s.hashRecoveryCode(code)
+	if err != nil {
+		return fmt.Errorf("[useRecoveryCode] internal error: %w", err)
+	}
+
+	ok, err := s.repo.UseRecoveryCode(ctx, userID, hash)
+	if err != nil {
+		return fmt.Errorf("[useRecoveryCode] internal error: %w", err)
+	}
+
+	if !ok {
+		return errs.ErrInvalidTwoFactorCode
+	}
+
+	return nil
+}
+
+func (s service) twoFactorIssuer() string {
+	if s.cfg.TwoFactor.Issuer != "" {
+		return s.cfg.TwoFactor.Issuer
+	}
+
+	return s.cfg.App.Name
+}
+
+// generateRecoveryCode generates a random recovery code formatted as XXXX-XXXX.
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, recoveryCodeSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	code := base32.StdEncoding.EncodeToString(b)
+
+	return code[:recoveryCodeHalf] + "-" + code[recoveryCodeHalf:], nil
+}
+
+// normalizeRecoveryCode makes recovery codes case and separator insensitive.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totp.Digits {
+		return false
+	}
+
+	_, err := strconv.Atoi(code)
+
+	return err == nil
+}
@@ -15,10 +15,12 @@ type Config struct {
 	} `mapstructure:"context"`
 
 	Jwt struct {
-		AccessSigningKey  string `mapstructure:"access_signing_key"`
-		AccessExpiration  int    `mapstructure:"access_expiration"`
-		RefreshSigningKey string `mapstructure:"refresh_signing_key"`
-		RefreshExpiration int    `mapstructure:"refresh_expiration"`
+		AccessSigningKey  string   `mapstructure:"access_signing_key"`
+		AccessExpiration  int      `mapstructure:"access_expiration"`
+		RefreshSigningKey string   `mapstructure:"refresh_signing_key"`
+		RefreshExpiration int      `mapstructure:"refresh_expiration"`
+		ActiveKeyID       string   `mapstructure:"active_kid"`
+		Keys              []JwtKey `mapstructure:"keys"`
 	} `mapstructure:"jwt"`
 
 	Dsn string `mapstructure:"dsn"`
@@ -30,6 +32,118 @@ type Config struct {
 		DB       int    `mapstructure:"db"`
 		PoolSize int    `mapstructure:"pool_size"`
 	} `mapstructure:"redis"`
+
+	SMS struct {
+		CodeLength     int `mapstructure:"code_length"`
+		CodeExpiration int `mapstructure:"code_expiration"`
+		Cooldown       int `mapstructure:"cooldown"`
+		DailyLimit     int `mapstructure:"daily_limit"`
+		MaxAttempt     int `mapstructure:"max_attempt"`
+	} `mapstructure:"sms"`
+
+	Lockout struct {
+		Threshold   int  `mapstructure:"threshold"`
+		Window      int  `mapstructure:"window"`
+		Duration    int  `mapstructure:"duration"`
+		Progressive bool `mapstructure:"progressive"`
+		MaxDuration int  `mapstructure:"max_duration"`
+	} `mapstructure:"lockout"`
+
+	RateLimit map[string]RateLimitRule `mapstructure:"rate_limit"`
+
+	// TrustedProxies are the IP ranges of the proxies in front of the server. The client IP is taken from
+	// X-Forwarded-For only if the request came through them, otherwise it is the address of the peer.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+
+	TwoFactor struct {
+		Issuer              string `mapstructure:"issuer"`
+		ChallengeExpiration int    `mapstructure:"challenge_expiration"`
+		MaxAttempt          int    `mapstructure:"max_attempt"`
+		Skew                int    `mapstructure:"skew"`
+		RecoveryCodes       int    `mapstructure:"recovery_codes"`
+		// EncryptionKey is the base64 encoded 256 bit key TOTP secrets are encrypted with.
+		EncryptionKey string `mapstructure:"encryption_key"`
+	} `mapstructure:"two_factor"`
+
+	Mail struct {
+		Host     string `mapstructure:"host"`
+		Port     int    `mapstructure:"port"`
+		Username string `mapstructure:"username"`
+		Password string `mapstructure:"password"`
+		From     string `mapstructure:"from"`
+	} `mapstructure:"mail"`
+
+	PasswordReset struct {
+		TokenExpiration int    `mapstructure:"token_expiration"`
+		Cooldown        int    `mapstructure:"cooldown"`
+		URL             string `mapstructure:"url"`
+	} `mapstructure:"password_reset"`
+
+	OIDC struct {
+		StateExpiration int                     `mapstructure:"state_expiration"`
+		Providers       map[string]OIDCProvider `mapstructure:"providers"`
+	} `mapstructure:"oidc"`
+
+	OAuth struct {
+		CodeExpiration int `mapstructure:"code_expiration"`
+	} `mapstructure:"oauth"`
+
+	WebAuthn struct {
+		RPID                string   `mapstructure:"rp_id"`
+		RPName              string   `mapstructure:"rp_name"`
+		Origins             []string `mapstructure:"origins"`
+		ChallengeExpiration int      `mapstructure:"challenge_expiration"`
+	} `mapstructure:"webauthn"`
+
+	PasswordPolicy PasswordPolicy `mapstructure:"password_policy"`
+
+	PasswordHash struct {
+		Algorithm string `mapstructure:"algorithm"`
+		Argon2id  struct {
+			Memory      uint32 `mapstructure:"memory"`
+			Iterations  uint32 `mapstructure:"iterations"`
+			Parallelism uint8  `mapstructure:"parallelism"`
+		} `mapstructure:"argon2id"`
+		Bcrypt struct {
+			Cost int `mapstructure:"cost"`
+		} `mapstructure:"bcrypt"`
+	} `mapstructure:"password_hash"`
+
+	EmailVerification EmailVerification `mapstructure:"email_verification"`
+
+	BlobStore struct {
+		Driver string `mapstructure:"driver"`
+		Path   string `mapstructure:"path"`
+		S3     struct {
+			Endpoint  string `mapstructure:"endpoint"`
+			Region    string `mapstructure:"region"`
+			Bucket    string `mapstructure:"bucket"`
+			AccessKey string `mapstructure:"access_key"`
+			SecretKey string `mapstructure:"secret_key"`
+		} `mapstructure:"s3"`
+	} `mapstructure:"blob_store"`
+
+	Avatar struct {
+		MaxSize       int `mapstructure:"max_size"`
+		MaxDimension  int `mapstructure:"max_dimension"`
+		ThumbnailSize int `mapstructure:"thumbnail_size"`
+	} `mapstructure:"avatar"`
+
+	SoftDelete SoftDelete `mapstructure:"soft_delete"`
+}
+
+// JwtKey is an asymmetric access token signing key. The private key file may be omitted
+// for keys that were rotated out and are only kept for verification.
+type JwtKey struct {
+	ID             string `mapstructure:"kid"`
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+	PublicKeyFile  string `mapstructure:"public_key_file"`
+}
+
+// RateLimitRule is the request budget of a route group per client IP. Window is in seconds.
+type RateLimitRule struct {
+	Limit  int `mapstructure:"limit"`
+	Window int `mapstructure:"window"`
 }
 
 func Load(env string) (Config, error) {
@@ -53,3 +167,60 @@ func Load(env string) (Config, error) {
 
 	return *conf, nil
 }
+
+// OIDCProvider is an OpenID Connect provider users can sign in with.
+// Providers without a client ID are disabled.
+type OIDCProvider struct {
+	Issuer       string   `mapstructure:"issuer"`
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	RedirectURL  string   `mapstructure:"redirect_url"`
+	Scopes       []string `mapstructure:"scopes"`
+}
+
+// PasswordPolicy are the rules passwords chosen by users must follow. BreachedPath is a directory
+// of breached password hash ranges, the breach check is skipped if it is empty.
+type PasswordPolicy struct {
+	MinLength        int    `mapstructure:"min_length"`
+	RequireUpper     bool   `mapstructure:"require_upper"`
+	RequireLower     bool   `mapstructure:"require_lower"`
+	RequireDigit     bool   `mapstructure:"require_digit"`
+	RequireSymbol    bool   `mapstructure:"require_symbol"`
+	DisallowUsername bool   `mapstructure:"disallow_username"`
+	BreachedPath     string `mapstructure:"breached_path"`
+}
+
+// SoftDelete configures how long deleted users can be restored. Users deleted more than Retention days
+// ago are purged every PurgeInterval minutes, PurgeBatch at a time. A Retention of 0 keeps them forever.
+type SoftDelete struct {
+	Retention     int `mapstructure:"retention"`
+	PurgeInterval int `mapstructure:"purge_interval"`
+	PurgeBatch    int `mapstructure:"purge_batch"`
+}
+
+// Actions users can be required to verify their email address for.
+const (
+	VerifyEmailForLogin  = "login"
+	VerifyEmailForAPIKey = "api_key"
+)
+
+// EmailVerification configures the tokens that verify the email address of users. TokenExpiration is in
+// minutes and Cooldown, the time between two verification emails a user requests, in seconds.
+// RequiredFor lists the actions that are blocked until a user verified their email.
+type EmailVerification struct {
+	TokenExpiration int      `mapstructure:"token_expiration"`
+	Cooldown        int      `mapstructure:"cooldown"`
+	URL             string   `mapstructure:"url"`
+	RequiredFor     []string `mapstructure:"required_for"`
+}
+
+// Requires reports whether users must verify their email address for an action.
+func (v EmailVerification) Requires(action string) bool {
+	for _, a := range v.RequiredFor {
+		if a == action {
+			return true
+		}
+	}
+
+	return false
+}
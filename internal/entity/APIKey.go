@@ -0,0 +1,34 @@
+package entity
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIKey is a long-lived credential a user creates for machine access.
+// Only the prefix and a hash of the key are stored, the key itself is shown once when it is created.
+// Scopes are permission names stored space separated, the key grants no permission outside of them.
+type APIKey struct {
+	ID         uuid.UUID    `db:"id" json:"id"`
+	UserID     uuid.UUID    `db:"user_id" json:"user_id"`
+	Name       string       `db:"name" json:"name"`
+	Prefix     string       `db:"prefix" json:"prefix"`
+	KeyHash    string       `db:"key_hash" json:"-"`
+	Scopes     string       `db:"scopes" json:"scopes"`
+	ExpiresAt  time.Time    `db:"expires_at" json:"expires_at"`
+	LastUsedAt sql.NullTime `db:"last_used_at" json:"last_used_at"`
+	CreatedAt  time.Time    `db:"created_at" json:"created_at"`
+}
+
+// ScopeList returns the scopes of the key.
+func (k APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// Expired reports whether the key is expired at t.
+func (k APIKey) Expired(t time.Time) bool {
+	return !t.Before(k.ExpiresAt)
+}
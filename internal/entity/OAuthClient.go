@@ -0,0 +1,54 @@
+package entity
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OAuthClient is an application registered to obtain tokens from the OAuth2 endpoints.
+// Clients without a secret are public clients, which may only use the authorization code grant with PKCE.
+// Redirect URIs, grant types and scopes are stored space separated, like OAuth2 scope strings.
+type OAuthClient struct {
+	ID           uuid.UUID      `db:"id" json:"id"`
+	ClientID     string         `db:"client_id" json:"client_id"`
+	SecretHash   sql.NullString `db:"secret_hash" json:"-"`
+	Name         string         `db:"name" json:"name"`
+	RedirectURIs string         `db:"redirect_uris" json:"redirect_uris"`
+	GrantTypes   string         `db:"grant_types" json:"grant_types"`
+	Scopes       string         `db:"scopes" json:"scopes"`
+	CreatedAt    time.Time      `db:"created_at" json:"created_at"`
+	DeletedAt    sql.NullTime   `db:"deleted_at" json:"deleted_at"`
+}
+
+// Confidential reports whether the client authenticates with a secret.
+func (c OAuthClient) Confidential() bool {
+	return c.SecretHash.Valid
+}
+
+// HasRedirectURI reports whether uri is registered for the client. URIs must match exactly.
+func (c OAuthClient) HasRedirectURI(uri string) bool {
+	return containsField(c.RedirectURIs, uri)
+}
+
+// AllowsGrant reports whether the client may use a grant type.
+func (c OAuthClient) AllowsGrant(grantType string) bool {
+	return containsField(c.GrantTypes, grantType)
+}
+
+// AllowedScopes returns the scopes the client may request.
+func (c OAuthClient) AllowedScopes() []string {
+	return strings.Fields(c.Scopes)
+}
+
+func containsField(list, value string) bool {
+	for _, f := range strings.Fields(list) {
+		if f == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,28 @@
+package entity
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Passkey is a WebAuthn credential a user registered to log in without a password.
+// PublicKey is COSE encoded and Transports are stored space separated as hints for the browser.
+type Passkey struct {
+	ID           uuid.UUID    `db:"id" json:"id"`
+	UserID       uuid.UUID    `db:"user_id" json:"user_id"`
+	Name         string       `db:"name" json:"name"`
+	CredentialID []byte       `db:"credential_id" json:"-"`
+	PublicKey    []byte       `db:"public_key" json:"-"`
+	SignCount    int64        `db:"sign_count" json:"-"`
+	Transports   string       `db:"transports" json:"transports"`
+	LastUsedAt   sql.NullTime `db:"last_used_at" json:"last_used_at"`
+	CreatedAt    time.Time    `db:"created_at" json:"created_at"`
+}
+
+// TransportList returns the transports of the passkey.
+func (p Passkey) TransportList() []string {
+	return strings.Fields(p.Transports)
+}
@@ -0,0 +1,18 @@
+package entity
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserIdentity links a user to the subject of an external OpenID Connect provider.
+type UserIdentity struct {
+	ID        uuid.UUID      `db:"id" json:"id"`
+	UserID    uuid.UUID      `db:"user_id" json:"user_id"`
+	Provider  string         `db:"provider" json:"provider"`
+	Subject   string         `db:"subject" json:"subject"`
+	Email     sql.NullString `db:"email" json:"email"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+}
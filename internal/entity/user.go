@@ -8,10 +8,31 @@ import (
 )
 
 type User struct {
-	ID        uuid.UUID    `db:"id" json:"id"`
-	Username  string       `db:"username" json:"username"`
-	Password  string       `db:"password" json:"password"`
-	CreatedAt time.Time    `db:"created_at" json:"created_at"`
-	UpdatedAt time.Time    `db:"updated_at" json:"updated_at"`
-	DeletedAt sql.NullTime `db:"deleted_at" json:"deleted_at"`
+	ID        uuid.UUID      `db:"id" json:"id"`
+	Username  string         `db:"username" json:"username"`
+	Password  string         `db:"password" json:"password"`
+	Phone     sql.NullString `db:"phone" json:"phone"`
+	Email     sql.NullString `db:"email" json:"email"`
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time      `db:"updated_at" json:"updated_at"`
+	DeletedAt sql.NullTime   `db:"deleted_at" json:"deleted_at"`
+
+	// Version counts the updates of the user, it is sent as the ETag of the user.
+	Version int64 `db:"version" json:"-"`
+
+	EmailVerifiedAt sql.NullTime `db:"email_verified_at" json:"email_verified_at"`
+
+	DisplayName sql.NullString `db:"display_name" json:"display_name"`
+	Bio         sql.NullString `db:"bio" json:"bio"`
+	Locale      sql.NullString `db:"locale" json:"locale"`
+	Timezone    sql.NullString `db:"timezone" json:"timezone"`
+	AvatarKey   sql.NullString `db:"avatar_key" json:"-"`
+
+	TOTPSecret    sql.NullString `db:"totp_secret" json:"-"`
+	TOTPEnabledAt sql.NullTime   `db:"totp_enabled_at" json:"-"`
+}
+
+// EmailVerified reports whether the user has an email address and verified it.
+func (u User) EmailVerified() bool {
+	return u.Email.Valid && u.EmailVerifiedAt.Valid
 }
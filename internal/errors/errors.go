@@ -4,27 +4,106 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+
+	"github.com/hinccvi/go-ddd/pkg/password"
+	"github.com/hinccvi/go-ddd/tools"
 )
 
 var (
-	ErrMaxAttempt          = errors.New("max attempt reached")
-	ErrInvalidCredentials  = errors.New("incorrect username or password")
-	ErrConditionNotFulfil  = errors.New("condition not fulfil")
-	ErrInvalidRefreshToken = errors.New("invalid refresh token")
-	ErrInvalidJwt          = errors.New("invalid token")
-	ErrEmptyField          = errors.New("empty field")
-	ErrNoRows              = sql.ErrNoRows
-	ErrSystemError         = errors.New("system error")
+	ErrMaxAttempt           = errors.New("max attempt reached")
+	ErrInvalidCredentials   = errors.New("incorrect username or password")
+	ErrConditionNotFulfil   = errors.New("condition not fulfil")
+	ErrInvalidRefreshToken  = errors.New("invalid refresh token")
+	ErrInvalidJwt           = errors.New("invalid token")
+	ErrMissingJwt           = errors.New("missing or malformed jwt")
+	ErrEmptyField           = errors.New("empty field")
+	ErrNoRows               = sql.ErrNoRows
+	ErrSystemError          = errors.New("system error")
+	ErrSMSCooldown          = errors.New("sms code requested too frequently")
+	ErrSMSLimit             = errors.New("sms daily limit reached")
+	ErrInvalidSMSCode       = errors.New("invalid sms code")
+	ErrSessionNotFound      = errors.New("session not found")
+	ErrForbidden            = errors.New("permission denied")
+	ErrAccountNotLocked     = errors.New("account not locked")
+	ErrTooManyRequests      = errors.New("too many requests")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication already enabled")
+	ErrTwoFactorNotEnrolled = errors.New("two-factor authentication not enrolled")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+	ErrInvalidChallenge     = errors.New("invalid or expired challenge")
+	ErrInvalidResetToken    = errors.New("invalid or expired reset token")
+	ErrUnknownProvider      = errors.New("unknown identity provider")
+	ErrInvalidOIDCState     = errors.New("invalid or expired login state")
+	ErrOIDCLogin            = errors.New("external login failed")
+	ErrOIDCAccountExists    = errors.New("an account with this email already exists, sign in with its password")
+	ErrInvalidAPIKey        = errors.New("invalid or expired api key")
+	ErrAPIKeyNotFound       = errors.New("api key not found")
+	ErrInvalidPasskey       = errors.New("passkey verification failed")
+	ErrPasskeyNotFound      = errors.New("passkey not found")
+	ErrPasskeyExists        = errors.New("passkey already registered")
+	ErrPasswordPolicy       = password.ErrPolicy
+	ErrPasswordTooLong      = tools.ErrPasswordTooLong
+	ErrEmailNotVerified     = errors.New("email not verified")
+	ErrEmailVerified        = errors.New("email already verified")
+	ErrInvalidEmailToken    = errors.New("invalid or expired verification token")
+	ErrNoEmail              = errors.New("no email address")
+	ErrWrongPassword        = errors.New("incorrect current password")
+	ErrInvalidImage         = tools.ErrInvalidImage
+	ErrImageTooLarge        = tools.ErrImageTooLarge
+	ErrAvatarNotFound       = errors.New("avatar not found")
+	ErrInvalidCursor        = errors.New("invalid cursor")
+	ErrRestoreConflict      = errors.New("an active user has the same username, email or phone")
+	ErrUsernameTaken        = errors.New("username already taken")
+	ErrEmailTaken           = errors.New("email already in use")
+	ErrPreconditionFailed   = tools.ErrPreconditionFailed
+	ErrPasswordChange       = errors.New("password must be changed with the current password at /v1/me/password")
 )
 
 func GetStatusCodeMap() map[error]int {
 	return map[error]int{
-		ErrInvalidCredentials:  http.StatusBadRequest,
-		ErrConditionNotFulfil:  http.StatusBadRequest,
-		ErrNoRows:              http.StatusBadRequest,
-		ErrInvalidRefreshToken: http.StatusForbidden,
-		ErrInvalidJwt:          http.StatusForbidden,
-		ErrSystemError:         http.StatusInternalServerError,
-		ErrMaxAttempt:          http.StatusBadRequest,
+		ErrInvalidCredentials:   http.StatusBadRequest,
+		ErrConditionNotFulfil:   http.StatusBadRequest,
+		ErrNoRows:               http.StatusBadRequest,
+		ErrInvalidRefreshToken:  http.StatusForbidden,
+		ErrInvalidJwt:           http.StatusForbidden,
+		ErrMissingJwt:           http.StatusBadRequest,
+		ErrSystemError:          http.StatusInternalServerError,
+		ErrMaxAttempt:           http.StatusBadRequest,
+		ErrSMSCooldown:          http.StatusTooManyRequests,
+		ErrSMSLimit:             http.StatusTooManyRequests,
+		ErrInvalidSMSCode:       http.StatusBadRequest,
+		ErrSessionNotFound:      http.StatusNotFound,
+		ErrForbidden:            http.StatusForbidden,
+		ErrAccountNotLocked:     http.StatusNotFound,
+		ErrTooManyRequests:      http.StatusTooManyRequests,
+		ErrTwoFactorEnabled:     http.StatusConflict,
+		ErrTwoFactorNotEnrolled: http.StatusBadRequest,
+		ErrInvalidTwoFactorCode: http.StatusBadRequest,
+		ErrInvalidChallenge:     http.StatusForbidden,
+		ErrInvalidResetToken:    http.StatusBadRequest,
+		ErrUnknownProvider:      http.StatusNotFound,
+		ErrInvalidOIDCState:     http.StatusForbidden,
+		ErrOIDCLogin:            http.StatusBadRequest,
+		ErrOIDCAccountExists:    http.StatusConflict,
+		ErrInvalidAPIKey:        http.StatusForbidden,
+		ErrAPIKeyNotFound:       http.StatusNotFound,
+		ErrInvalidPasskey:       http.StatusForbidden,
+		ErrPasskeyNotFound:      http.StatusNotFound,
+		ErrPasskeyExists:        http.StatusConflict,
+		ErrPasswordPolicy:       http.StatusBadRequest,
+		ErrPasswordTooLong:      http.StatusBadRequest,
+		ErrEmailNotVerified:     http.StatusForbidden,
+		ErrEmailVerified:        http.StatusConflict,
+		ErrInvalidEmailToken:    http.StatusBadRequest,
+		ErrNoEmail:              http.StatusBadRequest,
+		ErrWrongPassword:        http.StatusBadRequest,
+		ErrInvalidImage:         http.StatusUnsupportedMediaType,
+		ErrImageTooLarge:        http.StatusRequestEntityTooLarge,
+		ErrAvatarNotFound:       http.StatusNotFound,
+		ErrInvalidCursor:        http.StatusBadRequest,
+		ErrRestoreConflict:      http.StatusConflict,
+		ErrUsernameTaken:        http.StatusConflict,
+		ErrEmailTaken:           http.StatusConflict,
+		ErrPreconditionFailed:   http.StatusPreconditionFailed,
+		ErrPasswordChange:       http.StatusBadRequest,
 	}
 }
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// Principal is the authenticated identity of a request.
+	Principal interface {
+		GetSubject() string
+		GetRoles() []string
+	}
+
+	// ScopedPrincipal is a Principal restricted to a subset of the permissions of its roles, such as an API key.
+	ScopedPrincipal interface {
+		Principal
+		HasScope(permission string) bool
+	}
+
+	// SessionPrincipal is a Principal that logged in interactively, such as the access token of a login session.
+	SessionPrincipal interface {
+		Principal
+		GetSessionID() string
+	}
+
+	// TokenVerifier validates a bearer token and returns the identity it encodes.
+	TokenVerifier func(ctx context.Context, token string) (Principal, error)
+
+	// APIKeyVerifier validates an API key and returns the identity of its owner.
+	APIKeyVerifier func(ctx context.Context, key string) (Principal, error)
+)
+
+const (
+	// ContextKeyPrincipal is the echo context key the authenticated Principal is stored under.
+	ContextKeyPrincipal = "principal"
+
+	// HeaderAPIKey is the request header AuthWithAPIKey reads API keys from.
+	HeaderAPIKey = "X-API-Key"
+
+	bearerScheme = "Bearer"
+	bearerFormat = 2
+)
+
+// Auth authenticates requests by the bearer token in the Authorization header.
+// Requests without a token are rejected with ErrMissingJwt, and requests whose token
+// is rejected by verify fail with the error it returns.
+func Auth(verify TokenVerifier) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token, err := bearerToken(c)
+			if err != nil {
+				return err
+			}
+
+			principal, err := verify(c.Request().Context(), token)
+			if err != nil {
+				return err
+			}
+
+			c.Set(ContextKeyPrincipal, principal)
+
+			return next(c)
+		}
+	}
+}
+
+// AuthWithAPIKey authenticates requests like Auth, and accepts an API key in the X-API-Key header
+// instead of a bearer token. The key takes precedence if a request carries both.
+func AuthWithAPIKey(verify TokenVerifier, verifyKey APIKeyVerifier) echo.MiddlewareFunc {
+	bearer := Auth(verify)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withBearer := bearer(next)
+
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(HeaderAPIKey)
+			if key == "" {
+				return withBearer(c)
+			}
+
+			principal, err := verifyKey(c.Request().Context(), key)
+			if err != nil {
+				return err
+			}
+
+			c.Set(ContextKeyPrincipal, principal)
+
+			return next(c)
+		}
+	}
+}
+
+// GetPrincipal returns the Principal stored by Auth.
+func GetPrincipal(c echo.Context) (Principal, bool) {
+	principal, ok := c.Get(ContextKeyPrincipal).(Principal)
+	return principal, ok
+}
+
+func bearerToken(c echo.Context) (string, error) {
+	auth := strings.Split(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+	if len(auth) != bearerFormat || auth[0] != bearerScheme || auth[1] == "" {
+		return "", errs.ErrMissingJwt
+	}
+
+	return auth[1], nil
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type principal struct {
+	subject string
+	roles   []string
+}
+
+func (p principal) GetSubject() string { return p.subject }
+
+func (p principal) GetRoles() []string { return p.roles }
+
+func verifyToken(_ context.Context, token string) (Principal, error) {
+	if token != "valid" {
+		return nil, errs.ErrInvalidJwt
+	}
+
+	return principal{subject: "token-user"}, nil
+}
+
+func request(h echo.HandlerFunc, header http.Header) (echo.Context, error) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for k, v := range header {
+		req.Header.Set(k, v[0])
+	}
+
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	return c, h(c)
+}
+
+func TestAuth(t *testing.T) {
+	h := Auth(verifyToken)(ok)
+
+	tests := []struct {
+		name   string
+		header string
+		want   error
+	}{
+		{name: "fail: missing header", header: "", want: errs.ErrMissingJwt},
+		{name: "fail: non-bearer scheme", header: "Basic dXNlcjpwYXNz", want: errs.ErrMissingJwt},
+		{name: "fail: empty token", header: "Bearer ", want: errs.ErrMissingJwt},
+		{name: "fail: extra fields", header: "Bearer valid extra", want: errs.ErrMissingJwt},
+		{name: "fail: verifier error", header: "Bearer invalid", want: errs.ErrInvalidJwt},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := request(h, http.Header{echo.HeaderAuthorization: {tc.header}})
+			assert.ErrorIs(t, err, tc.want)
+
+			_, found := GetPrincipal(c)
+			assert.False(t, found)
+		})
+	}
+
+	t.Run("success: principal stored", func(t *testing.T) {
+		c, err := request(h, http.Header{echo.HeaderAuthorization: {"Bearer valid"}})
+		assert.NoError(t, err)
+
+		p, found := GetPrincipal(c)
+		assert.True(t, found)
+		assert.Equal(t, "token-user", p.GetSubject())
+	})
+}
+
+func TestAuthWithAPIKey(t *testing.T) {
+	verifyKey := func(_ context.Context, key string) (Principal, error) {
+		if key != "valid" {
+			return nil, errs.ErrInvalidAPIKey
+		}
+
+		return principal{subject: "key-user"}, nil
+	}
+	h := AuthWithAPIKey(verifyToken, verifyKey)(ok)
+
+	t.Run("success: bearer token without key", func(t *testing.T) {
+		c, err := request(h, http.Header{echo.HeaderAuthorization: {"Bearer valid"}})
+		assert.NoError(t, err)
+
+		p, _ := GetPrincipal(c)
+		assert.Equal(t, "token-user", p.GetSubject())
+	})
+
+	t.Run("success: key takes precedence", func(t *testing.T) {
+		c, err := request(h, http.Header{echo.HeaderAuthorization: {"Bearer valid"}, HeaderAPIKey: {"valid"}})
+		assert.NoError(t, err)
+
+		p, _ := GetPrincipal(c)
+		assert.Equal(t, "key-user", p.GetSubject())
+	})
+
+	t.Run("fail: invalid key with valid bearer token", func(t *testing.T) {
+		c, err := request(h, http.Header{echo.HeaderAuthorization: {"Bearer valid"}, HeaderAPIKey: {"invalid"}})
+		assert.ErrorIs(t, err, errs.ErrInvalidAPIKey)
+
+		_, found := GetPrincipal(c)
+		assert.False(t, found)
+	})
+
+	t.Run("fail: neither key nor bearer token", func(t *testing.T) {
+		_, err := request(h, http.Header{})
+		assert.ErrorIs(t, err, errs.ErrMissingJwt)
+	})
+}
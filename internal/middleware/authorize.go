@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"context"
+
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// PermissionChecker reports whether any of the given roles grants a permission.
+	PermissionChecker func(ctx context.Context, roles []string, permission string) (bool, error)
+
+	// Authorizer checks the permissions of the Principal stored by Auth.
+	Authorizer struct {
+		check PermissionChecker
+	}
+)
+
+// NewAuthorizer creates an Authorizer that resolves permissions with check.
+func NewAuthorizer(check PermissionChecker) Authorizer {
+	return Authorizer{check}
+}
+
+// Require rejects requests whose Principal lacks permission with ErrForbidden.
+// It must be registered after Auth.
+func (a Authorizer) Require(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ok, err := a.Can(c, permission)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				return errs.ErrForbidden
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// Can reports whether the Principal of a request has permission.
+// It is meant for handlers whose access rules depend on the request, such as acting on one's own account.
+// A ScopedPrincipal only has the permissions of its roles that are in its scope.
+func (a Authorizer) Can(c echo.Context, permission string) (bool, error) {
+	principal, ok := GetPrincipal(c)
+	if !ok {
+		return false, errs.ErrMissingJwt
+	}
+
+	if scoped, ok := principal.(ScopedPrincipal); ok && !scoped.HasScope(permission) {
+		return false, nil
+	}
+
+	return a.check(c.Request().Context(), principal.GetRoles(), permission)
+}
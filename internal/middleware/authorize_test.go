@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+type scopedPrincipal struct {
+	principal
+	scopes []string
+}
+
+func (p scopedPrincipal) HasScope(permission string) bool {
+	for _, scope := range p.scopes {
+		if scope == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// adminOnly grants every permission to the admin role.
+func adminOnly(_ context.Context, roles []string, _ string) (bool, error) {
+	for _, role := range roles {
+		if role == "admin" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func withPrincipal(p Principal) echo.Context {
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+	if p != nil {
+		c.Set(ContextKeyPrincipal, p)
+	}
+
+	return c
+}
+
+func TestAuthorizerCan(t *testing.T) {
+	a := NewAuthorizer(adminOnly)
+	admin := principal{subject: "admin", roles: []string{"admin"}}
+
+	t.Run("success: role grants permission", func(t *testing.T) {
+		can, err := a.Can(withPrincipal(admin), "user:list")
+		assert.NoError(t, err)
+		assert.True(t, can)
+	})
+
+	t.Run("success: role lacks permission", func(t *testing.T) {
+		can, err := a.Can(withPrincipal(principal{subject: "user"}), "user:list")
+		assert.NoError(t, err)
+		assert.False(t, can)
+	})
+
+	t.Run("success: scope narrows role", func(t *testing.T) {
+		c := withPrincipal(scopedPrincipal{principal: admin, scopes: []string{"user:list"}})
+
+		can, err := a.Can(c, "user:list")
+		assert.NoError(t, err)
+		assert.True(t, can)
+
+		can, err = a.Can(c, "user:delete")
+		assert.NoError(t, err)
+		assert.False(t, can)
+	})
+
+	t.Run("success: scope does not widen role", func(t *testing.T) {
+		c := withPrincipal(scopedPrincipal{principal: principal{subject: "user"}, scopes: []string{"user:list"}})
+
+		can, err := a.Can(c, "user:list")
+		assert.NoError(t, err)
+		assert.False(t, can)
+	})
+
+	t.Run("fail: missing principal", func(t *testing.T) {
+		_, err := a.Can(withPrincipal(nil), "user:list")
+		assert.ErrorIs(t, err, errs.ErrMissingJwt)
+	})
+
+	t.Run("fail: checker error", func(t *testing.T) {
+		checkErr := errors.New("checker error")
+		a := NewAuthorizer(func(context.Context, []string, string) (bool, error) { return false, checkErr })
+
+		_, err := a.Can(withPrincipal(admin), "user:list")
+		assert.ErrorIs(t, err, checkErr)
+	})
+}
+
+func TestAuthorizerRequire(t *testing.T) {
+	h := NewAuthorizer(adminOnly).Require("user:delete")(ok)
+
+	t.Run("success: permitted", func(t *testing.T) {
+		assert.NoError(t, h(withPrincipal(principal{subject: "admin", roles: []string{"admin"}})))
+	})
+
+	t.Run("fail: out of scope", func(t *testing.T) {
+		p := scopedPrincipal{principal: principal{subject: "admin", roles: []string{"admin"}}, scopes: []string{"user:list"}}
+		assert.ErrorIs(t, h(withPrincipal(p)), errs.ErrForbidden)
+	})
+}
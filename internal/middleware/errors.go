@@ -9,9 +9,18 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-type HTTPErrorHandler struct {
-	statusCodes map[error]int
-}
+type (
+	HTTPErrorHandler struct {
+		statusCodes map[error]int
+	}
+
+	// DetailedError is an error carrying details the client needs to fix its request,
+	// like every rule a field does not follow. The details are sent along with the message.
+	DetailedError interface {
+		error
+		Details() interface{}
+	}
+)
 
 func NewHTTPErrorHandler(errorStatusCodeMaps map[error]int) *HTTPErrorHandler {
 	return &HTTPErrorHandler{
@@ -31,6 +40,12 @@ func (eh *HTTPErrorHandler) GetStatusCode(err error) int {
 
 func (eh *HTTPErrorHandler) Handler(logger log.Logger) func(err error, c echo.Context) {
 	return func(err error, c echo.Context) {
+		var details interface{}
+		var de DetailedError
+		if errors.As(err, &de) {
+			details = de.Details()
+		}
+
 		var he *echo.HTTPError
 		if errors.As(err, &he) {
 			if he.Internal != nil {
@@ -61,8 +76,9 @@ func (eh *HTTPErrorHandler) Handler(logger log.Logger) func(err error, c echo.Co
 				err = c.NoContent(he.Code)
 			} else {
 				err = tools.JSONRespErr(c, code, struct {
-					Error string `json:"error"`
-				}{message})
+					Error   string      `json:"error"`
+					Details interface{} `json:"details,omitempty"`
+				}{message, details})
 			}
 
 			if err != nil {
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// RateLimiter throttles requests per client IP with a sliding window log kept in Redis,
+	// so that limits hold across replicas. If Redis cannot be reached, each replica falls back
+	// to limiting in memory until it is back.
+	RateLimiter struct {
+		rds      redis.Client
+		prefix   string
+		logger   log.Logger
+		fallback *memoryLimiter
+	}
+
+	rateLimitResult struct {
+		allowed   bool
+		remaining int
+		reset     time.Duration
+	}
+
+	memoryLimiter struct {
+		mu        sync.Mutex
+		windows   map[string]*memoryWindow
+		lastSweep time.Time
+	}
+
+	memoryWindow struct {
+		hits   []time.Time
+		window time.Duration
+	}
+)
+
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+
+	memorySweepInterval = time.Minute
+)
+
+// slidingWindowScript records a hit in the window of KEYS[1] if the limit allows it.
+// ARGV: now in ms, window in ms, limit, unique member for the hit.
+// It returns whether the hit was allowed, the hits in the window and the ms until the oldest hit leaves it.
+//
+//nolint:gochecknoglobals // compiled script shared by all limiters
+var slidingWindowScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	redis.call("PEXPIRE", KEYS[1], window)
+	count = count + 1
+	allowed = 1
+end
+local reset = window
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+return {allowed, count, reset}
+`)
+
+// NewRateLimiter creates a RateLimiter whose Redis keys start with prefix.
+func NewRateLimiter(rds redis.Client, prefix string, logger log.Logger) *RateLimiter {
+	return &RateLimiter{
+		rds:      rds,
+		prefix:   prefix,
+		logger:   logger,
+		fallback: &memoryLimiter{windows: make(map[string]*memoryWindow)},
+	}
+}
+
+// Limit allows each client IP at most limit requests per window on the routes it is registered on.
+// Routes sharing a name share their budget. Rejected requests fail with ErrTooManyRequests.
+// A limit of zero or less disables the limiter.
+func (rl *RateLimiter) Limit(name string, limit int, window time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if limit <= 0 || window <= 0 {
+			return next
+		}
+
+		return func(c echo.Context) error {
+			key := fmt.Sprintf("%s:rate_limit:%s:%s", rl.prefix, name, c.RealIP())
+
+			res, err := rl.take(c.Request().Context(), key, limit, window)
+			if err != nil {
+				rl.logger.Warnf("rate limiter falling back to memory: %v", err)
+				res = rl.fallback.take(key, limit, window, time.Now())
+			}
+
+			reset := strconv.Itoa(int(math.Ceil(res.reset.Seconds())))
+
+			h := c.Response().Header()
+			h.Set(HeaderRateLimitLimit, strconv.Itoa(limit))
+			h.Set(HeaderRateLimitRemaining, strconv.Itoa(res.remaining))
+			h.Set(HeaderRateLimitReset, reset)
+
+			if !res.allowed {
+				h.Set(echo.HeaderRetryAfter, reset)
+				return errs.ErrTooManyRequests
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// IPExtractor returns how the client IP of a request is determined. Without trusted proxies it is the
+// address of the peer, since any client can send X-Forwarded-For. Otherwise it is the rightmost address
+// of X-Forwarded-For that is not one of the proxies.
+func IPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range trustedProxies {
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("[IPExtractor] internal error: %w", err)
+		}
+
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+func (rl *RateLimiter) take(ctx context.Context, key string, limit int, window time.Duration) (rateLimitResult, error) {
+	val, err := slidingWindowScript.Run(
+		ctx,
+		rl.rds,
+		[]string{key},
+		time.Now().UnixMilli(), window.Milliseconds(), limit, uuid.NewString(),
+	).Int64Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+
+	return rateLimitResult{
+		allowed:   val[0] == 1,
+		remaining: limit - int(val[1]),
+		reset:     time.Duration(val[2]) * time.Millisecond,
+	}, nil
+}
+
+// take applies the same sliding window log as slidingWindowScript to the hits kept in memory.
+func (ml *memoryLimiter) take(key string, limit int, window time.Duration, now time.Time) rateLimitResult {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if now.Sub(ml.lastSweep) > memorySweepInterval {
+		ml.sweep(now)
+	}
+
+	w, ok := ml.windows[key]
+	if !ok {
+		w = &memoryWindow{window: window}
+		ml.windows[key] = w
+	}
+
+	for len(w.hits) > 0 && !w.hits[0].After(now.Add(-window)) {
+		w.hits = w.hits[1:]
+	}
+
+	allowed := len(w.hits) < limit
+	if allowed {
+		w.hits = append(w.hits, now)
+	}
+
+	return rateLimitResult{
+		allowed:   allowed,
+		remaining: limit - len(w.hits),
+		reset:     w.hits[0].Add(window).Sub(now),
+	}
+}
+
+// sweep drops the windows whose last hit has left them, so idle clients do not pile up.
+func (ml *memoryLimiter) sweep(now time.Time) {
+	for key, w := range ml.windows {
+		if len(w.hits) == 0 || !w.hits[len(w.hits)-1].After(now.Add(-w.window)) {
+			delete(ml.windows, key)
+		}
+	}
+
+	ml.lastSweep = now
+}
@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v9"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRateLimiter(t *testing.T) (*RateLimiter, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	return NewRateLimiter(*redis.NewClient(&redis.Options{Addr: mr.Addr()}), "test", logger), mr
+}
+
+func hit(h echo.HandlerFunc, ip string) (*httptest.ResponseRecorder, error) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = ip + ":1234"
+	rec := httptest.NewRecorder()
+
+	return rec, h(echo.New().NewContext(req, rec))
+}
+
+func ok(c echo.Context) error {
+	return c.NoContent(http.StatusOK)
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl, mr := newRateLimiter(t)
+	h := rl.Limit("test", 2, time.Minute)(ok)
+
+	t.Run("success: within limit", func(t *testing.T) {
+		for _, remaining := range []string{"1", "0"} {
+			rec, err := hit(h, "192.0.2.1")
+			assert.NoError(t, err)
+			assert.Equal(t, "2", rec.Header().Get(HeaderRateLimitLimit))
+			assert.Equal(t, remaining, rec.Header().Get(HeaderRateLimitRemaining))
+			assert.Equal(t, "60", rec.Header().Get(HeaderRateLimitReset))
+			assert.Empty(t, rec.Header().Get(echo.HeaderRetryAfter))
+		}
+	})
+
+	t.Run("fail: limit reached", func(t *testing.T) {
+		rec, err := hit(h, "192.0.2.1")
+		assert.ErrorIs(t, err, errs.ErrTooManyRequests)
+		assert.Equal(t, "0", rec.Header().Get(HeaderRateLimitRemaining))
+		assert.Equal(t, rec.Header().Get(HeaderRateLimitReset), rec.Header().Get(echo.HeaderRetryAfter))
+		assert.NotEmpty(t, rec.Header().Get(echo.HeaderRetryAfter))
+	})
+
+	t.Run("success: other client", func(t *testing.T) {
+		_, err := hit(h, "192.0.2.2")
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: shared by name", func(t *testing.T) {
+		_, err := hit(rl.Limit("test", 2, time.Minute)(ok), "192.0.2.2")
+		assert.NoError(t, err)
+
+		_, err = hit(h, "192.0.2.2")
+		assert.ErrorIs(t, err, errs.ErrTooManyRequests)
+	})
+
+	t.Run("success: window slides", func(t *testing.T) {
+		h := rl.Limit("slide", 1, 100*time.Millisecond)(ok)
+
+		_, err := hit(h, "192.0.2.1")
+		assert.NoError(t, err)
+
+		_, err = hit(h, "192.0.2.1")
+		assert.ErrorIs(t, err, errs.ErrTooManyRequests)
+
+		time.Sleep(150 * time.Millisecond)
+
+		_, err = hit(h, "192.0.2.1")
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: disabled", func(t *testing.T) {
+		h := rl.Limit("disabled", 0, time.Minute)(ok)
+
+		for i := 0; i < 3; i++ {
+			rec, err := hit(h, "192.0.2.1")
+			assert.NoError(t, err)
+			assert.Empty(t, rec.Header().Get(HeaderRateLimitLimit))
+		}
+	})
+
+	t.Run("success: memory fallback", func(t *testing.T) {
+		mr.Close()
+		h := rl.Limit("fallback", 1, time.Minute)(ok)
+
+		rec, err := hit(h, "192.0.2.1")
+		assert.NoError(t, err)
+		assert.Equal(t, "0", rec.Header().Get(HeaderRateLimitRemaining))
+
+		rec, err = hit(h, "192.0.2.1")
+		assert.ErrorIs(t, err, errs.ErrTooManyRequests)
+		assert.Equal(t, "60", rec.Header().Get(echo.HeaderRetryAfter))
+
+		_, err = hit(h, "192.0.2.2")
+		assert.NoError(t, err)
+	})
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	ml := &memoryLimiter{windows: make(map[string]*memoryWindow)}
+	now := time.Now()
+
+	res := ml.take("key", 2, 10*time.Second, now)
+	assert.Equal(t, rateLimitResult{allowed: true, remaining: 1, reset: 10 * time.Second}, res)
+
+	res = ml.take("key", 2, 10*time.Second, now.Add(time.Second))
+	assert.Equal(t, rateLimitResult{allowed: true, remaining: 0, reset: 9 * time.Second}, res)
+
+	res = ml.take("key", 2, 10*time.Second, now.Add(2*time.Second))
+	assert.Equal(t, rateLimitResult{allowed: false, remaining: 0, reset: 8 * time.Second}, res)
+
+	// the first hit left the window, the second is still in it
+	res = ml.take("key", 2, 10*time.Second, now.Add(10*time.Second))
+	assert.Equal(t, rateLimitResult{allowed: true, remaining: 0, reset: time.Second}, res)
+
+	// idle windows are swept
+	ml.take("other", 2, 10*time.Second, now.Add(2*memorySweepInterval))
+	assert.Len(t, ml.windows, 1)
+}
+
+func TestIPExtractor(t *testing.T) {
+	request := func(remoteAddr, forwardedFor string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr + ":1234"
+		req.Header.Set(echo.HeaderXForwardedFor, forwardedFor)
+		req.Header.Set(echo.HeaderXRealIP, forwardedFor)
+
+		return req
+	}
+
+	t.Run("success: no trusted proxies", func(t *testing.T) {
+		extract, err := IPExtractor(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "192.0.2.1", extract(request("192.0.2.1", "203.0.113.7")))
+	})
+
+	t.Run("success: trusted proxy", func(t *testing.T) {
+		extract, err := IPExtractor([]string{"10.0.0.0/8"})
+		assert.NoError(t, err)
+		assert.Equal(t, "203.0.113.7", extract(request("10.0.0.1", "203.0.113.7")))
+		assert.Equal(t, "203.0.113.7", extract(request("10.0.0.1", "198.51.100.9, 203.0.113.7, 10.0.0.2")))
+	})
+
+	t.Run("success: untrusted peer", func(t *testing.T) {
+		extract, err := IPExtractor([]string{"10.0.0.0/8"})
+		assert.NoError(t, err)
+		assert.Equal(t, "192.0.2.1", extract(request("192.0.2.1", "203.0.113.7")))
+	})
+
+	t.Run("fail: invalid range", func(t *testing.T) {
+		_, err := IPExtractor([]string{"10.0.0.1"})
+		assert.Error(t, err)
+	})
+}
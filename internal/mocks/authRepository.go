@@ -5,6 +5,8 @@ package mocks
 import (
 	context "context"
 
+	uuid "github.com/google/uuid"
+
 	entity "github.com/hinccvi/go-ddd/internal/entity"
 	mock "github.com/stretchr/testify/mock"
 )
@@ -14,20 +16,427 @@ type AuthRepository struct {
 	mock.Mock
 }
 
-// GetUserByUsername provides a mock function with given fields: ctx, username
-func (_m *AuthRepository) GetUserByUsername(ctx context.Context, username string) (entity.User, error) {
-	ret := _m.Called(ctx, username)
+// CreateIdentity provides a mock function with given fields: ctx, identity
+func (_m *AuthRepository) CreateIdentity(ctx context.Context, identity entity.UserIdentity) error {
+	ret := _m.Called(ctx, identity)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, entity.UserIdentity) error); ok {
+		r0 = rf(ctx, identity)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// CreateOAuthClient provides a mock function with given fields: ctx, client
+func (_m *AuthRepository) CreateOAuthClient(ctx context.Context, client entity.OAuthClient) error {
+	ret := _m.Called(ctx, client)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, entity.OAuthClient) error); ok {
+		r0 = rf(ctx, client)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// CreatePasskey provides a mock function with given fields: ctx, passkey
+func (_m *AuthRepository) CreatePasskey(ctx context.Context, passkey entity.Passkey) error {
+	ret := _m.Called(ctx, passkey)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, entity.Passkey) error); ok {
+		r0 = rf(ctx, passkey)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// CreateUserWithIdentity provides a mock function with given fields: ctx, user, identity
+func (_m *AuthRepository) CreateUserWithIdentity(ctx context.Context, user entity.User, identity entity.UserIdentity) (uuid.UUID, error) {
+	ret := _m.Called(ctx, user, identity)
+
+	var r0 uuid.UUID
+	if rf, ok := ret.Get(0).(func(context.Context, entity.User, entity.UserIdentity) uuid.UUID); ok {
+		r0 = rf(ctx, user, identity)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(uuid.UUID)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, entity.User, entity.UserIdentity) error); ok {
+		r1 = rf(ctx, user, identity)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// DeletePasskey provides a mock function with given fields: ctx, userID, id
+func (_m *AuthRepository) DeletePasskey(ctx context.Context, userID uuid.UUID, id uuid.UUID) error {
+	ret := _m.Called(ctx, userID, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, uuid.UUID) error); ok {
+		r0 = rf(ctx, userID, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// EnableTOTP provides a mock function with given fields: ctx, id, recoveryCodeHashes
+func (_m *AuthRepository) EnableTOTP(ctx context.Context, id uuid.UUID, recoveryCodeHashes []string) error {
+	ret := _m.Called(ctx, id, recoveryCodeHashes)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, []string) error); ok {
+		r0 = rf(ctx, id, recoveryCodeHashes)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetAPIKeyByPrefix provides a mock function with given fields: ctx, prefix
+func (_m *AuthRepository) GetAPIKeyByPrefix(ctx context.Context, prefix string) (entity.APIKey, error) {
+	ret := _m.Called(ctx, prefix)
+
+	var r0 entity.APIKey
+	if rf, ok := ret.Get(0).(func(context.Context, string) entity.APIKey); ok {
+		r0 = rf(ctx, prefix)
+	} else {
+		r0 = ret.Get(0).(entity.APIKey)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, prefix)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetOAuthClient provides a mock function with given fields: ctx, clientID
+func (_m *AuthRepository) GetOAuthClient(ctx context.Context, clientID string) (entity.OAuthClient, error) {
+	ret := _m.Called(ctx, clientID)
+
+	var r0 entity.OAuthClient
+	if rf, ok := ret.Get(0).(func(context.Context, string) entity.OAuthClient); ok {
+		r0 = rf(ctx, clientID)
+	} else {
+		r0 = ret.Get(0).(entity.OAuthClient)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, clientID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetPasskeyByCredentialID provides a mock function with given fields: ctx, credentialID
+func (_m *AuthRepository) GetPasskeyByCredentialID(ctx context.Context, credentialID []byte) (entity.Passkey, error) {
+	ret := _m.Called(ctx, credentialID)
+
+	var r0 entity.Passkey
+	if rf, ok := ret.Get(0).(func(context.Context, []byte) entity.Passkey); ok {
+		r0 = rf(ctx, credentialID)
+	} else {
+		r0 = ret.Get(0).(entity.Passkey)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []byte) error); ok {
+		r1 = rf(ctx, credentialID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetRolePermissions provides a mock function with given fields: ctx, roles
+func (_m *AuthRepository) GetRolePermissions(ctx context.Context, roles []string) ([]string, error) {
+	ret := _m.Called(ctx, roles)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context, []string) []string); ok {
+		r0 = rf(ctx, roles)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, []string) error); ok {
+		r1 = rf(ctx, roles)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetUser provides a mock function with given fields: ctx, id
+func (_m *AuthRepository) GetUser(ctx context.Context, id uuid.UUID) (entity.User, error) {
+	ret := _m.Called(ctx, id)
+
+	var r0 entity.User
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) entity.User); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Get(0).(entity.User)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID) error); ok {
+		r1 = rf(ctx, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetUserByEmail provides a mock function with given fields: ctx, email
+func (_m *AuthRepository) GetUserByEmail(ctx context.Context, email string) (entity.User, error) {
+	ret := _m.Called(ctx, email)
 
 	var r0 entity.User
 	if rf, ok := ret.Get(0).(func(context.Context, string) entity.User); ok {
-		r0 = rf(ctx, username)
+		r0 = rf(ctx, email)
 	} else {
 		r0 = ret.Get(0).(entity.User)
 	}
 
 	var r1 error
 	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
-		r1 = rf(ctx, username)
+		r1 = rf(ctx, email)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetUserByIdentity provides a mock function with given fields: ctx, provider, subject
+func (_m *AuthRepository) GetUserByIdentity(ctx context.Context, provider string, subject string) (entity.User, error) {
+	ret := _m.Called(ctx, provider, subject)
+
+	var r0 entity.User
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) entity.User); ok {
+		r0 = rf(ctx, provider, subject)
+	} else {
+		r0 = ret.Get(0).(entity.User)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, provider, subject)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetUserByLogin provides a mock function with given fields: ctx, login
+func (_m *AuthRepository) GetUserByLogin(ctx context.Context, login string) (entity.User, error) {
+	ret := _m.Called(ctx, login)
+
+	var r0 entity.User
+	if rf, ok := ret.Get(0).(func(context.Context, string) entity.User); ok {
+		r0 = rf(ctx, login)
+	} else {
+		r0 = ret.Get(0).(entity.User)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, login)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetUserByPhone provides a mock function with given fields: ctx, phone
+func (_m *AuthRepository) GetUserByPhone(ctx context.Context, phone string) (entity.User, error) {
+	ret := _m.Called(ctx, phone)
+
+	var r0 entity.User
+	if rf, ok := ret.Get(0).(func(context.Context, string) entity.User); ok {
+		r0 = rf(ctx, phone)
+	} else {
+		r0 = ret.Get(0).(entity.User)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, phone)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetUserRoles provides a mock function with given fields: ctx, id
+func (_m *AuthRepository) GetUserRoles(ctx context.Context, id uuid.UUID) ([]string, error) {
+	ret := _m.Called(ctx, id)
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) []string); ok {
+		r0 = rf(ctx, id)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID) error); ok {
+		r1 = rf(ctx, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetUserTOTP provides a mock function with given fields: ctx, id
+func (_m *AuthRepository) GetUserTOTP(ctx context.Context, id uuid.UUID) (entity.User, error) {
+	ret := _m.Called(ctx, id)
+
+	var r0 entity.User
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) entity.User); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Get(0).(entity.User)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID) error); ok {
+		r1 = rf(ctx, id)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListPasskeys provides a mock function with given fields: ctx, userID
+func (_m *AuthRepository) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]entity.Passkey, error) {
+	ret := _m.Called(ctx, userID)
+
+	var r0 []entity.Passkey
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) []entity.Passkey); ok {
+		r0 = rf(ctx, userID)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]entity.Passkey)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID) error); ok {
+		r1 = rf(ctx, userID)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetTOTPSecret provides a mock function with given fields: ctx, id, secret
+func (_m *AuthRepository) SetTOTPSecret(ctx context.Context, id uuid.UUID, secret string) error {
+	ret := _m.Called(ctx, id, secret)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string) error); ok {
+		r0 = rf(ctx, id, secret)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// TouchAPIKey provides a mock function with given fields: ctx, id
+func (_m *AuthRepository) TouchAPIKey(ctx context.Context, id uuid.UUID) error {
+	ret := _m.Called(ctx, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID) error); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdatePasskeySignCount provides a mock function with given fields: ctx, id, signCount
+func (_m *AuthRepository) UpdatePasskeySignCount(ctx context.Context, id uuid.UUID, signCount int64) error {
+	ret := _m.Called(ctx, id, signCount)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, int64) error); ok {
+		r0 = rf(ctx, id, signCount)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UpdatePassword provides a mock function with given fields: ctx, id, password
+func (_m *AuthRepository) UpdatePassword(ctx context.Context, id uuid.UUID, password string) error {
+	ret := _m.Called(ctx, id, password)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string) error); ok {
+		r0 = rf(ctx, id, password)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// UseRecoveryCode provides a mock function with given fields: ctx, id, codeHash
+func (_m *AuthRepository) UseRecoveryCode(ctx context.Context, id uuid.UUID, codeHash string) (bool, error) {
+	ret := _m.Called(ctx, id, codeHash)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(context.Context, uuid.UUID, string) bool); ok {
+		r0 = rf(ctx, id, codeHash)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, uuid.UUID, string) error); ok {
+		r1 = rf(ctx, id, codeHash)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -1,6 +1,7 @@
 package mocks
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"time"
@@ -17,11 +18,52 @@ import (
 
 type (
 	jwtCustomClaims struct {
-		UserName string `json:"username"`
+		UserName  string   `json:"username"`
+		SessionID string   `json:"sid,omitempty"`
+		Roles     []string `json:"roles,omitempty"`
 		jwt.RegisteredClaims
 	}
+
+	// APIKeyPrincipal is the owner of an API key accepted by AuthHandlerWithAPIKeys.
+	APIKeyPrincipal struct {
+		Subject string
+		Roles   []string
+		Scopes  []string
+	}
 )
 
+const signingKey = "secret"
+
+func (c *jwtCustomClaims) GetSubject() string {
+	return c.Subject
+}
+
+func (c *jwtCustomClaims) GetRoles() []string {
+	return c.Roles
+}
+
+func (c *jwtCustomClaims) GetSessionID() string {
+	return c.SessionID
+}
+
+func (p APIKeyPrincipal) GetSubject() string {
+	return p.Subject
+}
+
+func (p APIKeyPrincipal) GetRoles() []string {
+	return p.Roles
+}
+
+func (p APIKeyPrincipal) HasScope(permission string) bool {
+	for _, scope := range p.Scopes {
+		if scope == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Router creates a echo router for testing APIs.
 func Router(logger log.Logger) *echo.Echo {
 	e := echo.New()
@@ -33,43 +75,75 @@ func Router(logger log.Logger) *echo.Echo {
 	return e
 }
 
-// AuthHeader returns an HTTP header that can pass the authentication check by MockAuthHandler.
-func AuthHeader(id, username string) http.Header {
-	issuedAt := time.Now()
-	expiresAt := issuedAt.Add(1 * time.Minute)
-	signingKey := []byte("secret")
+// AuthHandler creates an authentication middleware that accepts the tokens created by Token and AuthHeader.
+func AuthHandler() echo.MiddlewareFunc {
+	return m.Auth(func(_ context.Context, token string) (m.Principal, error) {
+		claims := new(jwtCustomClaims)
+		if _, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+			return []byte(signingKey), nil
+		}); err != nil {
+			return nil, errs.ErrInvalidJwt
+		}
+
+		return claims, nil
+	})
+}
 
-	token := jwt.NewWithClaims(
-		jwt.SigningMethodHS256,
-		jwtCustomClaims{
-			username,
-			jwt.RegisteredClaims{
-				Issuer:    "test",
-				Subject:   id,
-				Audience:  jwt.ClaimStrings{"all"},
-				IssuedAt:  jwt.NewNumericDate(issuedAt),
-				ExpiresAt: jwt.NewNumericDate(expiresAt),
-				ID:        uuid.NewString(),
-			},
+// AuthHandlerWithAPIKeys creates an authentication middleware like AuthHandler that also accepts the given API keys.
+func AuthHandlerWithAPIKeys(keys map[string]APIKeyPrincipal) echo.MiddlewareFunc {
+	return m.AuthWithAPIKey(
+		func(_ context.Context, token string) (m.Principal, error) {
+			claims := new(jwtCustomClaims)
+			if _, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+				return []byte(signingKey), nil
+			}); err != nil {
+				return nil, errs.ErrInvalidJwt
+			}
+
+			return claims, nil
+		},
+		func(_ context.Context, key string) (m.Principal, error) {
+			principal, ok := keys[key]
+			if !ok {
+				return nil, errs.ErrInvalidAPIKey
+			}
+
+			return principal, nil
 		},
 	)
+}
 
-	jwt, _ := token.SignedString(signingKey)
+// Authorizer creates an Authorizer that grants the permissions listed for each role.
+func Authorizer(permissions map[string][]string) m.Authorizer {
+	return m.NewAuthorizer(func(_ context.Context, roles []string, permission string) (bool, error) {
+		for _, role := range roles {
+			for _, p := range permissions[role] {
+				if p == permission {
+					return true, nil
+				}
+			}
+		}
+
+		return false, nil
+	})
+}
 
+// AuthHeader returns an HTTP header that can pass the authentication check by AuthHandler.
+func AuthHeader(id, username string, roles ...string) http.Header {
 	header := http.Header{}
-	header.Add("Authorization", fmt.Sprintf("Bearer %s", jwt))
+	header.Add("Authorization", fmt.Sprintf("Bearer %s", Token(id, username, roles...)))
 	return header
 }
 
-func Token(id, username string) string {
+func Token(id, username string, roles ...string) string {
 	issuedAt := time.Now()
 	expiresAt := issuedAt.Add(1 * time.Minute)
-	signingKey := []byte("secret")
-
 	token := jwt.NewWithClaims(
 		jwt.SigningMethodHS256,
 		jwtCustomClaims{
 			username,
+			uuid.NewString(),
+			roles,
 			jwt.RegisteredClaims{
 				Issuer:    "test",
 				Subject:   id,
@@ -81,7 +155,7 @@ func Token(id, username string) string {
 		},
 	)
 
-	jwt, _ := token.SignedString(signingKey)
+	jwt, _ := token.SignedString([]byte(signingKey))
 
 	return jwt
 }
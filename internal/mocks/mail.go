@@ -0,0 +1,17 @@
+package mocks
+
+import (
+	"context"
+	"errors"
+
+	"github.com/hinccvi/go-ddd/pkg/mail"
+)
+
+var ErrMail = errors.New("error mail")
+
+// FailingMailer is a mailer whose deliveries always fail.
+type FailingMailer struct{}
+
+func (FailingMailer) Send(context.Context, mail.Message) error {
+	return ErrMail
+}
@@ -0,0 +1,203 @@
+package mocks
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+type (
+	// OIDCProvider is a stub OpenID Connect provider serving discovery, JWKS and token endpoints
+	// on a local server. Authorization codes are issued by Authorize instead of a consent page.
+	OIDCProvider struct {
+		Server       *httptest.Server
+		ClientID     string
+		ClientSecret string
+
+		key   *rsa.PrivateKey
+		mu    sync.Mutex
+		codes map[string]oidcGrant
+	}
+
+	// OIDCClaims are the claims of the ID token issued for an authorization code.
+	OIDCClaims struct {
+		Subject       string
+		Email         string
+		EmailVerified bool
+		Name          string
+	}
+
+	oidcGrant struct {
+		claims      OIDCClaims
+		nonce       string
+		challenge   string
+		redirectURI string
+	}
+)
+
+const (
+	OIDCKeyID          = "stub"
+	oidcTokenLifetime  = 5 * time.Minute
+	oidcProviderKeyLen = 2048
+)
+
+var ErrOIDCClient = errors.New("unknown oidc client")
+
+// NewOIDCProvider starts a stub OpenID Connect provider that is closed when the test ends.
+func NewOIDCProvider(t *testing.T) *OIDCProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, oidcProviderKeyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &OIDCProvider{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		key:          key,
+		codes:        make(map[string]oidcGrant),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Server.Close)
+
+	return p
+}
+
+// Issuer returns the issuer URL of the provider.
+func (p *OIDCProvider) Issuer() string {
+	return p.Server.URL
+}
+
+// Authorize plays the consent page: it issues an authorization code for the request encoded in authURL
+// and returns the code with the state to pass back to the client.
+func (p *OIDCProvider) Authorize(authURL string, claims OIDCClaims) (string, string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	q := u.Query()
+	if q.Get("client_id") != p.ClientID {
+		return "", "", ErrOIDCClient
+	}
+
+	code := uuid.NewString()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.codes[code] = oidcGrant{
+		claims:      claims,
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+
+	return code, q.Get("state"), nil
+}
+
+// SignIDToken signs arbitrary claims with the key of the provider.
+func (p *OIDCProvider) SignIDToken(claims jwt.Claims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = OIDCKeyID
+
+	signed, _ := token.SignedString(p.key)
+
+	return signed
+}
+
+func (p *OIDCProvider) discovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer(),
+		"authorization_endpoint":                p.Issuer() + "/authorize",
+		"token_endpoint":                        p.Issuer() + "/token",
+		"jwks_uri":                              p.Issuer() + "/jwks",
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic"},
+	})
+}
+
+func (p *OIDCProvider) jwks(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": OIDCKeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *OIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != p.ClientID || secret != p.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	p.mu.Lock()
+	grant, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok,
+		grant.redirectURI != r.PostForm.Get("redirect_uri"),
+		grant.challenge != base64.RawURLEncoding.EncodeToString(sum[:]):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	idToken := p.SignIDToken(jwt.MapClaims{
+		"iss":            p.Issuer(),
+		"aud":            p.ClientID,
+		"sub":            grant.claims.Subject,
+		"email":          grant.claims.Email,
+		"email_verified": grant.claims.EmailVerified,
+		"name":           grant.claims.Name,
+		"nonce":          grant.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(oidcTokenLifetime).Unix(),
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": uuid.NewString(),
+		"token_type":   "Bearer",
+		"expires_in":   int(oidcTokenLifetime.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
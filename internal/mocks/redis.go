@@ -2,7 +2,6 @@ package mocks
 
 import (
 	"context"
-	"fmt"
 
 	"github.com/go-redis/redis/v9"
 )
@@ -17,7 +16,3 @@ func Redis(host string) (redis.Client, error) {
 
 	return *rds, err
 }
-
-func RefreshTokenKey(field string) string {
-	return fmt.Sprintf("%s:%s:%s", "test", "refresh_token", field)
-}
@@ -0,0 +1,40 @@
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// SessionRevoker records the sessions ended for each user. Kept holds the session that survived
+// RevokeOtherSessions, it is empty after LogoutAll.
+type SessionRevoker struct {
+	mu      sync.Mutex
+	Revoked map[uuid.UUID]int
+	Kept    map[uuid.UUID]string
+}
+
+func (m *SessionRevoker) RevokeOtherSessions(_ context.Context, userID uuid.UUID, currentID string) error {
+	m.record(userID, currentID)
+
+	return nil
+}
+
+func (m *SessionRevoker) LogoutAll(_ context.Context, userID uuid.UUID) error {
+	m.record(userID, "")
+
+	return nil
+}
+
+func (m *SessionRevoker) record(userID uuid.UUID, kept string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Revoked == nil {
+		m.Revoked = make(map[uuid.UUID]int)
+		m.Kept = make(map[uuid.UUID]string)
+	}
+	m.Revoked[userID]++
+	m.Kept[userID] = kept
+}
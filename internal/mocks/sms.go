@@ -0,0 +1,39 @@
+package mocks
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var ErrSMS = errors.New("error sms")
+
+// SMSSender is an in-memory SMS sender that records the last message sent to each phone number.
+type SMSSender struct {
+	mu       sync.Mutex
+	Messages map[string]string
+}
+
+func (m *SMSSender) Send(_ context.Context, phone, message string) error {
+	if phone == "+10000000000" {
+		return ErrSMS
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Messages == nil {
+		m.Messages = make(map[string]string)
+	}
+	m.Messages[phone] = message
+
+	return nil
+}
+
+// Message returns the last message sent to the phone number.
+func (m *SMSSender) Message(phone string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.Messages[phone]
+}
@@ -1,20 +1,25 @@
 package mocks
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"errors"
 	"reflect"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/hinccvi/go-ddd/internal/entity"
+	"github.com/hinccvi/go-ddd/internal/user/repository"
 )
 
 var ErrCRUD = errors.New("error crud")
 
 type UserRepository struct {
-	Items []entity.User
+	Items   []entity.User
+	APIKeys []entity.APIKey
 }
 
 func (m *UserRepository) Get(_ context.Context, id uuid.UUID) (entity.User, error) {
@@ -25,8 +30,13 @@ func (m *UserRepository) Get(_ context.Context, id uuid.UUID) (entity.User, erro
 	for _, item := range m.Items {
 		if item.ID == id {
 			u := entity.User{
-				ID:       item.ID,
-				Username: item.Username,
+				ID:          item.ID,
+				Username:    item.Username,
+				DisplayName: item.DisplayName,
+				Bio:         item.Bio,
+				Locale:      item.Locale,
+				Timezone:    item.Timezone,
+				Version:     item.Version,
 			}
 
 			return u, nil
@@ -36,29 +46,132 @@ func (m *UserRepository) Get(_ context.Context, id uuid.UUID) (entity.User, erro
 	return entity.User{}, sql.ErrNoRows
 }
 
-func (m *UserRepository) Count(_ context.Context) (int64, error) {
-	return int64(len(m.Items)), nil
+func (m *UserRepository) Count(_ context.Context, opts repository.QueryOptions) (int64, error) {
+	return int64(len(m.filter(opts))), nil
 }
 
-func (m *UserRepository) Query(_ context.Context, page, size int) ([]entity.User, error) {
-	if page <= 0 || size <= 0 {
+func (m *UserRepository) Query(_ context.Context, opts repository.QueryOptions) ([]entity.User, error) {
+	if opts.Limit <= 0 || opts.Offset < 0 {
 		return []entity.User{}, ErrCRUD
 	}
 
+	less := func(a, b entity.User) bool {
+		if opts.Sort == repository.SortCreatedAt && !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt) != opts.Desc
+		}
+
+		if opts.Sort != repository.SortCreatedAt && a.Username != b.Username {
+			return a.Username < b.Username != opts.Desc
+		}
+
+		if a.ID == b.ID {
+			return false
+		}
+
+		return bytes.Compare(a.ID[:], b.ID[:]) < 0 != opts.Desc
+	}
+
 	users := []entity.User{}
+	for _, v := range m.filter(opts) {
+		if opts.After == nil || less(*opts.After, v) {
+			users = append(users, entity.User{
+				ID:          v.ID,
+				Username:    v.Username,
+				DisplayName: v.DisplayName,
+				Bio:         v.Bio,
+				Locale:      v.Locale,
+				Timezone:    v.Timezone,
+				CreatedAt:   v.CreatedAt,
+				UpdatedAt:   v.UpdatedAt,
+				DeletedAt:   v.DeletedAt,
+			})
+		}
+	}
+
+	sort.SliceStable(users, func(i, j int) bool { return less(users[i], users[j]) })
+
+	if opts.Offset >= len(users) {
+		return []entity.User{}, nil
+	}
+
+	users = users[opts.Offset:]
+	if len(users) > opts.Limit {
+		users = users[:opts.Limit]
+	}
+
+	return users, nil
+}
+
+// Search matches substrings only, users matching by username score higher.
+func (m *UserRepository) Search(_ context.Context, query string, limit int) ([]repository.SearchResult, error) {
+	if query == "error" {
+		return []repository.SearchResult{}, ErrCRUD
+	}
+
+	query = strings.ToLower(query)
+	results := []repository.SearchResult{}
 	for _, v := range m.Items {
-		users = append(users, entity.User{
-			ID:       v.ID,
-			Username: v.Username,
+		var score float64
+		switch {
+		case v.DeletedAt.Valid:
+			continue
+		case strings.Contains(strings.ToLower(v.Username), query):
+			score = 1
+		case strings.Contains(strings.ToLower(v.DisplayName.String), query),
+			strings.Contains(strings.ToLower(v.Bio.String), query):
+			score = 0.5
+		default:
+			continue
+		}
+
+		results = append(results, repository.SearchResult{
+			User: entity.User{
+				ID:          v.ID,
+				Username:    v.Username,
+				DisplayName: v.DisplayName,
+				Bio:         v.Bio,
+				Locale:      v.Locale,
+				Timezone:    v.Timezone,
+				CreatedAt:   v.CreatedAt,
+				UpdatedAt:   v.UpdatedAt,
+			},
+			Score: score,
 		})
 	}
 
-	return users, nil
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+func (m *UserRepository) filter(opts repository.QueryOptions) []entity.User {
+	users := []entity.User{}
+	for _, v := range m.Items {
+		switch {
+		case v.DeletedAt.Valid && !opts.IncludeDeleted,
+			!strings.HasPrefix(strings.ToLower(v.Username), strings.ToLower(opts.UsernamePrefix)),
+			opts.CreatedFrom != nil && v.CreatedAt.Before(*opts.CreatedFrom),
+			opts.CreatedTo != nil && !v.CreatedAt.Before(*opts.CreatedTo):
+			continue
+		}
+
+		users = append(users, v)
+	}
+
+	return users
 }
 
-func (m *UserRepository) Create(_ context.Context, u entity.User) error {
+// Create fails with repository.ErrUsernameTaken if an active user has the username in any case.
+func (m *UserRepository) Create(_ context.Context, u entity.User) (uuid.UUID, error) {
 	if u.Username == "error" {
-		return ErrCRUD
+		return uuid.Nil, ErrCRUD
+	}
+
+	if m.usernameTaken(u.Username, uuid.Nil) {
+		return uuid.Nil, repository.ErrUsernameTaken
 	}
 
 	id := uuid.New()
@@ -67,13 +180,16 @@ func (m *UserRepository) Create(_ context.Context, u entity.User) error {
 		ID:        id,
 		Username:  u.Username,
 		Password:  u.Password,
+		Email:     u.Email,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
+		Version:   1,
 	})
 
-	return nil
+	return id, nil
 }
 
+// Update fails with sql.ErrNoRows if u.Version is set and the user has another version.
 func (m *UserRepository) Update(_ context.Context, u entity.User) error {
 	if u.Username == "error" {
 		return ErrCRUD
@@ -82,6 +198,14 @@ func (m *UserRepository) Update(_ context.Context, u entity.User) error {
 	isFound := false
 	for i, item := range m.Items {
 		if item.ID == u.ID {
+			if u.Version != 0 && u.Version != item.Version {
+				return sql.ErrNoRows
+			}
+
+			if u.Username != "" && m.usernameTaken(u.Username, u.ID) {
+				return repository.ErrUsernameTaken
+			}
+
 			if u.Username != "" {
 				m.Items[i].Username = u.Username
 			}
@@ -90,7 +214,24 @@ func (m *UserRepository) Update(_ context.Context, u entity.User) error {
 				m.Items[i].Password = u.Password
 			}
 
+			if u.Email.Valid {
+				m.Items[i].Email = u.Email
+				m.Items[i].EmailVerifiedAt = sql.NullTime{}
+			}
+
+			for field, value := range map[*sql.NullString]sql.NullString{
+				&m.Items[i].DisplayName: u.DisplayName,
+				&m.Items[i].Bio:         u.Bio,
+				&m.Items[i].Locale:      u.Locale,
+				&m.Items[i].Timezone:    u.Timezone,
+			} {
+				if value.Valid {
+					*field = sql.NullString{String: value.String, Valid: value.String != ""}
+				}
+			}
+
 			m.Items[i].UpdatedAt = time.Now()
+			m.Items[i].Version++
 
 			isFound = true
 			break
@@ -111,7 +252,7 @@ func (m *UserRepository) Delete(_ context.Context, id uuid.UUID) error {
 
 	isFound := false
 	for i, item := range m.Items {
-		if item.ID == id {
+		if item.ID == id && !item.DeletedAt.Valid {
 			m.Items[i].DeletedAt = sql.NullTime{Time: time.Now(), Valid: true}
 
 			isFound = true
@@ -125,3 +266,180 @@ func (m *UserRepository) Delete(_ context.Context, id uuid.UUID) error {
 
 	return nil
 }
+
+// Restore fails with repository.ErrUsernameTaken if an active user has the same username.
+func (m *UserRepository) Restore(_ context.Context, id uuid.UUID) error {
+	for i, item := range m.Items {
+		if item.ID != id || !item.DeletedAt.Valid {
+			continue
+		}
+
+		if m.usernameTaken(item.Username, item.ID) {
+			return repository.ErrUsernameTaken
+		}
+
+		m.Items[i].DeletedAt = sql.NullTime{}
+		m.Items[i].UpdatedAt = time.Now()
+
+		return nil
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *UserRepository) UsernameExists(_ context.Context, username string) (bool, error) {
+	if username == "error" {
+		return false, ErrCRUD
+	}
+
+	return m.usernameTaken(username, uuid.Nil), nil
+}
+
+// usernameTaken reports whether an active user other than id has username in any case.
+func (m *UserRepository) usernameTaken(username string, id uuid.UUID) bool {
+	for _, item := range m.Items {
+		if item.ID != id && !item.DeletedAt.Valid && strings.EqualFold(item.Username, username) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *UserRepository) Purge(_ context.Context, deletedBefore time.Time, limit int) ([]entity.User, error) {
+	purged := []entity.User{}
+	items := []entity.User{}
+	for _, item := range m.Items {
+		if item.DeletedAt.Valid && item.DeletedAt.Time.Before(deletedBefore) && len(purged) < limit {
+			purged = append(purged, entity.User{ID: item.ID, AvatarKey: item.AvatarKey})
+			continue
+		}
+
+		items = append(items, item)
+	}
+	m.Items = items
+
+	return purged, nil
+}
+
+func (m *UserRepository) GetProfile(_ context.Context, id uuid.UUID) (entity.User, error) {
+	for _, item := range m.Items {
+		if item.ID == id && !item.DeletedAt.Valid {
+			return entity.User{
+				ID:              item.ID,
+				Username:        item.Username,
+				Email:           item.Email,
+				EmailVerifiedAt: item.EmailVerifiedAt,
+				DisplayName:     item.DisplayName,
+				Bio:             item.Bio,
+				Locale:          item.Locale,
+				Timezone:        item.Timezone,
+				AvatarKey:       item.AvatarKey,
+				CreatedAt:       item.CreatedAt,
+				UpdatedAt:       item.UpdatedAt,
+			}, nil
+		}
+	}
+
+	return entity.User{}, sql.ErrNoRows
+}
+
+func (m *UserRepository) VerifyEmail(_ context.Context, id uuid.UUID, email string) error {
+	for i, item := range m.Items {
+		if item.ID == id && !item.DeletedAt.Valid && item.Email.Valid && strings.EqualFold(item.Email.String, email) {
+			m.Items[i].EmailVerifiedAt = sql.NullTime{Time: time.Now(), Valid: true}
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *UserRepository) GetPassword(_ context.Context, id uuid.UUID) (string, error) {
+	for _, item := range m.Items {
+		if item.ID == id && !item.DeletedAt.Valid {
+			return item.Password, nil
+		}
+	}
+
+	return "", sql.ErrNoRows
+}
+
+func (m *UserRepository) UpdatePassword(_ context.Context, id uuid.UUID, password string) error {
+	for i, item := range m.Items {
+		if item.ID == id && !item.DeletedAt.Valid {
+			m.Items[i].Password = password
+			m.Items[i].UpdatedAt = time.Now()
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *UserRepository) UpdateAvatar(_ context.Context, id uuid.UUID, key sql.NullString) (sql.NullString, error) {
+	for i, item := range m.Items {
+		if item.ID == id && !item.DeletedAt.Valid {
+			m.Items[i].AvatarKey = key
+			m.Items[i].UpdatedAt = time.Now()
+			return item.AvatarKey, nil
+		}
+	}
+
+	return sql.NullString{}, sql.ErrNoRows
+}
+
+func (m *UserRepository) CreateAPIKey(_ context.Context, key entity.APIKey) (uuid.UUID, error) {
+	if key.Name == "error" {
+		return uuid.Nil, ErrCRUD
+	}
+
+	key.ID = uuid.New()
+	key.CreatedAt = time.Now()
+	m.APIKeys = append(m.APIKeys, key)
+
+	return key.ID, nil
+}
+
+func (m *UserRepository) ListAPIKeys(_ context.Context, userID uuid.UUID) ([]entity.APIKey, error) {
+	keys := []entity.APIKey{}
+	for _, key := range m.APIKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (m *UserRepository) GetAPIKey(_ context.Context, userID, id uuid.UUID) (entity.APIKey, error) {
+	for _, key := range m.APIKeys {
+		if key.ID == id && key.UserID == userID {
+			return key, nil
+		}
+	}
+
+	return entity.APIKey{}, sql.ErrNoRows
+}
+
+func (m *UserRepository) RenameAPIKey(_ context.Context, userID, id uuid.UUID, name string) error {
+	for i, key := range m.APIKeys {
+		if key.ID == id && key.UserID == userID {
+			m.APIKeys[i].Name = name
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *UserRepository) DeleteAPIKey(_ context.Context, userID, id uuid.UUID) error {
+	for i, key := range m.APIKeys {
+		if key.ID == id && key.UserID == userID {
+			m.APIKeys = append(m.APIKeys[:i], m.APIKeys[i+1:]...)
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
@@ -0,0 +1,179 @@
+package mocks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+// Authenticator is a software WebAuthn authenticator holding a single ES256 passkey.
+// It always reports that the user was present and verified.
+type Authenticator struct {
+	RPID         string
+	Origin       string
+	CredentialID []byte
+	UserHandle   []byte
+	SignCount    uint32
+
+	key *ecdsa.PrivateKey
+}
+
+const (
+	authenticatorFlags        = 0x01 | 0x04 // user present, user verified
+	authenticatorAttestedData = 0x40
+	credentialIDSize          = 16
+)
+
+// NewAuthenticator creates an authenticator with a new passkey for a relying party.
+func NewAuthenticator(t *testing.T, rpID, origin string) *Authenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, credentialIDSize)
+	if _, err = rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Authenticator{RPID: rpID, Origin: origin, CredentialID: id, key: key}
+}
+
+// Register plays navigator.credentials.create() for a challenge and returns the credential as JSON.
+func (a *Authenticator) Register(challenge, userHandle []byte) string {
+	a.UserHandle = userHandle
+
+	authData := a.authenticatorData(authenticatorFlags | authenticatorAttestedData)
+	authData = append(authData, make([]byte, 16)...) // aaguid
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.CredentialID)))
+	authData = append(authData, a.CredentialID...)
+	authData = append(authData, a.PublicKey()...)
+
+	// {"fmt": "none", "attStmt": {}, "authData": authData}
+	attestation := cborHeader(5, 3)
+	attestation = append(attestation, cborText("fmt")...)
+	attestation = append(attestation, cborText("none")...)
+	attestation = append(attestation, cborText("attStmt")...)
+	attestation = append(attestation, cborHeader(5, 0)...)
+	attestation = append(attestation, cborText("authData")...)
+	attestation = append(attestation, cborBytes(authData)...)
+
+	return a.credential(map[string]interface{}{
+		"clientDataJSON":    a.clientData("webauthn.create", challenge),
+		"attestationObject": b64(attestation),
+		"transports":        []string{"internal"},
+	})
+}
+
+// Assert plays navigator.credentials.get() for a challenge and returns the credential as JSON.
+// The signature counter is incremented on every assertion.
+func (a *Authenticator) Assert(challenge []byte) string {
+	a.SignCount++
+
+	authData := a.authenticatorData(authenticatorFlags)
+	clientData := a.clientData("webauthn.get", challenge)
+
+	raw, _ := base64.RawURLEncoding.DecodeString(clientData)
+	sum := sha256.Sum256(raw)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), sum[:]...))
+
+	sig, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+
+	return a.credential(map[string]interface{}{
+		"clientDataJSON":    clientData,
+		"authenticatorData": b64(authData),
+		"signature":         b64(sig),
+		"userHandle":        b64(a.UserHandle),
+	})
+}
+
+// PublicKey returns the COSE encoding of the passkey public key.
+func (a *Authenticator) PublicKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+
+	// {kty: EC2, alg: ES256, crv: P-256, x: x, y: y}
+	key := cborHeader(5, 5)
+	key = append(key, cborInt(1)...)
+	key = append(key, cborInt(2)...)
+	key = append(key, cborInt(3)...)
+	key = append(key, cborInt(-7)...)
+	key = append(key, cborInt(-1)...)
+	key = append(key, cborInt(1)...)
+	key = append(key, cborInt(-2)...)
+	key = append(key, cborBytes(x)...)
+	key = append(key, cborInt(-3)...)
+	key = append(key, cborBytes(y)...)
+
+	return key
+}
+
+func (a *Authenticator) authenticatorData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.RPID))
+
+	data := append(rpIDHash[:], flags)
+
+	return binary.BigEndian.AppendUint32(data, a.SignCount)
+}
+
+func (a *Authenticator) clientData(ceremony string, challenge []byte) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   b64(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+
+	return b64(data)
+}
+
+func (a *Authenticator) credential(response map[string]interface{}) string {
+	res, _ := json.Marshal(map[string]interface{}{
+		"id":       b64(a.CredentialID),
+		"rawId":    b64(a.CredentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+
+	return string(res)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func cborHeader(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+	}
+}
+
+func cborInt(n int64) []byte {
+	if n < 0 {
+		return cborHeader(1, uint64(-1-n))
+	}
+
+	return cborHeader(0, uint64(n))
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHeader(2, uint64(len(b))), b...)
+}
+
+func cborText(s string) []byte {
+	return append(cborHeader(3, uint64(len(s))), s...)
+}
@@ -2,30 +2,80 @@ package v1
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
 
+	"github.com/google/uuid"
 	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	m "github.com/hinccvi/go-ddd/internal/middleware"
 	"github.com/hinccvi/go-ddd/internal/user/service"
 	"github.com/hinccvi/go-ddd/pkg/log"
 	"github.com/hinccvi/go-ddd/tools"
 	"github.com/labstack/echo/v4"
 )
 
+// avatarField is the multipart form field avatars are uploaded in.
+const avatarField = "avatar"
+
+var (
+	// patchableFields are the fields of a user a merge patch or JSON patch may change.
+	patchableFields = []string{"username", "password", "email", "display_name", "bio", "locale", "timezone"}
+
+	// clearableFields are the patchable fields that may be removed, the others can only be replaced.
+	clearableFields = map[string]bool{"display_name": true, "bio": true, "locale": true, "timezone": true}
+)
+
 type resource struct {
-	logger  log.Logger
-	service service.Service
+	logger     log.Logger
+	service    service.Service
+	authorizer m.Authorizer
 }
 
-func RegisterHandlers(g *echo.Group, service service.Service, logger log.Logger, authHandler echo.MiddlewareFunc) {
-	r := &resource{logger, service}
+func RegisterHandlers(
+	g *echo.Group,
+	s service.Service,
+	logger log.Logger,
+	authHandler echo.MiddlewareFunc,
+	authorizer m.Authorizer,
+) {
+	r := &resource{logger, s, authorizer}
 
 	user := g.Group("/user")
 	{
 		user.GET("/:id", r.Get)
-		user.GET("/list", r.Query)
+		user.GET("/:id/avatar", r.GetAvatar)
+		user.GET("/list", r.Query, authHandler, authorizer.Require(service.PermissionList))
+		user.GET("/search", r.Search, authHandler, authorizer.Require(service.PermissionList))
+		user.GET("/availability", r.UsernameAvailability)
 		user.POST("", r.Create)
+		user.POST("/verify-email", r.VerifyEmail)
+		user.POST("/verify-email/resend", r.ResendVerificationEmail, authHandler)
 
 		user.PATCH("", r.Update, authHandler)
-		user.DELETE("/:id", r.Delete, authHandler)
+		user.DELETE("/:id", r.Delete, authHandler, authorizer.Require(service.PermissionDelete))
+		user.POST("/:id/restore", r.Restore, authHandler, authorizer.Require(service.PermissionRestore))
+
+		user.GET("/api-keys", r.ListAPIKeys, authHandler)
+		user.POST("/api-keys", r.CreateAPIKey, authHandler)
+		user.GET("/api-keys/:id", r.GetAPIKey, authHandler)
+		user.PATCH("/api-keys/:id", r.RenameAPIKey, authHandler)
+		user.DELETE("/api-keys/:id", r.DeleteAPIKey, authHandler)
+	}
+
+	// the account of the signed-in user, it is never taken from the request
+	me := g.Group("/me", authHandler)
+	{
+		me.GET("", r.GetProfile)
+		me.PATCH("", r.UpdateProfile)
+		me.POST("/password", r.ChangePassword)
+		me.DELETE("", r.DeleteAccount)
+		me.PUT("/avatar", r.UploadAvatar)
+		me.DELETE("/avatar", r.DeleteAvatar)
 	}
 }
 
@@ -40,6 +90,9 @@ func (r resource) Get(c echo.Context) error {
 		return err
 	}
 
+	// sent back in If-Match, so an update does not overwrite changes made since
+	c.Response().Header().Set(tools.HeaderETag, tools.ETag(user.Version))
+
 	return tools.JSONRespOk(c, user)
 }
 
@@ -49,28 +102,40 @@ func (r resource) Query(c echo.Context) error {
 		return err
 	}
 
-	if req.Page == 0 {
-		req.Page = 1
+	res, err := r.service.Query(c.Request().Context(), req)
+	if err != nil {
+		return err
 	}
 
-	if req.Size == 0 {
-		req.Size = 10
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) UsernameAvailability(c echo.Context) error {
+	var req service.UsernameAvailabilityRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
 	}
 
-	list, total, err := r.service.Query(c.Request().Context(), req.Page, req.Size)
+	res, err := r.service.UsernameAvailability(c.Request().Context(), req)
 	if err != nil {
 		return err
 	}
 
-	return tools.JSONRespOk(
-		c,
-		struct {
-			List  []entity.User `json:"list"`
-			Total int64         `json:"total"`
-		}{
-			List:  list,
-			Total: total,
-		})
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) Search(c echo.Context) error {
+	var req service.SearchUserRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	res, err := r.service.Search(c.Request().Context(), req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
 }
 
 func (r resource) Create(c echo.Context) error {
@@ -82,6 +147,7 @@ func (r resource) Create(c echo.Context) error {
 	u := entity.User{
 		Username: req.Username,
 		Password: req.Password,
+		Email:    sql.NullString{String: req.Email, Valid: req.Email != ""},
 	}
 	if err := r.service.Create(context.TODO(), u); err != nil {
 		return err
@@ -92,16 +158,53 @@ func (r resource) Create(c echo.Context) error {
 
 func (r resource) Update(c echo.Context) error {
 	var req service.UpdateUserRequest
-	if err := tools.BindValidate(c, &req); err != nil {
+	if err := bindUpdate(c, &req); err != nil {
+		return err
+	}
+
+	// users may update their own account with a login session, anyone else's requires the update permission
+	principal, ok := m.GetPrincipal(c)
+	if !ok {
+		return errs.ErrMissingJwt
+	}
+
+	if principal.GetSubject() == req.ID.String() {
+		if _, _, err := sessionUser(c); err != nil {
+			return err
+		}
+
+		// one's own password is changed with the current one, which also ends the other sessions
+		if req.Password != "" {
+			return errs.ErrPasswordChange
+		}
+	} else {
+		can, err := r.authorizer.Can(c, service.PermissionUpdate)
+		if err != nil {
+			return err
+		}
+
+		if !can {
+			return errs.ErrForbidden
+		}
+	}
+
+	version, err := tools.IfMatch(c)
+	if err != nil {
 		return err
 	}
 
 	u := entity.User{
-		ID:       req.ID,
-		Username: req.Username,
-		Password: req.Password,
+		ID:          req.ID,
+		Version:     version,
+		Username:    req.Username,
+		Password:    req.Password,
+		Email:       sql.NullString{String: req.Email, Valid: req.Email != ""},
+		DisplayName: tools.NullString(req.DisplayName),
+		Bio:         tools.NullString(req.Bio),
+		Locale:      tools.NullString(req.Locale),
+		Timezone:    tools.NullString(req.Timezone),
 	}
-	if err := r.service.Update(context.TODO(), u); err != nil {
+	if err = r.service.Update(context.TODO(), u); err != nil {
 		return err
 	}
 
@@ -120,3 +223,375 @@ func (r resource) Delete(c echo.Context) error {
 
 	return tools.JSONRespOk(c, nil)
 }
+
+func (r resource) Restore(c echo.Context) error {
+	var req service.RestoreUserRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	if err := r.service.Restore(c.Request().Context(), *req.ID); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) VerifyEmail(c echo.Context) error {
+	var req service.VerifyEmailRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	if err := r.service.VerifyEmail(c.Request().Context(), req); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) ResendVerificationEmail(c echo.Context) error {
+	userID, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err = r.service.ResendVerificationEmail(c.Request().Context(), userID); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) CreateAPIKey(c echo.Context) error {
+	var req service.CreateAPIKeyRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := keyOwner(c)
+	if err != nil {
+		return err
+	}
+
+	// a key may only be scoped to permissions its owner has
+	for _, scope := range req.Scopes {
+		can, err := r.authorizer.Can(c, scope)
+		if err != nil {
+			return err
+		}
+
+		if !can {
+			return errs.ErrForbidden
+		}
+	}
+
+	res, err := r.service.CreateAPIKey(c.Request().Context(), userID, req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) ListAPIKeys(c echo.Context) error {
+	userID, err := keyOwner(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.service.ListAPIKeys(c.Request().Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) GetAPIKey(c echo.Context) error {
+	var req service.APIKeyRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := keyOwner(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.service.GetAPIKey(c.Request().Context(), userID, *req.ID)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) RenameAPIKey(c echo.Context) error {
+	var req service.RenameAPIKeyRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := keyOwner(c)
+	if err != nil {
+		return err
+	}
+
+	if err = r.service.RenameAPIKey(c.Request().Context(), userID, req); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) DeleteAPIKey(c echo.Context) error {
+	var req service.APIKeyRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	userID, err := keyOwner(c)
+	if err != nil {
+		return err
+	}
+
+	if err = r.service.DeleteAPIKey(c.Request().Context(), userID, *req.ID); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) GetProfile(c echo.Context) error {
+	userID, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.service.GetProfile(c.Request().Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) UpdateProfile(c echo.Context) error {
+	var req service.UpdateProfileRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	userID, _, err := sessionUser(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.service.UpdateProfile(c.Request().Context(), userID, req)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) ChangePassword(c echo.Context) error {
+	var req service.ChangePasswordRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	userID, sessionID, err := sessionUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err = r.service.ChangePassword(c.Request().Context(), userID, sessionID, req); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) DeleteAccount(c echo.Context) error {
+	userID, _, err := sessionUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err = r.service.DeleteAccount(c.Request().Context(), userID); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) UploadAvatar(c echo.Context) error {
+	userID, _, err := sessionUser(c)
+	if err != nil {
+		return err
+	}
+
+	file, err := formFile(c, avatarField)
+	if err != nil {
+		return err
+	}
+
+	res, err := r.service.UploadAvatar(c.Request().Context(), userID, file)
+	if err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, res)
+}
+
+func (r resource) DeleteAvatar(c echo.Context) error {
+	userID, _, err := sessionUser(c)
+	if err != nil {
+		return err
+	}
+
+	if err = r.service.DeleteAvatar(c.Request().Context(), userID); err != nil {
+		return err
+	}
+
+	return tools.JSONRespOk(c, nil)
+}
+
+func (r resource) GetAvatar(c echo.Context) error {
+	var req service.GetAvatarRequest
+	if err := tools.BindValidate(c, &req); err != nil {
+		return err
+	}
+
+	obj, err := r.service.GetAvatar(c.Request().Context(), *req.ID, req.Size == service.AvatarThumbnail)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("X-Content-Type-Options", "nosniff")
+
+	return c.Blob(http.StatusOK, obj.ContentType, obj.Data)
+}
+
+// bindUpdate binds and validates the update of a user. The body is a JSON merge patch or a JSON patch,
+// selected by its content type, which changes only the fields it names. Any other body is bound as is,
+// ignoring empty fields.
+func bindUpdate(c echo.Context, req *service.UpdateUserRequest) error {
+	var patch tools.Patch
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	switch mediaType {
+	case tools.MIMEApplicationMergePatch:
+		patch, err = tools.MergePatch(c.Request().Body, patchableFields...)
+	case tools.MIMEApplicationJSONPatch:
+		patch, err = tools.JSONPatch(c.Request().Body, patchableFields...)
+	default:
+		return tools.BindValidate(c, req)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = (&echo.DefaultBinder{}).BindQueryParams(c, req); err != nil {
+		return err
+	}
+
+	for field, value := range patch {
+		switch {
+		case clearableFields[field] && value == nil:
+			// removing a profile field clears it
+			value = new(string)
+		case !clearableFields[field] && (value == nil || *value == ""):
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'%s' required", field))
+		}
+
+		switch field {
+		case "username":
+			req.Username = *value
+		case "password":
+			req.Password = *value
+		case "email":
+			req.Email = *value
+		case "display_name":
+			req.DisplayName = value
+		case "bio":
+			req.Bio = value
+		case "locale":
+			req.Locale = value
+		case "timezone":
+			req.Timezone = value
+		}
+	}
+
+	return c.Validate(req)
+}
+
+// formFile returns the first file uploaded in a field of a multipart form. The form is streamed,
+// so the size of the file is limited by whoever reads it rather than buffered here.
+func formFile(c echo.Context, field string) (io.Reader, error) {
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'%s' required", field))
+		}
+
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if part.FormName() == field && part.FileName() != "" {
+			return part, nil
+		}
+	}
+}
+
+// currentUser returns the user a request is authenticated as.
+func currentUser(c echo.Context) (uuid.UUID, error) {
+	principal, ok := m.GetPrincipal(c)
+	if !ok {
+		return uuid.Nil, errs.ErrMissingJwt
+	}
+
+	id, err := uuid.Parse(principal.GetSubject())
+	if err != nil {
+		return uuid.Nil, errs.ErrInvalidJwt
+	}
+
+	return id, nil
+}
+
+// sessionUser returns the user and the login session of a request. Accounts are changed with a login session only,
+// so neither an API key nor a token issued to a client can take over the account it belongs to.
+func sessionUser(c echo.Context) (uuid.UUID, string, error) {
+	principal, ok := m.GetPrincipal(c)
+	if !ok {
+		return uuid.Nil, "", errs.ErrMissingJwt
+	}
+
+	session, ok := principal.(m.SessionPrincipal)
+	if !ok || session.GetSessionID() == "" {
+		return uuid.Nil, "", errs.ErrForbidden
+	}
+
+	id, err := uuid.Parse(principal.GetSubject())
+	if err != nil {
+		return uuid.Nil, "", errs.ErrInvalidJwt
+	}
+
+	return id, session.GetSessionID(), nil
+}
+
+// keyOwner returns the user whose API keys a request manages. Keys are managed with a login session only,
+// otherwise a leaked key or a token issued to a client could create keys that outlive it.
+func keyOwner(c echo.Context) (uuid.UUID, error) {
+	id, _, err := sessionUser(c)
+
+	return id, err
+}
@@ -1,26 +1,37 @@
 package v1
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
+	"image"
+	"image/png"
+	"mime/multipart"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
-	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/config"
 	"github.com/hinccvi/go-ddd/internal/entity"
+	m "github.com/hinccvi/go-ddd/internal/middleware"
 	"github.com/hinccvi/go-ddd/internal/mocks"
 	"github.com/hinccvi/go-ddd/internal/test"
 	"github.com/hinccvi/go-ddd/internal/user/service"
 	"github.com/hinccvi/go-ddd/pkg/log"
-	"github.com/labstack/echo/v4/middleware"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/pkg/password"
+	"github.com/hinccvi/go-ddd/pkg/storage"
+	"github.com/hinccvi/go-ddd/tools"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestHandler(t *testing.T) {
 	id := uuid.New()
 
+	keyID := uuid.New()
 	repo := &mocks.UserRepository{Items: []entity.User{
 		{
 			ID:        id,
@@ -28,12 +39,20 @@ func TestHandler(t *testing.T) {
 			Password:  "secret",
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
-			DeletedAt: sql.NullTime{}},
+			DeletedAt: sql.NullTime{},
+			Version:   1},
+	}, APIKeys: []entity.APIKey{
+		{
+			ID:        keyID,
+			UserID:    id,
+			Name:      "ci",
+			Prefix:    "ak_0123456789abcdef",
+			ExpiresAt: time.Now().Add(time.Hour),
+			CreatedAt: time.Now()},
 	}}
 
-	authHandler := middleware.JWTWithConfig(middleware.JWTConfig{
-		Claims:     &jwt.MapClaims{},
-		SigningKey: []byte("secret"),
+	authorizer := mocks.Authorizer(map[string][]string{
+		"admin": {service.PermissionList, service.PermissionUpdate, service.PermissionDelete, service.PermissionRestore},
 	})
 
 	l, _ := log.NewForTest()
@@ -49,17 +68,102 @@ func TestHandler(t *testing.T) {
 		t.FailNow()
 	}
 
-	RegisterHandlers(router.Group("v1"), service.New(rds, repo, logger, 2*time.Second), logger, authHandler)
+	policy := password.New(config.PasswordPolicy{MinLength: 6, DisallowUsername: true}, nil)
+
+	authHandler := mocks.AuthHandlerWithAPIKeys(map[string]mocks.APIKeyPrincipal{
+		"user-key":  {Subject: id.String(), Roles: []string{"user"}},
+		"admin-key": {Subject: uuid.NewString(), Roles: []string{"admin"}, Scopes: []string{service.PermissionList}},
+	})
+
+	var cfg config.Config
+	cfg.App.Name = "test"
+	cfg.EmailVerification.TokenExpiration = 60
+	cfg.EmailVerification.Cooldown = 60
+
+	hashers := tools.NewPasswordHashers(tools.BcryptHasher{Cost: tools.BcryptCost})
+	sessions := &mocks.SessionRevoker{}
+	cfg.Avatar.MaxSize = 64 << 10
+	cfg.Avatar.MaxDimension = 1024
+	cfg.Avatar.ThumbnailSize = 32
+
+	blobs := storage.NewLocal(t.TempDir())
+	svc := service.New(&cfg, rds, repo, policy, hashers, &mail.Memory{}, sessions, blobs, logger, 2*time.Second)
+
+	RegisterHandlers(router.Group("v1"), svc, logger, authHandler, authorizer)
 	header := mocks.AuthHeader(id.String(), "user")
+	otherHeader := mocks.AuthHeader(uuid.NewString(), "other")
+	adminHeader := mocks.AuthHeader(uuid.NewString(), "admin", "admin")
+
+	apiKeyHeader := func(key string) http.Header {
+		h := http.Header{}
+		h.Set(m.HeaderAPIKey, key)
+		return h
+	}
+
+	// upload returns the body and the header of a multipart form uploading a file in field
+	ifMatchHeader := func(etag string) http.Header {
+		h := header.Clone()
+		h.Set(tools.HeaderIfMatch, etag)
+
+		return h
+	}
+
+	patchHeader := func(h http.Header, contentType string) http.Header {
+		h = h.Clone()
+		h.Set("Content-Type", contentType)
+
+		return h
+	}
+	mergePatch := patchHeader(header, tools.MIMEApplicationMergePatch)
+	jsonPatch := patchHeader(header, tools.MIMEApplicationJSONPatch)
+
+	upload := func(h http.Header, field string, data []byte) (string, http.Header) {
+		var b bytes.Buffer
+		w := multipart.NewWriter(&b)
+		part, err := w.CreateFormFile(field, "avatar.png")
+		assert.NoError(t, err)
+		_, err = part.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Close())
+
+		h = h.Clone()
+		h.Set("Content-Type", w.FormDataContentType())
+		return b.String(), h
+	}
+
+	var avatar bytes.Buffer
+	assert.NoError(t, png.Encode(&avatar, image.NewRGBA(image.Rect(0, 0, 64, 48))))
+
+	avatarBody, avatarHeader := upload(header, "avatar", avatar.Bytes())
+	svgBody, svgHeader := upload(header, "avatar", []byte("<svg></svg>"))
+	largeBody, largeHeader := upload(header, "avatar", make([]byte, cfg.Avatar.MaxSize+1))
+	fieldBody, fieldHeader := upload(header, "file", avatar.Bytes())
+	keyBody, keyHeader := upload(apiKeyHeader("user-key"), "avatar", avatar.Bytes())
+
+	expiresAt := time.Now().Add(time.Hour).Format(time.RFC3339)
 
 	tests := []test.APITestCase{
 		{
 			Name:         "get all",
 			Method:       http.MethodGet,
 			URL:          "/v1/user/list",
+			Header:       adminHeader,
 			WantStatus:   http.StatusOK,
 			WantResponse: fmt.Sprintf(`*{"list":[{"id":"%s","username":"user"*`, id.String()),
 		},
+		{
+			Name:       "get all auth error",
+			Method:     http.MethodGet,
+			URL:        "/v1/user/list",
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "get all forbidden",
+			Method:     http.MethodGet,
+			URL:        "/v1/user/list",
+			Header:     header,
+			WantStatus: http.StatusForbidden,
+		},
 		{
 			Name:         "get init user",
 			Method:       http.MethodGet,
@@ -78,18 +182,99 @@ func TestHandler(t *testing.T) {
 			Name:         "create ok",
 			Method:       http.MethodPost,
 			URL:          "/v1/user",
-			Body:         `{"username": "user","password": "secret"}`,
+			Body:         `{"username": "user2","password": "secret"}`,
 			Header:       header,
 			WantStatus:   http.StatusOK,
 			WantResponse: `*"message":"success"*`,
 		},
+		{
+			Name:         "create username taken",
+			Method:       http.MethodPost,
+			URL:          "/v1/user",
+			Body:         `{"username": "User2","password": "secret"}`,
+			Header:       header,
+			WantStatus:   http.StatusConflict,
+			WantResponse: `*"error":"username already taken"*`,
+		},
+		{
+			Name:         "username available",
+			Method:       http.MethodGet,
+			URL:          "/v1/user/availability?username=user3",
+			WantStatus:   http.StatusOK,
+			WantResponse: `*{"username":"user3","available":true}*`,
+		},
+		{
+			Name:         "username unavailable",
+			Method:       http.MethodGet,
+			URL:          "/v1/user/availability?username=USER2",
+			WantStatus:   http.StatusOK,
+			WantResponse: `*{"username":"USER2","available":false}*`,
+		},
+		{
+			Name:       "username availability verify",
+			Method:     http.MethodGet,
+			URL:        "/v1/user/availability?username=a@b",
+			WantStatus: http.StatusBadRequest,
+		},
 		{
 			Name:         "create ok count",
 			Method:       http.MethodGet,
-			URL:          "/v1/user/list",
-			Header:       nil,
+			URL:          "/v1/user/list?total=true",
+			Header:       adminHeader,
 			WantStatus:   http.StatusOK,
-			WantResponse: `*"total":2*`,
+			WantResponse: `*"total":2,"next_cursor":null}}`,
+		},
+		{
+			Name:         "get all next cursor",
+			Method:       http.MethodGet,
+			URL:          "/v1/user/list?size=1&sort=-created_at",
+			Header:       adminHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"next_cursor":"*`,
+		},
+		{
+			Name:         "get all filtered",
+			Method:       http.MethodGet,
+			URL:          "/v1/user/list?username=us&created_from=2020-01-01T00:00:00Z&total=true",
+			Header:       adminHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"total":2,*`,
+		},
+		{
+			Name:         "search ok",
+			Method:       http.MethodGet,
+			URL:          "/v1/user/search?q=use",
+			Header:       adminHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"highlights":{"username":"\u003cmark\u003euser\u003c/mark\u003e"}*`,
+		},
+		{
+			Name:       "search missing query",
+			Method:     http.MethodGet,
+			URL:        "/v1/user/search",
+			Header:     adminHeader,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "search forbidden",
+			Method:     http.MethodGet,
+			URL:        "/v1/user/search?q=use",
+			Header:     header,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "get all invalid cursor",
+			Method:     http.MethodGet,
+			URL:        "/v1/user/list?cursor=xxx",
+			Header:     adminHeader,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "get all invalid sort",
+			Method:     http.MethodGet,
+			URL:        "/v1/user/list?sort=password",
+			Header:     adminHeader,
+			WantStatus: http.StatusBadRequest,
 		},
 		{
 			Name:       "create input error",
@@ -107,15 +292,265 @@ func TestHandler(t *testing.T) {
 			Header:     header,
 			WantStatus: http.StatusInternalServerError,
 		},
+		{
+			Name:       "create password policy",
+			Method:     http.MethodPost,
+			URL:        "/v1/user",
+			Body:       `{"username": "alice","password": "alice"}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+			WantResponse: `*"error":"password does not meet policy","details":[` +
+				`{"rule":"min_length","message":"must be at least 6 characters long"},` +
+				`{"rule":"username","message":"must not contain the username"}]*`,
+		},
+		{
+			Name:       "create invalid email",
+			Method:     http.MethodPost,
+			URL:        "/v1/user",
+			Body:       `{"username": "bob","password": "secret","email": "bob"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "create username with at sign",
+			Method:     http.MethodPost,
+			URL:        "/v1/user",
+			Body:       `{"username": "bob@example.com","password": "secret"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "create username too long",
+			Method:     http.MethodPost,
+			URL:        "/v1/user",
+			Body:       fmt.Sprintf(`{"username": "%s","password": "secret"}`, strings.Repeat("a", 26)),
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "verify email invalid token",
+			Method:     http.MethodPost,
+			URL:        "/v1/user/verify-email",
+			Body:       `{"token": "xxx"}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "verify email validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/user/verify-email",
+			Body:       `{}`,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "resend verification without email",
+			Method:       http.MethodPost,
+			URL:          "/v1/user/verify-email/resend",
+			Header:       header,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"no email address"*`,
+		},
+		{
+			Name:         "update email ok",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user",
+			Body:         fmt.Sprintf(`{"id":"%s","email": "user@example.com"}`, id.String()),
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:         "resend verification ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/user/verify-email/resend",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "resend verification cooldown",
+			Method:     http.MethodPost,
+			URL:        "/v1/user/verify-email/resend",
+			Header:     header,
+			WantStatus: http.StatusTooManyRequests,
+		},
+		{
+			Name:       "resend verification auth error",
+			Method:     http.MethodPost,
+			URL:        "/v1/user/verify-email/resend",
+			WantStatus: http.StatusBadRequest,
+		},
 		{
 			Name:         "update ok",
 			Method:       http.MethodPatch,
 			URL:          "/v1/user",
-			Body:         fmt.Sprintf(`{"id":"%s","username": "newuser","password": "newsecret"}`, id.String()),
+			Body:         fmt.Sprintf(`{"id":"%s","username": "newuser"}`, id.String()),
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:         "update own password",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user",
+			Body:         fmt.Sprintf(`{"id":"%s","password": "newsecret"}`, id.String()),
 			Header:       header,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"password must be changed with the current password at /v1/me/password"*`,
+		},
+		{
+			Name:         "merge patch own password",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user?id=" + id.String(),
+			Body:         `{"password":"newsecret"}`,
+			Header:       mergePatch,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"password must be changed with the current password at /v1/me/password"*`,
+		},
+		{
+			Name:         "update password policy",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user",
+			Body:         fmt.Sprintf(`{"id":"%s","password": "newuser1"}`, id.String()),
+			Header:       adminHeader,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"details":[{"rule":"username","message":"must not contain the username"}]*`,
+		},
+		{
+			Name:       "update username too long",
+			Method:     http.MethodPatch,
+			URL:        "/v1/user",
+			Body:       fmt.Sprintf(`{"id":"%s","username": "%s"}`, id.String(), strings.Repeat("a", 26)),
+			Header:     adminHeader,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "update other forbidden",
+			Method:     http.MethodPatch,
+			URL:        "/v1/user",
+			Body:       fmt.Sprintf(`{"id":"%s","username": "other","password": "othersecret"}`, id.String()),
+			Header:     otherHeader,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "update other as admin ok",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user",
+			Body:         fmt.Sprintf(`{"id":"%s","username": "newuser","password": "newsecret"}`, id.String()),
+			Header:       adminHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:         "update if-match ok",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user",
+			Body:         fmt.Sprintf(`{"id":"%s","bio": "bio"}`, id.String()),
+			Header:       ifMatchHeader(`"4"`),
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:         "update if-match stale",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user",
+			Body:         fmt.Sprintf(`{"id":"%s","bio": "bio"}`, id.String()),
+			Header:       ifMatchHeader(`"4"`),
+			WantStatus:   http.StatusPreconditionFailed,
+			WantResponse: `*"precondition failed, the resource was modified"*`,
+		},
+		{
+			Name:       "update if-match list",
+			Method:     http.MethodPatch,
+			URL:        "/v1/user",
+			Body:       fmt.Sprintf(`{"id":"%s","bio": "bio"}`, id.String()),
+			Header:     ifMatchHeader(`"4", "5"`),
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "merge patch ok",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user?id=" + id.String(),
+			Body:         `{"display_name":"User","bio":null}`,
+			Header:       mergePatch,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:         "merge patch remove username",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user?id=" + id.String(),
+			Body:         `{"username":null}`,
+			Header:       mergePatch,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"'username' required"*`,
+		},
+		{
+			Name:         "merge patch empty password",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user?id=" + id.String(),
+			Body:         `{"password":""}`,
+			Header:       mergePatch,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"'password' required"*`,
+		},
+		{
+			Name:         "merge patch not patchable",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user?id=" + id.String(),
+			Body:         fmt.Sprintf(`{"id":"%s"}`, uuid.NewString()),
+			Header:       mergePatch,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"'id' cannot be patched"*`,
+		},
+		{
+			Name:       "merge patch invalid locale",
+			Method:     http.MethodPatch,
+			URL:        "/v1/user?id=" + id.String(),
+			Body:       `{"locale":"not a locale"}`,
+			Header:     mergePatch,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "merge patch missing id",
+			Method:     http.MethodPatch,
+			URL:        "/v1/user",
+			Body:       `{"display_name":"User"}`,
+			Header:     mergePatch,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "merge patch other forbidden",
+			Method:     http.MethodPatch,
+			URL:        "/v1/user?id=" + id.String(),
+			Body:       `{"display_name":"Other"}`,
+			Header:     patchHeader(otherHeader, tools.MIMEApplicationMergePatch),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:   "json patch ok",
+			Method: http.MethodPatch,
+			URL:    "/v1/user?id=" + id.String(),
+			Body: `[{"op":"replace","path":"/display_name","value":"User"},` +
+				`{"op":"remove","path":"/timezone"}]`,
+			Header:       jsonPatch,
 			WantStatus:   http.StatusOK,
 			WantResponse: `*"message":"success"*`,
 		},
+		{
+			Name:         "json patch remove email",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user?id=" + id.String(),
+			Body:         `[{"op":"remove","path":"/email"}]`,
+			Header:       jsonPatch,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"'email' required"*`,
+		},
+		{
+			Name:         "json patch unsupported operation",
+			Method:       http.MethodPatch,
+			URL:          "/v1/user?id=" + id.String(),
+			Body:         `[{"op":"test","path":"/username","value":"user"}]`,
+			Header:       jsonPatch,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"unsupported operation 'test'"*`,
+		},
 		{
 			Name:       "update verify",
 			Method:     http.MethodPatch,
@@ -142,15 +577,295 @@ func TestHandler(t *testing.T) {
 			Name:       "update error",
 			Method:     http.MethodPatch,
 			URL:        "/v1/user",
-			Body:       fmt.Sprintf(`{"id":"%s","username": "error","password": "newsecret"}`, id.String()),
+			Body:       fmt.Sprintf(`{"id":"%s","username": "error"}`, id.String()),
 			Header:     header,
 			WantStatus: http.StatusInternalServerError,
 		},
+		{
+			Name:       "delete forbidden",
+			Method:     http.MethodDelete,
+			URL:        fmt.Sprintf("/v1/user/%s", id.String()),
+			Header:     header,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "me ok",
+			Method:       http.MethodGet,
+			URL:          "/v1/me",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: fmt.Sprintf(`*{"id":"%s","username":"newuser","email":"user@example.com"*`, id.String()),
+		},
+		{
+			Name:         "me api key ok",
+			Method:       http.MethodGet,
+			URL:          "/v1/me",
+			Header:       apiKeyHeader("user-key"),
+			WantStatus:   http.StatusOK,
+			WantResponse: fmt.Sprintf(`*{"id":"%s"*`, id.String()),
+		},
+		{
+			Name:       "me auth error",
+			Method:     http.MethodGet,
+			URL:        "/v1/me",
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "me update ok",
+			Method:       http.MethodPatch,
+			URL:          "/v1/me",
+			Body:         `{"email": "me@example.com"}`,
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"username":"newuser","email":"me@example.com","email_verified":false*`,
+		},
+		{
+			Name:       "me update username with at sign",
+			Method:     http.MethodPatch,
+			URL:        "/v1/me",
+			Body:       `{"username": "me@example.com"}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "me update username too long",
+			Method:     http.MethodPatch,
+			URL:        "/v1/me",
+			Body:       fmt.Sprintf(`{"username": "%s"}`, strings.Repeat("a", 26)),
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "me update api key forbidden",
+			Method:     http.MethodPatch,
+			URL:        "/v1/me",
+			Body:       `{"username": "keyuser"}`,
+			Header:     apiKeyHeader("user-key"),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "me change password wrong current",
+			Method:       http.MethodPost,
+			URL:          "/v1/me/password",
+			Body:         `{"current_password": "secret","new_password": "changed"}`,
+			Header:       header,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"incorrect current password"*`,
+		},
+		{
+			Name:       "me change password validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/me/password",
+			Body:       `{"new_password": "changed"}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "me change password api key forbidden",
+			Method:     http.MethodPost,
+			URL:        "/v1/me/password",
+			Body:       `{"current_password": "newsecret","new_password": "changed"}`,
+			Header:     apiKeyHeader("user-key"),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "me change password ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/me/password",
+			Body:         `{"current_password": "newsecret","new_password": "changed"}`,
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "me update profile ok",
+			Method:     http.MethodPatch,
+			URL:        "/v1/me",
+			Body:       `{"display_name": "User","locale": "en-GB","timezone": "Europe/Berlin"}`,
+			Header:     header,
+			WantStatus: http.StatusOK,
+			WantResponse: `*"display_name":"User","bio":null,"locale":"en-GB","timezone":"Europe/Berlin",` +
+				`"avatar_url":null*`,
+		},
+		{
+			Name:         "me clear profile field ok",
+			Method:       http.MethodPatch,
+			URL:          "/v1/me",
+			Body:         `{"locale": ""}`,
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"display_name":"User","bio":null,"locale":null*`,
+		},
+		{
+			Name:         "get user with profile",
+			Method:       http.MethodGet,
+			URL:          fmt.Sprintf("/v1/user/%s", id.String()),
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"display_name":{"String":"User","Valid":true}*`,
+		},
+		{
+			Name:       "me update invalid locale",
+			Method:     http.MethodPatch,
+			URL:        "/v1/me",
+			Body:       `{"locale": "not a locale"}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "me update invalid timezone",
+			Method:     http.MethodPatch,
+			URL:        "/v1/me",
+			Body:       `{"timezone": "Mars/Olympus_Mons"}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "update other profile forbidden",
+			Method:     http.MethodPatch,
+			URL:        "/v1/user",
+			Body:       fmt.Sprintf(`{"id":"%s","display_name": "Other"}`, id.String()),
+			Header:     otherHeader,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "avatar not found",
+			Method:     http.MethodGet,
+			URL:        fmt.Sprintf("/v1/user/%s/avatar", id.String()),
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:       "avatar delete not found",
+			Method:     http.MethodDelete,
+			URL:        "/v1/me/avatar",
+			Header:     header,
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "avatar upload ok",
+			Method:       http.MethodPut,
+			URL:          "/v1/me/avatar",
+			Body:         avatarBody,
+			Header:       avatarHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: fmt.Sprintf(`*"avatar_url":"/v1/user/%s/avatar"*`, id.String()),
+		},
+		{
+			Name:       "avatar get ok",
+			Method:     http.MethodGet,
+			URL:        fmt.Sprintf("/v1/user/%s/avatar", id.String()),
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "avatar get thumbnail ok",
+			Method:     http.MethodGet,
+			URL:        fmt.Sprintf("/v1/user/%s/avatar?size=thumbnail", id.String()),
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "avatar get invalid size",
+			Method:     http.MethodGet,
+			URL:        fmt.Sprintf("/v1/user/%s/avatar?size=huge", id.String()),
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "avatar upload unsupported type",
+			Method:       http.MethodPut,
+			URL:          "/v1/me/avatar",
+			Body:         svgBody,
+			Header:       svgHeader,
+			WantStatus:   http.StatusUnsupportedMediaType,
+			WantResponse: `*"error":"unsupported or invalid image"*`,
+		},
+		{
+			Name:       "avatar upload too large",
+			Method:     http.MethodPut,
+			URL:        "/v1/me/avatar",
+			Body:       largeBody,
+			Header:     largeHeader,
+			WantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			Name:         "avatar upload missing field",
+			Method:       http.MethodPut,
+			URL:          "/v1/me/avatar",
+			Body:         fieldBody,
+			Header:       fieldHeader,
+			WantStatus:   http.StatusBadRequest,
+			WantResponse: `*"error":"'avatar' required"*`,
+		},
+		{
+			Name:       "avatar upload not multipart",
+			Method:     http.MethodPut,
+			URL:        "/v1/me/avatar",
+			Body:       `{}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "avatar upload api key forbidden",
+			Method:     http.MethodPut,
+			URL:        "/v1/me/avatar",
+			Body:       keyBody,
+			Header:     keyHeader,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "avatar delete ok",
+			Method:       http.MethodDelete,
+			URL:          "/v1/me/avatar",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "me delete api key forbidden",
+			Method:     http.MethodDelete,
+			URL:        "/v1/me",
+			Header:     apiKeyHeader("user-key"),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "me delete ok",
+			Method:       http.MethodDelete,
+			URL:          "/v1/me",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "me deleted",
+			Method:     http.MethodGet,
+			URL:        "/v1/me",
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "restore forbidden",
+			Method:     http.MethodPost,
+			URL:        fmt.Sprintf("/v1/user/%s/restore", id.String()),
+			Header:     otherHeader,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "restore ok",
+			Method:       http.MethodPost,
+			URL:          fmt.Sprintf("/v1/user/%s/restore", id.String()),
+			Header:       adminHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "restore not deleted",
+			Method:     http.MethodPost,
+			URL:        fmt.Sprintf("/v1/user/%s/restore", id.String()),
+			Header:     adminHeader,
+			WantStatus: http.StatusBadRequest,
+		},
 		{
 			Name:         "delete ok",
 			Method:       http.MethodDelete,
 			URL:          fmt.Sprintf("/v1/user/%s", id.String()),
-			Header:       header,
+			Header:       adminHeader,
 			WantStatus:   http.StatusOK,
 			WantResponse: `*"message":"success"*`,
 		},
@@ -158,7 +873,7 @@ func TestHandler(t *testing.T) {
 			Name:       "delete verify",
 			Method:     http.MethodDelete,
 			URL:        "/v1/user/xxx",
-			Header:     header,
+			Header:     adminHeader,
 			WantStatus: http.StatusBadRequest,
 		},
 		{
@@ -171,13 +886,153 @@ func TestHandler(t *testing.T) {
 			Name:         "delete error",
 			Method:       http.MethodDelete,
 			URL:          fmt.Sprintf("/v1/user/%s", uuid.New().String()),
-			Header:       header,
+			Header:       adminHeader,
 			WantStatus:   http.StatusBadRequest,
 			WantResponse: `*"error"*`,
 		},
+		{
+			Name:         "api key get all ok",
+			Method:       http.MethodGet,
+			URL:          "/v1/user/list?include_deleted=true&total=true",
+			Header:       apiKeyHeader("admin-key"),
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"total":2*`,
+		},
+		{
+			Name:       "api key out of scope",
+			Method:     http.MethodPatch,
+			URL:        "/v1/user",
+			Body:       fmt.Sprintf(`{"id":"%s","username": "newuser"}`, id.String()),
+			Header:     apiKeyHeader("admin-key"),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "api key update own forbidden",
+			Method:     http.MethodPatch,
+			URL:        "/v1/user",
+			Body:       fmt.Sprintf(`{"id":"%s","username": "newuser"}`, id.String()),
+			Header:     apiKeyHeader("user-key"),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "api key invalid",
+			Method:     http.MethodGet,
+			URL:        "/v1/user/list",
+			Header:     apiKeyHeader("xxx"),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "create api key ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/user/api-keys",
+			Body:         fmt.Sprintf(`{"name":"deploy","expires_at":"%s"}`, expiresAt),
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"key":"ak_*`,
+		},
+		{
+			Name:         "create scoped api key ok",
+			Method:       http.MethodPost,
+			URL:          "/v1/user/api-keys",
+			Body:         fmt.Sprintf(`{"name":"report","scopes":["%s"],"expires_at":"%s"}`, service.PermissionList, expiresAt),
+			Header:       adminHeader,
+			WantStatus:   http.StatusOK,
+			WantResponse: fmt.Sprintf(`*"scopes":["%s"]*`, service.PermissionList),
+		},
+		{
+			Name:       "create api key scope not held",
+			Method:     http.MethodPost,
+			URL:        "/v1/user/api-keys",
+			Body:       fmt.Sprintf(`{"name":"report","scopes":["%s"],"expires_at":"%s"}`, service.PermissionList, expiresAt),
+			Header:     header,
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "create api key expired",
+			Method:     http.MethodPost,
+			URL:        "/v1/user/api-keys",
+			Body:       `{"name":"deploy","expires_at":"2020-01-01T00:00:00Z"}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "create api key validate fail",
+			Method:     http.MethodPost,
+			URL:        "/v1/user/api-keys",
+			Body:       fmt.Sprintf(`{"expires_at":"%s"}`, expiresAt),
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:       "create api key with api key forbidden",
+			Method:     http.MethodPost,
+			URL:        "/v1/user/api-keys",
+			Body:       fmt.Sprintf(`{"name":"deploy","expires_at":"%s"}`, expiresAt),
+			Header:     apiKeyHeader("user-key"),
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:         "list api keys ok",
+			Method:       http.MethodGet,
+			URL:          "/v1/user/api-keys",
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"prefix":"ak_0123456789abcdef"*`,
+		},
+		{
+			Name:         "get api key ok",
+			Method:       http.MethodGet,
+			URL:          fmt.Sprintf("/v1/user/api-keys/%s", keyID),
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"name":"ci"*`,
+		},
+		{
+			Name:       "get api key of other user",
+			Method:     http.MethodGet,
+			URL:        fmt.Sprintf("/v1/user/api-keys/%s", keyID),
+			Header:     otherHeader,
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:         "rename api key ok",
+			Method:       http.MethodPatch,
+			URL:          fmt.Sprintf("/v1/user/api-keys/%s", keyID),
+			Body:         `{"name":"deploy"}`,
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "rename api key validate fail",
+			Method:     http.MethodPatch,
+			URL:        fmt.Sprintf("/v1/user/api-keys/%s", keyID),
+			Body:       `{"name":""}`,
+			Header:     header,
+			WantStatus: http.StatusBadRequest,
+		},
+		{
+			Name:         "delete api key ok",
+			Method:       http.MethodDelete,
+			URL:          fmt.Sprintf("/v1/user/api-keys/%s", keyID),
+			Header:       header,
+			WantStatus:   http.StatusOK,
+			WantResponse: `*"message":"success"*`,
+		},
+		{
+			Name:       "delete api key not found",
+			Method:     http.MethodDelete,
+			URL:        fmt.Sprintf("/v1/user/api-keys/%s", keyID),
+			Header:     header,
+			WantStatus: http.StatusNotFound,
+		},
 	}
 
 	for _, tc := range tests {
 		test.Endpoint(t, router, tc)
 	}
+
+	// the password change kept the session it was made with, both deletions ended all of them
+	assert.Equal(t, 3, sessions.Revoked[id])
+	assert.Empty(t, sessions.Kept[id])
 }
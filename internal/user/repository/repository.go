@@ -2,10 +2,16 @@ package repository
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/hinccvi/go-ddd/internal/entity"
 	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -13,12 +19,48 @@ type (
 	// Repository encapsulates the logic to access users from the data source.
 	Repository interface {
 		Get(ctx context.Context, id uuid.UUID) (entity.User, error)
-		Count(ctx context.Context) (int64, error)
-		Query(ctx context.Context, page, size int) ([]entity.User, error)
-		Create(ctx context.Context, u entity.User) error
+		Count(ctx context.Context, opts QueryOptions) (int64, error)
+		Query(ctx context.Context, opts QueryOptions) ([]entity.User, error)
+		Search(ctx context.Context, query string, limit int) ([]SearchResult, error)
+		Create(ctx context.Context, u entity.User) (uuid.UUID, error)
 		Update(ctx context.Context, u entity.User) error
 		Delete(ctx context.Context, id uuid.UUID) error
+		Restore(ctx context.Context, id uuid.UUID) error
+		UsernameExists(ctx context.Context, username string) (bool, error)
+		Purge(ctx context.Context, deletedBefore time.Time, limit int) ([]entity.User, error)
+		GetProfile(ctx context.Context, id uuid.UUID) (entity.User, error)
+		VerifyEmail(ctx context.Context, id uuid.UUID, email string) error
+		GetPassword(ctx context.Context, id uuid.UUID) (string, error)
+		UpdatePassword(ctx context.Context, id uuid.UUID, password string) error
+		UpdateAvatar(ctx context.Context, id uuid.UUID, key sql.NullString) (sql.NullString, error)
+		CreateAPIKey(ctx context.Context, key entity.APIKey) (uuid.UUID, error)
+		ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]entity.APIKey, error)
+		GetAPIKey(ctx context.Context, userID, id uuid.UUID) (entity.APIKey, error)
+		RenameAPIKey(ctx context.Context, userID, id uuid.UUID, name string) error
+		DeleteAPIKey(ctx context.Context, userID, id uuid.UUID) error
 	}
+
+	// QueryOptions filters, orders and pages the users returned by Query. Users are ordered by Sort and then
+	// by id, so the last user of a page is a unique position that the next page starts After.
+	// Count ignores the ordering and paging. UsernamePrefix is matched case-insensitively, like usernames are.
+	QueryOptions struct {
+		UsernamePrefix string
+		CreatedFrom    *time.Time
+		CreatedTo      *time.Time
+		IncludeDeleted bool
+		Sort           string
+		Desc           bool
+		After          *entity.User
+		Offset         int
+		Limit          int
+	}
+
+	// SearchResult is a user found by Search, Score is how closely it matched from 0 to 1.
+	SearchResult struct {
+		entity.User
+		Score float64 `db:"score"`
+	}
+
 	// repository persists albums in database.
 	repository struct {
 		db     *sqlx.DB
@@ -28,16 +70,105 @@ type (
 
 //nolint:gosec //false positive
 const (
-	getUser             string = `SELECT id, username FROM "user" WHERE id = $1 AND deleted_at IS NULL LIMIT 1`
-	countUser           string = `SELECT COUNT(id) FROM "user"`
-	queryUser           string = `SELECT id, username FROM "user" ORDER BY username LIMIT($1) OFFSET($2)`
-	createUser          string = `INSERT INTO "user" (username, password) VALUES (:username, :password)`
-	updateUserUsername  string = `UPDATE "user" SET username = VARCHAR(:username)`
+	getUser string = `SELECT id, username, display_name, bio, locale, timezone, version
+                    FROM "user"
+                    WHERE id = $1 AND deleted_at IS NULL
+                    LIMIT 1`
+	countUser string = `SELECT COUNT(id) FROM "user"`
+	queryUser string = `SELECT id, username, display_name, bio, locale, timezone, created_at, updated_at, deleted_at
+                      FROM "user"`
+	searchUser string = `SELECT id, username, display_name, bio, locale, timezone, created_at, updated_at, deleted_at,
+                              GREATEST(word_similarity($1, username), word_similarity($1, display_name),
+                                       word_similarity($1, bio)) AS score
+                       FROM "user"
+                       WHERE ($1 <% username OR $1 <% display_name OR $1 <% bio
+                              OR username ILIKE $2 OR display_name ILIKE $2)
+                             AND deleted_at IS NULL
+                       ORDER BY score DESC, username, id
+                       LIMIT $3`
+	setSearchThreshold string = `SELECT set_config('pg_trgm.word_similarity_threshold', $1, true)`
+	createUser         string = `INSERT INTO "user" (username, password, email) VALUES (:username, :password, :email) RETURNING id`
+	updateUser         string = `UPDATE "user"
+                               SET updated_at = (current_timestamp AT TIME ZONE 'UTC'), version = version + 1`
+	updateUserUsername  string = `, username = VARCHAR(:username)`
 	updateUserPassword  string = `, password = VARCHAR(:password)`
-	updateUserCondition string = ` WHERE id = UUID(:id)`
+	updateUserEmail     string = `, email = VARCHAR(:email), email_verified_at = NULL`
+	updateUserName      string = `, display_name = NULLIF(VARCHAR(:display_name), '')`
+	updateUserBio       string = `, bio = NULLIF(VARCHAR(:bio), '')`
+	updateUserLocale    string = `, locale = NULLIF(VARCHAR(:locale), '')`
+	updateUserTimezone  string = `, timezone = NULLIF(VARCHAR(:timezone), '')`
+	updateUserCondition string = ` WHERE id = UUID(:id) AND deleted_at IS NULL`
+	updateUserVersion   string = ` AND version = :version`
 	deleteUser          string = `UPDATE "user" 
-                       SET deleted_at = (current_timestamp AT TIME ZONE 'UTC') 
+                       SET deleted_at = (current_timestamp AT TIME ZONE 'UTC'), version = version + 1
                        WHERE id = $1 AND deleted_at IS NULL`
+	usernameExists string = `SELECT EXISTS (SELECT 1 FROM "user" WHERE LOWER(username) = LOWER($1) AND deleted_at IS NULL)`
+	restoreUser    string = `UPDATE "user"
+                            SET deleted_at = NULL, updated_at = (current_timestamp AT TIME ZONE 'UTC'),
+                                version = version + 1
+                            WHERE id = $1 AND deleted_at IS NOT NULL`
+	purgeUsers string = `DELETE FROM "user"
+                       WHERE id IN (SELECT id FROM "user" WHERE deleted_at < $1 ORDER BY deleted_at LIMIT $2)
+                       RETURNING id, avatar_key`
+	getUserProfile string = `SELECT id, username, email, email_verified_at, display_name, bio, locale, timezone,
+                                  avatar_key, created_at, updated_at
+                           FROM "user"
+                           WHERE id = $1 AND deleted_at IS NULL
+                           LIMIT 1`
+	verifyEmail string = `UPDATE "user"
+                        SET email_verified_at = (current_timestamp AT TIME ZONE 'UTC'), version = version + 1
+                        WHERE id = $1 AND LOWER(email) = LOWER($2) AND deleted_at IS NULL`
+	getUserPassword string = `SELECT password FROM "user" WHERE id = $1 AND deleted_at IS NULL LIMIT 1`
+	updatePassword  string = `UPDATE "user"
+                            SET password = $2, updated_at = (current_timestamp AT TIME ZONE 'UTC'),
+                                version = version + 1
+                            WHERE id = $1 AND deleted_at IS NULL`
+	updateAvatar string = `UPDATE "user" u
+                         SET avatar_key = $2, updated_at = (current_timestamp AT TIME ZONE 'UTC'),
+                             version = u.version + 1
+                         FROM (SELECT id, avatar_key FROM "user" WHERE id = $1 AND deleted_at IS NULL FOR UPDATE) old
+                         WHERE u.id = old.id
+                         RETURNING old.avatar_key`
+	createAPIKey string = `INSERT INTO api_key (user_id, name, prefix, key_hash, scopes, expires_at)
+                         VALUES (:user_id, :name, :prefix, :key_hash, :scopes, :expires_at)
+                         RETURNING id`
+	listAPIKeys string = `SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at
+                        FROM api_key
+                        WHERE user_id = $1
+                        ORDER BY created_at DESC`
+	getAPIKey string = `SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, created_at
+                      FROM api_key
+                      WHERE id = $1 AND user_id = $2
+                      LIMIT 1`
+	renameAPIKey string = `UPDATE api_key SET name = $3 WHERE id = $1 AND user_id = $2`
+	deleteAPIKey string = `DELETE FROM api_key WHERE id = $1 AND user_id = $2`
+)
+
+// ErrConflict is returned when a user would have the same username, email address or phone number
+// as an active user. ErrUsernameTaken and ErrEmailTaken tell which one.
+var (
+	ErrConflict      = errors.New("conflicts with an active user")
+	ErrUsernameTaken = fmt.Errorf("username: %w", ErrConflict)
+	ErrEmailTaken    = fmt.Errorf("email: %w", ErrConflict)
+)
+
+// uniqueViolation is the SQLSTATE of a unique index refusing a row.
+const uniqueViolation = "23505"
+
+// Unique indexes of the active users.
+const (
+	usernameKey = "user_username_key"
+	emailKey    = "user_email_key"
+)
+
+// searchThreshold is the word similarity a Search match needs. The pg_trgm default of 0.6 misses
+// most misspelled names.
+const searchThreshold = "0.3"
+
+// Fields users can be sorted by.
+const (
+	SortUsername  = "username"
+	SortCreatedAt = "created_at"
 )
 
 func New(db *sqlx.DB, logger log.Logger) Repository {
@@ -59,50 +190,168 @@ func (r repository) Get(ctx context.Context, id uuid.UUID) (entity.User, error)
 	return user, nil
 }
 
-func (r repository) Count(ctx context.Context) (int64, error) {
+func (r repository) Count(ctx context.Context, opts QueryOptions) (int64, error) {
+	where, args := opts.filter()
+
 	var total int64
-	if err := r.db.GetContext(ctx, &total, countUser); err != nil {
+	if err := r.db.GetContext(ctx, &total, countUser+where, args...); err != nil {
 		return 0, err
 	}
 
 	return total, nil
 }
 
-func (r repository) Query(ctx context.Context, page, size int) ([]entity.User, error) {
-	queryUserStmt, err := r.db.PreparexContext(ctx, queryUser)
-	if err != nil {
-		return []entity.User{}, err
+// Query returns a page of users. Pages are either read after a position with keyset pagination,
+// which stays fast and stable while users are added, or by offset.
+func (r repository) Query(ctx context.Context, opts QueryOptions) ([]entity.User, error) {
+	column, after := SortUsername, interface{}(nil)
+	if opts.After != nil {
+		after = opts.After.Username
+	}
+	if opts.Sort == SortCreatedAt {
+		column = SortCreatedAt
+		if opts.After != nil {
+			after = opts.After.CreatedAt
+		}
 	}
-	defer queryUserStmt.Close()
 
-	var users []entity.User
-	if err = queryUserStmt.SelectContext(ctx, &users, page, size); err != nil {
+	direction, comparison := "ASC", ">"
+	if opts.Desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	where, args := opts.filter()
+	if opts.After != nil {
+		args = append(args, after, opts.After.ID)
+		where += and(where) + fmt.Sprintf("(%s, id) %s ($%d, $%d)", column, comparison, len(args)-1, len(args))
+	}
+
+	args = append(args, opts.Limit, opts.Offset)
+	query := queryUser + where +
+		fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d OFFSET $%d", column, direction, direction, len(args)-1, len(args))
+
+	users := []entity.User{}
+	if err := r.db.SelectContext(ctx, &users, query, args...); err != nil {
 		return []entity.User{}, err
 	}
 
 	return users, nil
 }
 
-func (r repository) Create(ctx context.Context, u entity.User) error {
+// Search returns the users whose username, display name or bio contains or resembles query,
+// best matches first. The trigram indexes serve both the similarity and the substring match.
+func (r repository) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+	// the transaction only scopes the threshold, nothing is written
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err = tx.ExecContext(ctx, setSearchThreshold, searchThreshold); err != nil {
+		return []SearchResult{}, err
+	}
+
+	results := []SearchResult{}
+	if err = tx.SelectContext(ctx, &results, searchUser, query, "%"+escapeLike(query)+"%", limit); err != nil {
+		return []SearchResult{}, err
+	}
+
+	return results, nil
+}
+
+// filter returns the WHERE clause selecting the users of opts and its arguments.
+func (opts QueryOptions) filter() (string, []interface{}) {
+	var where string
+	var args []interface{}
+
+	if !opts.IncludeDeleted {
+		where += and(where) + "deleted_at IS NULL"
+	}
+
+	if opts.UsernamePrefix != "" {
+		args = append(args, likePrefix(opts.UsernamePrefix))
+		where += and(where) + fmt.Sprintf("LOWER(username) LIKE LOWER($%d)", len(args))
+	}
+
+	if opts.CreatedFrom != nil {
+		args = append(args, opts.CreatedFrom.UTC())
+		where += and(where) + fmt.Sprintf("created_at >= $%d", len(args))
+	}
+
+	if opts.CreatedTo != nil {
+		args = append(args, opts.CreatedTo.UTC())
+		where += and(where) + fmt.Sprintf("created_at < $%d", len(args))
+	}
+
+	return where, args
+}
+
+func and(where string) string {
+	if where == "" {
+		return " WHERE "
+	}
+
+	return " AND "
+}
+
+// likePrefix returns a LIKE pattern matching strings starting with prefix.
+func likePrefix(prefix string) string {
+	return escapeLike(prefix) + "%"
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func (r repository) Create(ctx context.Context, u entity.User) (uuid.UUID, error) {
 	createUserStmt, err := r.db.PrepareNamedContext(ctx, createUser)
 	if err != nil {
-		return err
+		return uuid.Nil, err
 	}
 	defer createUserStmt.Close()
 
-	if _, err = createUserStmt.ExecContext(ctx, u); err != nil {
-		return err
+	var id uuid.UUID
+	if err = createUserStmt.GetContext(ctx, &id, u); err != nil {
+		return uuid.Nil, uniqueConflict(err)
 	}
 
-	return nil
+	return id, nil
 }
 
+// Update changes the fields of a user that are set, the username, the password, the email address
+// and the profile. Profile fields set to an empty string are cleared. If the version is set, the user
+// is only changed if it is still at that version. Every update increments the version.
+// It fails with sql.ErrNoRows if no user was changed.
 func (r repository) Update(ctx context.Context, u entity.User) error {
-	query := updateUserUsername
+	query := updateUser
+	if u.Username != "" {
+		query += updateUserUsername
+	}
 	if u.Password != "" {
 		query += updateUserPassword
 	}
+	// a new email address has to be verified again
+	if u.Email.Valid {
+		query += updateUserEmail
+	}
+	if u.DisplayName.Valid {
+		query += updateUserName
+	}
+	if u.Bio.Valid {
+		query += updateUserBio
+	}
+	if u.Locale.Valid {
+		query += updateUserLocale
+	}
+	if u.Timezone.Valid {
+		query += updateUserTimezone
+	}
 	query += updateUserCondition
+	if u.Version != 0 {
+		query += updateUserVersion
+	}
 
 	updateUserStmt, err := r.db.PrepareNamedContext(ctx, query)
 	if err != nil {
@@ -110,11 +359,12 @@ func (r repository) Update(ctx context.Context, u entity.User) error {
 	}
 	defer updateUserStmt.Close()
 
-	if _, err = updateUserStmt.ExecContext(ctx, u); err != nil {
-		return err
+	res, err := updateUserStmt.ExecContext(ctx, u)
+	if err != nil {
+		return uniqueConflict(err)
 	}
 
-	return nil
+	return requireAffected(res)
 }
 
 func (r repository) Delete(ctx context.Context, id uuid.UUID) error {
@@ -124,9 +374,191 @@ func (r repository) Delete(ctx context.Context, id uuid.UUID) error {
 	}
 	defer deleteUserStmt.Close()
 
-	if _, err = deleteUserStmt.ExecContext(ctx, &id); err != nil {
+	res, err := deleteUserStmt.ExecContext(ctx, &id)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// Restore undoes the deletion of a user. It fails with ErrConflict if an active user took
+// their username, email address or phone number meanwhile.
+func (r repository) Restore(ctx context.Context, id uuid.UUID) error {
+	res, err := r.db.ExecContext(ctx, restoreUser, id)
+	if err != nil {
+		return uniqueConflict(err)
+	}
+
+	return requireAffected(res)
+}
+
+// UsernameExists reports whether an active user has username, compared case-insensitively.
+func (r repository) UsernameExists(ctx context.Context, username string) (bool, error) {
+	var exists bool
+	if err := r.db.GetContext(ctx, &exists, usernameExists, username); err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// Purge permanently deletes up to limit users that were deleted before deletedBefore, oldest first.
+// Their roles, keys and other rows are deleted with them. It returns the ID and avatar of each purged user.
+func (r repository) Purge(ctx context.Context, deletedBefore time.Time, limit int) ([]entity.User, error) {
+	users := []entity.User{}
+	if err := r.db.SelectContext(ctx, &users, purgeUsers, deletedBefore.UTC(), limit); err != nil {
+		return []entity.User{}, err
+	}
+
+	return users, nil
+}
+
+// GetProfile returns the account details of a user, including their email address and whether it was verified.
+func (r repository) GetProfile(ctx context.Context, id uuid.UUID) (entity.User, error) {
+	getProfileStmt, err := r.db.PreparexContext(ctx, getUserProfile)
+	if err != nil {
+		return entity.User{}, err
+	}
+	defer getProfileStmt.Close()
+
+	var user entity.User
+	if err = getProfileStmt.GetContext(ctx, &user, id); err != nil {
+		return entity.User{}, err
+	}
+
+	return user, nil
+}
+
+// VerifyEmail marks the email address of a user as verified. It fails with sql.ErrNoRows
+// if the user changed their email address in the meantime.
+func (r repository) VerifyEmail(ctx context.Context, id uuid.UUID, email string) error {
+	res, err := r.db.ExecContext(ctx, verifyEmail, id, email)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// GetPassword returns the password hash of a user.
+func (r repository) GetPassword(ctx context.Context, id uuid.UUID) (string, error) {
+	var password string
+	if err := r.db.GetContext(ctx, &password, getUserPassword, id); err != nil {
+		return "", err
+	}
+
+	return password, nil
+}
+
+// UpdatePassword replaces the password hash of a user.
+func (r repository) UpdatePassword(ctx context.Context, id uuid.UUID, password string) error {
+	res, err := r.db.ExecContext(ctx, updatePassword, id, password)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// UpdateAvatar replaces the avatar of a user and returns the key of the previous one, so its blobs can be removed.
+func (r repository) UpdateAvatar(ctx context.Context, id uuid.UUID, key sql.NullString) (sql.NullString, error) {
+	var previous sql.NullString
+	if err := r.db.GetContext(ctx, &previous, updateAvatar, id, key); err != nil {
+		return sql.NullString{}, err
+	}
+
+	return previous, nil
+}
+
+func (r repository) CreateAPIKey(ctx context.Context, key entity.APIKey) (uuid.UUID, error) {
+	createKeyStmt, err := r.db.PrepareNamedContext(ctx, createAPIKey)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer createKeyStmt.Close()
+
+	var id uuid.UUID
+	if err = createKeyStmt.GetContext(ctx, &id, key); err != nil {
+		return uuid.Nil, err
+	}
+
+	return id, nil
+}
+
+// ListAPIKeys returns the API keys of a user, newest first.
+func (r repository) ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]entity.APIKey, error) {
+	keys := []entity.APIKey{}
+	if err := r.db.SelectContext(ctx, &keys, listAPIKeys, userID); err != nil {
+		return []entity.APIKey{}, err
+	}
+
+	return keys, nil
+}
+
+// GetAPIKey returns an API key of a user. It fails with sql.ErrNoRows if the key belongs to someone else.
+func (r repository) GetAPIKey(ctx context.Context, userID, id uuid.UUID) (entity.APIKey, error) {
+	getKeyStmt, err := r.db.PreparexContext(ctx, getAPIKey)
+	if err != nil {
+		return entity.APIKey{}, err
+	}
+	defer getKeyStmt.Close()
+
+	var key entity.APIKey
+	if err = getKeyStmt.GetContext(ctx, &key, id, userID); err != nil {
+		return entity.APIKey{}, err
+	}
+
+	return key, nil
+}
+
+// RenameAPIKey renames an API key of a user. It fails with sql.ErrNoRows if the key belongs to someone else.
+func (r repository) RenameAPIKey(ctx context.Context, userID, id uuid.UUID, name string) error {
+	res, err := r.db.ExecContext(ctx, renameAPIKey, id, userID, name)
+	if err != nil {
 		return err
 	}
 
+	return requireAffected(res)
+}
+
+// DeleteAPIKey deletes an API key of a user. It fails with sql.ErrNoRows if the key belongs to someone else.
+func (r repository) DeleteAPIKey(ctx context.Context, userID, id uuid.UUID) error {
+	res, err := r.db.ExecContext(ctx, deleteAPIKey, id, userID)
+	if err != nil {
+		return err
+	}
+
+	return requireAffected(res)
+}
+
+// uniqueConflict translates a unique index of the database refusing a row into ErrUsernameTaken,
+// ErrEmailTaken or ErrConflict. Other errors are returned as is.
+func uniqueConflict(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != uniqueViolation {
+		return err
+	}
+
+	switch pgErr.ConstraintName {
+	case usernameKey:
+		return ErrUsernameTaken
+	case emailKey:
+		return ErrEmailTaken
+	default:
+		return ErrConflict
+	}
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
 	return nil
 }
@@ -6,10 +6,12 @@ import (
 	"errors"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/hinccvi/go-ddd/internal/entity"
 	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
 	"github.com/stretchr/testify/assert"
@@ -79,11 +81,28 @@ func TestCount(t *testing.T) {
 		rows := sqlmock.NewRows([]string{"total"}).
 			AddRow(expectedTotal)
 
-		mock.ExpectQuery(regexp.QuoteMeta(countUser)).WillReturnRows(rows)
+		mock.ExpectQuery(regexp.QuoteMeta(countUser + " WHERE deleted_at IS NULL")).WillReturnRows(rows)
 
 		repo := New(dbx, logger)
 		var total int64
-		total, err = repo.Count(context.TODO())
+		total, err = repo.Count(context.TODO(), QueryOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, expectedTotal, total)
+	})
+
+	t.Run("success: filtered", func(t *testing.T) {
+		var expectedTotal int64 = 1
+		rows := sqlmock.NewRows([]string{"total"}).
+			AddRow(expectedTotal)
+
+		from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		mock.ExpectQuery(regexp.QuoteMeta(countUser+" WHERE LOWER(username) LIKE LOWER($1) AND created_at >= $2")).
+			WithArgs(`a\_b%`, from).
+			WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+		var total int64
+		total, err = repo.Count(context.TODO(), QueryOptions{UsernamePrefix: "a_b", CreatedFrom: &from, IncludeDeleted: true})
 		assert.NoError(t, err)
 		assert.Equal(t, expectedTotal, total)
 	})
@@ -97,7 +116,7 @@ func TestCount(t *testing.T) {
 
 		repo := New(dbx, logger)
 		var total int64
-		total, err = repo.Count(context.TODO())
+		total, err = repo.Count(context.TODO(), QueryOptions{})
 		assert.NoError(t, err)
 		assert.Equal(t, expectedTotal, total)
 	})
@@ -106,7 +125,7 @@ func TestCount(t *testing.T) {
 		mock.ExpectQuery(regexp.QuoteMeta(countUser)).WillReturnError(errConnectionRefused)
 
 		repo := New(dbx, logger)
-		_, err = repo.Count(context.TODO())
+		_, err = repo.Count(context.TODO(), QueryOptions{})
 		assert.Error(t, err)
 	})
 }
@@ -128,24 +147,100 @@ func TestQuery(t *testing.T) {
 			AddRow(uuid.NewString(), "user2").
 			AddRow(uuid.NewString(), "user3")
 
-		mock.ExpectPrepare(regexp.QuoteMeta(queryUser)).ExpectQuery().WithArgs(1, 10).WillReturnRows(rows)
+		mock.ExpectQuery(regexp.QuoteMeta(queryUser+" WHERE deleted_at IS NULL"+
+			" ORDER BY username ASC, id ASC LIMIT $1 OFFSET $2")).
+			WithArgs(10, 0).
+			WillReturnRows(rows)
 
 		repo := New(dbx, logger)
 		var users []entity.User
-		users, err = repo.Query(context.TODO(), 1, 10)
+		users, err = repo.Query(context.TODO(), QueryOptions{Limit: 10})
 		assert.NoError(t, err)
 		assert.Len(t, users, 3)
 	})
 
+	t.Run("success: after", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"id", "username"}).
+			AddRow(uuid.NewString(), "user1")
+
+		after := entity.User{ID: uuid.New(), CreatedAt: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+		mock.ExpectQuery(regexp.QuoteMeta(queryUser+" WHERE LOWER(username) LIKE LOWER($1) AND (created_at, id) < ($2, $3)"+
+			" ORDER BY created_at DESC, id DESC LIMIT $4 OFFSET $5")).
+			WithArgs("user%", after.CreatedAt, after.ID, 10, 0).
+			WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+		var users []entity.User
+		users, err = repo.Query(context.TODO(), QueryOptions{
+			UsernamePrefix: "user",
+			IncludeDeleted: true,
+			Sort:           SortCreatedAt,
+			Desc:           true,
+			After:          &after,
+			Limit:          10,
+		})
+		assert.NoError(t, err)
+		assert.Len(t, users, 1)
+	})
+
 	t.Run("fail: db down", func(t *testing.T) {
-		mock.ExpectPrepare(regexp.QuoteMeta(queryUser)).ExpectQuery().WithArgs(1, 10).WillReturnError(errConnectionRefused)
+		mock.ExpectQuery(regexp.QuoteMeta(queryUser)).WithArgs(10, 0).WillReturnError(errConnectionRefused)
 
 		repo := New(dbx, logger)
-		_, err = repo.Query(context.TODO(), 1, 10)
+		_, err = repo.Query(context.TODO(), QueryOptions{Limit: 10})
 		assert.Error(t, err)
 	})
 }
 
+func TestSearch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"id", "username", "display_name", "score"}).
+			AddRow(uuid.NewString(), "john", nil, 0.8).
+			AddRow(uuid.NewString(), "jsmith", "John Smith", 0.6)
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(setSearchThreshold)).
+			WithArgs(searchThreshold).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta(searchUser)).WithArgs("jo_n", `%jo\_n%`, 10).WillReturnRows(rows)
+		mock.ExpectRollback()
+
+		repo := New(dbx, logger)
+		var results []SearchResult
+		results, err = repo.Search(context.TODO(), "jo_n", 10)
+		assert.NoError(t, err)
+		assert.Len(t, results, 2)
+		assert.Equal(t, "john", results[0].Username)
+		assert.Equal(t, 0.8, results[0].Score)
+		assert.Equal(t, "John Smith", results[1].DisplayName.String)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(setSearchThreshold)).
+			WithArgs(searchThreshold).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(regexp.QuoteMeta(searchUser)).WillReturnError(errConnectionRefused)
+		mock.ExpectRollback()
+
+		repo := New(dbx, logger)
+		_, err = repo.Search(context.TODO(), "john", 10)
+		assert.Error(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
 func TestCreate(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -158,18 +253,47 @@ func TestCreate(t *testing.T) {
 	logger := log.NewWithZap(l)
 
 	t.Run("success", func(t *testing.T) {
+		id := uuid.New()
 		u := entity.User{
 			Username: "user",
 			Password: "secret",
+			Email:    sql.NullString{String: "user@example.com", Valid: true},
 		}
-		mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO "user" (username, password)`)).
-			ExpectExec().
-			WithArgs(u.Username, u.Password).
-			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO "user" (username, password, email)`)).
+			ExpectQuery().
+			WithArgs(u.Username, u.Password, u.Email).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id.String()))
 
 		repo := New(dbx, logger)
-		err = repo.Create(context.TODO(), u)
+
+		var got uuid.UUID
+		got, err = repo.Create(context.TODO(), u)
 		assert.NoError(t, err)
+		assert.Equal(t, id, got)
+	})
+
+	t.Run("fail: taken", func(t *testing.T) {
+		u := entity.User{
+			Username: "User",
+			Password: "secret",
+			Email:    sql.NullString{String: "user@example.com", Valid: true},
+		}
+
+		for constraint, want := range map[string]error{
+			usernameKey:      ErrUsernameTaken,
+			emailKey:         ErrEmailTaken,
+			"user_phone_key": ErrConflict,
+		} {
+			mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO "user" (username, password, email)`)).
+				ExpectQuery().
+				WithArgs(u.Username, u.Password, u.Email).
+				WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: constraint})
+
+			repo := New(dbx, logger)
+			_, err = repo.Create(context.TODO(), u)
+			assert.ErrorIs(t, err, want, constraint)
+			assert.ErrorIs(t, err, ErrConflict, constraint)
+		}
 	})
 
 	t.Run("fail: db down", func(t *testing.T) {
@@ -177,11 +301,11 @@ func TestCreate(t *testing.T) {
 			Username: "user",
 			Password: "secret",
 		}
-		mock.ExpectPrepare(regexp.QuoteMeta(createUser)).
-			ExpectExec().WithArgs(u.Username, u.Password).WillReturnError(errConnectionRefused)
+		mock.ExpectPrepare(regexp.QuoteMeta(`INSERT INTO "user" (username, password, email)`)).
+			ExpectQuery().WithArgs(u.Username, u.Password, u.Email).WillReturnError(errConnectionRefused)
 
 		repo := New(dbx, logger)
-		err = repo.Create(context.TODO(), u)
+		_, err = repo.Create(context.TODO(), u)
 		assert.Error(t, err)
 	})
 }
@@ -213,6 +337,68 @@ func TestUpdate(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("success: unset fields are kept", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(`, password = VARCHAR($1) WHERE id = UUID($2) AND deleted_at IS NULL`)).
+			ExpectExec().
+			WithArgs(u.Password, u.ID).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		repo := New(dbx, logger)
+		err = repo.Update(context.TODO(), entity.User{ID: u.ID, Password: u.Password})
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: profile", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(`, display_name = NULLIF(VARCHAR($1), ''), `+
+			`bio = NULLIF(VARCHAR($2), ''), timezone = NULLIF(VARCHAR($3), '') WHERE id = UUID($4)`)).
+			ExpectExec().
+			WithArgs("User", "", "Europe/Berlin", u.ID).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		repo := New(dbx, logger)
+		err = repo.Update(context.TODO(), entity.User{
+			ID:          u.ID,
+			DisplayName: sql.NullString{String: "User", Valid: true},
+			Bio:         sql.NullString{Valid: true},
+			Timezone:    sql.NullString{String: "Europe/Berlin", Valid: true},
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: email", func(t *testing.T) {
+		email := sql.NullString{String: "user@example.com", Valid: true}
+		mock.ExpectPrepare(regexp.QuoteMeta(`, username = VARCHAR($1), password = VARCHAR($2), email = VARCHAR($3), email_verified_at = NULL`)).
+			ExpectExec().
+			WithArgs(u.Username, u.Password, email, u.ID).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		repo := New(dbx, logger)
+		err = repo.Update(context.TODO(), entity.User{ID: u.ID, Username: u.Username, Password: u.Password, Email: email})
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: version", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(`WHERE id = UUID($2) AND deleted_at IS NULL AND version = $3`)).
+			ExpectExec().
+			WithArgs(u.Password, u.ID, int64(2)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+
+		repo := New(dbx, logger)
+		err = repo.Update(context.TODO(), entity.User{ID: u.ID, Password: u.Password, Version: 2})
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: version mismatch", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(`AND version = $3`)).
+			ExpectExec().
+			WithArgs(u.Password, u.ID, int64(1)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.Update(context.TODO(), entity.User{ID: u.ID, Password: u.Password, Version: 1})
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
 	t.Run("fail: not found", func(t *testing.T) {
 		mock.ExpectPrepare(regexp.QuoteMeta(`UPDATE "user"`)).ExpectExec().
 			WithArgs(u.ID, u.Username, u.Password).
@@ -257,10 +443,10 @@ func TestDelete(t *testing.T) {
 
 	t.Run("fail: not found", func(t *testing.T) {
 		id := uuid.New()
-		mock.ExpectPrepare(regexp.QuoteMeta(deleteUser)).ExpectExec().WithArgs(id).WillReturnError(sql.ErrNoRows)
+		mock.ExpectPrepare(regexp.QuoteMeta(deleteUser)).ExpectExec().WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 0))
 		repo := New(dbx, logger)
 		err = repo.Delete(context.TODO(), id)
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
 	})
 
 	t.Run("fail: db down", func(t *testing.T) {
@@ -271,3 +457,479 @@ func TestDelete(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+func TestRestore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(restoreUser)).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.Restore(context.TODO(), id)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: not deleted", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(restoreUser)).WithArgs(id).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.Restore(context.TODO(), id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("fail: conflict", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(restoreUser)).
+			WithArgs(id).
+			WillReturnError(&pgconn.PgError{Code: "23505", ConstraintName: "user_username_key"})
+
+		repo := New(dbx, logger)
+		err = repo.Restore(context.TODO(), id)
+		assert.ErrorIs(t, err, ErrConflict)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(restoreUser)).WithArgs(id).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		err = repo.Restore(context.TODO(), id)
+		assert.ErrorIs(t, err, errConnectionRefused)
+	})
+}
+
+func TestUsernameExists(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	t.Run("success", func(t *testing.T) {
+		for _, exists := range []bool{true, false} {
+			mock.ExpectQuery(regexp.QuoteMeta(usernameExists)).
+				WithArgs("User").
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(exists))
+
+			repo := New(dbx, logger)
+			var got bool
+			got, err = repo.UsernameExists(context.TODO(), "User")
+			assert.NoError(t, err)
+			assert.Equal(t, exists, got)
+		}
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(usernameExists)).WithArgs("User").WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.UsernameExists(context.TODO(), "User")
+		assert.Error(t, err)
+	})
+}
+
+func TestPurge(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	before := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"id", "avatar_key"}).
+			AddRow(uuid.NewString(), nil).
+			AddRow(uuid.NewString(), "avatars/a.png")
+
+		mock.ExpectQuery(regexp.QuoteMeta(purgeUsers)).WithArgs(before, 100).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+		var users []entity.User
+		users, err = repo.Purge(context.TODO(), before, 100)
+		assert.NoError(t, err)
+		assert.Len(t, users, 2)
+		assert.False(t, users[0].AvatarKey.Valid)
+		assert.Equal(t, "avatars/a.png", users[1].AvatarKey.String)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(purgeUsers)).WithArgs(before, 100).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.Purge(context.TODO(), before, 100)
+		assert.Error(t, err)
+	})
+}
+
+func TestGetProfile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		verifiedAt := time.Now()
+		rows := sqlmock.NewRows([]string{"id", "username", "email", "email_verified_at"}).
+			AddRow(id.String(), "user", "user@example.com", verifiedAt)
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserProfile)).ExpectQuery().WithArgs(id).WillReturnRows(rows)
+		repo := New(dbx, logger)
+
+		var user entity.User
+		user, err = repo.GetProfile(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, "user@example.com", user.Email.String)
+		assert.True(t, user.EmailVerified())
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getUserProfile)).ExpectQuery().WithArgs(id).WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetProfile(context.TODO(), id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestVerifyEmail(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(verifyEmail)).WithArgs(id, "user@example.com").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.VerifyEmail(context.TODO(), id, "user@example.com")
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: email changed", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(verifyEmail)).WithArgs(id, "old@example.com").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.VerifyEmail(context.TODO(), id, "old@example.com")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+
+	t.Run("success: get", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(getUserPassword)).WithArgs(id).
+			WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow("hash"))
+
+		repo := New(dbx, logger)
+
+		var password string
+		password, err = repo.GetPassword(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, "hash", password)
+	})
+
+	t.Run("fail: get not found", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(getUserPassword)).WithArgs(id).WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetPassword(context.TODO(), id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("success: update", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(updatePassword)).WithArgs(id, "hash").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.UpdatePassword(context.TODO(), id, "hash")
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: update not found", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(updatePassword)).WithArgs(id, "hash").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.UpdatePassword(context.TODO(), id, "hash")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestUpdateAvatar(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+	key := sql.NullString{String: "avatars/new.png", Valid: true}
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(updateAvatar)).WithArgs(id, key).
+			WillReturnRows(sqlmock.NewRows([]string{"avatar_key"}).AddRow("avatars/old.png"))
+
+		repo := New(dbx, logger)
+
+		var previous sql.NullString
+		previous, err = repo.UpdateAvatar(context.TODO(), id, key)
+		assert.NoError(t, err)
+		assert.Equal(t, sql.NullString{String: "avatars/old.png", Valid: true}, previous)
+	})
+
+	t.Run("success: no previous avatar", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(updateAvatar)).WithArgs(id, sql.NullString{}).
+			WillReturnRows(sqlmock.NewRows([]string{"avatar_key"}).AddRow(nil))
+
+		repo := New(dbx, logger)
+
+		var previous sql.NullString
+		previous, err = repo.UpdateAvatar(context.TODO(), id, sql.NullString{})
+		assert.NoError(t, err)
+		assert.False(t, previous.Valid)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(updateAvatar)).WithArgs(id, key).
+			WillReturnRows(sqlmock.NewRows([]string{"avatar_key"}))
+
+		repo := New(dbx, logger)
+		_, err = repo.UpdateAvatar(context.TODO(), id, key)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestCreateAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	key := entity.APIKey{
+		UserID:    uuid.New(),
+		Name:      "ci",
+		Prefix:    "ak_0123456789abcdef",
+		KeyHash:   "hash",
+		Scopes:    "user:list",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	t.Run("success", func(t *testing.T) {
+		id := uuid.New()
+		mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO api_key")).ExpectQuery().
+			WithArgs(key.UserID, key.Name, key.Prefix, key.KeyHash, key.Scopes, key.ExpiresAt).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(id.String()))
+
+		repo := New(dbx, logger)
+
+		var got uuid.UUID
+		got, err = repo.CreateAPIKey(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, id, got)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO api_key")).ExpectQuery().WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.CreateAPIKey(context.TODO(), key)
+		assert.Error(t, err)
+	})
+}
+
+func TestListAPIKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	userID := uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "expires_at", "last_used_at", "created_at"}).
+			AddRow(uuid.NewString(), userID.String(), "ci", "ak_0123456789abcdef", "", time.Now(), nil, time.Now()).
+			AddRow(uuid.NewString(), userID.String(), "backup", "ak_fedcba9876543210", "", time.Now(), time.Now(), time.Now())
+
+		mock.ExpectQuery(regexp.QuoteMeta(listAPIKeys)).WithArgs(userID).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var keys []entity.APIKey
+		keys, err = repo.ListAPIKeys(context.TODO(), userID)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 2)
+		assert.True(t, keys[1].LastUsedAt.Valid)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectQuery(regexp.QuoteMeta(listAPIKeys)).WithArgs(userID).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		_, err = repo.ListAPIKeys(context.TODO(), userID)
+		assert.Error(t, err)
+	})
+}
+
+func TestGetAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id, userID := uuid.New(), uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		rows := sqlmock.NewRows([]string{"id", "user_id", "name", "prefix", "scopes", "expires_at", "last_used_at", "created_at"}).
+			AddRow(id.String(), userID.String(), "ci", "ak_0123456789abcdef", "", time.Now(), nil, time.Now())
+
+		mock.ExpectPrepare(regexp.QuoteMeta(getAPIKey)).ExpectQuery().WithArgs(id, userID).WillReturnRows(rows)
+
+		repo := New(dbx, logger)
+
+		var key entity.APIKey
+		key, err = repo.GetAPIKey(context.TODO(), userID, id)
+		assert.NoError(t, err)
+		assert.Equal(t, id, key.ID)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectPrepare(regexp.QuoteMeta(getAPIKey)).ExpectQuery().WithArgs(id, userID).WillReturnError(sql.ErrNoRows)
+
+		repo := New(dbx, logger)
+		_, err = repo.GetAPIKey(context.TODO(), userID, id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestRenameAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id, userID := uuid.New(), uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(renameAPIKey)).WithArgs(id, userID, "deploy").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.RenameAPIKey(context.TODO(), userID, id, "deploy")
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(renameAPIKey)).WithArgs(id, userID, "deploy").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.RenameAPIKey(context.TODO(), userID, id, "deploy")
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestDeleteAPIKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	dbx := sqlx.NewDb(db, "pgx")
+	defer db.Close()
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id, userID := uuid.New(), uuid.New()
+
+	t.Run("success", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(deleteAPIKey)).WithArgs(id, userID).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		repo := New(dbx, logger)
+		err = repo.DeleteAPIKey(context.TODO(), userID, id)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: not found", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(deleteAPIKey)).WithArgs(id, userID).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := New(dbx, logger)
+		err = repo.DeleteAPIKey(context.TODO(), userID, id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("fail: db down", func(t *testing.T) {
+		mock.ExpectExec(regexp.QuoteMeta(deleteAPIKey)).WithArgs(id, userID).WillReturnError(errConnectionRefused)
+
+		repo := New(dbx, logger)
+		err = repo.DeleteAPIKey(context.TODO(), userID, id)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/config"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/tools"
+)
+
+type (
+	// http request struct.
+	// Scopes are permission names, a key grants no permission outside of them.
+	CreateAPIKeyRequest struct {
+		Name      string    `json:"name" validate:"required,max=100"`
+		Scopes    []string  `json:"scopes" validate:"dive,required,max=100,excludesall= "`
+		ExpiresAt time.Time `json:"expires_at" validate:"required"`
+	}
+
+	APIKeyRequest struct {
+		ID *uuid.UUID `param:"id" validate:"required"`
+	}
+
+	RenameAPIKeyRequest struct {
+		ID   *uuid.UUID `param:"id" validate:"required"`
+		Name string     `json:"name" validate:"required,max=100"`
+	}
+
+	// http response struct.
+	// Key is only returned when the key is created.
+	apiKeyResponse struct {
+		ID         uuid.UUID  `json:"id"`
+		Name       string     `json:"name"`
+		Prefix     string     `json:"prefix"`
+		Key        string     `json:"key,omitempty"`
+		Scopes     []string   `json:"scopes"`
+		ExpiresAt  time.Time  `json:"expires_at"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+		CreatedAt  time.Time  `json:"created_at"`
+	}
+)
+
+func newAPIKeyResponse(key entity.APIKey) apiKeyResponse {
+	res := apiKeyResponse{
+		ID:        key.ID,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.ScopeList(),
+		ExpiresAt: key.ExpiresAt,
+		CreatedAt: key.CreatedAt,
+	}
+	if key.LastUsedAt.Valid {
+		res.LastUsedAt = &key.LastUsedAt.Time
+	}
+
+	return res
+}
+
+// CreateAPIKey creates an API key for a user. The key is only returned here, it is stored hashed.
+func (s service) CreateAPIKey(ctx context.Context, userID uuid.UUID, req CreateAPIKeyRequest) (apiKeyResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if !req.ExpiresAt.After(time.Now()) {
+		return apiKeyResponse{}, fmt.Errorf("[CreateAPIKey] internal error: %w", errs.ErrConditionNotFulfil)
+	}
+
+	if err := s.requireVerifiedEmail(ctx, userID, config.VerifyEmailForAPIKey); err != nil {
+		return apiKeyResponse{}, fmt.Errorf("[CreateAPIKey] internal error: %w", err)
+	}
+
+	key, prefix, err := tools.GenerateAPIKey()
+	if err != nil {
+		return apiKeyResponse{}, fmt.Errorf("[CreateAPIKey] internal error: %w", err)
+	}
+
+	apiKey := entity.APIKey{
+		UserID:    userID,
+		Name:      req.Name,
+		Prefix:    prefix,
+		KeyHash:   tools.SHA256(key),
+		Scopes:    strings.Join(req.Scopes, " "),
+		ExpiresAt: req.ExpiresAt.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if apiKey.ID, err = s.repo.CreateAPIKey(ctx, apiKey); err != nil {
+		return apiKeyResponse{}, fmt.Errorf("[CreateAPIKey] internal error: %w", err)
+	}
+
+	res := newAPIKeyResponse(apiKey)
+	res.Key = key
+
+	return res, nil
+}
+
+// ListAPIKeys returns the API keys of a user.
+func (s service) ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]apiKeyResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	keys, err := s.repo.ListAPIKeys(ctx, userID)
+	if err != nil {
+		return []apiKeyResponse{}, fmt.Errorf("[ListAPIKeys] internal error: %w", err)
+	}
+
+	res := make([]apiKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, newAPIKeyResponse(key))
+	}
+
+	return res, nil
+}
+
+// GetAPIKey returns an API key of a user.
+func (s service) GetAPIKey(ctx context.Context, userID, id uuid.UUID) (apiKeyResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	key, err := s.repo.GetAPIKey(ctx, userID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return apiKeyResponse{}, fmt.Errorf("[GetAPIKey] internal error: %w", errs.ErrAPIKeyNotFound)
+	case err != nil:
+		return apiKeyResponse{}, fmt.Errorf("[GetAPIKey] internal error: %w", err)
+	}
+
+	return newAPIKeyResponse(key), nil
+}
+
+// RenameAPIKey renames an API key of a user. Scopes and expiry cannot be changed, create a new key instead.
+func (s service) RenameAPIKey(ctx context.Context, userID uuid.UUID, req RenameAPIKeyRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	err := s.repo.RenameAPIKey(ctx, userID, *req.ID, req.Name)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("[RenameAPIKey] internal error: %w", errs.ErrAPIKeyNotFound)
+	case err != nil:
+		return fmt.Errorf("[RenameAPIKey] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteAPIKey revokes an API key of a user.
+func (s service) DeleteAPIKey(ctx context.Context, userID, id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	err := s.repo.DeleteAPIKey(ctx, userID, id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("[DeleteAPIKey] internal error: %w", errs.ErrAPIKeyNotFound)
+	case err != nil:
+		return fmt.Errorf("[DeleteAPIKey] internal error: %w", err)
+	}
+
+	return nil
+}
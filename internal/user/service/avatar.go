@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/storage"
+	"github.com/hinccvi/go-ddd/tools"
+)
+
+type (
+	// http request struct.
+	GetAvatarRequest struct {
+		ID   *uuid.UUID `param:"id" validate:"required"`
+		Size string     `query:"size" validate:"omitempty,oneof=thumbnail"`
+	}
+)
+
+// AvatarThumbnail is the size of GetAvatarRequest that returns the thumbnail of an avatar.
+const AvatarThumbnail = "thumbnail"
+
+const (
+	avatarPrefix    = "avatars"
+	thumbnailSuffix = "_thumb"
+)
+
+// UploadAvatar replaces the avatar of a user with a JPEG, PNG or GIF image. The image is re-encoded,
+// which drops metadata such as where a photo was taken, and a square thumbnail is stored next to it.
+func (s service) UploadAvatar(ctx context.Context, userID uuid.UUID, r io.Reader) (profileResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	data, err := io.ReadAll(io.LimitReader(r, int64(s.cfg.Avatar.MaxSize)+1))
+	if err != nil {
+		return profileResponse{}, fmt.Errorf("[UploadAvatar] internal error: %w", err)
+	}
+
+	if len(data) > s.cfg.Avatar.MaxSize {
+		return profileResponse{}, fmt.Errorf("[UploadAvatar] internal error: %w", errs.ErrImageTooLarge)
+	}
+
+	img, contentType, err := tools.DecodeImage(data, s.cfg.Avatar.MaxDimension)
+	if err != nil {
+		return profileResponse{}, fmt.Errorf("[UploadAvatar] internal error: %w", err)
+	}
+
+	avatar, contentType, err := tools.EncodeImage(img, contentType)
+	if err != nil {
+		return profileResponse{}, fmt.Errorf("[UploadAvatar] internal error: %w", err)
+	}
+
+	thumbnail, _, err := tools.EncodeImage(tools.Thumbnail(img, s.cfg.Avatar.ThumbnailSize), contentType)
+	if err != nil {
+		return profileResponse{}, fmt.Errorf("[UploadAvatar] internal error: %w", err)
+	}
+
+	// every upload gets a new key, so a cached avatar is never served for a new one
+	ext := ".png"
+	if contentType == "image/jpeg" {
+		ext = ".jpg"
+	}
+	key := fmt.Sprintf("%s/%s/%s%s", avatarPrefix, userID, uuid.NewString(), ext)
+
+	if err = s.blobs.Put(ctx, key, storage.Object{ContentType: contentType, Data: avatar}); err != nil {
+		return profileResponse{}, fmt.Errorf("[UploadAvatar] internal error: %w", err)
+	}
+
+	err = s.blobs.Put(ctx, thumbnailKey(key), storage.Object{ContentType: contentType, Data: thumbnail})
+	if err != nil {
+		s.deleteAvatarBlobs(ctx, key)
+		return profileResponse{}, fmt.Errorf("[UploadAvatar] internal error: %w", err)
+	}
+
+	previous, err := s.repo.UpdateAvatar(ctx, userID, sql.NullString{String: key, Valid: true})
+	if err != nil {
+		s.deleteAvatarBlobs(ctx, key)
+		return profileResponse{}, fmt.Errorf("[UploadAvatar] internal error: %w", err)
+	}
+
+	if previous.Valid {
+		s.deleteAvatarBlobs(ctx, previous.String)
+	}
+
+	user, err := s.repo.GetProfile(ctx, userID)
+	if err != nil {
+		return profileResponse{}, fmt.Errorf("[UploadAvatar] internal error: %w", err)
+	}
+
+	return newProfileResponse(user), nil
+}
+
+// DeleteAvatar removes the avatar of a user.
+func (s service) DeleteAvatar(ctx context.Context, userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	previous, err := s.repo.UpdateAvatar(ctx, userID, sql.NullString{})
+	if err != nil {
+		return fmt.Errorf("[DeleteAvatar] internal error: %w", err)
+	}
+
+	if !previous.Valid {
+		return fmt.Errorf("[DeleteAvatar] internal error: %w", errs.ErrAvatarNotFound)
+	}
+
+	s.deleteAvatarBlobs(ctx, previous.String)
+
+	return nil
+}
+
+// GetAvatar returns the avatar of a user, or its thumbnail.
+func (s service) GetAvatar(ctx context.Context, userID uuid.UUID, thumbnail bool) (storage.Object, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	user, err := s.repo.GetProfile(ctx, userID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return storage.Object{}, fmt.Errorf("[GetAvatar] internal error: %w", errs.ErrAvatarNotFound)
+	case err != nil:
+		return storage.Object{}, fmt.Errorf("[GetAvatar] internal error: %w", err)
+	}
+
+	if !user.AvatarKey.Valid {
+		return storage.Object{}, fmt.Errorf("[GetAvatar] internal error: %w", errs.ErrAvatarNotFound)
+	}
+
+	key := user.AvatarKey.String
+	if thumbnail {
+		key = thumbnailKey(key)
+	}
+
+	obj, err := s.blobs.Get(ctx, key)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return storage.Object{}, fmt.Errorf("[GetAvatar] internal error: %w", errs.ErrAvatarNotFound)
+	case err != nil:
+		return storage.Object{}, fmt.Errorf("[GetAvatar] internal error: %w", err)
+	}
+
+	return obj, nil
+}
+
+// deleteAvatarBlobs removes an avatar that is no longer referenced. A leftover blob is harmless,
+// so failures are only logged.
+func (s service) deleteAvatarBlobs(ctx context.Context, key string) {
+	for _, k := range []string{key, thumbnailKey(key)} {
+		if err := s.blobs.Delete(ctx, k); err != nil {
+			s.logger.Warnf("deleting avatar blob %s failed: %v", k, err)
+		}
+	}
+}
+
+// thumbnailKey returns the key of the thumbnail stored next to an avatar.
+func thumbnailKey(key string) string {
+	ext := path.Ext(key)
+
+	return strings.TrimSuffix(key, ext) + thumbnailSuffix + ext
+}
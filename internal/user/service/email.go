@@ -0,0 +1,179 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/tools"
+)
+
+type (
+	// http request struct.
+	VerifyEmailRequest struct {
+		Token string `json:"token" validate:"required"`
+	}
+)
+
+const (
+	emailVerification         = "email_verification"
+	emailVerificationCooldown = "email_verification_cooldown"
+
+	emailTokenSize = 32
+)
+
+// VerifyEmail marks an email address as verified with a token sent by sendVerificationEmail.
+// The token is consumed, and it is rejected if the user changed their email address since it was sent.
+func (s service) VerifyEmail(ctx context.Context, req VerifyEmailRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	key := s.getRedisKey(emailVerification, tools.SHA256(req.Token))
+
+	var get *redis.MapStringStringCmd
+	var del *redis.IntCmd
+	_, err := s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HGetAll(ctx, key)
+		del = pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("[VerifyEmail] internal error: %w", err)
+	}
+
+	if del.Val() == 0 {
+		return fmt.Errorf("[VerifyEmail] internal error: %w", errs.ErrInvalidEmailToken)
+	}
+
+	token := get.Val()
+
+	id, err := uuid.Parse(token["id"])
+	if err != nil {
+		return fmt.Errorf("[VerifyEmail] internal error: %w", errs.ErrInvalidEmailToken)
+	}
+
+	err = s.repo.VerifyEmail(ctx, id, token["email"])
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("[VerifyEmail] internal error: %w", errs.ErrInvalidEmailToken)
+	case err != nil:
+		return fmt.Errorf("[VerifyEmail] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// ResendVerificationEmail sends a new verification token to the email address of a user.
+// Users may request one email per cooldown.
+func (s service) ResendVerificationEmail(ctx context.Context, userID uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	user, err := s.repo.GetProfile(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("[ResendVerificationEmail] internal error: %w", err)
+	}
+
+	switch {
+	case !user.Email.Valid:
+		return fmt.Errorf("[ResendVerificationEmail] internal error: %w", errs.ErrNoEmail)
+	case user.EmailVerified():
+		return fmt.Errorf("[ResendVerificationEmail] internal error: %w", errs.ErrEmailVerified)
+	}
+
+	ok, err := s.rds.SetNX(
+		ctx,
+		s.getRedisKey(emailVerificationCooldown, userID.String()),
+		1,
+		time.Duration(s.cfg.EmailVerification.Cooldown)*time.Second,
+	).Result()
+	if err != nil {
+		return fmt.Errorf("[ResendVerificationEmail] internal error: %w", err)
+	}
+
+	if !ok {
+		return fmt.Errorf("[ResendVerificationEmail] internal error: %w", errs.ErrTooManyRequests)
+	}
+
+	if err = s.sendVerificationEmail(ctx, user); err != nil {
+		return fmt.Errorf("[ResendVerificationEmail] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// sendVerificationEmail emails a single-use token that verifies the email address of a user.
+func (s service) sendVerificationEmail(ctx context.Context, user entity.User) error {
+	b := make([]byte, emailTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	key := s.getRedisKey(emailVerification, tools.SHA256(token))
+
+	_, err := s.rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "id", user.ID.String(), "email", user.Email.String)
+		pipe.Expire(ctx, key, time.Duration(s.cfg.EmailVerification.TokenExpiration)*time.Minute)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.mail.Send(ctx, mail.Message{
+		To:      user.Email.String,
+		Subject: fmt.Sprintf("[%s] Verify your email address", s.cfg.App.Name),
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the link below to verify your email address. It expires in %d minutes.\n\n%s\n\n"+
+				"If you did not sign up with this email address, you can ignore this email.\n",
+			user.Username, s.cfg.EmailVerification.TokenExpiration, s.verifyURL(token),
+		),
+	})
+}
+
+// requireVerifiedEmail fails with ErrEmailNotVerified if users must verify their email address
+// for an action and the user has not.
+func (s service) requireVerifiedEmail(ctx context.Context, userID uuid.UUID, action string) error {
+	if !s.cfg.EmailVerification.Requires(action) {
+		return nil
+	}
+
+	user, err := s.repo.GetProfile(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if !user.EmailVerified() {
+		return errs.ErrEmailNotVerified
+	}
+
+	return nil
+}
+
+func (s service) verifyURL(token string) string {
+	u, err := url.Parse(s.cfg.EmailVerification.URL)
+	if err != nil {
+		return s.cfg.EmailVerification.URL + "?token=" + url.QueryEscape(token)
+	}
+
+	q := u.Query()
+	q.Set("token", token)
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+func (s service) getRedisKey(key, field string) string {
+	return fmt.Sprintf("%s:%s:%s", s.cfg.App.Name, key, field)
+}
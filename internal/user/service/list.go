@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/internal/user/repository"
+)
+
+type (
+	// http request struct.
+	// Pages are read with the next_cursor of the previous page. Page is the older offset pagination,
+	// which gets slower the further it goes and skips or repeats users added meanwhile.
+	// Sort is a field, prefixed with - for descending order. Total is only counted when asked for.
+	QueryUserRequest struct {
+		Cursor         string     `query:"cursor"`
+		Page           int        `query:"page" validate:"omitempty,min=1,excluded_with=Cursor"`
+		Size           int        `query:"size" validate:"omitempty,min=1,max=100"`
+		Username       string     `query:"username" validate:"max=25"`
+		CreatedFrom    *time.Time `query:"created_from"`
+		CreatedTo      *time.Time `query:"created_to"`
+		IncludeDeleted bool       `query:"include_deleted"`
+		Sort           string     `query:"sort" validate:"omitempty,oneof=username -username created_at -created_at"`
+		Total          bool       `query:"total"`
+	}
+
+	// http response struct.
+	userListResponse struct {
+		List       []entity.User `json:"list"`
+		Total      *int64        `json:"total,omitempty"`
+		NextCursor *string       `json:"next_cursor"`
+	}
+
+	// cursor is the position of the last user of a page in the order it was sorted by.
+	cursor struct {
+		Sort      string     `json:"s"`
+		Username  string     `json:"u,omitempty"`
+		CreatedAt *time.Time `json:"c,omitempty"`
+		ID        uuid.UUID  `json:"i"`
+	}
+)
+
+const defaultPageSize = 10
+
+func (s service) Query(ctx context.Context, req QueryUserRequest) (userListResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if req.Size == 0 {
+		req.Size = defaultPageSize
+	}
+
+	if req.Sort == "" {
+		req.Sort = repository.SortUsername
+	}
+
+	opts := repository.QueryOptions{
+		UsernamePrefix: req.Username,
+		CreatedFrom:    req.CreatedFrom,
+		CreatedTo:      req.CreatedTo,
+		IncludeDeleted: req.IncludeDeleted,
+		Sort:           strings.TrimPrefix(req.Sort, "-"),
+		Desc:           strings.HasPrefix(req.Sort, "-"),
+		// one more user than asked for tells whether there is a next page
+		Limit: req.Size + 1,
+	}
+
+	if req.Page > 1 {
+		opts.Offset = (req.Page - 1) * req.Size
+	}
+
+	if req.Cursor != "" {
+		after, err := decodeCursor(req.Cursor, req.Sort)
+		if err != nil {
+			return userListResponse{}, fmt.Errorf("[Query] internal error: %w", err)
+		}
+		opts.After = &after
+	}
+
+	items, err := s.repo.Query(ctx, opts)
+	if err != nil {
+		return userListResponse{}, fmt.Errorf("[Query] internal error: %w", err)
+	}
+
+	res := userListResponse{List: items}
+	if len(items) > req.Size {
+		res.List = items[:req.Size]
+
+		next, err := encodeCursor(res.List[req.Size-1], req.Sort)
+		if err != nil {
+			return userListResponse{}, fmt.Errorf("[Query] internal error: %w", err)
+		}
+		res.NextCursor = &next
+	}
+
+	if req.Total {
+		total, err := s.repo.Count(ctx, opts)
+		if err != nil {
+			return userListResponse{}, fmt.Errorf("[Query] internal error: %w", err)
+		}
+		res.Total = &total
+	}
+
+	return res, nil
+}
+
+// encodeCursor returns the opaque cursor of the page following u.
+func encodeCursor(u entity.User, sort string) (string, error) {
+	c := cursor{Sort: sort, ID: u.ID}
+	if strings.TrimPrefix(sort, "-") == repository.SortCreatedAt {
+		c.CreatedAt = &u.CreatedAt
+	} else {
+		c.Username = u.Username
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor returns the position a cursor continues after. A cursor only continues the order
+// it was created for.
+func decodeCursor(s, sort string) (entity.User, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return entity.User{}, errs.ErrInvalidCursor
+	}
+
+	var c cursor
+	if err = json.Unmarshal(b, &c); err != nil || c.Sort != sort || c.ID == uuid.Nil {
+		return entity.User{}, errs.ErrInvalidCursor
+	}
+
+	u := entity.User{ID: c.ID, Username: c.Username}
+	if strings.TrimPrefix(sort, "-") == repository.SortCreatedAt {
+		if c.CreatedAt == nil {
+			return entity.User{}, errs.ErrInvalidCursor
+		}
+		u.CreatedAt = *c.CreatedAt
+	}
+
+	return u, nil
+}
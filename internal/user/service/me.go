@@ -0,0 +1,172 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/entity"
+	errs "github.com/hinccvi/go-ddd/internal/errors"
+	"github.com/hinccvi/go-ddd/tools"
+)
+
+type (
+	// http request struct.
+	// Unset fields are left unchanged, profile fields set to an empty string are cleared.
+	UpdateProfileRequest struct {
+		Username    string  `json:"username" validate:"max=25,excludes=@"`
+		Email       string  `json:"email" validate:"omitempty,email,max=254"`
+		DisplayName *string `json:"display_name" validate:"omitempty,max=100"`
+		Bio         *string `json:"bio" validate:"omitempty,max=500"`
+		Locale      *string `json:"locale" validate:"omitempty,max=35,eq=|bcp47_language_tag"`
+		Timezone    *string `json:"timezone" validate:"omitempty,max=64,eq=|timezone"`
+	}
+
+	ChangePasswordRequest struct {
+		CurrentPassword string `json:"current_password" validate:"required"`
+		NewPassword     string `json:"new_password" validate:"required"`
+	}
+
+	// http response struct.
+	profileResponse struct {
+		ID            uuid.UUID `json:"id"`
+		Username      string    `json:"username"`
+		Email         *string   `json:"email"`
+		EmailVerified bool      `json:"email_verified"`
+		DisplayName   *string   `json:"display_name"`
+		Bio           *string   `json:"bio"`
+		Locale        *string   `json:"locale"`
+		Timezone      *string   `json:"timezone"`
+		AvatarURL     *string   `json:"avatar_url"`
+		CreatedAt     time.Time `json:"created_at"`
+		UpdatedAt     time.Time `json:"updated_at"`
+	}
+)
+
+// avatarPath is the route serving the avatar of a user, see GetAvatar.
+const avatarPath = "/v1/user/%s/avatar"
+
+func stringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+
+	return &s.String
+}
+
+func newProfileResponse(u entity.User) profileResponse {
+	res := profileResponse{
+		ID:            u.ID,
+		Username:      u.Username,
+		Email:         stringPtr(u.Email),
+		EmailVerified: u.EmailVerified(),
+		DisplayName:   stringPtr(u.DisplayName),
+		Bio:           stringPtr(u.Bio),
+		Locale:        stringPtr(u.Locale),
+		Timezone:      stringPtr(u.Timezone),
+		CreatedAt:     u.CreatedAt,
+		UpdatedAt:     u.UpdatedAt,
+	}
+	if u.AvatarKey.Valid {
+		avatarURL := fmt.Sprintf(avatarPath, u.ID)
+		res.AvatarURL = &avatarURL
+	}
+
+	return res
+}
+
+// GetProfile returns the account of the signed-in user.
+func (s service) GetProfile(ctx context.Context, userID uuid.UUID) (profileResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	user, err := s.repo.GetProfile(ctx, userID)
+	if err != nil {
+		return profileResponse{}, fmt.Errorf("[GetProfile] internal error: %w", err)
+	}
+
+	return newProfileResponse(user), nil
+}
+
+// UpdateProfile changes the username, email address and profile of the signed-in user.
+// The password is changed with ChangePassword, which asks for the current one.
+func (s service) UpdateProfile(ctx context.Context, userID uuid.UUID, req UpdateProfileRequest) (profileResponse, error) {
+	u := entity.User{
+		ID:          userID,
+		Username:    req.Username,
+		Email:       sql.NullString{String: req.Email, Valid: req.Email != ""},
+		DisplayName: tools.NullString(req.DisplayName),
+		Bio:         tools.NullString(req.Bio),
+		Locale:      tools.NullString(req.Locale),
+		Timezone:    tools.NullString(req.Timezone),
+	}
+	if err := s.Update(ctx, u); err != nil {
+		return profileResponse{}, fmt.Errorf("[UpdateProfile] internal error: %w", err)
+	}
+
+	res, err := s.GetProfile(ctx, userID)
+	if err != nil {
+		return profileResponse{}, fmt.Errorf("[UpdateProfile] internal error: %w", err)
+	}
+
+	return res, nil
+}
+
+// ChangePassword replaces the password of the signed-in user if the current one matches.
+// Every session but sessionID is ended, so a stolen session does not survive the change.
+func (s service) ChangePassword(
+	ctx context.Context,
+	userID uuid.UUID,
+	sessionID string,
+	req ChangePasswordRequest,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	current, err := s.repo.GetPassword(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("[ChangePassword] internal error: %w", err)
+	}
+
+	// a hash no hasher recognizes cannot match
+	ok, _, err := s.hashers.Verify(req.CurrentPassword, current)
+	if err != nil && !errors.Is(err, tools.ErrUnknownPasswordHash) {
+		return fmt.Errorf("[ChangePassword] internal error: %w", err)
+	}
+
+	if !ok {
+		return fmt.Errorf("[ChangePassword] internal error: %w", errs.ErrWrongPassword)
+	}
+
+	if err = s.checkPassword(ctx, entity.User{ID: userID, Password: req.NewPassword}); err != nil {
+		return fmt.Errorf("[ChangePassword] internal error: %w", err)
+	}
+
+	hashedPassword, err := s.hashers.Hash(req.NewPassword)
+	if err != nil {
+		return fmt.Errorf("[ChangePassword] internal error: %w", err)
+	}
+
+	if err = s.repo.UpdatePassword(ctx, userID, hashedPassword); err != nil {
+		return fmt.Errorf("[ChangePassword] internal error: %w", err)
+	}
+
+	if err = s.sessions.RevokeOtherSessions(ctx, userID, sessionID); err != nil {
+		return fmt.Errorf("[ChangePassword] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteAccount deletes the account of the signed-in user. Sessions are ended first,
+// so a failed deletion can be retried by signing in again.
+func (s service) DeleteAccount(ctx context.Context, userID uuid.UUID) error {
+	if err := s.Delete(ctx, userID); err != nil {
+		return fmt.Errorf("[DeleteAccount] internal error: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/user/repository"
+)
+
+type (
+	// http request struct.
+	SearchUserRequest struct {
+		Q    string `query:"q" validate:"required,max=100"`
+		Size int    `query:"size" validate:"omitempty,min=1,max=50"`
+	}
+
+	// http response struct.
+	// Highlights holds the matched fields with the matching words wrapped in <mark> tags.
+	// The rest of the text is HTML escaped, so it can be displayed as is.
+	searchResult struct {
+		ID          uuid.UUID         `json:"id"`
+		Username    string            `json:"username"`
+		DisplayName *string           `json:"display_name"`
+		Bio         *string           `json:"bio"`
+		Score       float64           `json:"score"`
+		Highlights  map[string]string `json:"highlights"`
+	}
+
+	searchResponse struct {
+		List []searchResult `json:"list"`
+	}
+)
+
+// highlightThreshold is the similarity a word needs to a word of the query to be highlighted,
+// it matches the threshold of the search.
+const highlightThreshold = 0.3
+
+// Search finds users by a partial or misspelled username, display name or bio, best matches first.
+func (s service) Search(ctx context.Context, req SearchUserRequest) (searchResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if req.Size == 0 {
+		req.Size = defaultPageSize
+	}
+
+	results, err := s.repo.Search(ctx, req.Q, req.Size)
+	if err != nil {
+		return searchResponse{}, fmt.Errorf("[Search] internal error: %w", err)
+	}
+
+	res := searchResponse{List: make([]searchResult, 0, len(results))}
+	for _, r := range results {
+		res.List = append(res.List, newSearchResult(r, req.Q))
+	}
+
+	return res, nil
+}
+
+func newSearchResult(r repository.SearchResult, q string) searchResult {
+	res := searchResult{
+		ID:          r.ID,
+		Username:    r.Username,
+		DisplayName: stringPtr(r.DisplayName),
+		Bio:         stringPtr(r.Bio),
+		Score:       r.Score,
+		Highlights:  map[string]string{},
+	}
+
+	for field, text := range map[string]string{
+		"username":     r.Username,
+		"display_name": r.DisplayName.String,
+		"bio":          r.Bio.String,
+	} {
+		if marked, ok := highlight(text, q); ok {
+			res.Highlights[field] = marked
+		}
+	}
+
+	return res
+}
+
+// highlight escapes text and wraps its words that contain or resemble a word of q in <mark> tags.
+// It reports whether any word matched.
+func highlight(text, q string) (string, bool) {
+	queryWords := words(strings.ToLower(q))
+
+	var b strings.Builder
+	var matched bool
+	last := 0
+	for _, span := range wordSpans(text) {
+		word := strings.ToLower(text[span[0]:span[1]])
+		for _, qw := range queryWords {
+			if strings.Contains(word, qw) || wordSimilarity(qw, word) >= highlightThreshold {
+				b.WriteString(html.EscapeString(text[last:span[0]]))
+				b.WriteString("<mark>" + html.EscapeString(text[span[0]:span[1]]) + "</mark>")
+				last, matched = span[1], true
+
+				break
+			}
+		}
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+
+	return b.String(), matched
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func words(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return !isWordRune(r) })
+}
+
+// wordSpans returns the byte offsets of the start and end of each word of s.
+func wordSpans(s string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range s {
+		switch {
+		case isWordRune(r) && start < 0:
+			start = i
+		case !isWordRune(r) && start >= 0:
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(s)})
+	}
+
+	return spans
+}
+
+// wordSimilarity returns the share of the trigrams of q that word contains. It approximates
+// word_similarity of pg_trgm for a single word: both are padded with two spaces in front and one behind.
+func wordSimilarity(q, word string) float64 {
+	tq, tw := trigrams(q), trigrams(word)
+
+	common := 0
+	for t := range tq {
+		if tw[t] {
+			common++
+		}
+	}
+
+	return float64(common) / float64(len(tq))
+}
+
+func trigrams(word string) map[string]bool {
+	r := []rune("  " + word + " ")
+
+	set := make(map[string]bool, len(r))
+	for i := 0; i+3 <= len(r); i++ {
+		set[string(r[i:i+3])] = true
+	}
+
+	return set
+}
@@ -5,14 +5,20 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v9"
 	"github.com/google/uuid"
+	"github.com/hinccvi/go-ddd/internal/config"
 	"github.com/hinccvi/go-ddd/internal/entity"
 	errs "github.com/hinccvi/go-ddd/internal/errors"
 	"github.com/hinccvi/go-ddd/internal/user/repository"
 	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/pkg/password"
+	"github.com/hinccvi/go-ddd/pkg/storage"
 	"github.com/hinccvi/go-ddd/tools"
 )
 
@@ -20,47 +26,131 @@ type (
 	// Service encapsulates usecase logic for user.
 	Service interface {
 		Get(ctx context.Context, id uuid.UUID) (entity.User, error)
-		Query(ctx context.Context, page, size int) ([]entity.User, int64, error)
+		// Query returns a page of users, see QueryUserRequest.
+		Query(ctx context.Context, req QueryUserRequest) (userListResponse, error)
+		// Search finds users by a partial or misspelled username, display name or bio.
+		Search(ctx context.Context, req SearchUserRequest) (searchResponse, error)
 		Create(ctx context.Context, u entity.User) error
+		// UsernameAvailability reports whether a username can be taken, usernames are case-insensitive.
+		UsernameAvailability(ctx context.Context, req UsernameAvailabilityRequest) (usernameAvailabilityResponse, error)
 		Update(ctx context.Context, u entity.User) error
+		// Delete deletes a user and ends their sessions. Deleted users can be restored until they are purged.
 		Delete(ctx context.Context, id uuid.UUID) error
+		// Restore undoes the deletion of a user.
+		Restore(ctx context.Context, id uuid.UUID) error
+		// PurgeDeleted permanently deletes the users deleted longer ago than the retention period.
+		PurgeDeleted(ctx context.Context) (int, error)
+		// VerifyEmail marks the email address of a user as verified with a token sent to it.
+		VerifyEmail(ctx context.Context, req VerifyEmailRequest) error
+		// ResendVerificationEmail sends a new verification token to the email address of a user.
+		ResendVerificationEmail(ctx context.Context, userID uuid.UUID) error
+		CreateAPIKey(ctx context.Context, userID uuid.UUID, req CreateAPIKeyRequest) (apiKeyResponse, error)
+		ListAPIKeys(ctx context.Context, userID uuid.UUID) ([]apiKeyResponse, error)
+		GetAPIKey(ctx context.Context, userID, id uuid.UUID) (apiKeyResponse, error)
+		RenameAPIKey(ctx context.Context, userID uuid.UUID, req RenameAPIKeyRequest) error
+		DeleteAPIKey(ctx context.Context, userID, id uuid.UUID) error
+		// GetProfile returns the account of the signed-in user.
+		GetProfile(ctx context.Context, userID uuid.UUID) (profileResponse, error)
+		// UpdateProfile changes the username, email address and profile of the signed-in user.
+		UpdateProfile(ctx context.Context, userID uuid.UUID, req UpdateProfileRequest) (profileResponse, error)
+		// ChangePassword replaces the password of the signed-in user and ends their other sessions.
+		ChangePassword(ctx context.Context, userID uuid.UUID, sessionID string, req ChangePasswordRequest) error
+		// DeleteAccount deletes the account of the signed-in user and ends all of their sessions.
+		DeleteAccount(ctx context.Context, userID uuid.UUID) error
+		// UploadAvatar replaces the avatar of a user with an uploaded image.
+		UploadAvatar(ctx context.Context, userID uuid.UUID, r io.Reader) (profileResponse, error)
+		// DeleteAvatar removes the avatar of a user.
+		DeleteAvatar(ctx context.Context, userID uuid.UUID) error
+		// GetAvatar returns the avatar of a user, or its thumbnail.
+		GetAvatar(ctx context.Context, userID uuid.UUID, thumbnail bool) (storage.Object, error)
+	}
+
+	// SessionRevoker ends the login sessions of a user, it is implemented by the auth service.
+	SessionRevoker interface {
+		RevokeOtherSessions(ctx context.Context, userID uuid.UUID, currentID string) error
+		LogoutAll(ctx context.Context, userID uuid.UUID) error
 	}
 
 	service struct {
-		rds     redis.Client
-		repo    repository.Repository
-		logger  log.Logger
-		timeout time.Duration
+		rds      redis.Client
+		repo     repository.Repository
+		logger   log.Logger
+		timeout  time.Duration
+		policy   *password.Policy
+		hashers  *tools.PasswordHashers
+		cfg      *config.Config
+		mail     mail.Mailer
+		sessions SessionRevoker
+		blobs    storage.BlobStore
 	}
 
 	GetUserRequest struct {
 		ID *uuid.UUID `param:"id" validate:"required"`
 	}
 
-	QueryUserRequest struct {
-		Page int `query:"page"`
-		Size int `query:"size"`
-	}
-
+	// Usernames may not contain @, so that a login is either a username or an email address.
 	CreateUserRequest struct {
-		Username string `json:"username" validate:"required"`
+		Username string `json:"username" validate:"required,max=25,excludes=@"`
 		Password string `json:"password" validate:"required"`
+		Email    string `json:"email" validate:"omitempty,email,max=254"`
 	}
 
+	UsernameAvailabilityRequest struct {
+		Username string `query:"username" validate:"required,max=25,excludes=@"`
+	}
+
+	// Profile fields set to an empty string are cleared. The id of a patch is taken from the query.
 	UpdateUserRequest struct {
-		ID       uuid.UUID `json:"id" validate:"required"`
-		Username string    `json:"username"`
-		Password string    `json:"password"`
+		ID          uuid.UUID `json:"id" query:"id" validate:"required"`
+		Username    string    `json:"username" validate:"max=25,excludes=@"`
+		Password    string    `json:"password"`
+		Email       string    `json:"email" validate:"omitempty,email,max=254"`
+		DisplayName *string   `json:"display_name" validate:"omitempty,max=100"`
+		Bio         *string   `json:"bio" validate:"omitempty,max=500"`
+		Locale      *string   `json:"locale" validate:"omitempty,max=35,eq=|bcp47_language_tag"`
+		Timezone    *string   `json:"timezone" validate:"omitempty,max=64,eq=|timezone"`
+	}
+
+	// http response struct.
+	usernameAvailabilityResponse struct {
+		Username  string `json:"username"`
+		Available bool   `json:"available"`
 	}
 
 	DeleteUserRequest struct {
 		ID *uuid.UUID `param:"id" validate:"required"`
 	}
+
+	RestoreUserRequest struct {
+		ID *uuid.UUID `param:"id" validate:"required"`
+	}
+)
+
+// Permissions guarding the user management endpoints. They are seeded by the rbac migration.
+const (
+	PermissionList    = "user:list"
+	PermissionUpdate  = "user:update"
+	PermissionDelete  = "user:delete"
+	PermissionRestore = "user:restore"
 )
 
-// NewService creates a new user service.
-func New(rds redis.Client, repo repository.Repository, logger log.Logger, timeout time.Duration) Service {
-	return service{rds, repo, logger, timeout}
+// NewService creates a new user service. Passwords users choose are checked against policy
+// and hashed with the current algorithm of hashers. Email verification tokens are sent with mailer.
+// Sessions are ended with sessions when users change their password or delete their account.
+// Avatars are kept in blobs.
+func New(
+	cfg *config.Config,
+	rds redis.Client,
+	repo repository.Repository,
+	policy *password.Policy,
+	hashers *tools.PasswordHashers,
+	mailer mail.Mailer,
+	sessions SessionRevoker,
+	blobs storage.BlobStore,
+	logger log.Logger,
+	timeout time.Duration,
+) Service {
+	return service{rds, repo, logger, timeout, policy, hashers, cfg, mailer, sessions, blobs}
 }
 
 func (s service) Get(ctx context.Context, id uuid.UUID) (entity.User, error) {
@@ -78,28 +168,11 @@ func (s service) Get(ctx context.Context, id uuid.UUID) (entity.User, error) {
 	return item, nil
 }
 
-func (s service) Query(ctx context.Context, page, size int) ([]entity.User, int64, error) {
-	ctx, cancel := context.WithTimeout(ctx, s.timeout)
-	defer cancel()
-
-	items, err := s.repo.Query(ctx, page, size)
-	if err != nil {
-		return []entity.User{}, 0, fmt.Errorf("[Query] internal error: %w", err)
-	}
-
-	total, err := s.repo.Count(ctx)
-	if err != nil {
-		return []entity.User{}, 0, fmt.Errorf("[Query] internal error: %w", err)
-	}
-
-	return items, total, nil
-}
-
 func (s service) Count(ctx context.Context) (int64, error) {
 	ctx, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
-	return s.repo.Count(ctx)
+	return s.repo.Count(ctx, repository.QueryOptions{})
 }
 
 func (s service) Create(ctx context.Context, u entity.User) error {
@@ -110,25 +183,42 @@ func (s service) Create(ctx context.Context, u entity.User) error {
 		return fmt.Errorf("[Create] internal error: %w", errs.ErrEmptyField)
 	}
 
-	hashedPassword, err := tools.Bcrypt(u.Password)
+	if err := s.policy.Check(u.Password, u.Username); err != nil {
+		return fmt.Errorf("[Create] internal error: %w", err)
+	}
+
+	hashedPassword, err := s.hashers.Hash(u.Password)
 	if err != nil {
 		return fmt.Errorf("[Create] internal error: %w", err)
 	}
 	u.Password = hashedPassword
 
-	if err = s.repo.Create(ctx, u); err != nil {
-		return fmt.Errorf("[Create] internal error: %w", err)
+	if u.ID, err = s.repo.Create(ctx, u); err != nil {
+		return fmt.Errorf("[Create] internal error: %w", conflictError(err))
+	}
+
+	// the user exists either way, a lost email can be sent again
+	if u.Email.Valid {
+		if err = s.sendVerificationEmail(ctx, u); err != nil {
+			s.logger.Warnf("sending verification email to user %s failed: %v", u.ID, err)
+		}
 	}
 
 	return nil
 }
 
+// Update changes the fields of a user that are set. If the version of u is set, the user is only
+// changed if nobody else changed it since, otherwise it fails with ErrPreconditionFailed.
 func (s service) Update(ctx context.Context, u entity.User) error {
 	ctx, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
 	if u.Password != "" {
-		hashedPassword, err := tools.Bcrypt(u.Password)
+		if err := s.checkPassword(ctx, u); err != nil {
+			return fmt.Errorf("[Update] internal error: %w", err)
+		}
+
+		hashedPassword, err := s.hashers.Hash(u.Password)
 		if err != nil {
 			return fmt.Errorf("[Update] internal error: %w", err)
 		}
@@ -136,20 +226,154 @@ func (s service) Update(ctx context.Context, u entity.User) error {
 		u.Password = hashedPassword
 	}
 
-	if err := s.repo.Update(ctx, u); err != nil {
-		return fmt.Errorf("[Update] internal error: %w", err)
+	// a changed email address has to be verified again, an unchanged one stays verified
+	var verify entity.User
+	if u.Email.Valid {
+		current, err := s.repo.GetProfile(ctx, u.ID)
+		if err != nil {
+			return fmt.Errorf("[Update] internal error: %w", err)
+		}
+
+		if current.Email.Valid && strings.EqualFold(current.Email.String, u.Email.String) {
+			u.Email = sql.NullString{}
+		} else {
+			verify = entity.User{ID: u.ID, Username: current.Username, Email: u.Email}
+		}
+	}
+
+	err := s.repo.Update(ctx, u)
+	if errors.Is(err, sql.ErrNoRows) && u.Version != 0 {
+		// the user was either changed since the version was read or does not exist
+		if _, err = s.repo.Get(ctx, u.ID); err == nil {
+			err = errs.ErrPreconditionFailed
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("[Update] internal error: %w", conflictError(err))
+	}
+
+	if verify.Email.Valid {
+		if err := s.sendVerificationEmail(ctx, verify); err != nil {
+			s.logger.Warnf("sending verification email to user %s failed: %v", u.ID, err)
+		}
 	}
 
 	return nil
 }
 
+// Delete deletes a user. Sessions are ended first, so a failed deletion does not leave
+// a deleted user signed in.
 func (s service) Delete(ctx context.Context, id uuid.UUID) error {
 	ctx, cancel := context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
+	if err := s.sessions.LogoutAll(ctx, id); err != nil {
+		return fmt.Errorf("[Delete] internal error: %w", err)
+	}
+
 	if err := s.repo.Delete(ctx, id); err != nil {
 		return fmt.Errorf("[Delete] internal error: %w", err)
 	}
 
 	return nil
 }
+
+func (s service) Restore(ctx context.Context, id uuid.UUID) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	err := s.repo.Restore(ctx, id)
+	switch {
+	case errors.Is(err, repository.ErrConflict):
+		return fmt.Errorf("[Restore] internal error: %w", errs.ErrRestoreConflict)
+	case err != nil:
+		return fmt.Errorf("[Restore] internal error: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeDeleted permanently deletes the users deleted more than the configured retention ago, in batches
+// so a large backlog does not hold locks for long. The avatars of purged users are removed as well.
+// It returns how many users were purged.
+func (s service) PurgeDeleted(ctx context.Context) (int, error) {
+	retention := s.cfg.SoftDelete.Retention
+	if retention <= 0 || s.cfg.SoftDelete.PurgeBatch <= 0 {
+		return 0, nil
+	}
+
+	deletedBefore := time.Now().AddDate(0, 0, -retention)
+
+	var total int
+	for {
+		purged, err := s.purgeBatch(ctx, deletedBefore)
+		if err != nil {
+			return total, fmt.Errorf("[PurgeDeleted] internal error: %w", err)
+		}
+
+		total += len(purged)
+
+		for _, u := range purged {
+			if u.AvatarKey.Valid {
+				s.deleteAvatarBlobs(ctx, u.AvatarKey.String)
+			}
+		}
+
+		if len(purged) < s.cfg.SoftDelete.PurgeBatch {
+			return total, nil
+		}
+	}
+}
+
+func (s service) purgeBatch(ctx context.Context, deletedBefore time.Time) ([]entity.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	return s.repo.Purge(ctx, deletedBefore, s.cfg.SoftDelete.PurgeBatch)
+}
+
+// UsernameAvailability reports whether no active user has the username. Create can still fail
+// with ErrUsernameTaken if someone takes it first.
+func (s service) UsernameAvailability(
+	ctx context.Context,
+	req UsernameAvailabilityRequest,
+) (usernameAvailabilityResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	exists, err := s.repo.UsernameExists(ctx, req.Username)
+	if err != nil {
+		return usernameAvailabilityResponse{}, fmt.Errorf("[UsernameAvailability] internal error: %w", err)
+	}
+
+	return usernameAvailabilityResponse{Username: req.Username, Available: !exists}, nil
+}
+
+// conflictError translates a conflict with an active user reported by the repository into the domain error
+// telling which field conflicts. Other errors are returned as is.
+func conflictError(err error) error {
+	switch {
+	case errors.Is(err, repository.ErrUsernameTaken):
+		return errs.ErrUsernameTaken
+	case errors.Is(err, repository.ErrEmailTaken):
+		return errs.ErrEmailTaken
+	default:
+		return err
+	}
+}
+
+// checkPassword checks the new password of an updated user against the policy.
+// The current username is used if the update does not change it.
+func (s service) checkPassword(ctx context.Context, u entity.User) error {
+	if u.Username == "" {
+		current, err := s.repo.Get(ctx, u.ID)
+		if err != nil {
+			return err
+		}
+
+		u.Username = current.Username
+	}
+
+	return s.policy.Check(u.Password, u.Username)
+}
@@ -1,8 +1,15 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,10 +20,16 @@ import (
 	errs "github.com/hinccvi/go-ddd/internal/errors"
 	"github.com/hinccvi/go-ddd/internal/mocks"
 	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/hinccvi/go-ddd/pkg/mail"
+	"github.com/hinccvi/go-ddd/pkg/password"
+	"github.com/hinccvi/go-ddd/pkg/storage"
 	"github.com/hinccvi/go-ddd/tools"
 	"github.com/stretchr/testify/assert"
 )
 
+//nolint:gochecknoglobals // test fixture
+var testHashers = tools.NewPasswordHashers(tools.BcryptHasher{Cost: tools.BcryptCost})
+
 func TestGet(t *testing.T) {
 	cfg, err := config.Load("local")
 	assert.NoError(t, err)
@@ -38,7 +51,10 @@ func TestGet(t *testing.T) {
 			UpdatedAt: time.Now(),
 			DeletedAt: sql.NullTime{}},
 	}}
-	s := service{rds, repo, logger, 2 * time.Second}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+	}
 
 	t.Run("success", func(t *testing.T) {
 		var resp entity.User
@@ -71,33 +87,153 @@ func TestQuery(t *testing.T) {
 	l, _ := log.NewForTest()
 	logger := log.NewWithZap(l)
 
-	id := uuid.New()
+	now := time.Now()
 	repo := &mocks.UserRepository{Items: []entity.User{
-		{
-			ID:        id,
-			Username:  "user",
-			Password:  "secret",
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
-			DeletedAt: sql.NullTime{}},
+		{ID: uuid.New(), Username: "carol", CreatedAt: now},
+		{ID: uuid.New(), Username: "alice", CreatedAt: now.Add(time.Minute)},
+		{ID: uuid.New(), Username: "bob", CreatedAt: now.Add(2 * time.Minute)},
+		{ID: uuid.New(), Username: "alan", CreatedAt: now.Add(3 * time.Minute), DeletedAt: sql.NullTime{Time: now, Valid: true}},
 	}}
-	s := service{rds, repo, logger, 2 * time.Second}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+	}
+
+	usernames := func(list []entity.User) []string {
+		names := []string{}
+		for _, u := range list {
+			names = append(names, u.Username)
+		}
+
+		return names
+	}
 
 	t.Run("success", func(t *testing.T) {
-		var list []entity.User
-		var total int64
-		list, total, err = s.Query(context.TODO(), 1, 10)
+		var res userListResponse
+		res, err = s.Query(context.TODO(), QueryUserRequest{Size: 10, Total: true})
 		assert.NoError(t, err)
-		assert.Len(t, list, 1)
-		assert.Equal(t, total, int64(1))
+		assert.Equal(t, []string{"alice", "bob", "carol"}, usernames(res.List))
+		assert.Equal(t, int64(3), *res.Total)
+		assert.Nil(t, res.NextCursor)
+	})
+
+	t.Run("success: cursor", func(t *testing.T) {
+		var res userListResponse
+		res, err = s.Query(context.TODO(), QueryUserRequest{Size: 2, Sort: "-created_at"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"bob", "alice"}, usernames(res.List))
+		assert.Nil(t, res.Total)
+		assert.NotNil(t, res.NextCursor)
+
+		res, err = s.Query(context.TODO(), QueryUserRequest{Size: 2, Sort: "-created_at", Cursor: *res.NextCursor})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"carol"}, usernames(res.List))
+		assert.Nil(t, res.NextCursor)
+	})
+
+	t.Run("success: page", func(t *testing.T) {
+		var res userListResponse
+		res, err = s.Query(context.TODO(), QueryUserRequest{Size: 2, Page: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"carol"}, usernames(res.List))
+	})
+
+	t.Run("success: filters", func(t *testing.T) {
+		from := now.Add(time.Minute)
+		var res userListResponse
+		res, err = s.Query(context.TODO(), QueryUserRequest{
+			Username:       "al",
+			CreatedFrom:    &from,
+			IncludeDeleted: true,
+			Total:          true,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"alan", "alice"}, usernames(res.List))
+		assert.Equal(t, int64(2), *res.Total)
+	})
+
+	t.Run("fail: invalid cursor", func(t *testing.T) {
+		var res userListResponse
+		res, err = s.Query(context.TODO(), QueryUserRequest{Size: 1})
+		assert.NoError(t, err)
+
+		for _, req := range []QueryUserRequest{
+			{Cursor: "not a cursor"},
+			{Cursor: *res.NextCursor, Sort: "-username"},
+		} {
+			_, err = s.Query(context.TODO(), req)
+			assert.ErrorIs(t, err, errs.ErrInvalidCursor)
+		}
+	})
+
+	t.Run("fail: db error", func(t *testing.T) {
+		_, err = s.Query(context.TODO(), QueryUserRequest{Size: -1})
+		assert.Error(t, err)
+	})
+}
+
+func TestSearch(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	repo := &mocks.UserRepository{Items: []entity.User{
+		{ID: uuid.New(), Username: "jsmith", DisplayName: sql.NullString{String: "John <Smith>", Valid: true}},
+		{ID: uuid.New(), Username: "john"},
+		{ID: uuid.New(), Username: "alice"},
+	}}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+	}
+
+	t.Run("success", func(t *testing.T) {
+		var res searchResponse
+		res, err = s.Search(context.TODO(), SearchUserRequest{Q: "john"})
+		assert.NoError(t, err)
+		assert.Len(t, res.List, 2)
+
+		assert.Equal(t, "john", res.List[0].Username)
+		assert.Equal(t, map[string]string{"username": "<mark>john</mark>"}, res.List[0].Highlights)
+
+		assert.Equal(t, "jsmith", res.List[1].Username)
+		assert.Equal(t, map[string]string{"display_name": "<mark>John</mark> &lt;Smith&gt;"}, res.List[1].Highlights)
 	})
 
 	t.Run("fail: db error", func(t *testing.T) {
-		_, _, err = s.Query(context.TODO(), 1, -1)
+		_, err = s.Search(context.TODO(), SearchUserRequest{Q: "error"})
 		assert.Error(t, err)
 	})
 }
 
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		text, q, want string
+		matched       bool
+	}{
+		{"John Smith", "john", "<mark>John</mark> Smith", true},
+		{"John Smith", "jonh smiht", "<mark>John</mark> <mark>Smith</mark>", true},
+		{"johnny_b", "john", "<mark>johnny</mark>_b", true},
+		{"Émile Zola", "emile", "<mark>Émile</mark> Zola", true},
+		{"Alice Smith", "bob", "Alice Smith", false},
+		{"Élodie", "élo", "<mark>Élodie</mark>", true},
+		{"a & b", "c", "a &amp; b", false},
+		{"", "john", "", false},
+	}
+
+	for _, test := range tests {
+		got, matched := highlight(test.text, test.q)
+		assert.Equal(t, test.want, got, test.text)
+		assert.Equal(t, test.matched, matched, test.text)
+	}
+}
+
 func TestCount(t *testing.T) {
 	cfg, err := config.Load("local")
 	assert.NoError(t, err)
@@ -121,7 +257,10 @@ func TestCount(t *testing.T) {
 	}}
 
 	t.Run("success", func(t *testing.T) {
-		s := service{rds, repo, logger, 2 * time.Second}
+		s := service{
+			rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+			&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+		}
 
 		var total int64
 		total, err = s.Count(context.TODO())
@@ -142,7 +281,10 @@ func TestCreate(t *testing.T) {
 	logger := log.NewWithZap(l)
 
 	repo := &mocks.UserRepository{}
-	s := service{rds, repo, logger, 2 * time.Second}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+	}
 
 	t.Run("success", func(t *testing.T) {
 		u := entity.User{
@@ -153,6 +295,11 @@ func TestCreate(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("fail: username taken", func(t *testing.T) {
+		err = s.Create(context.TODO(), entity.User{Username: "USER", Password: "secret"})
+		assert.ErrorIs(t, err, errs.ErrUsernameTaken)
+	})
+
 	t.Run("fail: empty field", func(t *testing.T) {
 		err = s.Create(context.TODO(), entity.User{})
 		assert.Error(t, err)
@@ -164,6 +311,62 @@ func TestCreate(t *testing.T) {
 		assert.Error(t, err)
 		assert.Equal(t, mocks.ErrCRUD, tools.UnwrapRecursive(err))
 	})
+
+	t.Run("fail: password policy", func(t *testing.T) {
+		s := service{
+			rds, repo, logger, 2 * time.Second, password.New(cfg.PasswordPolicy, nil), testHashers, &cfg, &mail.Memory{},
+			&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+		}
+
+		err = s.Create(context.TODO(), entity.User{Username: "alice", Password: "alice"})
+		var policyErr *password.PolicyError
+		assert.ErrorAs(t, err, &policyErr)
+		assert.ErrorIs(t, err, errs.ErrPasswordPolicy)
+
+		rules := make([]string, 0, len(policyErr.Violations))
+		for _, v := range policyErr.Violations {
+			rules = append(rules, v.Rule)
+		}
+		assert.Equal(t, []string{password.RuleMinLength, password.RuleUpper, password.RuleDigit, password.RuleUsername}, rules)
+
+		err = s.Create(context.TODO(), entity.User{Username: "alice", Password: "Correct-Horse-1"})
+		assert.NoError(t, err)
+	})
+}
+
+func TestUsernameAvailability(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	repo := &mocks.UserRepository{Items: []entity.User{
+		{ID: uuid.New(), Username: "user"},
+		{ID: uuid.New(), Username: "deleted", DeletedAt: sql.NullTime{Time: time.Now(), Valid: true}},
+	}}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+	}
+
+	t.Run("success", func(t *testing.T) {
+		for username, available := range map[string]bool{"User": false, "deleted": true, "new": true} {
+			var res usernameAvailabilityResponse
+			res, err = s.UsernameAvailability(context.TODO(), UsernameAvailabilityRequest{Username: username})
+			assert.NoError(t, err)
+			assert.Equal(t, usernameAvailabilityResponse{Username: username, Available: available}, res)
+		}
+	})
+
+	t.Run("fail: db error", func(t *testing.T) {
+		_, err = s.UsernameAvailability(context.TODO(), UsernameAvailabilityRequest{Username: "error"})
+		assert.Error(t, err)
+	})
 }
 
 func TestUpdate(t *testing.T) {
@@ -185,9 +388,13 @@ func TestUpdate(t *testing.T) {
 			Password:  "secret",
 			CreatedAt: time.Now(),
 			UpdatedAt: time.Now(),
-			DeletedAt: sql.NullTime{}},
+			DeletedAt: sql.NullTime{},
+			Version:   1},
 	}}
-	s := service{rds, repo, logger, 2 * time.Second}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+	}
 
 	t.Run("success", func(t *testing.T) {
 		u := entity.User{
@@ -199,6 +406,29 @@ func TestUpdate(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("fail: username taken", func(t *testing.T) {
+		_, err = repo.Create(context.TODO(), entity.User{Username: "taken"})
+		assert.NoError(t, err)
+
+		err = s.Update(context.TODO(), entity.User{ID: id, Username: "Taken"})
+		assert.ErrorIs(t, err, errs.ErrUsernameTaken)
+	})
+
+	t.Run("success: version", func(t *testing.T) {
+		err = s.Update(context.TODO(), entity.User{ID: id, Password: "newsecret", Version: 2})
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: stale version", func(t *testing.T) {
+		err = s.Update(context.TODO(), entity.User{ID: id, Password: "newsecret", Version: 2})
+		assert.ErrorIs(t, err, errs.ErrPreconditionFailed)
+	})
+
+	t.Run("fail: not found with version", func(t *testing.T) {
+		err = s.Update(context.TODO(), entity.User{ID: uuid.New(), Password: "newsecret", Version: 1})
+		assert.Equal(t, sql.ErrNoRows, tools.UnwrapRecursive(err))
+	})
+
 	t.Run("fail: not found", func(t *testing.T) {
 		args := entity.User{
 			ID:       uuid.New(),
@@ -209,6 +439,20 @@ func TestUpdate(t *testing.T) {
 		assert.Error(t, err)
 		assert.Equal(t, sql.ErrNoRows, tools.UnwrapRecursive(err))
 	})
+
+	t.Run("fail: password policy", func(t *testing.T) {
+		s := service{
+			rds, repo, logger, 2 * time.Second, password.New(cfg.PasswordPolicy, nil), testHashers, &cfg, &mail.Memory{},
+			&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+		}
+
+		// the current username is checked when the update keeps it
+		err = s.Update(context.TODO(), entity.User{ID: id, Password: "Newuser-2024"})
+		assert.ErrorIs(t, err, errs.ErrPasswordPolicy)
+
+		err = s.Update(context.TODO(), entity.User{ID: id, Password: "Correct-Horse-1"})
+		assert.NoError(t, err)
+	})
 }
 
 func TestDelete(t *testing.T) {
@@ -232,11 +476,16 @@ func TestDelete(t *testing.T) {
 			UpdatedAt: time.Now(),
 			DeletedAt: sql.NullTime{}},
 	}}
-	s := service{rds, repo, logger, 2 * time.Second}
+	sessions := &mocks.SessionRevoker{}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		sessions, storage.NewLocal(t.TempDir()),
+	}
 
 	t.Run("success", func(t *testing.T) {
 		err = s.Delete(context.TODO(), id)
 		assert.NoError(t, err)
+		assert.Equal(t, 1, sessions.Revoked[id])
 	})
 
 	t.Run("fail: not found", func(t *testing.T) {
@@ -245,3 +494,512 @@ func TestDelete(t *testing.T) {
 		assert.Equal(t, sql.ErrNoRows, tools.UnwrapRecursive(err))
 	})
 }
+
+func TestRestore(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id, takenID := uuid.New(), uuid.New()
+	deletedAt := sql.NullTime{Time: time.Now(), Valid: true}
+	repo := &mocks.UserRepository{Items: []entity.User{
+		{ID: id, Username: "user", DeletedAt: deletedAt},
+		{ID: takenID, Username: "taken", DeletedAt: deletedAt},
+		{ID: uuid.New(), Username: "taken"},
+	}}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+	}
+
+	t.Run("success", func(t *testing.T) {
+		err = s.Restore(context.TODO(), id)
+		assert.NoError(t, err)
+
+		_, err = s.GetProfile(context.TODO(), id)
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: not deleted", func(t *testing.T) {
+		err = s.Restore(context.TODO(), id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+
+	t.Run("fail: username taken", func(t *testing.T) {
+		err = s.Restore(context.TODO(), takenID)
+		assert.ErrorIs(t, err, errs.ErrRestoreConflict)
+	})
+}
+
+func TestPurgeDeleted(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	assert.NotNil(t, cfg)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	cfg.SoftDelete.Retention = 30
+	cfg.SoftDelete.PurgeBatch = 2
+
+	blobs := storage.NewLocal(t.TempDir())
+	avatarKey := "avatars/purged.png"
+	assert.NoError(t, blobs.Put(context.TODO(), avatarKey, storage.Object{ContentType: "image/png", Data: []byte("png")}))
+
+	expired := sql.NullTime{Time: time.Now().AddDate(0, 0, -31), Valid: true}
+	recent := sql.NullTime{Time: time.Now().AddDate(0, 0, -1), Valid: true}
+	repo := &mocks.UserRepository{Items: []entity.User{
+		{ID: uuid.New(), Username: "a", DeletedAt: expired, AvatarKey: sql.NullString{String: avatarKey, Valid: true}},
+		{ID: uuid.New(), Username: "b", DeletedAt: expired},
+		{ID: uuid.New(), Username: "c", DeletedAt: expired},
+		{ID: uuid.New(), Username: "d", DeletedAt: recent},
+		{ID: uuid.New(), Username: "e"},
+	}}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		&mocks.SessionRevoker{}, blobs,
+	}
+
+	t.Run("success", func(t *testing.T) {
+		var n int
+		n, err = s.PurgeDeleted(context.TODO())
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+		assert.Len(t, repo.Items, 2)
+
+		_, err = blobs.Get(context.TODO(), avatarKey)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("success: retention disabled", func(t *testing.T) {
+		s.cfg.SoftDelete.Retention = 0
+		defer func() { s.cfg.SoftDelete.Retention = 30 }()
+
+		repo.Items[0].DeletedAt = expired
+
+		var n int
+		n, err = s.PurgeDeleted(context.TODO())
+		assert.NoError(t, err)
+		assert.Zero(t, n)
+		assert.Len(t, repo.Items, 2)
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+	repo := &mocks.UserRepository{}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &config.Config{}, &mail.Memory{},
+		&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+	}
+
+	var created apiKeyResponse
+
+	t.Run("success: create", func(t *testing.T) {
+		created, err = s.CreateAPIKey(context.TODO(), id, CreateAPIKeyRequest{
+			Name:      "ci",
+			Scopes:    []string{PermissionList},
+			ExpiresAt: time.Now().Add(time.Hour),
+		})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, created.Key)
+		assert.Equal(t, []string{PermissionList}, created.Scopes)
+
+		prefix, ok := tools.APIKeyPrefix(created.Key)
+		assert.True(t, ok)
+		assert.Equal(t, prefix, created.Prefix)
+
+		// only a hash of the key is stored
+		assert.Len(t, repo.APIKeys, 1)
+		assert.Equal(t, tools.SHA256(created.Key), repo.APIKeys[0].KeyHash)
+	})
+
+	t.Run("fail: create expired", func(t *testing.T) {
+		_, err = s.CreateAPIKey(context.TODO(), id, CreateAPIKeyRequest{Name: "ci", ExpiresAt: time.Now()})
+		assert.Equal(t, errs.ErrConditionNotFulfil, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("fail: create db error", func(t *testing.T) {
+		_, err = s.CreateAPIKey(context.TODO(), id, CreateAPIKeyRequest{Name: "error", ExpiresAt: time.Now().Add(time.Hour)})
+		assert.Equal(t, mocks.ErrCRUD, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: list and get", func(t *testing.T) {
+		var keys []apiKeyResponse
+		keys, err = s.ListAPIKeys(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 1)
+		assert.Empty(t, keys[0].Key)
+
+		keys, err = s.ListAPIKeys(context.TODO(), uuid.New())
+		assert.NoError(t, err)
+		assert.Empty(t, keys)
+
+		var key apiKeyResponse
+		key, err = s.GetAPIKey(context.TODO(), id, created.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "ci", key.Name)
+		assert.Empty(t, key.Key)
+	})
+
+	t.Run("fail: other user", func(t *testing.T) {
+		other := uuid.New()
+
+		_, err = s.GetAPIKey(context.TODO(), other, created.ID)
+		assert.Equal(t, errs.ErrAPIKeyNotFound, tools.UnwrapRecursive(err))
+
+		err = s.RenameAPIKey(context.TODO(), other, RenameAPIKeyRequest{ID: &created.ID, Name: "mine"})
+		assert.Equal(t, errs.ErrAPIKeyNotFound, tools.UnwrapRecursive(err))
+
+		err = s.DeleteAPIKey(context.TODO(), other, created.ID)
+		assert.Equal(t, errs.ErrAPIKeyNotFound, tools.UnwrapRecursive(err))
+	})
+
+	t.Run("success: rename and delete", func(t *testing.T) {
+		err = s.RenameAPIKey(context.TODO(), id, RenameAPIKeyRequest{ID: &created.ID, Name: "deploy"})
+		assert.NoError(t, err)
+		assert.Equal(t, "deploy", repo.APIKeys[0].Name)
+
+		err = s.DeleteAPIKey(context.TODO(), id, created.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, repo.APIKeys)
+	})
+}
+
+func TestEmailVerification(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	cfg.EmailVerification.RequiredFor = []string{config.VerifyEmailForAPIKey}
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	repo := &mocks.UserRepository{}
+	mailer := &mail.Memory{}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, mailer,
+		&mocks.SessionRevoker{}, storage.NewLocal(t.TempDir()),
+	}
+
+	// lastToken returns the token of the latest verification email
+	lastToken := func(t *testing.T) string {
+		if !assert.NotEmpty(t, mailer.Messages) {
+			t.FailNow()
+		}
+
+		msg := mailer.Messages[len(mailer.Messages)-1]
+		i := strings.Index(msg.Body, "token=")
+		if !assert.GreaterOrEqual(t, i, 0) {
+			t.FailNow()
+		}
+
+		return strings.Fields(msg.Body[i+len("token="):])[0]
+	}
+
+	email := sql.NullString{String: "user@example.com", Valid: true}
+	err = s.Create(context.TODO(), entity.User{Username: "user", Password: "secret", Email: email})
+	assert.NoError(t, err)
+	id := repo.Items[0].ID
+
+	t.Run("success: verification email on create", func(t *testing.T) {
+		assert.Len(t, mailer.Messages, 1)
+		assert.Equal(t, email.String, mailer.Messages[0].To)
+		assert.Contains(t, mailer.Messages[0].Body, cfg.EmailVerification.URL+"?token=")
+	})
+
+	t.Run("fail: unverified user creates api key", func(t *testing.T) {
+		_, err = s.CreateAPIKey(context.TODO(), id, CreateAPIKeyRequest{Name: "ci", ExpiresAt: time.Now().Add(time.Hour)})
+		assert.ErrorIs(t, err, errs.ErrEmailNotVerified)
+	})
+
+	t.Run("success: verify", func(t *testing.T) {
+		token := lastToken(t)
+
+		err = s.VerifyEmail(context.TODO(), VerifyEmailRequest{Token: token})
+		assert.NoError(t, err)
+		assert.True(t, repo.Items[0].EmailVerified())
+
+		// the token is single-use
+		err = s.VerifyEmail(context.TODO(), VerifyEmailRequest{Token: token})
+		assert.ErrorIs(t, err, errs.ErrInvalidEmailToken)
+
+		_, err = s.CreateAPIKey(context.TODO(), id, CreateAPIKeyRequest{Name: "ci", ExpiresAt: time.Now().Add(time.Hour)})
+		assert.NoError(t, err)
+	})
+
+	t.Run("fail: resend when verified", func(t *testing.T) {
+		err = s.ResendVerificationEmail(context.TODO(), id)
+		assert.ErrorIs(t, err, errs.ErrEmailVerified)
+	})
+
+	t.Run("success: unchanged email stays verified", func(t *testing.T) {
+		err = s.Update(context.TODO(), entity.User{
+			ID:       id,
+			Username: "user",
+			Email:    sql.NullString{String: "USER@example.com", Valid: true},
+		})
+		assert.NoError(t, err)
+		assert.True(t, repo.Items[0].EmailVerified())
+		assert.Len(t, mailer.Messages, 1)
+	})
+
+	t.Run("fail: token of a replaced email", func(t *testing.T) {
+		err = s.Update(context.TODO(), entity.User{
+			ID:       id,
+			Username: "user",
+			Email:    sql.NullString{String: "old@example.com", Valid: true},
+		})
+		assert.NoError(t, err)
+		assert.False(t, repo.Items[0].EmailVerified())
+		token := lastToken(t)
+
+		err = s.Update(context.TODO(), entity.User{ID: id, Username: "user", Email: email})
+		assert.NoError(t, err)
+
+		err = s.VerifyEmail(context.TODO(), VerifyEmailRequest{Token: token})
+		assert.ErrorIs(t, err, errs.ErrInvalidEmailToken)
+		assert.False(t, repo.Items[0].EmailVerified())
+	})
+
+	t.Run("success: resend", func(t *testing.T) {
+		err = s.ResendVerificationEmail(context.TODO(), id)
+		assert.NoError(t, err)
+
+		err = s.ResendVerificationEmail(context.TODO(), id)
+		assert.ErrorIs(t, err, errs.ErrTooManyRequests)
+
+		err = s.VerifyEmail(context.TODO(), VerifyEmailRequest{Token: lastToken(t)})
+		assert.NoError(t, err)
+		assert.True(t, repo.Items[0].EmailVerified())
+	})
+}
+
+func TestMe(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	hash, err := testHashers.Hash("secret")
+	assert.NoError(t, err)
+
+	id := uuid.New()
+	repo := &mocks.UserRepository{Items: []entity.User{
+		{ID: id, Username: "user", Password: hash, CreatedAt: time.Now(), UpdatedAt: time.Now()},
+	}}
+	sessions := &mocks.SessionRevoker{}
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(cfg.PasswordPolicy, nil), testHashers, &cfg, &mail.Memory{},
+		sessions, storage.NewLocal(t.TempDir()),
+	}
+
+	t.Run("success: get profile", func(t *testing.T) {
+		var res profileResponse
+		res, err = s.GetProfile(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.Equal(t, id, res.ID)
+		assert.Equal(t, "user", res.Username)
+		assert.Nil(t, res.Email)
+		assert.False(t, res.EmailVerified)
+	})
+
+	t.Run("success: update profile", func(t *testing.T) {
+		var res profileResponse
+		res, err = s.UpdateProfile(context.TODO(), id, UpdateProfileRequest{Email: "user@example.com"})
+		assert.NoError(t, err)
+		assert.Equal(t, "user", res.Username)
+		if assert.NotNil(t, res.Email) {
+			assert.Equal(t, "user@example.com", *res.Email)
+		}
+		assert.Equal(t, hash, repo.Items[0].Password)
+	})
+
+	t.Run("success: update and clear profile fields", func(t *testing.T) {
+		name, locale, empty := "User", "en-GB", ""
+
+		var res profileResponse
+		res, err = s.UpdateProfile(context.TODO(), id, UpdateProfileRequest{DisplayName: &name, Locale: &locale})
+		assert.NoError(t, err)
+		assert.Equal(t, &name, res.DisplayName)
+		assert.Equal(t, &locale, res.Locale)
+		assert.Nil(t, res.Bio)
+
+		res, err = s.UpdateProfile(context.TODO(), id, UpdateProfileRequest{DisplayName: &empty})
+		assert.NoError(t, err)
+		assert.Nil(t, res.DisplayName)
+		assert.Equal(t, &locale, res.Locale)
+	})
+
+	t.Run("fail: wrong current password", func(t *testing.T) {
+		err = s.ChangePassword(context.TODO(), id, "session", ChangePasswordRequest{
+			CurrentPassword: "wrong",
+			NewPassword:     "Correct-Horse-1",
+		})
+		assert.ErrorIs(t, err, errs.ErrWrongPassword)
+		assert.Equal(t, hash, repo.Items[0].Password)
+		assert.Zero(t, sessions.Revoked[id])
+	})
+
+	t.Run("fail: new password policy", func(t *testing.T) {
+		err = s.ChangePassword(context.TODO(), id, "session", ChangePasswordRequest{
+			CurrentPassword: "secret",
+			NewPassword:     "user",
+		})
+		assert.ErrorIs(t, err, errs.ErrPasswordPolicy)
+		assert.Zero(t, sessions.Revoked[id])
+	})
+
+	t.Run("success: change password", func(t *testing.T) {
+		err = s.ChangePassword(context.TODO(), id, "session", ChangePasswordRequest{
+			CurrentPassword: "secret",
+			NewPassword:     "Correct-Horse-1",
+		})
+		assert.NoError(t, err)
+
+		var ok bool
+		ok, _, err = testHashers.Verify("Correct-Horse-1", repo.Items[0].Password)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 1, sessions.Revoked[id])
+		assert.Equal(t, "session", sessions.Kept[id])
+	})
+
+	t.Run("success: delete account", func(t *testing.T) {
+		err = s.DeleteAccount(context.TODO(), id)
+		assert.NoError(t, err)
+		assert.True(t, repo.Items[0].DeletedAt.Valid)
+		assert.Equal(t, 2, sessions.Revoked[id])
+		assert.Empty(t, sessions.Kept[id])
+
+		_, err = s.GetProfile(context.TODO(), id)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func TestAvatar(t *testing.T) {
+	cfg, err := config.Load("local")
+	assert.NoError(t, err)
+	cfg.Avatar.MaxSize = 64 << 10
+
+	rds, err := mocks.Redis(miniredis.RunT(t).Addr())
+	assert.NoError(t, err)
+
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	id := uuid.New()
+	repo := &mocks.UserRepository{Items: []entity.User{{ID: id, Username: "user"}}}
+	blobs := storage.NewLocal(t.TempDir())
+	s := service{
+		rds, repo, logger, 2 * time.Second, password.New(config.PasswordPolicy{}, nil), testHashers, &cfg, &mail.Memory{},
+		&mocks.SessionRevoker{}, blobs,
+	}
+
+	encode := func(t *testing.T, enc func(io.Writer, image.Image) error, w, h int) []byte {
+		var b bytes.Buffer
+		assert.NoError(t, enc(&b, image.NewRGBA(image.Rect(0, 0, w, h))))
+		return b.Bytes()
+	}
+	encodeJPEG := func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) }
+
+	t.Run("fail: no avatar", func(t *testing.T) {
+		_, err = s.GetAvatar(context.TODO(), id, false)
+		assert.ErrorIs(t, err, errs.ErrAvatarNotFound)
+
+		err = s.DeleteAvatar(context.TODO(), id)
+		assert.ErrorIs(t, err, errs.ErrAvatarNotFound)
+	})
+
+	t.Run("fail: invalid image", func(t *testing.T) {
+		_, err = s.UploadAvatar(context.TODO(), id, strings.NewReader("<svg></svg>"))
+		assert.ErrorIs(t, err, errs.ErrInvalidImage)
+	})
+
+	t.Run("fail: file too large", func(t *testing.T) {
+		_, err = s.UploadAvatar(context.TODO(), id, bytes.NewReader(make([]byte, cfg.Avatar.MaxSize+1)))
+		assert.ErrorIs(t, err, errs.ErrImageTooLarge)
+	})
+
+	t.Run("fail: dimensions too large", func(t *testing.T) {
+		data := encode(t, png.Encode, cfg.Avatar.MaxDimension+1, 1)
+		_, err = s.UploadAvatar(context.TODO(), id, bytes.NewReader(data))
+		assert.ErrorIs(t, err, errs.ErrImageTooLarge)
+	})
+
+	var first string
+
+	t.Run("success: upload", func(t *testing.T) {
+		var res profileResponse
+		res, err = s.UploadAvatar(context.TODO(), id, bytes.NewReader(encode(t, png.Encode, 300, 200)))
+		assert.NoError(t, err)
+		if assert.NotNil(t, res.AvatarURL) {
+			assert.Equal(t, fmt.Sprintf("/v1/user/%s/avatar", id), *res.AvatarURL)
+		}
+		first = repo.Items[0].AvatarKey.String
+
+		var obj storage.Object
+		obj, err = s.GetAvatar(context.TODO(), id, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "image/png", obj.ContentType)
+
+		obj, err = s.GetAvatar(context.TODO(), id, true)
+		assert.NoError(t, err)
+
+		var img image.Config
+		img, err = png.DecodeConfig(bytes.NewReader(obj.Data))
+		assert.NoError(t, err)
+		assert.Equal(t, cfg.Avatar.ThumbnailSize, img.Width)
+		assert.Equal(t, cfg.Avatar.ThumbnailSize, img.Height)
+	})
+
+	t.Run("success: replace", func(t *testing.T) {
+		_, err = s.UploadAvatar(context.TODO(), id, bytes.NewReader(encode(t, encodeJPEG, 200, 300)))
+		assert.NoError(t, err)
+
+		var obj storage.Object
+		obj, err = s.GetAvatar(context.TODO(), id, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "image/jpeg", obj.ContentType)
+
+		// the previous avatar and its thumbnail are removed
+		_, err = blobs.Get(context.TODO(), first)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+		_, err = blobs.Get(context.TODO(), thumbnailKey(first))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("success: delete", func(t *testing.T) {
+		key := repo.Items[0].AvatarKey.String
+
+		err = s.DeleteAvatar(context.TODO(), id)
+		assert.NoError(t, err)
+
+		_, err = s.GetAvatar(context.TODO(), id, false)
+		assert.ErrorIs(t, err, errs.ErrAvatarNotFound)
+
+		_, err = blobs.Get(context.TODO(), key)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+}
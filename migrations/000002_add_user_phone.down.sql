@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP INDEX IF EXISTS user_phone_key;
+
+ALTER TABLE "user" DROP COLUMN IF EXISTS phone;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS phone VARCHAR(20) NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_phone_key ON "user" (phone) WHERE deleted_at IS NULL;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP TABLE IF EXISTS user_role;
+
+DROP TABLE IF EXISTS role_permission;
+
+DROP TABLE IF EXISTS permission;
+
+DROP TABLE IF EXISTS role;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,42 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS role (
+  id    uuid    DEFAULT uuid_generate_v4(),
+  name  VARCHAR(50) NOT NULL,
+  created_at    timestamp WITHOUT TIME ZONE NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC'),
+  PRIMARY KEY (id),
+  UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS permission (
+  id    uuid    DEFAULT uuid_generate_v4(),
+  name  VARCHAR(100) NOT NULL,
+  created_at    timestamp WITHOUT TIME ZONE NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC'),
+  PRIMARY KEY (id),
+  UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS role_permission (
+  role_id   uuid    NOT NULL REFERENCES role (id) ON DELETE CASCADE,
+  permission_id   uuid    NOT NULL REFERENCES permission (id) ON DELETE CASCADE,
+  PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_role (
+  user_id   uuid    NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+  role_id   uuid    NOT NULL REFERENCES role (id) ON DELETE CASCADE,
+  PRIMARY KEY (user_id, role_id)
+);
+
+-- Users without a role only reach the endpoints that need no permission. Roles are granted by hand,
+-- e.g. the first admin with:
+--   INSERT INTO user_role (user_id, role_id) SELECT '<user id>', id FROM role WHERE name = 'admin';
+INSERT INTO role (name) VALUES ('admin') ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO permission (name) VALUES ('user:list'), ('user:update'), ('user:delete') ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permission (role_id, permission_id)
+SELECT r.id, p.id FROM role r CROSS JOIN permission p WHERE r.name = 'admin'
+ON CONFLICT DO NOTHING;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+DELETE FROM permission WHERE name = 'user:unlock';
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,9 @@
+BEGIN;
+
+INSERT INTO permission (name) VALUES ('user:unlock') ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permission (role_id, permission_id)
+SELECT r.id, p.id FROM role r CROSS JOIN permission p WHERE r.name = 'admin' AND p.name = 'user:unlock'
+ON CONFLICT DO NOTHING;
+
+COMMIT;
\ No newline at end of file
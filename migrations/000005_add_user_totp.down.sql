@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP TABLE IF EXISTS user_recovery_code;
+
+ALTER TABLE "user" DROP COLUMN IF EXISTS totp_enabled_at;
+
+ALTER TABLE "user" DROP COLUMN IF EXISTS totp_secret;
+
+COMMIT;
\ No newline at end of file
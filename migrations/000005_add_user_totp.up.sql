@@ -0,0 +1,17 @@
+BEGIN;
+
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64) NULL;
+
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS totp_enabled_at timestamp WITHOUT TIME ZONE NULL;
+
+CREATE TABLE IF NOT EXISTS user_recovery_code (
+  id    uuid    DEFAULT uuid_generate_v4(),
+  user_id   uuid    NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+  code_hash VARCHAR(64) NOT NULL,
+  used_at   timestamp WITHOUT TIME ZONE NULL,
+  created_at    timestamp WITHOUT TIME ZONE NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC'),
+  PRIMARY KEY (id),
+  UNIQUE (user_id, code_hash)
+);
+
+COMMIT;
\ No newline at end of file
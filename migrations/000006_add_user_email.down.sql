@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP INDEX IF EXISTS user_email_key;
+
+ALTER TABLE "user" DROP COLUMN IF EXISTS email;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS email VARCHAR(254) NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_email_key ON "user" (email) WHERE deleted_at IS NULL;
+
+COMMIT;
\ No newline at end of file
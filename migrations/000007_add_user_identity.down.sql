@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE IF EXISTS user_identity;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,16 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS user_identity (
+  id    uuid    DEFAULT uuid_generate_v4(),
+  user_id   uuid    NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+  provider  VARCHAR(50) NOT NULL,
+  subject   VARCHAR(255) NOT NULL,
+  email VARCHAR(254) NULL,
+  created_at    timestamp WITHOUT TIME ZONE NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC'),
+  PRIMARY KEY (id),
+  UNIQUE (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identity_user_id_idx ON user_identity (user_id);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,7 @@
+BEGIN;
+
+DELETE FROM permission WHERE name = 'oauth:client';
+
+DROP TABLE IF EXISTS oauth_client;
+
+COMMIT;
\ No newline at end of file
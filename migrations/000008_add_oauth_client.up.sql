@@ -0,0 +1,23 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS oauth_client (
+  id    uuid    DEFAULT uuid_generate_v4(),
+  client_id VARCHAR(64) NOT NULL,
+  secret_hash   VARCHAR(64) NULL,
+  name  VARCHAR(100) NOT NULL,
+  redirect_uris TEXT NOT NULL DEFAULT '',
+  grant_types   TEXT NOT NULL DEFAULT '',
+  scopes    TEXT NOT NULL DEFAULT '',
+  created_at    timestamp WITHOUT TIME ZONE NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC'),
+  deleted_at    timestamp WITHOUT TIME ZONE NULL,
+  PRIMARY KEY (id),
+  UNIQUE (client_id)
+);
+
+INSERT INTO permission (name) VALUES ('oauth:client') ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permission (role_id, permission_id)
+SELECT r.id, p.id FROM role r CROSS JOIN permission p WHERE r.name = 'admin' AND p.name = 'oauth:client'
+ON CONFLICT DO NOTHING;
+
+COMMIT;
\ No newline at end of file
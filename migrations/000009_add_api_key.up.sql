@@ -0,0 +1,19 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS api_key (
+  id    uuid    DEFAULT uuid_generate_v4(),
+  user_id   uuid    NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+  name  VARCHAR(100) NOT NULL,
+  prefix    VARCHAR(32) NOT NULL,
+  key_hash  VARCHAR(64) NOT NULL,
+  scopes    TEXT NOT NULL DEFAULT '',
+  expires_at    timestamp WITHOUT TIME ZONE NOT NULL,
+  last_used_at  timestamp WITHOUT TIME ZONE NULL,
+  created_at    timestamp WITHOUT TIME ZONE NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC'),
+  PRIMARY KEY (id),
+  UNIQUE (prefix)
+);
+
+CREATE INDEX IF NOT EXISTS api_key_user_id_idx ON api_key (user_id);
+
+COMMIT;
\ No newline at end of file
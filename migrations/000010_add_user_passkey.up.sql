@@ -0,0 +1,19 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS user_passkey (
+  id    uuid    DEFAULT uuid_generate_v4(),
+  user_id   uuid    NOT NULL REFERENCES "user" (id) ON DELETE CASCADE,
+  name  VARCHAR(100) NOT NULL,
+  credential_id BYTEA NOT NULL,
+  public_key    BYTEA NOT NULL,
+  sign_count    BIGINT NOT NULL DEFAULT 0,
+  transports    TEXT NOT NULL DEFAULT '',
+  last_used_at  timestamp WITHOUT TIME ZONE NULL,
+  created_at    timestamp WITHOUT TIME ZONE NOT NULL DEFAULT (current_timestamp AT TIME ZONE 'UTC'),
+  PRIMARY KEY (id),
+  UNIQUE (credential_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_passkey_user_id_idx ON user_passkey (user_id);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "user" ALTER COLUMN password TYPE VARCHAR(60);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "user" ALTER COLUMN password TYPE VARCHAR(255);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS user_email_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_email_key ON "user" (email) WHERE deleted_at IS NULL;
+
+ALTER TABLE "user" DROP COLUMN IF EXISTS email_verified_at;
+
+COMMIT;
\ No newline at end of file
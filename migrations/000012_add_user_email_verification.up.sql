@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS email_verified_at timestamp WITHOUT TIME ZONE NULL;
+
+DROP INDEX IF EXISTS user_email_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_email_key ON "user" (LOWER(email)) WHERE deleted_at IS NULL;
+
+COMMIT;
\ No newline at end of file
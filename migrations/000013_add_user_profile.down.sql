@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE "user" DROP COLUMN IF EXISTS avatar_key;
+ALTER TABLE "user" DROP COLUMN IF EXISTS timezone;
+ALTER TABLE "user" DROP COLUMN IF EXISTS locale;
+ALTER TABLE "user" DROP COLUMN IF EXISTS bio;
+ALTER TABLE "user" DROP COLUMN IF EXISTS display_name;
+
+COMMIT;
\ No newline at end of file
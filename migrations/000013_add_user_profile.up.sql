@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS display_name VARCHAR(100) NULL;
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS bio VARCHAR(500) NULL;
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS locale VARCHAR(35) NULL;
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS timezone VARCHAR(64) NULL;
+ALTER TABLE "user" ADD COLUMN IF NOT EXISTS avatar_key VARCHAR(255) NULL;
+
+COMMIT;
\ No newline at end of file
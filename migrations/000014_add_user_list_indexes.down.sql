@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP INDEX IF EXISTS user_created_at_id_idx;
+DROP INDEX IF EXISTS user_username_pattern_idx;
+DROP INDEX IF EXISTS user_username_id_idx;
+
+COMMIT;
\ No newline at end of file
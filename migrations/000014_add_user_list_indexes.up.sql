@@ -0,0 +1,7 @@
+BEGIN;
+
+CREATE INDEX IF NOT EXISTS user_username_id_idx ON "user" (username, id);
+CREATE INDEX IF NOT EXISTS user_username_pattern_idx ON "user" (username varchar_pattern_ops);
+CREATE INDEX IF NOT EXISTS user_created_at_id_idx ON "user" (created_at, id);
+
+COMMIT;
\ No newline at end of file
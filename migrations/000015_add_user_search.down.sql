@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP INDEX IF EXISTS user_bio_trgm_idx;
+DROP INDEX IF EXISTS user_display_name_trgm_idx;
+DROP INDEX IF EXISTS user_username_trgm_idx;
+
+DROP EXTENSION IF EXISTS "pg_trgm";
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,9 @@
+BEGIN;
+
+CREATE EXTENSION IF NOT EXISTS "pg_trgm";
+
+CREATE INDEX IF NOT EXISTS user_username_trgm_idx ON "user" USING GIN (username gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS user_display_name_trgm_idx ON "user" USING GIN (display_name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS user_bio_trgm_idx ON "user" USING GIN (bio gin_trgm_ops);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,8 @@
+BEGIN;
+
+DELETE FROM permission WHERE name = 'user:restore';
+
+DROP INDEX IF EXISTS user_deleted_at_idx;
+DROP INDEX IF EXISTS user_username_key;
+
+COMMIT;
\ No newline at end of file
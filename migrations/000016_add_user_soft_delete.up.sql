@@ -0,0 +1,12 @@
+BEGIN;
+
+CREATE UNIQUE INDEX IF NOT EXISTS user_username_key ON "user" (username) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS user_deleted_at_idx ON "user" (deleted_at) WHERE deleted_at IS NOT NULL;
+
+INSERT INTO permission (name) VALUES ('user:restore') ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permission (role_id, permission_id)
+SELECT r.id, p.id FROM role r CROSS JOIN permission p WHERE r.name = 'admin' AND p.name = 'user:restore'
+ON CONFLICT DO NOTHING;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP INDEX IF EXISTS user_username_key;
+CREATE UNIQUE INDEX IF NOT EXISTS user_username_key ON "user" (username) WHERE deleted_at IS NULL;
+
+COMMIT;
\ No newline at end of file
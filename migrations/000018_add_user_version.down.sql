@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "user" DROP COLUMN IF EXISTS version;
+
+COMMIT;
\ No newline at end of file
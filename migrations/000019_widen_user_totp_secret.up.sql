@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "user" ALTER COLUMN totp_secret TYPE VARCHAR(128);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP INDEX IF EXISTS user_username_pattern_idx;
+CREATE INDEX IF NOT EXISTS user_username_lower_pattern_idx ON "user" (LOWER(username) text_pattern_ops);
+
+COMMIT;
\ No newline at end of file
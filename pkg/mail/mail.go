@@ -0,0 +1,150 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hinccvi/go-ddd/internal/config"
+	"github.com/hinccvi/go-ddd/pkg/log"
+)
+
+type (
+	// Mailer delivers emails.
+	Mailer interface {
+		Send(ctx context.Context, msg Message) error
+	}
+
+	// Message is a plain text email.
+	Message struct {
+		To      string
+		Subject string
+		Body    string
+	}
+
+	smtpMailer struct {
+		addr string
+		auth smtp.Auth
+		from string
+	}
+
+	logMailer struct {
+		logger log.Logger
+	}
+
+	// Memory is a Mailer that keeps sent messages in memory instead of delivering them.
+	// It is intended for tests.
+	Memory struct {
+		mu       sync.Mutex
+		Messages []Message
+	}
+)
+
+// New creates a SMTP Mailer if a SMTP host is configured. Without one it falls back to a Mailer that
+// writes emails to the log in the local and dev environments, and fails in any other environment.
+func New(cfg *config.Config, env string, logger log.Logger) (Mailer, error) {
+	if cfg.Mail.Host != "" {
+		return NewSMTP(cfg), nil
+	}
+
+	if env != "local" && env != "dev" {
+		return nil, fmt.Errorf("[New] internal error: mail.host is not configured for env %q", env)
+	}
+
+	return NewLog(logger), nil
+}
+
+// NewLog creates a Mailer that writes emails to the log instead of delivering them.
+// It is intended for local development only.
+func NewLog(logger log.Logger) Mailer {
+	return logMailer{logger}
+}
+
+// NewSMTP creates a Mailer that delivers emails through the configured SMTP server.
+// It authenticates with PLAIN auth if a username is configured.
+func NewSMTP(cfg *config.Config) Mailer {
+	var auth smtp.Auth
+	if cfg.Mail.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Mail.Username, cfg.Mail.Password, cfg.Mail.Host)
+	}
+
+	return smtpMailer{
+		addr: net.JoinHostPort(cfg.Mail.Host, strconv.Itoa(cfg.Mail.Port)),
+		auth: auth,
+		from: cfg.Mail.From,
+	}
+}
+
+func (m smtpMailer) Send(ctx context.Context, msg Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return fmt.Errorf("[Send] internal error: invalid recipient %q", msg.To)
+	}
+
+	// net/smtp does not take a context, so the send is abandoned rather than cancelled
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, m.build(msg))
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("[Send] internal error: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("[Send] internal error: %w", ctx.Err())
+	}
+}
+
+func (m smtpMailer) build(msg Message) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return b.Bytes()
+}
+
+func (l logMailer) Send(_ context.Context, msg Message) error {
+	l.logger.Infof("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+
+	return nil
+}
+
+func (m *Memory) Send(_ context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Messages = append(m.Messages, msg)
+
+	return nil
+}
+
+// Last returns the last message sent to an address.
+func (m *Memory) Last(to string) (Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.Messages) - 1; i >= 0; i-- {
+		if m.Messages[i].To == to {
+			return m.Messages[i], true
+		}
+	}
+
+	return Message{}, false
+}
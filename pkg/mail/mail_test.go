@@ -0,0 +1,157 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hinccvi/go-ddd/internal/config"
+	"github.com/hinccvi/go-ddd/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// smtpServer accepts a single SMTP session and returns the data it received.
+func smtpServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	data := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		write := func(s string) { _, _ = conn.Write([]byte(s + "\r\n")) }
+
+		write("220 localhost ESMTP")
+		var b strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				write("250 localhost")
+			case cmd == "DATA":
+				write("354 end data with <CR><LF>.<CR><LF>")
+				for {
+					line, err = r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					b.WriteString(line)
+				}
+				data <- b.String()
+				write("250 ok")
+			case cmd == "QUIT":
+				write("221 bye")
+				return
+			default:
+				write("250 ok")
+			}
+		}
+	}()
+
+	return ln.Addr().String(), data
+}
+
+func TestNew(t *testing.T) {
+	l, _ := log.NewForTest()
+	logger := log.NewWithZap(l)
+
+	var cfg config.Config
+	for _, env := range []string{"local", "dev"} {
+		m, err := New(&cfg, env, logger)
+		assert.NoError(t, err)
+		assert.IsType(t, logMailer{}, m)
+	}
+
+	for _, env := range []string{"qa", "prod"} {
+		_, err := New(&cfg, env, logger)
+		assert.Error(t, err)
+	}
+
+	cfg.Mail.Host = "localhost"
+	m, err := New(&cfg, "prod", logger)
+	assert.NoError(t, err)
+	assert.IsType(t, smtpMailer{}, m)
+}
+
+func TestLog(t *testing.T) {
+	l, entries := log.NewForTest()
+
+	err := NewLog(log.NewWithZap(l)).Send(context.TODO(), Message{To: "user@example.com", Subject: "Hello"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, entries.Len())
+	assert.Contains(t, entries.All()[0].Message, "user@example.com")
+}
+
+func TestSMTPSend(t *testing.T) {
+	addr, data := smtpServer(t)
+	host, port, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+
+	var cfg config.Config
+	cfg.Mail.Host = host
+	cfg.Mail.Port, _ = strconv.Atoi(port)
+	cfg.Mail.From = "no-reply@example.com"
+
+	m := NewSMTP(&cfg)
+
+	t.Run("success", func(t *testing.T) {
+		err = m.Send(context.TODO(), Message{To: "user@example.com", Subject: "Hello", Body: "line 1\nline 2"})
+		assert.NoError(t, err)
+
+		select {
+		case msg := <-data:
+			assert.Contains(t, msg, "From: no-reply@example.com\r\n")
+			assert.Contains(t, msg, "To: user@example.com\r\n")
+			assert.Contains(t, msg, "Subject: Hello\r\n")
+			assert.Contains(t, msg, "\r\n\r\nline 1\r\nline 2")
+		case <-time.After(time.Second):
+			t.Fatal("no message received")
+		}
+	})
+
+	t.Run("fail: header injection", func(t *testing.T) {
+		err = m.Send(context.TODO(), Message{To: "user@example.com\r\nBcc: x@example.com", Subject: "Hello"})
+		assert.Error(t, err)
+	})
+
+	t.Run("fail: server down", func(t *testing.T) {
+		cfg.Mail.Port = 1
+
+		err = NewSMTP(&cfg).Send(context.TODO(), Message{To: "user@example.com", Subject: "Hello"})
+		assert.Error(t, err)
+	})
+}
+
+func TestMemory(t *testing.T) {
+	var m Memory
+
+	_, ok := m.Last("user@example.com")
+	assert.False(t, ok)
+
+	assert.NoError(t, m.Send(context.TODO(), Message{To: "user@example.com", Body: "1"}))
+	assert.NoError(t, m.Send(context.TODO(), Message{To: "other@example.com", Body: "2"}))
+	assert.NoError(t, m.Send(context.TODO(), Message{To: "user@example.com", Body: "3"}))
+
+	msg, ok := m.Last("user@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "3", msg.Body)
+	assert.Len(t, m.Messages, 3)
+}
@@ -0,0 +1,379 @@
+// Package oidc implements the relying party side of OpenID Connect: provider discovery,
+// the authorization code flow with PKCE (RFC 7636) and ID token validation.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/hinccvi/go-ddd/internal/config"
+)
+
+type (
+	// Provider is an OpenID Connect provider. Its discovery document and signing keys
+	// are fetched on first use and cached.
+	Provider struct {
+		cfg    config.OIDCProvider
+		client *http.Client
+
+		mu            sync.Mutex
+		metadata      *Metadata
+		keys          map[string]interface{}
+		keysFetchedAt time.Time
+	}
+
+	// Metadata is the part of the provider discovery document the authorization code flow needs.
+	Metadata struct {
+		Issuer                   string   `json:"issuer"`
+		AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+		TokenEndpoint            string   `json:"token_endpoint"`
+		JWKSURI                  string   `json:"jwks_uri"`
+		TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+	}
+
+	// Token is the response of the token endpoint.
+	Token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		IDToken     string `json:"id_token"`
+	}
+
+	// IDToken holds the claims of a validated ID token.
+	IDToken struct {
+		Nonce           string `json:"nonce"`
+		Email           string `json:"email"`
+		EmailVerified   Bool   `json:"email_verified"`
+		Name            string `json:"name"`
+		AuthorizedParty string `json:"azp"`
+		jwt.RegisteredClaims
+	}
+
+	// Bool is a boolean claim that some providers encode as a string.
+	Bool bool
+
+	tokenError struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+)
+
+const (
+	discoveryPath = "/.well-known/openid-configuration"
+	randomSize    = 32
+
+	// keysRefreshInterval limits how often an unknown key ID triggers a refetch of the signing keys.
+	keysRefreshInterval = time.Minute
+	maxResponseSize     = 1 << 20
+)
+
+var (
+	ErrInvalidIDToken = errors.New("invalid id token")
+	ErrExchange       = errors.New("authorization code exchange failed")
+
+	errIssuerMismatch = errors.New("issuer mismatch")
+	errUnknownKey     = errors.New("unknown signing key")
+
+	//nolint:gochecknoglobals // ID tokens must be signed with an asymmetric algorithm
+	validMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+)
+
+// NewProvider creates a Provider. Nothing is fetched until the provider is first used.
+// If client is nil, http.DefaultClient is used.
+func NewProvider(cfg config.OIDCProvider, client *http.Client) *Provider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Provider{cfg: cfg, client: client}
+}
+
+// Discover returns the discovery document of the provider.
+// The issuer in the document must match the configured issuer.
+func (p *Provider) Discover(ctx context.Context) (Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return *p.metadata, nil
+	}
+
+	var m Metadata
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.cfg.Issuer, "/")+discoveryPath, &m); err != nil {
+		return Metadata{}, fmt.Errorf("[Discover] internal error: %w", err)
+	}
+
+	if m.Issuer != p.cfg.Issuer {
+		return Metadata{}, fmt.Errorf("[Discover] internal error: %w: %s", errIssuerMismatch, m.Issuer)
+	}
+
+	p.metadata = &m
+
+	return m, nil
+}
+
+// AuthCodeURL returns the URL of the provider's consent page.
+// verifier is the PKCE code verifier, only its S256 challenge is sent.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	m, err := p.Discover(ctx)
+	if err != nil {
+		return "", fmt.Errorf("[AuthCodeURL] internal error: %w", err)
+	}
+
+	u, err := url.Parse(m.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("[AuthCodeURL] internal error: %w", err)
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.scopes(), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", CodeChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code at the token endpoint.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (Token, error) {
+	m, err := p.Discover(ctx)
+	if err != nil {
+		return Token{}, fmt.Errorf("[Exchange] internal error: %w", err)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	usePost := len(m.TokenEndpointAuthMethods) > 0 && !contains(m.TokenEndpointAuthMethods, "client_secret_basic")
+	if usePost || p.cfg.ClientSecret == "" {
+		form.Set("client_id", p.cfg.ClientID)
+	}
+	if usePost && p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Token{}, fmt.Errorf("[Exchange] internal error: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !usePost && p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return Token{}, fmt.Errorf("[Exchange] internal error: %w", err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return Token{}, fmt.Errorf("[Exchange] internal error: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		var e tokenError
+		_ = json.Unmarshal(body, &e)
+
+		return Token{}, fmt.Errorf("[Exchange] internal error: %w: %d %s %s",
+			ErrExchange, res.StatusCode, e.Error, e.ErrorDescription)
+	}
+
+	var t Token
+	if err = json.Unmarshal(body, &t); err != nil {
+		return Token{}, fmt.Errorf("[Exchange] internal error: %w", err)
+	}
+
+	if t.IDToken == "" {
+		return Token{}, fmt.Errorf("[Exchange] internal error: %w: missing id_token", ErrExchange)
+	}
+
+	return t, nil
+}
+
+// VerifyIDToken validates the signature, issuer, audience, lifetime and nonce of an ID token.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (IDToken, error) {
+	m, err := p.Discover(ctx)
+	if err != nil {
+		return IDToken{}, fmt.Errorf("[VerifyIDToken] internal error: %w", err)
+	}
+
+	var claims IDToken
+	_, err = jwt.ParseWithClaims(raw, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, m.JWKSURI, kid)
+	}, jwt.WithValidMethods(validMethods))
+	if err != nil {
+		return IDToken{}, fmt.Errorf("[VerifyIDToken] internal error: %w: %v", ErrInvalidIDToken, err)
+	}
+
+	switch {
+	case !claims.VerifyIssuer(m.Issuer, true):
+		return IDToken{}, fmt.Errorf("[VerifyIDToken] internal error: %w: issuer", ErrInvalidIDToken)
+	case !claims.VerifyAudience(p.cfg.ClientID, true):
+		return IDToken{}, fmt.Errorf("[VerifyIDToken] internal error: %w: audience", ErrInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID:
+		return IDToken{}, fmt.Errorf("[VerifyIDToken] internal error: %w: authorized party", ErrInvalidIDToken)
+	case claims.ExpiresAt == nil:
+		return IDToken{}, fmt.Errorf("[VerifyIDToken] internal error: %w: expiration", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return IDToken{}, fmt.Errorf("[VerifyIDToken] internal error: %w: subject", ErrInvalidIDToken)
+	case claims.Nonce != nonce:
+		return IDToken{}, fmt.Errorf("[VerifyIDToken] internal error: %w: nonce", ErrInvalidIDToken)
+	}
+
+	return claims, nil
+}
+
+// key returns the signing key with the given ID. The key set is refetched if the ID is unknown,
+// since providers rotate their keys, but at most once per keysRefreshInterval.
+func (p *Provider) key(ctx context.Context, jwksURI, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetchedAt) < keysRefreshInterval {
+		return nil, errUnknownKey
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+
+		keys[k.Kid] = key
+	}
+
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+
+	return nil, errUnknownKey
+}
+
+// lookup finds a cached key. A token without key ID is accepted if the provider has a single key.
+func (p *Provider) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+
+	key, ok := p.keys[kid]
+
+	return key, ok
+}
+
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", res.StatusCode, u)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, maxResponseSize)).Decode(v)
+}
+
+func (p *Provider) scopes() []string {
+	if len(p.cfg.Scopes) == 0 {
+		return []string{"openid"}
+	}
+
+	if !contains(p.cfg.Scopes, "openid") {
+		return append([]string{"openid"}, p.cfg.Scopes...)
+	}
+
+	return p.cfg.Scopes
+}
+
+// RandomString returns a random URL-safe string, suitable for state, nonce and PKCE code verifiers.
+func RandomString() (string, error) {
+	b := make([]byte, randomSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE code challenge of a verifier.
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`:
+		*b = true
+	case "false", `"false"`, "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
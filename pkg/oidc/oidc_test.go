@@ -0,0 +1,183 @@
+package oidc
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/hinccvi/go-ddd/internal/config"
+	"github.com/hinccvi/go-ddd/internal/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProvider(t *testing.T) (*Provider, *mocks.OIDCProvider) {
+	t.Helper()
+
+	stub := mocks.NewOIDCProvider(t)
+
+	p := NewProvider(config.OIDCProvider{
+		Issuer:       stub.Issuer(),
+		ClientID:     stub.ClientID,
+		ClientSecret: stub.ClientSecret,
+		RedirectURL:  "https://example.com/callback",
+		Scopes:       []string{"email"},
+	}, stub.Server.Client())
+
+	return p, stub
+}
+
+func TestDiscover(t *testing.T) {
+	p, stub := newTestProvider(t)
+
+	m, err := p.Discover(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, stub.Issuer(), m.Issuer)
+	assert.Equal(t, stub.Issuer()+"/token", m.TokenEndpoint)
+
+	t.Run("fail: issuer mismatch", func(t *testing.T) {
+		p = NewProvider(config.OIDCProvider{Issuer: stub.Issuer() + "/"}, stub.Server.Client())
+
+		_, err = p.Discover(context.TODO())
+		assert.ErrorIs(t, err, errIssuerMismatch)
+	})
+
+	t.Run("fail: provider down", func(t *testing.T) {
+		p = NewProvider(config.OIDCProvider{Issuer: "http://127.0.0.1:1"}, nil)
+
+		_, err = p.Discover(context.TODO())
+		assert.Error(t, err)
+	})
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	p, stub := newTestProvider(t)
+
+	verifier, err := RandomString()
+	assert.NoError(t, err)
+
+	authURL, err := p.AuthCodeURL(context.TODO(), "state", "nonce", verifier)
+	assert.NoError(t, err)
+
+	u, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "openid email", u.Query().Get("scope"))
+	assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+	assert.Equal(t, CodeChallenge(verifier), u.Query().Get("code_challenge"))
+	assert.Empty(t, u.Query().Get("code_verifier"))
+
+	claims := mocks.OIDCClaims{Subject: "123", Email: "user@example.com", EmailVerified: true}
+
+	t.Run("success", func(t *testing.T) {
+		code, state, err := stub.Authorize(authURL, claims)
+		assert.NoError(t, err)
+		assert.Equal(t, "state", state)
+
+		token, err := p.Exchange(context.TODO(), code, verifier)
+		assert.NoError(t, err)
+
+		idToken, err := p.VerifyIDToken(context.TODO(), token.IDToken, "nonce")
+		assert.NoError(t, err)
+		assert.Equal(t, "123", idToken.Subject)
+		assert.Equal(t, "user@example.com", idToken.Email)
+		assert.True(t, bool(idToken.EmailVerified))
+	})
+
+	t.Run("fail: wrong verifier", func(t *testing.T) {
+		code, _, err := stub.Authorize(authURL, claims)
+		assert.NoError(t, err)
+
+		_, err = p.Exchange(context.TODO(), code, "xxx")
+		assert.ErrorIs(t, err, ErrExchange)
+	})
+
+	t.Run("fail: code reused", func(t *testing.T) {
+		code, _, err := stub.Authorize(authURL, claims)
+		assert.NoError(t, err)
+
+		_, err = p.Exchange(context.TODO(), code, verifier)
+		assert.NoError(t, err)
+
+		_, err = p.Exchange(context.TODO(), code, verifier)
+		assert.ErrorIs(t, err, ErrExchange)
+	})
+
+	t.Run("fail: nonce mismatch", func(t *testing.T) {
+		code, _, err := stub.Authorize(authURL, claims)
+		assert.NoError(t, err)
+
+		token, err := p.Exchange(context.TODO(), code, verifier)
+		assert.NoError(t, err)
+
+		_, err = p.VerifyIDToken(context.TODO(), token.IDToken, "xxx")
+		assert.ErrorIs(t, err, ErrInvalidIDToken)
+	})
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	p, stub := newTestProvider(t)
+
+	now := time.Now()
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":   stub.Issuer(),
+			"aud":   stub.ClientID,
+			"sub":   "123",
+			"nonce": "nonce",
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Minute).Unix(),
+		}
+	}
+
+	t.Run("success", func(t *testing.T) {
+		_, err := p.VerifyIDToken(context.TODO(), stub.SignIDToken(valid()), "nonce")
+		assert.NoError(t, err)
+	})
+
+	t.Run("success: email_verified as string", func(t *testing.T) {
+		claims := valid()
+		claims["email_verified"] = "true"
+
+		idToken, err := p.VerifyIDToken(context.TODO(), stub.SignIDToken(claims), "nonce")
+		assert.NoError(t, err)
+		assert.True(t, bool(idToken.EmailVerified))
+	})
+
+	tests := []struct {
+		name   string
+		modify func(jwt.MapClaims)
+	}{
+		{"issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{"audience", func(c jwt.MapClaims) { c["aud"] = "other" }},
+		{"authorized party", func(c jwt.MapClaims) { c["aud"] = []string{stub.ClientID, "other"}; c["azp"] = "other" }},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Minute).Unix() }},
+		{"no expiration", func(c jwt.MapClaims) { delete(c, "exp") }},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }},
+	}
+
+	for _, tc := range tests {
+		t.Run("fail: "+tc.name, func(t *testing.T) {
+			claims := valid()
+			tc.modify(claims)
+
+			_, err := p.VerifyIDToken(context.TODO(), stub.SignIDToken(claims), "nonce")
+			assert.ErrorIs(t, err, ErrInvalidIDToken)
+		})
+	}
+
+	t.Run("fail: symmetric signature", func(t *testing.T) {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, valid()).SignedString([]byte("secret"))
+		assert.NoError(t, err)
+
+		_, err = p.VerifyIDToken(context.TODO(), signed, "nonce")
+		assert.ErrorIs(t, err, ErrInvalidIDToken)
+	})
+
+	t.Run("fail: unknown key", func(t *testing.T) {
+		other := mocks.NewOIDCProvider(t)
+
+		_, err := p.VerifyIDToken(context.TODO(), other.SignIDToken(valid()), "nonce")
+		assert.ErrorIs(t, err, ErrInvalidIDToken)
+	})
+}
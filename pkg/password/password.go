@@ -0,0 +1,198 @@
+// Package password checks the passwords users choose against a configurable policy
+// and a list of breached passwords.
+package password
+
+import (
+	"bufio"
+	"crypto/sha1" //nolint:gosec // breached password lists are indexed by SHA-1
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hinccvi/go-ddd/internal/config"
+)
+
+type (
+	// Policy checks passwords against the configured rules.
+	Policy struct {
+		cfg      config.PasswordPolicy
+		breached Breached
+	}
+
+	// Breached reports whether a password appeared in a data breach.
+	Breached interface {
+		Contains(password string) (bool, error)
+	}
+
+	// RangeList is a list of breached passwords in the layout of the Pwned Passwords range API:
+	// the uppercase hex SHA-1 hashes are split into files named after their first 5 digits
+	// (00000.txt to FFFFF.txt) with one "SUFFIX:COUNT" line per hash. Only the file of the prefix
+	// is read for a lookup, so the list can be as large as the full breach corpus.
+	RangeList struct {
+		fsys fs.FS
+	}
+
+	// Violation is a rule a password does not follow.
+	Violation struct {
+		Rule    string `json:"rule"`
+		Message string `json:"message"`
+	}
+
+	// PolicyError lists every rule a password does not follow.
+	PolicyError struct {
+		Violations []Violation
+	}
+)
+
+// Rules of a policy, as reported in violations.
+const (
+	RuleMinLength = "min_length"
+	RuleUpper     = "upper"
+	RuleLower     = "lower"
+	RuleDigit     = "digit"
+	RuleSymbol    = "symbol"
+	RuleUsername  = "username"
+	RuleBreached  = "breached"
+)
+
+const rangePrefixLength = 5
+
+// ErrPolicy is wrapped by every PolicyError.
+var ErrPolicy = errors.New("password does not meet policy")
+
+// New creates a policy. The breach check is skipped if breached is nil.
+func New(cfg config.PasswordPolicy, breached Breached) *Policy {
+	return &Policy{cfg, breached}
+}
+
+// Load creates a policy with the breached password ranges in cfg.BreachedPath.
+func Load(cfg config.PasswordPolicy) (*Policy, error) {
+	if cfg.BreachedPath == "" {
+		return New(cfg, nil), nil
+	}
+
+	info, err := os.Stat(cfg.BreachedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("breached password path %s is not a directory", cfg.BreachedPath)
+	}
+
+	return New(cfg, NewRangeList(os.DirFS(cfg.BreachedPath))), nil
+}
+
+// Check checks a password chosen by the user with a username. It returns a *PolicyError listing
+// every rule the password does not follow, or an error if the breached password list cannot be read.
+func (p *Policy) Check(password, username string) error {
+	var violations []Violation
+	violate := func(rule, message string) {
+		violations = append(violations, Violation{rule, message})
+	}
+
+	if utf8.RuneCountInString(password) < p.cfg.MinLength {
+		violate(RuleMinLength, fmt.Sprintf("must be at least %d characters long", p.cfg.MinLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r), unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+
+	if p.cfg.RequireUpper && !upper {
+		violate(RuleUpper, "must contain an uppercase letter")
+	}
+	if p.cfg.RequireLower && !lower {
+		violate(RuleLower, "must contain a lowercase letter")
+	}
+	if p.cfg.RequireDigit && !digit {
+		violate(RuleDigit, "must contain a digit")
+	}
+	if p.cfg.RequireSymbol && !symbol {
+		violate(RuleSymbol, "must contain a symbol")
+	}
+
+	if p.cfg.DisallowUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		violate(RuleUsername, "must not contain the username")
+	}
+
+	if p.breached != nil {
+		found, err := p.breached.Contains(password)
+		if err != nil {
+			return err
+		}
+
+		if found {
+			violate(RuleBreached, "appeared in a data breach")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{violations}
+	}
+
+	return nil
+}
+
+// NewRangeList creates a breached password list from the range files in fsys.
+func NewRangeList(fsys fs.FS) *RangeList {
+	return &RangeList{fsys}
+}
+
+// Contains reports whether the hash of a password is in the list. Hashes with a count of zero
+// are padding added to hide the size of the range and do not match.
+func (l *RangeList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password)) //nolint:gosec // not used for security, only to look up the hash
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	f, err := l.fsys.Open(hash[:rangePrefixLength] + ".txt")
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		suffix, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(suffix, hash[rangePrefixLength:]) {
+			return count != "0", nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", ErrPolicy, strings.Join(messages, ", "))
+}
+
+func (e *PolicyError) Unwrap() error {
+	return ErrPolicy
+}
+
+// Details returns the violations, so that clients can report every rule at once.
+func (e *PolicyError) Details() interface{} {
+	return e.Violations
+}
@@ -0,0 +1,132 @@
+package password
+
+import (
+	"crypto/sha1" //nolint:gosec // breached password lists are indexed by SHA-1
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/hinccvi/go-ddd/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// rangeFS returns range files listing the given passwords, next to a padding entry.
+func rangeFS(passwords ...string) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for _, p := range passwords {
+		sum := sha1.Sum([]byte(p)) //nolint:gosec // test fixture
+		hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+		name := hash[:5] + ".txt"
+
+		data := "0018A45C4D1DEF81644B54AB7F969B88D65:0\r\n" + hash[5:] + ":42\r\n"
+		if f, ok := fsys[name]; ok {
+			data = string(f.Data) + data
+		}
+		fsys[name] = &fstest.MapFile{Data: []byte(data)}
+	}
+
+	return fsys
+}
+
+func rules(err error) []string {
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+
+	res := make([]string, 0, len(policyErr.Violations))
+	for _, v := range policyErr.Violations {
+		res = append(res, v.Rule)
+	}
+
+	return res
+}
+
+func TestCheck(t *testing.T) {
+	cfg := config.PasswordPolicy{
+		MinLength:        8,
+		RequireUpper:     true,
+		RequireLower:     true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		DisallowUsername: true,
+	}
+	p := New(cfg, NewRangeList(rangeFS("P@ssw0rd!")))
+
+	tests := []struct {
+		password string
+		username string
+		rules    []string
+	}{
+		{"Correct-Horse-1", "alice", nil},
+		{"", "alice", []string{RuleMinLength, RuleUpper, RuleLower, RuleDigit, RuleSymbol}},
+		{"Ünïcödé-1", "alice", nil},
+		{"short1A!", "alice", nil},
+		{"shrt1A!", "alice", []string{RuleMinLength}},
+		{"correct-horse-1", "alice", []string{RuleUpper}},
+		{"CORRECT-HORSE-1", "alice", []string{RuleLower}},
+		{"Correct-Horse-!", "alice", []string{RuleDigit}},
+		{"CorrectHorse1", "alice", []string{RuleSymbol}},
+		{"My-ALICE-pass-1", "alice", []string{RuleUsername}},
+		{"P@ssw0rd!", "alice", []string{RuleBreached}},
+	}
+
+	for _, test := range tests {
+		err := p.Check(test.password, test.username)
+		assert.Equal(t, test.rules, rules(err), test.password)
+
+		if test.rules != nil {
+			assert.ErrorIs(t, err, ErrPolicy)
+		}
+	}
+
+	// no rules are configured by default
+	assert.NoError(t, New(config.PasswordPolicy{}, nil).Check("x", "x"))
+}
+
+func TestPolicyError(t *testing.T) {
+	err := New(config.PasswordPolicy{MinLength: 8, RequireDigit: true}, nil).Check("secret", "")
+
+	var policyErr *PolicyError
+	assert.ErrorAs(t, err, &policyErr)
+	assert.Equal(t, "password does not meet policy: must be at least 8 characters long, must contain a digit", err.Error())
+	assert.Equal(t, policyErr.Violations, policyErr.Details())
+}
+
+func TestRangeList(t *testing.T) {
+	l := NewRangeList(rangeFS("password", "123456"))
+
+	for _, p := range []string{"password", "123456"} {
+		found, err := l.Contains(p)
+		assert.NoError(t, err)
+		assert.True(t, found, p)
+	}
+
+	found, err := l.Contains("Correct-Horse-1")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestLoad(t *testing.T) {
+	p, err := Load(config.PasswordPolicy{})
+	assert.NoError(t, err)
+	assert.Nil(t, p.breached)
+
+	dir := t.TempDir()
+	p, err = Load(config.PasswordPolicy{BreachedPath: dir})
+	assert.NoError(t, err)
+	assert.NotNil(t, p.breached)
+
+	file := filepath.Join(dir, "00000.txt")
+	assert.NoError(t, os.WriteFile(file, nil, 0o600))
+
+	_, err = Load(config.PasswordPolicy{BreachedPath: file})
+	assert.Error(t, err)
+
+	_, err = Load(config.PasswordPolicy{BreachedPath: filepath.Join(dir, "missing")})
+	assert.Error(t, err)
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hinccvi/go-ddd/internal/config"
+)
+
+type (
+	// BlobStore stores binary objects, such as uploaded images, under slash separated keys.
+	BlobStore interface {
+		Put(ctx context.Context, key string, obj Object) error
+		// Get fails with ErrNotFound if there is no object with the key.
+		Get(ctx context.Context, key string) (Object, error)
+		// Delete succeeds if there is no object with the key.
+		Delete(ctx context.Context, key string) error
+	}
+
+	// Object is the content of a blob.
+	Object struct {
+		ContentType string
+		Data        []byte
+	}
+)
+
+// Blob store drivers.
+const (
+	DriverLocal = "local"
+	DriverS3    = "s3"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// New creates the configured BlobStore, a local directory unless the S3 driver is configured.
+func New(cfg *config.Config) (BlobStore, error) {
+	switch cfg.BlobStore.Driver {
+	case DriverLocal, "":
+		return NewLocal(cfg.BlobStore.Path), nil
+	case DriverS3:
+		s3 := cfg.BlobStore.S3
+		return NewS3(s3.Endpoint, s3.Region, s3.Bucket, s3.AccessKey, s3.SecretKey), nil
+	default:
+		return nil, fmt.Errorf("[New] internal error: unknown blob store driver %q", cfg.BlobStore.Driver)
+	}
+}
+
+// validKey reports whether a key is a relative slash separated path that does not leave its root.
+func validKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,153 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// CBOR major types as defined in RFC 8949 section 3.1.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborSimple = 7
+
+	cborFalse = 20
+	cborTrue  = 21
+	cborNull  = 22
+
+	// cborMaxDepth bounds the nesting of decoded items. Attestation objects nest three levels deep.
+	cborMaxDepth = 16
+)
+
+var errCBOR = errors.New("malformed cbor")
+
+// decodeCBOR decodes the first CBOR item of b and returns it with the bytes that follow it.
+// It supports the subset authenticators produce: integers, byte and text strings, arrays,
+// maps with integer or text keys, booleans and null, all with definite lengths.
+// Integers are returned as int64, byte strings as []byte and maps as map[interface{}]interface{}.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth || len(b) == 0 {
+		return nil, nil, errCBOR
+	}
+
+	major, info := b[0]>>5, b[0]&0x1f //nolint:gomnd // initial byte layout
+	if major == cborSimple {
+		switch info {
+		case cborFalse:
+			return false, b[1:], nil
+		case cborTrue:
+			return true, b[1:], nil
+		case cborNull:
+			return nil, b[1:], nil
+		default:
+			return nil, nil, errCBOR
+		}
+	}
+
+	arg, rest, err := cborArgument(info, b[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case cborUint:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+
+		return int64(arg), rest, nil
+	case cborNegInt:
+		if arg > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+
+		return -1 - int64(arg), rest, nil
+	case cborBytes, cborText:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+
+		if major == cborText {
+			return string(rest[:arg]), rest[arg:], nil
+		}
+
+		return append([]byte(nil), rest[:arg]...), rest[arg:], nil
+	case cborArray:
+		// every item takes at least one byte, which bounds the allocation
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			if item, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			items = append(items, item)
+		}
+
+		return items, rest, nil
+	case cborMap:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBOR
+		}
+
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			if key, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+
+			if _, ok := m[key]; ok {
+				return nil, nil, errCBOR
+			}
+
+			if value, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+
+			m[key] = value
+		}
+
+		return m, rest, nil
+	default:
+		return nil, nil, errCBOR
+	}
+}
+
+// cborArgument decodes the argument of an item from the additional information of its initial byte.
+func cborArgument(info byte, b []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24: //nolint:gomnd // the argument is the additional information itself
+		return uint64(info), b, nil
+	case info == 24 && len(b) >= 1:
+		return uint64(b[0]), b[1:], nil
+	case info == 25 && len(b) >= 2:
+		return uint64(binary.BigEndian.Uint16(b)), b[2:], nil
+	case info == 26 && len(b) >= 4:
+		return uint64(binary.BigEndian.Uint32(b)), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return binary.BigEndian.Uint64(b), b[8:], nil
+	default:
+		// indefinite lengths and reserved values are not used by authenticators
+		return 0, nil, errCBOR
+	}
+}
@@ -0,0 +1,117 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithms the relying party accepts, in order of preference (RFC 9053).
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// COSE key parameters (RFC 9052 section 7 and RFC 9053 section 7).
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+	coseN   = -1
+	coseE   = -2
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+
+	p256CoordinateSize = 32
+	minRSAKeySize      = 2048
+)
+
+var errUnsupportedKey = errors.New("unsupported public key")
+
+// PublicKey is a credential public key decoded from its COSE encoding.
+type PublicKey struct {
+	Alg int
+	key crypto.PublicKey
+}
+
+// ParsePublicKey decodes a COSE encoded credential public key.
+func ParsePublicKey(cose []byte) (PublicKey, error) {
+	v, rest, err := decodeCBOR(cose)
+	if err != nil {
+		return PublicKey{}, err
+	}
+
+	m, ok := v.(map[interface{}]interface{})
+	if !ok || len(rest) != 0 {
+		return PublicKey{}, errCBOR
+	}
+
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != coseCrvP256 || len(x) != p256CoordinateSize || len(y) != p256CoordinateSize {
+			return PublicKey{}, errUnsupportedKey
+		}
+
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return PublicKey{}, errUnsupportedKey
+		}
+
+		return PublicKey{AlgES256, pub}, nil
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return PublicKey{}, errUnsupportedKey
+		}
+
+		return PublicKey{AlgEdDSA, ed25519.PublicKey(x)}, nil
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseN)].([]byte)
+		e, _ := m[int64(coseE)].([]byte)
+
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < minRSAKeySize || pub.E < 3 || len(e) > 4 {
+			return PublicKey{}, errUnsupportedKey
+		}
+
+		return PublicKey{AlgRS256, pub}, nil
+	default:
+		return PublicKey{}, errUnsupportedKey
+	}
+}
+
+// Verify reports whether sig is a valid signature of data.
+func (k PublicKey) Verify(data, sig []byte) bool {
+	switch pub := k.key.(type) {
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(data)
+		return ecdsa.VerifyASN1(pub, sum[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, data, sig)
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,389 @@
+// Package webauthn implements the relying party side of Web Authentication (WebAuthn Level 2):
+// credential creation options, registration and assertion verification for passkeys.
+// Attestation statements are not verified, the relying party requests none and trusts any authenticator.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type (
+	// RelyingParty is the service users register credentials with.
+	// ID is the domain credentials are scoped to and Origins the web origins allowed to use them.
+	RelyingParty struct {
+		ID      string
+		Name    string
+		Origins []string
+		Timeout time.Duration
+	}
+
+	// Base64URL is binary data encoded as unpadded base64url in JSON, as WebAuthn clients expect.
+	Base64URL []byte
+
+	// UserEntity identifies the account a credential is created for.
+	// ID is an opaque handle that must not contain personal information.
+	UserEntity struct {
+		ID          Base64URL `json:"id"`
+		Name        string    `json:"name"`
+		DisplayName string    `json:"displayName"`
+	}
+
+	RelyingPartyEntity struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+
+	CredentialParameter struct {
+		Type string `json:"type"`
+		Alg  int    `json:"alg"`
+	}
+
+	CredentialDescriptor struct {
+		Type       string    `json:"type"`
+		ID         Base64URL `json:"id"`
+		Transports []string  `json:"transports,omitempty"`
+	}
+
+	AuthenticatorSelection struct {
+		ResidentKey        string `json:"residentKey"`
+		RequireResidentKey bool   `json:"requireResidentKey"`
+		UserVerification   string `json:"userVerification"`
+	}
+
+	// CreationOptions are the options of navigator.credentials.create().
+	CreationOptions struct {
+		Challenge              Base64URL              `json:"challenge"`
+		RP                     RelyingPartyEntity     `json:"rp"`
+		User                   UserEntity             `json:"user"`
+		PubKeyCredParams       []CredentialParameter  `json:"pubKeyCredParams"`
+		Timeout                int64                  `json:"timeout"`
+		ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+		AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+		Attestation            string                 `json:"attestation"`
+	}
+
+	// RequestOptions are the options of navigator.credentials.get(). No credentials are listed,
+	// so the authenticator offers the discoverable credentials it holds for the relying party.
+	RequestOptions struct {
+		Challenge        Base64URL `json:"challenge"`
+		Timeout          int64     `json:"timeout"`
+		RPID             string    `json:"rpId"`
+		UserVerification string    `json:"userVerification"`
+	}
+
+	// AttestationResponse is the credential returned by navigator.credentials.create(), encoded as JSON.
+	AttestationResponse struct {
+		ID       string    `json:"id"`
+		RawID    Base64URL `json:"rawId"`
+		Type     string    `json:"type"`
+		Response struct {
+			ClientDataJSON    Base64URL `json:"clientDataJSON"`
+			AttestationObject Base64URL `json:"attestationObject"`
+			Transports        []string  `json:"transports"`
+		} `json:"response"`
+	}
+
+	// AssertionResponse is the credential returned by navigator.credentials.get(), encoded as JSON.
+	AssertionResponse struct {
+		ID       string    `json:"id"`
+		RawID    Base64URL `json:"rawId"`
+		Type     string    `json:"type"`
+		Response struct {
+			ClientDataJSON    Base64URL `json:"clientDataJSON"`
+			AuthenticatorData Base64URL `json:"authenticatorData"`
+			Signature         Base64URL `json:"signature"`
+			UserHandle        Base64URL `json:"userHandle"`
+		} `json:"response"`
+	}
+
+	// Credential is a verified public key credential to store for the user.
+	Credential struct {
+		ID         []byte
+		PublicKey  []byte
+		SignCount  uint32
+		Transports []string
+	}
+
+	clientData struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+
+	authenticatorData struct {
+		rpIDHash     []byte
+		flags        byte
+		signCount    uint32
+		credentialID []byte
+		publicKey    []byte
+	}
+)
+
+// TypePublicKey is the only type of WebAuthn credential.
+const TypePublicKey = "public-key"
+
+const (
+	challengeSize = 32
+
+	ceremonyCreate = "webauthn.create"
+	ceremonyGet    = "webauthn.get"
+
+	// authenticator data flags (WebAuthn section 6.1)
+	flagUserPresent   = 0x01
+	flagUserVerified  = 0x04
+	flagAttestedData  = 0x40
+	authDataMinLength = 37
+	aaguidLength      = 16
+	credentialIDMax   = 1023
+)
+
+var (
+	// ErrInvalidCredential is returned when a registration or assertion response fails verification.
+	ErrInvalidCredential = errors.New("invalid webauthn credential")
+
+	// ErrSignCount is returned when the signature counter of an authenticator did not increase,
+	// which indicates that the credential was cloned.
+	ErrSignCount = errors.New("webauthn signature counter did not increase")
+)
+
+// NewChallenge returns a random challenge.
+func NewChallenge() ([]byte, error) {
+	b := make([]byte, challengeSize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	// some clients pad the encoding
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+
+	*b = decoded
+
+	return nil
+}
+
+// CreationOptions returns the options to register a passkey for user. Credentials the user
+// already registered are excluded, so that an authenticator is not registered twice.
+func (rp *RelyingParty) CreationOptions(
+	challenge []byte,
+	user UserEntity,
+	exclude []CredentialDescriptor,
+) CreationOptions {
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+
+	return CreationOptions{
+		Challenge: challenge,
+		RP:        RelyingPartyEntity{rp.ID, rp.Name},
+		User:      user,
+		PubKeyCredParams: []CredentialParameter{
+			{TypePublicKey, AlgES256},
+			{TypePublicKey, AlgEdDSA},
+			{TypePublicKey, AlgRS256},
+		},
+		Timeout:            rp.Timeout.Milliseconds(),
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "required",
+		},
+		Attestation: "none",
+	}
+}
+
+// RequestOptions returns the options to log in with a passkey.
+func (rp *RelyingParty) RequestOptions(challenge []byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          rp.Timeout.Milliseconds(),
+		RPID:             rp.ID,
+		UserVerification: "required",
+	}
+}
+
+// VerifyRegistration verifies the response to a registration ceremony with challenge (WebAuthn section 7.1)
+// and returns the credential to store.
+func (rp *RelyingParty) VerifyRegistration(res AttestationResponse, challenge []byte) (Credential, error) {
+	if res.Type != TypePublicKey {
+		return Credential{}, fmt.Errorf("%w: type", ErrInvalidCredential)
+	}
+
+	if err := rp.verifyClientData(res.Response.ClientDataJSON, ceremonyCreate, challenge); err != nil {
+		return Credential{}, err
+	}
+
+	v, rest, err := decodeCBOR(res.Response.AttestationObject)
+	if err != nil || len(rest) != 0 {
+		return Credential{}, fmt.Errorf("%w: attestation object", ErrInvalidCredential)
+	}
+
+	attestation, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return Credential{}, fmt.Errorf("%w: attestation object", ErrInvalidCredential)
+	}
+
+	raw, _ := attestation["authData"].([]byte)
+
+	authData, err := rp.parseAuthenticatorData(raw)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	if authData.flags&flagAttestedData == 0 || !bytes.Equal(authData.credentialID, res.RawID) {
+		return Credential{}, fmt.Errorf("%w: attested credential data", ErrInvalidCredential)
+	}
+
+	if _, err = ParsePublicKey(authData.publicKey); err != nil {
+		return Credential{}, fmt.Errorf("%w: %v", ErrInvalidCredential, err)
+	}
+
+	return Credential{
+		ID:         authData.credentialID,
+		PublicKey:  authData.publicKey,
+		SignCount:  authData.signCount,
+		Transports: res.Response.Transports,
+	}, nil
+}
+
+// VerifyAssertion verifies the response to an authentication ceremony with challenge (WebAuthn section 7.2)
+// against a stored credential and returns the new signature counter to store.
+// The caller must check that the credential belongs to the user handle of the response.
+func (rp *RelyingParty) VerifyAssertion(res AssertionResponse, challenge []byte, cred Credential) (uint32, error) {
+	if res.Type != TypePublicKey || !bytes.Equal(res.RawID, cred.ID) {
+		return 0, fmt.Errorf("%w: credential", ErrInvalidCredential)
+	}
+
+	if err := rp.verifyClientData(res.Response.ClientDataJSON, ceremonyGet, challenge); err != nil {
+		return 0, err
+	}
+
+	authData, err := rp.parseAuthenticatorData(res.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	pub, err := ParsePublicKey(cred.PublicKey)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidCredential, err)
+	}
+
+	sum := sha256.Sum256(res.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), res.Response.AuthenticatorData...), sum[:]...)
+	if !pub.Verify(signed, res.Response.Signature) {
+		return 0, fmt.Errorf("%w: signature", ErrInvalidCredential)
+	}
+
+	// authenticators without a counter always report zero
+	if (authData.signCount != 0 || cred.SignCount != 0) && authData.signCount <= cred.SignCount {
+		return 0, ErrSignCount
+	}
+
+	return authData.signCount, nil
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony string, challenge []byte) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("%w: client data", ErrInvalidCredential)
+	}
+
+	want := base64.RawURLEncoding.EncodeToString(challenge)
+
+	switch {
+	case data.Type != ceremony:
+		return fmt.Errorf("%w: ceremony", ErrInvalidCredential)
+	case subtle.ConstantTimeCompare([]byte(strings.TrimRight(data.Challenge, "=")), []byte(want)) != 1:
+		return fmt.Errorf("%w: challenge", ErrInvalidCredential)
+	case data.CrossOrigin || !rp.allowsOrigin(data.Origin):
+		return fmt.Errorf("%w: origin", ErrInvalidCredential)
+	}
+
+	return nil
+}
+
+func (rp *RelyingParty) allowsOrigin(origin string) bool {
+	for _, o := range rp.Origins {
+		if o == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseAuthenticatorData decodes authenticator data (WebAuthn section 6.1) and checks
+// that it is scoped to the relying party and that the user was present and verified.
+func (rp *RelyingParty) parseAuthenticatorData(b []byte) (authenticatorData, error) {
+	if len(b) < authDataMinLength {
+		return authenticatorData{}, fmt.Errorf("%w: authenticator data", ErrInvalidCredential)
+	}
+
+	data := authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(data.rpIDHash, rpIDHash[:]) {
+		return authenticatorData{}, fmt.Errorf("%w: relying party", ErrInvalidCredential)
+	}
+
+	if data.flags&flagUserPresent == 0 || data.flags&flagUserVerified == 0 {
+		return authenticatorData{}, fmt.Errorf("%w: user verification", ErrInvalidCredential)
+	}
+
+	if data.flags&flagAttestedData == 0 {
+		return data, nil
+	}
+
+	rest := b[authDataMinLength:]
+	if len(rest) < aaguidLength+2 {
+		return authenticatorData{}, fmt.Errorf("%w: attested credential data", ErrInvalidCredential)
+	}
+	rest = rest[aaguidLength:]
+
+	n := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if n == 0 || n > credentialIDMax || n > len(rest) {
+		return authenticatorData{}, fmt.Errorf("%w: credential id", ErrInvalidCredential)
+	}
+	data.credentialID, rest = rest[:n], rest[n:]
+
+	// the public key is followed by extensions if the authenticator sent any
+	_, ext, err := decodeCBOR(rest)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("%w: public key", ErrInvalidCredential)
+	}
+	data.publicKey = rest[:len(rest)-len(ext)]
+
+	return data, nil
+}
@@ -0,0 +1,164 @@
+package webauthn
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hinccvi/go-ddd/internal/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+//nolint:gochecknoglobals // test fixture
+var rp = RelyingParty{
+	ID:      "example.com",
+	Name:    "Example",
+	Origins: []string{"https://example.com"},
+	Timeout: 5 * time.Minute,
+}
+
+func register(t *testing.T, a *mocks.Authenticator, challenge []byte) AttestationResponse {
+	t.Helper()
+
+	var res AttestationResponse
+	if err := json.Unmarshal([]byte(a.Register(challenge, []byte("user"))), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func assertion(t *testing.T, a *mocks.Authenticator, challenge []byte) AssertionResponse {
+	t.Helper()
+
+	var res AssertionResponse
+	if err := json.Unmarshal([]byte(a.Assert(challenge)), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func TestCreationOptions(t *testing.T) {
+	challenge, err := NewChallenge()
+	assert.NoError(t, err)
+	assert.Len(t, challenge, challengeSize)
+
+	opts := rp.CreationOptions(challenge, UserEntity{ID: []byte{1, 2}, Name: "user", DisplayName: "user"}, nil)
+
+	b, err := json.Marshal(opts)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"rp":{"id":"example.com","name":"Example"}`)
+	assert.Contains(t, string(b), `"user":{"id":"AQI","name":"user","displayName":"user"}`)
+	assert.Contains(t, string(b), `"excludeCredentials":[]`)
+	assert.Contains(t, string(b), `"timeout":300000`)
+
+	req := rp.RequestOptions(challenge)
+	assert.Equal(t, "example.com", req.RPID)
+	assert.Equal(t, "required", req.UserVerification)
+}
+
+func TestVerifyRegistration(t *testing.T) {
+	a := mocks.NewAuthenticator(t, rp.ID, rp.Origins[0])
+	challenge, _ := NewChallenge()
+
+	cred, err := rp.VerifyRegistration(register(t, a, challenge), challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, a.CredentialID, cred.ID)
+	assert.Equal(t, a.PublicKey(), cred.PublicKey)
+	assert.Equal(t, []string{"internal"}, cred.Transports)
+
+	other, _ := NewChallenge()
+	_, err = rp.VerifyRegistration(register(t, a, challenge), other)
+	assert.ErrorIs(t, err, ErrInvalidCredential)
+
+	// no client data
+	_, err = rp.VerifyRegistration(AttestationResponse{Type: TypePublicKey}, challenge)
+	assert.ErrorIs(t, err, ErrInvalidCredential)
+
+	evil := mocks.NewAuthenticator(t, rp.ID, "https://evil.com")
+	_, err = rp.VerifyRegistration(register(t, evil, challenge), challenge)
+	assert.ErrorIs(t, err, ErrInvalidCredential)
+
+	otherRP := mocks.NewAuthenticator(t, "evil.com", rp.Origins[0])
+	_, err = rp.VerifyRegistration(register(t, otherRP, challenge), challenge)
+	assert.ErrorIs(t, err, ErrInvalidCredential)
+
+	res := register(t, a, challenge)
+	res.RawID = []byte("other")
+	_, err = rp.VerifyRegistration(res, challenge)
+	assert.ErrorIs(t, err, ErrInvalidCredential)
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	a := mocks.NewAuthenticator(t, rp.ID, rp.Origins[0])
+	challenge, _ := NewChallenge()
+
+	cred, err := rp.VerifyRegistration(register(t, a, challenge), challenge)
+	assert.NoError(t, err)
+
+	challenge, _ = NewChallenge()
+	count, err := rp.VerifyAssertion(assertion(t, a, challenge), challenge, cred)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), count)
+
+	// a cloned authenticator reports a counter that did not increase
+	cred.SignCount = 5
+	_, err = rp.VerifyAssertion(assertion(t, a, challenge), challenge, cred)
+	assert.ErrorIs(t, err, ErrSignCount)
+	cred.SignCount = 0
+
+	res := assertion(t, a, challenge)
+	res.Response.Signature[len(res.Response.Signature)-1] ^= 0xff
+	_, err = rp.VerifyAssertion(res, challenge, cred)
+	assert.ErrorIs(t, err, ErrInvalidCredential)
+
+	other, _ := NewChallenge()
+	_, err = rp.VerifyAssertion(assertion(t, a, challenge), other, cred)
+	assert.ErrorIs(t, err, ErrInvalidCredential)
+
+	// the passkey of another authenticator does not verify
+	b := mocks.NewAuthenticator(t, rp.ID, rp.Origins[0])
+	b.CredentialID = a.CredentialID
+	_, err = rp.VerifyAssertion(assertion(t, b, challenge), challenge, cred)
+	assert.ErrorIs(t, err, ErrInvalidCredential)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	// {kty: OKP, alg: EdDSA, crv: Ed25519, x: pub}
+	cose := append([]byte{0xa4, 0x01, 0x01, 0x03, 0x27, 0x20, 0x06, 0x21, 0x58, 0x20}, pub...)
+	key, err := ParsePublicKey(cose)
+	assert.NoError(t, err)
+	assert.Equal(t, AlgEdDSA, key.Alg)
+
+	// ES256 with a P-384 curve
+	_, err = ParsePublicKey([]byte{0xa3, 0x01, 0x02, 0x03, 0x26, 0x20, 0x02})
+	assert.ErrorIs(t, err, errUnsupportedKey)
+
+	_, err = ParsePublicKey([]byte{0xa1, 0x01})
+	assert.Error(t, err)
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	v, rest, err := decodeCBOR([]byte{0x82, 0x18, 0x64, 0x63, 'a', 'b', 'c', 0xf5})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(100), "abc"}, v)
+	assert.Equal(t, []byte{0xf5}, rest)
+
+	// duplicate map key
+	_, _, err = decodeCBOR([]byte{0xa2, 0x01, 0x01, 0x01, 0x02})
+	assert.Error(t, err)
+
+	// indefinite length
+	_, _, err = decodeCBOR([]byte{0x9f, 0xff})
+	assert.Error(t, err)
+
+	// truncated
+	_, _, err = decodeCBOR([]byte{0x58, 0x20, 0x01})
+	assert.Error(t, err)
+}
@@ -0,0 +1,45 @@
+package tools
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	apiKeyScheme     = "ak_"
+	apiKeyPrefixSize = 8
+	apiKeySecretSize = 32
+)
+
+// GenerateAPIKey returns a random API key of the form ak_<prefix>_<secret> and its prefix.
+// The prefix identifies the key without revealing it, so it can be stored and displayed in clear.
+func GenerateAPIKey() (string, string, error) {
+	b := make([]byte, apiKeyPrefixSize+apiKeySecretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	prefix := apiKeyScheme + hex.EncodeToString(b[:apiKeyPrefixSize])
+
+	return prefix + "_" + base64.RawURLEncoding.EncodeToString(b[apiKeyPrefixSize:]), prefix, nil
+}
+
+// APIKeyPrefix returns the prefix of an API key created by GenerateAPIKey.
+func APIKeyPrefix(key string) (string, bool) {
+	if !strings.HasPrefix(key, apiKeyScheme) {
+		return "", false
+	}
+
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, apiKeyScheme), "_")
+	if !ok || len(id) != hex.EncodedLen(apiKeyPrefixSize) || secret == "" {
+		return "", false
+	}
+
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", false
+	}
+
+	return apiKeyScheme + id, true
+}
@@ -0,0 +1,39 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, prefix, err := GenerateAPIKey()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, prefix+"_"))
+
+	other, _, err := GenerateAPIKey()
+	assert.NoError(t, err)
+	assert.NotEqual(t, key, other)
+
+	parsed, ok := APIKeyPrefix(key)
+	assert.True(t, ok)
+	assert.Equal(t, prefix, parsed)
+}
+
+func TestAPIKeyPrefix_WhenFail(t *testing.T) {
+	tests := []string{
+		"",
+		"secret",
+		"ak_0123456789abcdef",
+		"ak_0123456789abcdef_",
+		"ak_0123456789abcdeg_secret",
+		"ak_0123_secret",
+		"xx_0123456789abcdef_secret",
+	}
+
+	for _, test := range tests {
+		_, ok := APIKeyPrefix(test)
+		assert.False(t, ok, test)
+	}
+}
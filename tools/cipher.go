@@ -0,0 +1,96 @@
+package tools
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const encryptionKeySize = 32
+
+var ErrCiphertext = errors.New("malformed ciphertext")
+
+// CheckEncryptionKey fails unless key is a base64 encoded 256 bit key, as used by Encrypt and Decrypt.
+func CheckEncryptionKey(key string) error {
+	_, err := newGCM(key)
+	return err
+}
+
+// Encrypt seals a secret with AES-256-GCM under a base64 encoded key.
+// The random nonce is prepended to the ciphertext, and the result is base64 encoded.
+func Encrypt(key, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+// Decrypt opens a secret sealed by Encrypt with the same key.
+func Decrypt(key, ciphertext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return "", ErrCiphertext
+	}
+
+	plaintext, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", ErrCiphertext
+	}
+
+	return string(plaintext), nil
+}
+
+// HMACSHA256 returns the hex encoded HMAC-SHA256 of a secret under a base64 encoded key.
+// Unlike SHA256, the digest of a low entropy secret can't be brute forced without the key.
+func HMACSHA256(key, secret string) (string, error) {
+	b, err := decodeEncryptionKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, b)
+	mac.Write([]byte(secret))
+
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func newGCM(key string) (cipher.AEAD, error) {
+	b, err := decodeEncryptionKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func decodeEncryptionKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != encryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d base64 encoded bytes", encryptionKeySize)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,60 @@
+package tools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testEncryptionKey  = "cEa6wwJp/FQNrQ2QYAVgBvbLrwMf3Es+gvjmwZi0eAY="
+	otherEncryptionKey = "5gDVtGGkX8C4X59cLDFvJmXVY0MnqLtE9H5CLH58DyE="
+)
+
+func TestCheckEncryptionKey(t *testing.T) {
+	assert.NoError(t, CheckEncryptionKey(testEncryptionKey))
+	assert.Error(t, CheckEncryptionKey(""))
+	assert.Error(t, CheckEncryptionKey("c2hvcnQ="))
+	assert.Error(t, CheckEncryptionKey("not base64"))
+}
+
+func TestEncrypt(t *testing.T) {
+	ciphertext, err := Encrypt(testEncryptionKey, "secret")
+	assert.NoError(t, err)
+	assert.NotContains(t, ciphertext, "secret")
+
+	again, err := Encrypt(testEncryptionKey, "secret")
+	assert.NoError(t, err)
+	assert.NotEqual(t, ciphertext, again)
+
+	plaintext, err := Decrypt(testEncryptionKey, ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", plaintext)
+
+	_, err = Decrypt(otherEncryptionKey, ciphertext)
+	assert.ErrorIs(t, err, ErrCiphertext)
+
+	_, err = Decrypt(testEncryptionKey, ciphertext[:8])
+	assert.ErrorIs(t, err, ErrCiphertext)
+
+	_, err = Encrypt("", "secret")
+	assert.Error(t, err)
+}
+
+func TestHMACSHA256(t *testing.T) {
+	mac, err := HMACSHA256(testEncryptionKey, "secret")
+	assert.NoError(t, err)
+	assert.Len(t, mac, 64)
+	assert.NotEqual(t, SHA256("secret"), mac)
+
+	again, err := HMACSHA256(testEncryptionKey, "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, mac, again)
+
+	other, err := HMACSHA256(otherEncryptionKey, "secret")
+	assert.NoError(t, err)
+	assert.NotEqual(t, mac, other)
+
+	_, err = HMACSHA256("", "secret")
+	assert.Error(t, err)
+}
@@ -1,7 +1,11 @@
 package tools
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 )
@@ -24,6 +28,16 @@ const (
 	Error   message = "error"
 )
 
+// Headers of conditional requests, echo does not declare them.
+const (
+	HeaderETag    = "ETag"
+	HeaderIfMatch = "If-Match"
+)
+
+// ErrPreconditionFailed is returned when the If-Match header of a request does not match
+// the current version of the resource.
+var ErrPreconditionFailed = errors.New("precondition failed, the resource was modified")
+
 func generateStatusCode(code int) int {
 	if code > http.StatusNetworkAuthenticationRequired {
 		code = http.StatusBadRequest
@@ -57,3 +71,33 @@ func JSONRespErr(c echo.Context, code int, i interface{}) error {
 		Data:    i,
 	})
 }
+
+// ETag returns the strong entity tag of a version of a resource.
+func ETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// IfMatch returns the version of the resource the If-Match header of a request requires.
+// It returns 0 if the header is missing or *. Only a single entity tag is supported, and a weak
+// or unknown tag never matches, see RFC 9110 section 13.1.1.
+func IfMatch(c echo.Context) (int64, error) {
+	h := strings.TrimSpace(c.Request().Header.Get(HeaderIfMatch))
+	if h == "" || h == "*" {
+		return 0, nil
+	}
+
+	if strings.Contains(h, ",") {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "'If-Match' must be * or a single entity tag")
+	}
+
+	if len(h) < 2 || h[0] != '"' || h[len(h)-1] != '"' {
+		return 0, ErrPreconditionFailed
+	}
+
+	version, err := strconv.ParseInt(h[1:len(h)-1], 10, 64)
+	if err != nil || version <= 0 {
+		return 0, ErrPreconditionFailed
+	}
+
+	return version, nil
+}
@@ -217,3 +217,48 @@ func TestRespWithData_CustomErrorStruct(t *testing.T) {
 		assert.JSONEq(t, okJSON, rec.Body.String())
 	}
 }
+
+func TestETag(t *testing.T) {
+	assert.Equal(t, `"3"`, ETag(3))
+}
+
+func TestIfMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		version int64
+		code    int
+		wantErr error
+	}{
+		{name: "missing", header: ""},
+		{name: "any", header: "*"},
+		{name: "etag", header: `"3"`, version: 3},
+		{name: "weak etag", header: `W/"3"`, wantErr: ErrPreconditionFailed},
+		{name: "unquoted", header: "3", wantErr: ErrPreconditionFailed},
+		{name: "unknown etag", header: `"abc"`, wantErr: ErrPreconditionFailed},
+		{name: "zero", header: `"0"`, wantErr: ErrPreconditionFailed},
+		{name: "list", header: `"1", "2"`, code: http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/", nil)
+			req.Header.Set(HeaderIfMatch, tc.header)
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			version, err := IfMatch(c)
+			switch {
+			case tc.code != 0:
+				var herr *echo.HTTPError
+				if assert.ErrorAs(t, err, &herr) {
+					assert.Equal(t, tc.code, herr.Code)
+				}
+			case tc.wantErr != nil:
+				assert.ErrorIs(t, err, tc.wantErr)
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, tc.version, version)
+			}
+		})
+	}
+}
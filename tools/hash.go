@@ -1,17 +1,20 @@
 package tools
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	// 12 bcrypt cost produce around ~300ms delay,
 	// and this is the max delay that average users can tolerate.
-	bcryptCost = bcrypt.DefaultCost + 2
+	BcryptCost = bcrypt.DefaultCost + 2
 )
 
 func Bcrypt(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCost)
 	if err != nil {
 		return "", err
 	}
@@ -22,3 +25,10 @@ func Bcrypt(password string) (string, error) {
 func BcryptCompare(password, hashedPassword string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 }
+
+// SHA256 returns the hex encoded SHA-256 digest of a high entropy secret, such as a random token.
+// Use Bcrypt for passwords.
+func SHA256(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -56,3 +56,17 @@ func TestBcryptCompare_WhenSuccess(t *testing.T) {
 		}
 	}
 }
+
+func TestSHA256(t *testing.T) {
+	tests := []struct {
+		plainText  string
+		cypherText string
+	}{
+		{plainText: "", cypherText: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{plainText: "secret", cypherText: "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.cypherText, SHA256(test.plainText))
+	}
+}
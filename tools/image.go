@@ -0,0 +1,114 @@
+package tools
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	// registers the GIF decoder, GIFs are re-encoded as PNG
+	_ "image/gif"
+)
+
+const jpegQuality = 90
+
+var (
+	ErrInvalidImage  = errors.New("unsupported or invalid image")
+	ErrImageTooLarge = errors.New("image too large")
+)
+
+// DecodeImage decodes an uploaded JPEG, PNG or GIF image. The content is sniffed rather than trusting
+// the declared type, and the dimensions are checked before decoding so a small file cannot expand
+// into a huge image.
+func DecodeImage(data []byte, maxDimension int) (image.Image, string, error) {
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		return nil, "", ErrInvalidImage
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || "image/"+format != contentType || cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, "", ErrInvalidImage
+	}
+
+	if cfg.Width > maxDimension || cfg.Height > maxDimension {
+		return nil, "", ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrInvalidImage
+	}
+
+	return img, contentType, nil
+}
+
+// EncodeImage encodes an image decoded from contentType, JPEGs as JPEG and anything else as PNG.
+// It returns the content type of the encoded image.
+func EncodeImage(img image.Image, contentType string) ([]byte, string, error) {
+	var b bytes.Buffer
+	if contentType == "image/jpeg" {
+		if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, "", err
+		}
+
+		return b.Bytes(), contentType, nil
+	}
+
+	if err := png.Encode(&b, img); err != nil {
+		return nil, "", err
+	}
+
+	return b.Bytes(), "image/png", nil
+}
+
+// Thumbnail crops the center square of an image and scales it down to size x size pixels
+// by averaging the pixels each thumbnail pixel covers. Smaller images are cropped only.
+func Thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+
+	// premultiplied alpha, so transparent pixels do not bleed their color into the average
+	src := image.NewRGBA(image.Rect(0, 0, side, side))
+	offset := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	draw.Draw(src, src.Bounds(), img, offset, draw.Src)
+
+	if side <= size {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		y0, y1 := y*side/size, (y+1)*side/size
+		for x := 0; x < size; x++ {
+			x0, x1 := x*side/size, (x+1)*side/size
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+
+			n := (y1 - y0) * (x1 - x0)
+			i := y*dst.Stride + x*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+
+	return dst
+}
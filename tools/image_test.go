@@ -0,0 +1,96 @@
+package tools
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+
+	return img
+}
+
+func TestDecodeImage(t *testing.T) {
+	var pngData, jpegData, gifData bytes.Buffer
+	assert.NoError(t, png.Encode(&pngData, testImage(40, 20)))
+	assert.NoError(t, jpeg.Encode(&jpegData, testImage(40, 20), nil))
+	assert.NoError(t, gif.Encode(&gifData, testImage(40, 20), nil))
+
+	for contentType, data := range map[string][]byte{
+		"image/png":  pngData.Bytes(),
+		"image/jpeg": jpegData.Bytes(),
+		"image/gif":  gifData.Bytes(),
+	} {
+		img, got, err := DecodeImage(data, 100)
+		assert.NoError(t, err, contentType)
+		assert.Equal(t, contentType, got)
+		assert.Equal(t, image.Rect(0, 0, 40, 20), img.Bounds())
+	}
+
+	_, _, err := DecodeImage(pngData.Bytes(), 30)
+	assert.ErrorIs(t, err, ErrImageTooLarge)
+}
+
+func TestDecodeImage_WhenFail(t *testing.T) {
+	var pngData bytes.Buffer
+	assert.NoError(t, png.Encode(&pngData, testImage(40, 20)))
+
+	tests := [][]byte{
+		nil,
+		[]byte("not an image"),
+		[]byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"),
+		pngData.Bytes()[:40],
+	}
+
+	for _, test := range tests {
+		_, _, err := DecodeImage(test, 100)
+		assert.ErrorIs(t, err, ErrInvalidImage)
+	}
+}
+
+func TestEncodeImage(t *testing.T) {
+	data, contentType, err := EncodeImage(testImage(4, 4), "image/jpeg")
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+
+	_, got, err := DecodeImage(data, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", got)
+
+	_, contentType, err = EncodeImage(testImage(4, 4), "image/gif")
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+}
+
+func TestThumbnail(t *testing.T) {
+	// a red image with a blue left half, which the center crop cuts
+	img := testImage(300, 100)
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 150; x++ {
+			img.Set(x, y, color.NRGBA{B: 255, A: 255})
+		}
+	}
+
+	thumb := Thumbnail(img, 10)
+	assert.Equal(t, image.Rect(0, 0, 10, 10), thumb.Bounds())
+
+	assert.Equal(t, color.RGBA{B: 255, A: 255}, thumb.At(0, 0))
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, thumb.At(9, 9))
+
+	// smaller images are not scaled up
+	thumb = Thumbnail(testImage(6, 8), 10)
+	assert.Equal(t, image.Rect(0, 0, 6, 6), thumb.Bounds())
+}
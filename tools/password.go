@@ -0,0 +1,196 @@
+package tools
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type (
+	// PasswordHasher hashes passwords into PHC strings (https://github.com/P-H-C/phc-string-format).
+	PasswordHasher interface {
+		// Hash hashes a password with a random salt.
+		Hash(password string) (string, error)
+		// Verify reports whether a password matches a hash the hasher handles.
+		Verify(password, hash string) (bool, error)
+		// Handles reports whether a hash was produced by the algorithm of the hasher.
+		Handles(hash string) bool
+		// Outdated reports whether a hash was produced with other parameters than the hasher uses.
+		Outdated(hash string) bool
+	}
+
+	// Argon2idHasher hashes passwords with argon2id (RFC 9106). Memory is in KiB.
+	Argon2idHasher struct {
+		Memory      uint32
+		Iterations  uint32
+		Parallelism uint8
+	}
+
+	// BcryptHasher hashes passwords with bcrypt. Its hashes use the modular crypt format,
+	// which PHC strings are a superset of.
+	BcryptHasher struct {
+		Cost int
+	}
+
+	// PasswordHashers hashes new passwords with the current hasher and verifies the hashes
+	// of every hasher, so that hashes of a former algorithm keep working until they are replaced.
+	PasswordHashers struct {
+		current PasswordHasher
+		hashers []PasswordHasher
+	}
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+
+	// bcrypt ignores everything after the first 72 bytes of a password.
+	bcryptMaxLength = 72
+)
+
+var (
+	ErrUnknownPasswordHash = errors.New("unknown password hash")
+	ErrPasswordTooLong     = errors.New("password too long")
+)
+
+// NewPasswordHashers creates hashers that hash with current and also verify the hashes of others.
+func NewPasswordHashers(current PasswordHasher, others ...PasswordHasher) *PasswordHashers {
+	return &PasswordHashers{current, append([]PasswordHasher{current}, others...)}
+}
+
+// Hash hashes a password with the current hasher.
+func (h *PasswordHashers) Hash(password string) (string, error) {
+	return h.current.Hash(password)
+}
+
+// Verify reports whether a password matches a hash, and whether the hash is outdated and should be
+// replaced by a new hash of the password, because it was produced by another algorithm or other parameters.
+func (h *PasswordHashers) Verify(password, hash string) (bool, bool, error) {
+	for _, hasher := range h.hashers {
+		if !hasher.Handles(hash) {
+			continue
+		}
+
+		ok, err := hasher.Verify(password, hash)
+		if err != nil || !ok {
+			return false, false, err
+		}
+
+		return true, hasher != h.current || hasher.Outdated(hash), nil
+	}
+
+	return false, false, ErrUnknownPasswordHash
+}
+
+func (a Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, argon2idKeyLength)
+
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		AlgorithmArgon2id, argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a Argon2idHasher) Verify(password, hash string) (bool, error) {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	//nolint:gosec // the key length was checked when the hash was parsed
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a Argon2idHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$"+AlgorithmArgon2id+"$")
+}
+
+func (a Argon2idHasher) Outdated(hash string) bool {
+	params, _, key, err := parseArgon2id(hash)
+
+	return err != nil || params != a || len(key) != argon2idKeyLength
+}
+
+// parseArgon2id decodes a PHC string of argon2id, such as $argon2id$v=19$m=65536,t=3,p=2$salt$key.
+func parseArgon2id(hash string) (Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return Argon2idHasher{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return Argon2idHasher{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	var params Argon2idHasher
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return Argon2idHasher{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2idHasher{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return Argon2idHasher{}, nil, nil, ErrUnknownPasswordHash
+	}
+
+	return params, salt, key, nil
+}
+
+// Hash hashes a password with bcrypt. Passwords longer than 72 bytes are rejected
+// rather than silently truncated.
+func (b BcryptHasher) Hash(password string) (string, error) {
+	if len(password) > bcryptMaxLength {
+		return "", ErrPasswordTooLong
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (b BcryptHasher) Verify(password, hash string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	switch {
+	case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (b BcryptHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (b BcryptHasher) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+
+	return err != nil || cost != b.Cost
+}
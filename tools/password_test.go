@@ -0,0 +1,112 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher := Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+	hash, err := hasher.Hash("secret")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	assert.True(t, hasher.Handles(hash))
+	assert.False(t, hasher.Outdated(hash))
+
+	other, err := hasher.Hash("secret")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+
+	ok, err := hasher.Verify("secret", hash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = hasher.Verify("anothersecret", hash)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.True(t, Argon2idHasher{Memory: 2048, Iterations: 1, Parallelism: 1}.Outdated(hash))
+}
+
+func TestArgon2idHasher_WhenFail(t *testing.T) {
+	tests := []string{
+		"",
+		"$argon2id$",
+		"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$",
+	}
+
+	hasher := Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1}
+	for _, test := range tests {
+		_, err := hasher.Verify("secret", test)
+		assert.ErrorIs(t, err, ErrUnknownPasswordHash, test)
+		assert.True(t, hasher.Outdated(test), test)
+	}
+}
+
+func TestBcryptHasher(t *testing.T) {
+	hasher := BcryptHasher{Cost: bcrypt.MinCost}
+
+	hash, err := hasher.Hash("secret")
+	assert.NoError(t, err)
+	assert.True(t, hasher.Handles(hash))
+	assert.False(t, hasher.Outdated(hash))
+	assert.True(t, BcryptHasher{Cost: bcrypt.MinCost + 1}.Outdated(hash))
+
+	ok, err := hasher.Verify("secret", hash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = hasher.Verify("anothersecret", hash)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = hasher.Hash(strings.Repeat("a", 73))
+	assert.ErrorIs(t, err, ErrPasswordTooLong)
+}
+
+func TestPasswordHashers(t *testing.T) {
+	argon2id := Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1}
+	legacy := BcryptHasher{Cost: bcrypt.MinCost}
+	hashers := NewPasswordHashers(argon2id, legacy)
+
+	hash, err := hashers.Hash("secret")
+	assert.NoError(t, err)
+	assert.True(t, argon2id.Handles(hash))
+
+	ok, rehash, err := hashers.Verify("secret", hash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, rehash)
+
+	outdated, err := Argon2idHasher{Memory: 2048, Iterations: 1, Parallelism: 1}.Hash("secret")
+	assert.NoError(t, err)
+
+	ok, rehash, err = hashers.Verify("secret", outdated)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	bcryptHash, err := legacy.Hash("secret")
+	assert.NoError(t, err)
+
+	ok, rehash, err = hashers.Verify("secret", bcryptHash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, rehash)
+
+	ok, rehash, err = hashers.Verify("anothersecret", bcryptHash)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, rehash)
+
+	_, _, err = hashers.Verify("secret", "secret")
+	assert.ErrorIs(t, err, ErrUnknownPasswordHash)
+}
@@ -0,0 +1,111 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Media types of patch documents, echo does not declare them.
+const (
+	MIMEApplicationMergePatch = "application/merge-patch+json"
+	MIMEApplicationJSONPatch  = "application/json-patch+json"
+)
+
+type (
+	// Patch holds the fields a patch document changes and their new values, nil if a field is removed.
+	Patch map[string]*string
+
+	patchOperation struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+)
+
+// MergePatch decodes a JSON merge patch of the string fields of a resource, see RFC 7396.
+// A field set to null is removed. Fields other than the given ones cannot be patched.
+func MergePatch(r io.Reader, fields ...string) (Patch, error) {
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&doc); err != nil || doc == nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "merge patch must be a JSON object")
+	}
+
+	p := make(Patch, len(doc))
+	for field, value := range doc {
+		if err := p.set(field, value, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// JSONPatch decodes a JSON patch of the string fields of a resource, see RFC 6902. The operations
+// are applied in order, only add, replace and remove are supported. Fields other than the given
+// ones cannot be patched.
+func JSONPatch(r io.Reader, fields ...string) (Patch, error) {
+	var ops []patchOperation
+	if err := json.NewDecoder(r).Decode(&ops); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "json patch must be an array of operations")
+	}
+
+	p := make(Patch, len(ops))
+	for _, op := range ops {
+		field := strings.TrimPrefix(op.Path, "/")
+		if !strings.HasPrefix(op.Path, "/") || !contains(fields, field) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'%s' cannot be patched", op.Path))
+		}
+
+		switch op.Op {
+		case "add", "replace":
+			if op.Value == nil {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'%s' requires a value", op.Op))
+			}
+
+			if err := p.set(field, op.Value, fields); err != nil {
+				return nil, err
+			}
+		case "remove":
+			p[field] = nil
+		default:
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported operation '%s'", op.Op))
+		}
+	}
+
+	return p, nil
+}
+
+func (p Patch) set(field string, value json.RawMessage, fields []string) error {
+	if !contains(fields, field) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'%s' cannot be patched", field))
+	}
+
+	if string(value) == "null" {
+		p[field] = nil
+
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("'%s' must be a string", field))
+	}
+	p[field] = &s
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
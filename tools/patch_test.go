@@ -0,0 +1,96 @@
+package tools
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var patchFields = []string{"name", "bio"}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+func assertBadRequest(t *testing.T, err error) {
+	t.Helper()
+
+	var herr *echo.HTTPError
+	if assert.ErrorAs(t, err, &herr) {
+		assert.Equal(t, http.StatusBadRequest, herr.Code)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    Patch
+		wantErr bool
+	}{
+		{name: "set and remove", body: `{"name":"user","bio":null}`, want: Patch{"name": stringPtr("user"), "bio": nil}},
+		{name: "empty string", body: `{"bio":""}`, want: Patch{"bio": stringPtr("")}},
+		{name: "empty", body: `{}`, want: Patch{}},
+		{name: "unknown field", body: `{"id":"1"}`, wantErr: true},
+		{name: "not a string", body: `{"name":1}`, wantErr: true},
+		{name: "not an object", body: `["name"]`, wantErr: true},
+		{name: "null", body: `null`, wantErr: true},
+		{name: "malformed", body: `{"name"`, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := MergePatch(strings.NewReader(tc.body), patchFields...)
+			if tc.wantErr {
+				assertBadRequest(t, err)
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, p)
+		})
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    Patch
+		wantErr bool
+	}{
+		{
+			name: "add, replace and remove",
+			body: `[{"op":"add","path":"/name","value":"user"},{"op":"replace","path":"/bio","value":"bio"},` +
+				`{"op":"remove","path":"/bio"}]`,
+			want: Patch{"name": stringPtr("user"), "bio": nil},
+		},
+		{name: "null value", body: `[{"op":"replace","path":"/bio","value":null}]`, want: Patch{"bio": nil}},
+		{name: "empty", body: `[]`, want: Patch{}},
+		{name: "missing value", body: `[{"op":"replace","path":"/name"}]`, wantErr: true},
+		{name: "unknown field", body: `[{"op":"remove","path":"/id"}]`, wantErr: true},
+		{name: "relative path", body: `[{"op":"replace","path":"name","value":"user"}]`, wantErr: true},
+		{name: "nested path", body: `[{"op":"replace","path":"/name/0","value":"user"}]`, wantErr: true},
+		{name: "unsupported operation", body: `[{"op":"move","from":"/name","path":"/bio"}]`, wantErr: true},
+		{name: "not a string", body: `[{"op":"add","path":"/name","value":{}}]`, wantErr: true},
+		{name: "not an array", body: `{"op":"remove","path":"/bio"}`, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := JSONPatch(strings.NewReader(tc.body), patchFields...)
+			if tc.wantErr {
+				assertBadRequest(t, err)
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, p)
+		})
+	}
+}
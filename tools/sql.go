@@ -0,0 +1,13 @@
+package tools
+
+import "database/sql"
+
+// NullString returns a valid NullString holding *s, or a null one if s is nil.
+// Request fields that are nil are left unchanged, while an empty string clears them.
+func NullString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+
+	return sql.NullString{String: *s, Valid: true}
+}